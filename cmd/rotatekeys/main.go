@@ -0,0 +1,124 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// @Title  main
+// @Description  rotation of the master key the data keys of encrypted image files are wrapped with
+// @Author  GuoZhen Gao (2021/6/30 10:40)
+//
+// Usage:
+//
+//	rotatekeys -active k2                  rewrap every data key with key k2 of the key file
+//	rotatekeys -active k2 -dry-run         count the files which would be rewrapped
+//
+// To rotate, add the new key to the key file, set encryptionActiveKey to it so new files use it and run
+// rotatekeys with it. Only the header of each file is rewritten, the image data isn't read or encrypted
+// again. The old key can be dropped from the key file once no file is wrapped with it.
+package main
+
+import (
+	"fileSystem/pkg/envelope"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// counts of the files of a rotation
+type rotation struct {
+	files     int
+	encrypted int
+	rewrapped int
+	failed    int
+}
+
+// Rewrap the data key of a file unless it isn't encrypted or already wrapped with the active key. Files are
+// walked without their rows, so encrypted ones are told by their header. A plain file starting like one
+// fails to unwrap and is left as it is.
+func (r *rotation) rotate(path string, keys envelope.KeyProvider, dryRun bool) error {
+	flags := os.O_RDWR
+	if dryRun {
+		flags = os.O_RDONLY
+	}
+	f, err := os.OpenFile(path, flags, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r.files++
+	encrypted, err := envelope.IsEncrypted(f)
+	if err != nil || !encrypted {
+		return err
+	}
+	r.encrypted++
+	keyId, err := envelope.KeyId(f)
+	if err != nil || keyId == keys.ActiveKey() {
+		return err
+	}
+	if dryRun {
+		r.rewrapped++
+		return nil
+	}
+	rewrapped, err := envelope.Rewrap(f, keys)
+	if err != nil {
+		return err
+	}
+	if rewrapped {
+		r.rewrapped++
+	}
+	return f.Close()
+}
+
+func main() {
+	root := flag.String("root", "/usr/app/vmImage/", "storage directory of the images, blobs and chunks")
+	keyFile := flag.String("key-file", "/usr/app/keys/master.keys", "key file of id=base64 master keys")
+	active := flag.String("active", "", "id of the key to wrap data keys with, the first key of the file when empty")
+	dryRun := flag.Bool("dry-run", false, "count the files to rewrap without writing them")
+	flag.Parse()
+
+	keys, err := envelope.LoadKeyFile(*keyFile, *active)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	r := &rotation{}
+	err = filepath.Walk(*root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if err := r.rotate(path, keys, *dryRun); err != nil {
+			// a file which fails is reported and the others are still rotated, running again retries it
+			r.failed++
+			fmt.Fprintln(os.Stderr, path+": "+err.Error())
+		}
+		return nil
+	})
+	verb := "rewrapped"
+	if *dryRun {
+		verb = "to rewrap"
+	}
+	fmt.Printf("%d files, %d encrypted, %d %s with key %s, %d failed\n", r.files, r.encrypted, r.rewrapped, verb,
+		keys.ActiveKey(), r.failed)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if r.failed > 0 {
+		os.Exit(1)
+	}
+}
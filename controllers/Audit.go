@@ -0,0 +1,235 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// @Title  controllers
+// @Description  audit log api for filesystem
+// @Author  GuoZhen Gao (2021/6/30 10:40)
+package controllers
+
+import (
+	"crypto/subtle"
+	"encoding/csv"
+	"fileSystem/models"
+	"fileSystem/pkg/dbAdpater"
+	"fileSystem/util"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"time"
+)
+
+var auditCsvHeader = []string{"eventTime", "action", "imageId", "userId", "clientIp", "requestId", "outcome", "details"}
+
+// AuditController   Define the controller to query the audit log
+type AuditController struct {
+	BaseController
+}
+
+// Persist an audit event, a failed write is logged but never fails the audited operation
+func (c *BaseController) recordAudit(action, imageId, outcome, details string) {
+	requestId, _ := c.Ctx.Input.GetData(util.RequestIdKey).(string)
+	event := &models.AuditEvent{
+		Action:    action,
+		ImageId:   imageId,
+		UserId:    c.Ctx.Input.Query(util.UserId),
+		ClientIp:  c.Ctx.Input.IP(),
+		RequestId: requestId,
+		Outcome:   outcome,
+		Details:   details,
+	}
+	writeAuditEvent(c.Db, event)
+}
+
+// Name the audited operation of the request, HandleApiError audits it as failed or denied when it fails
+func (c *BaseController) auditAs(action string) {
+	c.Ctx.Input.SetData(util.AuditActionKey, action)
+}
+
+// Audit the failure of the audited operation of the request, requests without one aren't audited
+func (c *BaseController) auditFailure(apiErr util.ApiError) {
+	action, ok := c.Ctx.Input.GetData(util.AuditActionKey).(string)
+	if !ok || action == "" {
+		return
+	}
+	outcome := util.AuditOutcomeFailure
+	if apiErr.Status == util.StatusUnauthorized || apiErr.Status == util.StatusForbidden {
+		outcome = util.AuditOutcomeDenied
+	}
+	details := apiErr.Code
+	if apiErr.Details != "" {
+		details += ": " + apiErr.Details
+	}
+	c.recordAudit(action, c.Ctx.Input.Param(":imageId"), outcome, details)
+}
+
+// Persist an audit event raised outside of a request, like by a background job
+func writeAuditEvent(db dbAdpater.Database, event *models.AuditEvent) {
+	err := db.InsertData(event)
+	if err != nil && err.Error() != util.LastInsertIdNotSupported {
+		log.Error("fail to write audit event " + event.Action + ": " + err.Error())
+	}
+}
+
+// Report whether the request carries the configured admin token
+func (c *BaseController) isAdmin() bool {
+	token := util.GetAdminToken()
+	if token == "" {
+		return false
+	}
+	given := c.Ctx.Input.Header(util.AdminTokenHeader)
+	return subtle.ConstantTimeCompare([]byte(token), []byte(given)) == 1
+}
+
+// Parse an optional RFC3339 time query parameter
+func (c *AuditController) parseTimeQuery(key string) (time.Time, bool, error) {
+	value := c.Ctx.Input.Query(key)
+	if value == "" {
+		return time.Time{}, false, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	return t, err == nil, err
+}
+
+// Build the filters of an audit query from the request
+func (c *AuditController) auditFilters() (map[string]interface{}, error) {
+	filters := map[string]interface{}{}
+	for query, field := range map[string]string{
+		util.UserId: "user_id__exact",
+		"imageId":   "image_id__exact",
+		"action":    "action__exact",
+		"outcome":   "outcome__exact",
+	} {
+		if value := c.Ctx.Input.Query(query); value != "" {
+			filters[field] = value
+		}
+	}
+	from, ok, err := c.parseTimeQuery("from")
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		filters["event_time__gte"] = from
+	}
+	to, ok, err := c.parseTimeQuery("to")
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		filters["event_time__lt"] = to
+	}
+	return filters, nil
+}
+
+// Write events as a csv attachment
+func (c *AuditController) writeCsv(events []*models.AuditEvent) {
+	c.Ctx.Output.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Ctx.Output.Header("Content-Disposition", "attachment; filename=audit-events.csv")
+	writer := csv.NewWriter(c.Ctx.ResponseWriter)
+	_ = writer.Write(auditCsvHeader)
+	for _, event := range events {
+		_ = writer.Write([]string{
+			event.EventTime.Format(time.RFC3339),
+			event.Action,
+			event.ImageId,
+			event.UserId,
+			event.ClientIp,
+			event.RequestId,
+			event.Outcome,
+			event.Details,
+		})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		c.logger().Error("fail to write audit csv: " + err.Error())
+	}
+}
+
+// @Title Get
+// @Description query audit events by user, image, action and time range, admin only
+// @Param   userId     query  string  false  "userId"
+// @Param   imageId    query  string  false  "imageId"
+// @Param   action     query  string  false  "upload, download, update or delete"
+// @Param   from       query  string  false  "RFC3339 start time, inclusive"
+// @Param   to         query  string  false  "RFC3339 end time, exclusive"
+// @Param   limit      query  int     false  "max events returned, 0 returns all for csv"
+// @Param   offset     query  int     false  "offset"
+// @Param   format     query  string  false  "json or csv"
+// @Success 200 ok
+// @Failure 403 forbidden
+// @router /image-management/v1/audit-events [get]
+func (c *AuditController) Get() {
+	c.logger().Info("Audit event query request received.")
+	clientIp := c.Ctx.Input.IP()
+	err := util.ValidateSrcAddress(clientIp)
+	if err != nil {
+		c.HandleApiError(clientIp, util.BadRequest, util.ClientIpaddressInvalid, util.ErrInvalidClientIp)
+		return
+	}
+	c.displayReceivedMsg(clientIp)
+
+	if !c.isAdmin() {
+		c.HandleApiError(clientIp, util.StatusForbidden, "admin token is required", util.ErrForbidden)
+		return
+	}
+
+	filters, err := c.auditFilters()
+	if err != nil {
+		c.HandleApiError(clientIp, util.BadRequest, "time range is invalid",
+			util.ErrInvalidParameter.WithDetails(err.Error()))
+		return
+	}
+	format := c.Ctx.Input.Query("format")
+	limit := util.DefaultAuditQueryLimit
+	if format == "csv" {
+		limit = 0
+	}
+	if value := c.Ctx.Input.Query("limit"); value != "" {
+		limit, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || limit < 0 {
+			c.HandleApiError(clientIp, util.BadRequest, "limit is invalid", util.ErrInvalidParameter.WithDetails("limit"))
+			return
+		}
+	}
+	offset, err := c.GetInt64("offset", 0)
+	if err != nil || offset < 0 {
+		c.HandleApiError(clientIp, util.BadRequest, "offset is invalid", util.ErrInvalidParameter.WithDetails("offset"))
+		return
+	}
+
+	var events []*models.AuditEvent
+	_, err = c.Db.QueryTableWithFilters("audit_event", &events, filters, []string{"-event_time"}, limit, offset)
+	var total int64
+	if err == nil && format != "csv" {
+		total, err = c.Db.QueryCountWithFilters("audit_event", filters)
+	}
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to query audit events",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return
+	}
+
+	if format == "csv" {
+		c.writeCsv(events)
+		return
+	}
+	if events == nil {
+		events = []*models.AuditEvent{}
+	}
+	c.Data["json"] = map[string]interface{}{
+		"total":  total,
+		"events": events,
+	}
+	c.ServeJSON()
+}
@@ -0,0 +1,182 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fileSystem/models"
+	"fileSystem/util"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+const testAdminToken = "admin-secret"
+
+// Configure the admin token for the duration of a test
+func useAdminToken(t *testing.T) {
+	t.Helper()
+	previous, set := os.LookupEnv("FILESYSTEM_ADMIN_TOKEN")
+	_ = os.Setenv("FILESYSTEM_ADMIN_TOKEN", testAdminToken)
+	t.Cleanup(func() {
+		if set {
+			_ = os.Setenv("FILESYSTEM_ADMIN_TOKEN", previous)
+		} else {
+			_ = os.Unsetenv("FILESYSTEM_ADMIN_TOKEN")
+		}
+	})
+}
+
+// Seed events an hour apart, the first one is the oldest
+func newAuditTestDb() *fakeDb {
+	db := newFakeDb()
+	begin := time.Date(2021, 7, 1, 10, 0, 0, 0, time.UTC)
+	for i, event := range []models.AuditEvent{
+		{Action: util.AuditActionUpload, ImageId: "image1", UserId: "user1", Outcome: util.AuditOutcomeSuccess},
+		{Action: util.AuditActionDownload, ImageId: "image1", UserId: "user2", Outcome: util.AuditOutcomeSuccess},
+		{Action: util.AuditActionDownload, ImageId: "image1", UserId: "user1", Outcome: util.AuditOutcomeFailure},
+		{Action: util.AuditActionDelete, ImageId: "image1", UserId: "user1", Outcome: util.AuditOutcomeSuccess},
+	} {
+		event.EventTime = begin.Add(time.Duration(i) * time.Hour)
+		db.insert(&event)
+	}
+	return db
+}
+
+func queryAudit(t *testing.T, db *fakeDb, query string, admin bool) (int, []byte) {
+	t.Helper()
+	c := &AuditController{BaseController{Db: db}}
+	req, rw := newTestRequest(c, http.MethodGet, "/image-management/v1/audit-events?"+query, nil, nil)
+	if admin {
+		req.Header.Set(util.AdminTokenHeader, testAdminToken)
+	}
+	c.Get()
+	return rw.Code, rw.Body.Bytes()
+}
+
+func TestAuditQueryRequiresAdmin(t *testing.T) {
+	useAdminToken(t)
+	if code, _ := queryAudit(t, newAuditTestDb(), "", false); code != util.StatusForbidden {
+		t.Fatalf("got status %d, want %d", code, util.StatusForbidden)
+	}
+}
+
+func TestAuditQueryFilters(t *testing.T) {
+	useAdminToken(t)
+	code, body := queryAudit(t, newAuditTestDb(),
+		"action=download&from=2021-07-01T11:00:00Z&to=2021-07-01T13:00:00Z", true)
+	if code != util.StatusOK {
+		t.Fatalf("got status %d: %s", code, body)
+	}
+	var result struct {
+		Events []*models.AuditEvent `json:"events"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		t.Fatal(err)
+	}
+	// newest first
+	if len(result.Events) != 2 || result.Events[0].UserId != "user1" || result.Events[1].UserId != "user2" {
+		t.Fatalf("unexpected events %s", body)
+	}
+}
+
+func TestAuditQueryTotalCountsAllPages(t *testing.T) {
+	useAdminToken(t)
+	code, body := queryAudit(t, newAuditTestDb(), "userId=user1&limit=1&offset=1", true)
+	var result struct {
+		Total  int64                `json:"total"`
+		Events []*models.AuditEvent `json:"events"`
+	}
+	if err := json.Unmarshal(body, &result); code != util.StatusOK || err != nil {
+		t.Fatalf("got status %d: %s", code, body)
+	}
+	if result.Total != 3 || len(result.Events) != 1 || result.Events[0].Outcome != util.AuditOutcomeFailure {
+		t.Fatalf("unexpected page %s", body)
+	}
+}
+
+func TestAuditQueryRejectsInvalidTime(t *testing.T) {
+	useAdminToken(t)
+	if code, _ := queryAudit(t, newAuditTestDb(), "from=yesterday", true); code != util.BadRequest {
+		t.Fatalf("got status %d, want %d", code, util.BadRequest)
+	}
+}
+
+func TestAuditQueryCsv(t *testing.T) {
+	useAdminToken(t)
+	code, body := queryAudit(t, newAuditTestDb(), "format=csv&userId=user1", true)
+	if code != util.StatusOK {
+		t.Fatalf("got status %d: %s", code, body)
+	}
+	records, err := csv.NewReader(bytes.NewReader(body)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 || records[0][0] != "eventTime" || records[1][1] != util.AuditActionDelete {
+		t.Fatalf("unexpected csv %q", records)
+	}
+}
+
+func TestRecordAudit(t *testing.T) {
+	db := newFakeDb()
+	c := &ImageController{BaseController{Db: db}}
+	newTestRequest(c, http.MethodDelete, "/image-management/v1/images/image1?userId=user1", nil, nil)
+	c.Ctx.Input.SetData(util.RequestIdKey, "request-1")
+	c.recordAudit(util.AuditActionDelete, "image1", util.AuditOutcomeSuccess, "")
+
+	var events []*models.AuditEvent
+	if _, err := db.QueryTableWithFilters("audit_event", &events, nil, nil, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("got %d events, want 1", len(events))
+	}
+	event := events[0]
+	if event.UserId != "user1" || event.RequestId != "request-1" || event.ClientIp != "192.0.2.1" ||
+		event.EventTime.IsZero() {
+		t.Fatalf("unexpected event %+v", event)
+	}
+}
+
+func TestFailedOperationsAreAudited(t *testing.T) {
+	db := newPatchTestDb()
+	if code, _ := patchImage(db, `"2"`, `{"description":"after"}`); code != util.StatusPreconditionFailed {
+		t.Fatalf("got status %d, want %d", code, util.StatusPreconditionFailed)
+	}
+	if code := deleteImageAs(db, "image1", "userId=other"); code != util.StatusForbidden {
+		t.Fatalf("got status %d, want %d", code, util.StatusForbidden)
+	}
+
+	var events []*models.AuditEvent
+	if _, err := db.QueryTableWithFilters("audit_event", &events, nil, []string{"id"}, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2", len(events))
+	}
+	if events[0].Action != util.AuditActionUpdate || events[0].Outcome != util.AuditOutcomeFailure ||
+		events[0].ImageId != "image1" {
+		t.Fatalf("unexpected event of the stale patch %+v", events[0])
+	}
+	if events[1].Action != util.AuditActionDelete || events[1].Outcome != util.AuditOutcomeDenied ||
+		events[1].UserId != "other" {
+		t.Fatalf("unexpected event of the denied delete %+v", events[1])
+	}
+}
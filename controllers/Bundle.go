@@ -0,0 +1,272 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// @Title  controllers
+// @Description  bundle download api for filesystem, several images streamed as one archive
+// @Author  GuoZhen Gao (2021/6/30 10:40)
+package controllers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fileSystem/models"
+	"fileSystem/pkg/transfer"
+	"fileSystem/util"
+	"io"
+	"strconv"
+	"time"
+)
+
+// BundleController   Define the controller to download several images as one archive
+type BundleController struct {
+	BaseController
+}
+
+// BundleRequest   Define the images of a bundle download and its archive format, zip by default
+type BundleRequest struct {
+	ImageIds []string `json:"imageIds"`
+	Format   string   `json:"format"`
+}
+
+// BundleManifest   Define the manifest closing a bundle, checksums are SHA-256 of the bundled files.
+// A bundle without its manifest was truncated.
+type BundleManifest struct {
+	CreatedAt string        `json:"createdAt"`
+	Images    []BundleImage `json:"images"`
+}
+
+// BundleImage   Define an image of a bundle and the path of its file in the archive
+type BundleImage struct {
+	ImageId     string `json:"imageId"`
+	FileName    string `json:"fileName"`
+	DisplayName string `json:"displayName,omitempty"`
+	Path        string `json:"path"`
+	Size        int64  `json:"size"`
+	Checksum    string `json:"checksum"`
+}
+
+// bundleFile is an image of a bundle opened for streaming
+type bundleFile struct {
+	image    *models.ImageDB
+	name     string
+	stream   *imageStream
+	size     int64
+	transfer *transfer.Transfer
+	closed   bool
+}
+
+// Close the image and end its transfer once it is streamed or the bundle fails
+func (f *bundleFile) close() {
+	if f.closed {
+		return
+	}
+	f.closed = true
+	_ = f.stream.Close()
+	transfer.End(f.transfer)
+}
+
+// Validate a bundle request and default its format
+func (r *BundleRequest) validate() error {
+	if len(r.ImageIds) == 0 || len(r.ImageIds) > util.MaxBundleImages {
+		return errors.New("imageIds should have 1 to " + strconv.Itoa(util.MaxBundleImages) + " images")
+	}
+	seen := map[string]bool{}
+	for _, imageId := range r.ImageIds {
+		if seen[imageId] {
+			return errors.New("imageId " + imageId + " is repeated")
+		}
+		seen[imageId] = true
+	}
+	if r.Format == "" {
+		r.Format = util.FormatZip
+	}
+	return util.ValidateBundleFormat(r.Format)
+}
+
+// Query the images of a bundle in request order, the error response is written unless the caller may
+// read all of them and all are available
+func (c *BundleController) queryBundleImages(clientIp string, imageIds []string) ([]*models.ImageDB, bool) {
+	var found []*models.ImageDB
+	_, err := c.Db.QueryTableWithFilters("image_d_b", &found, map[string]interface{}{"image_id__in": imageIds}, nil, 0, 0)
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to query database",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return nil, false
+	}
+	grants, err := c.callerGrants(imageIds)
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to query database",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return nil, false
+	}
+	byId := map[string]*models.ImageDB{}
+	for _, image := range found {
+		byId[image.ImageId] = image
+	}
+	images := make([]*models.ImageDB, 0, len(imageIds))
+	for _, imageId := range imageIds {
+		image, ok := byId[imageId]
+		if !ok {
+			c.HandleApiError(clientIp, util.StatusNotFound, "image doesn't exist",
+				util.ErrImageNotFound.WithDetails("imageId "+imageId))
+			return nil, false
+		}
+		if c.accessFromGrants(image, grants) < accessRead {
+			c.HandleApiError(clientIp, util.StatusForbidden, "no permission to access this image",
+				util.ErrForbidden.WithDetails("imageId "+imageId))
+			return nil, false
+		}
+		if !imageAvailable(image) {
+			c.HandleApiError(clientIp, util.StatusNotFound, "image is not available for download",
+				util.ErrImageNotAvailable.WithDetails("imageId "+imageId+" status is "+image.Status))
+			return nil, false
+		}
+		if !c.checkSignaturePolicy(clientIp, image) {
+			return nil, false
+		}
+		images = append(images, image)
+	}
+	return images, true
+}
+
+// Write a bundled image into the archive, the checksum of images stored with one is verified on the way
+func writeBundleFile(archive *archiveWriter, file *bundleFile) (BundleImage, error) {
+	entry := BundleImage{
+		ImageId:     file.image.ImageId,
+		FileName:    file.image.FileName,
+		DisplayName: file.image.DisplayName,
+		Path:        file.image.ImageId + "/" + file.name,
+		Size:        file.size,
+	}
+	h := sha256.New()
+	err := archive.add(entry.Path, file.size, file.image.UploadTime, io.TeeReader(file.stream, h))
+	if err != nil {
+		return entry, err
+	}
+	entry.Checksum = hex.EncodeToString(h.Sum(nil))
+	if !isPackage(file.image) && file.image.Checksum != "" && entry.Checksum != file.image.Checksum {
+		return entry, errors.New("checksum of image " + file.image.ImageId + " doesn't match")
+	}
+	return entry, nil
+}
+
+// @Title Post
+// @Description download several images as one zip, tar, tar.gz or tar.zst ending with a manifest.json of
+// their names and checksums, the caller must be able to read every image
+// @Param   userId      query  string  false  "caller"
+// @Param   tenantId    query  string  false  "tenant of the caller"
+// @Param   body        body   string  true   "json with imageIds and format"
+// @Success 200 ok
+// @Failure 400 bad request
+// @Failure 403 forbidden
+// @Failure 404 not found
+// @router /image-management/v1/bundles [post]
+func (c *BundleController) Post() {
+	c.logger().Info("Bundle download request received.")
+	c.auditAs(util.AuditActionDownload)
+	clientIp := c.Ctx.Input.IP()
+	err := util.ValidateSrcAddress(clientIp)
+	if err != nil {
+		c.HandleApiError(clientIp, util.BadRequest, util.ClientIpaddressInvalid, util.ErrInvalidClientIp)
+		return
+	}
+	c.displayReceivedMsg(clientIp)
+
+	var request BundleRequest
+	decoder := json.NewDecoder(io.LimitReader(c.Ctx.Request.Body, util.MaxMetadataBodySize))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&request)
+	if err != nil {
+		c.HandleApiError(clientIp, util.BadRequest, "request body is invalid",
+			util.ErrInvalidParameter.WithDetails(err.Error()))
+		return
+	}
+	err = request.validate()
+	if err != nil {
+		c.HandleApiError(clientIp, util.BadRequest, err.Error(), util.ErrInvalidParameter.WithDetails(err.Error()))
+		return
+	}
+	images, ok := c.queryBundleImages(clientIp, request.ImageIds)
+	if !ok {
+		return
+	}
+
+	// every image is opened before the response starts, so a missing file is still reported as an error
+	files := make([]*bundleFile, 0, len(images))
+	defer func() {
+		for _, file := range files {
+			file.close()
+		}
+	}()
+	for _, image := range images {
+		tr, err := transfer.Begin(transfer.Download, image.ImageId)
+		if err != nil {
+			c.HandleApiError(clientIp, util.StatusServiceUnavailable, err.Error(), util.ErrServiceShuttingDown)
+			return
+		}
+		name, stream, size, err := c.openImageStream(image, "")
+		if err != nil {
+			transfer.End(tr)
+			c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to read image",
+				util.ErrImageFileMissing.WithDetails("imageId "+image.ImageId+": "+err.Error()))
+			return
+		}
+		files = append(files, &bundleFile{image: image, name: name, stream: stream, size: size, transfer: tr})
+	}
+
+	extension, contentType := archiveType(request.Format)
+	downloadName := "images" + extension
+	c.setDownloadHeaders(downloadName, contentType)
+
+	now := time.Now()
+	manifest := BundleManifest{CreatedAt: now.Format("2006-01-02 15:04:05"), Images: make([]BundleImage, 0, len(files))}
+	archive, err := newArchiveWriter(c.Ctx.ResponseWriter, request.Format, "images.tar", now)
+	// each image is audited and its transfer ended once it is streamed
+	for _, file := range files {
+		if err != nil {
+			break
+		}
+		var entry BundleImage
+		entry, err = writeBundleFile(archive, file)
+		file.close()
+		manifest.Images = append(manifest.Images, entry)
+		if err != nil {
+			c.recordAudit(util.AuditActionDownload, file.image.ImageId, util.AuditOutcomeFailure,
+				"bundle="+downloadName+" file="+file.name+" error="+err.Error())
+			break
+		}
+		c.markDownloaded(file.image.ImageId)
+		c.recordAudit(util.AuditActionDownload, file.image.ImageId, util.AuditOutcomeSuccess,
+			"bundle="+downloadName+" file="+file.name)
+	}
+	var manifestJson []byte
+	if err == nil {
+		manifestJson, err = json.MarshalIndent(manifest, "", "  ")
+	}
+	if err == nil {
+		err = archive.add(util.BundleManifestName, int64(len(manifestJson)), now, bytes.NewReader(manifestJson))
+	}
+	if err == nil {
+		err = archive.close()
+	}
+	if err != nil {
+		// the response has started, the client sees an archive without manifest
+		c.logger().Error("fail to stream bundle " + downloadName + ": " + err.Error())
+	}
+}
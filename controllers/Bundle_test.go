@@ -0,0 +1,166 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fileSystem/models"
+	"fileSystem/pkg/transfer"
+	"fileSystem/util"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func postBundle(db *fakeDb, query, body string) (int, []byte) {
+	c := &BundleController{BaseController{Db: db}}
+	_, rw := newTestRequest(c, http.MethodPost, "/image-management/v1/bundles?"+query, strings.NewReader(body), nil)
+	c.Post()
+	return rw.Code, rw.Body.Bytes()
+}
+
+// Check the files of a bundle and its manifest, files maps archive paths to their content
+func checkBundle(t *testing.T, files map[string][]byte, wantPaths ...string) {
+	var manifest BundleManifest
+	if err := json.Unmarshal(files[util.BundleManifestName], &manifest); err != nil {
+		t.Fatalf("bundle manifest is invalid: %v", err)
+	}
+	if len(files) != len(wantPaths)+1 || len(manifest.Images) != len(wantPaths) {
+		t.Fatalf("got %d files and %d manifest images, want %d", len(files), len(manifest.Images), len(wantPaths))
+	}
+	sum := sha256.Sum256(testImageContent)
+	for i, path := range wantPaths {
+		image := manifest.Images[i]
+		if image.Path != path || image.Checksum != hex.EncodeToString(sum[:]) ||
+			image.Size != int64(len(testImageContent)) {
+			t.Fatalf("got manifest image %+v", image)
+		}
+		if !bytes.Equal(files[path], testImageContent) {
+			t.Fatalf("bundled file %s differs from the image", path)
+		}
+	}
+}
+
+func TestBundleZip(t *testing.T) {
+	root := useTestStores(t)
+	db := newFakeDb()
+	insertDownloadImage(t, db, root, "zipped", "disk.img", "default:deflate")
+	insertDownloadImage(t, db, root, "unzipped", "disk.img", "default:none")
+
+	code, body := postBundle(db, "", `{"imageIds":["zipped","unzipped"]}`)
+	if code != util.StatusOK {
+		t.Fatalf("got status %d: %s", code, body)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{}
+	for _, file := range zr.File {
+		r, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[file.Name], err = ioutil.ReadAll(r)
+		_ = r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if zr.File[len(zr.File)-1].Name != util.BundleManifestName {
+		t.Fatal("manifest doesn't close the bundle")
+	}
+	checkBundle(t, files, "zipped/disk.img", "unzipped/disk.img")
+	if events := db.tables["audit_event"]; len(events) != 2 {
+		t.Fatalf("got %d audit events, want one per image", len(events))
+	}
+	if active := transfer.ActiveCount(); active != 0 {
+		t.Fatalf("%d transfers are still active after the bundle", active)
+	}
+}
+
+func TestBundleTarGz(t *testing.T) {
+	root := useTestStores(t)
+	db := newFakeDb()
+	insertDownloadImage(t, db, root, "zipped", "disk.img", "default:deflate")
+
+	code, body := postBundle(db, "", `{"imageIds":["zipped"],"format":"tar.gz"}`)
+	if code != util.StatusOK {
+		t.Fatalf("got status %d: %s", code, body)
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{}
+	tr := tar.NewReader(gr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if files[header.Name], err = ioutil.ReadAll(tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkBundle(t, files, "zipped/disk.img")
+}
+
+func TestBundleRejectsRequest(t *testing.T) {
+	root := useTestStores(t)
+	db := newFakeDb()
+	insertDownloadImage(t, db, root, "image1", "disk.img", "default:deflate")
+	db.insert(&models.ImageDB{ImageId: "private1", UserId: "owner", Visibility: util.VisibilityPrivate,
+		Status: util.ImageStatusActive})
+	db.insert(&models.ImageDB{ImageId: "trashed1", Status: util.ImageStatusTrashed})
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"no images", `{"imageIds":[]}`, util.BadRequest},
+		{"repeated image", `{"imageIds":["image1","image1"]}`, util.BadRequest},
+		{"gzip", `{"imageIds":["image1"],"format":"gzip"}`, util.BadRequest},
+		{"unknown field", `{"imageIds":["image1"],"name":"x"}`, util.BadRequest},
+		{"missing image", `{"imageIds":["image1","missing"]}`, util.StatusNotFound},
+		{"private image", `{"imageIds":["image1","private1"]}`, util.StatusForbidden},
+		{"trashed image", `{"imageIds":["trashed1"]}`, util.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code, body := postBundle(db, "userId=other", tt.body); code != tt.want {
+				t.Fatalf("got status %d: %s", code, body)
+			}
+		})
+	}
+	// the owner passes the access check, private1 has no stored file
+	if code, body := postBundle(db, "userId=owner", `{"imageIds":["private1"]}`); code != util.StatusInternalServerError {
+		t.Fatalf("owner got status %d: %s", code, body)
+	}
+}
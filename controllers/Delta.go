@@ -0,0 +1,544 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// @Title  controllers
+// @Description  delta upload api for filesystem, only blocks missing from an existing image are sent
+// @Author  GuoZhen Gao (2021/6/30 10:40)
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fileSystem/models"
+	"fileSystem/pkg/codec"
+	"fileSystem/pkg/storage"
+	"fileSystem/pkg/transfer"
+	"fileSystem/util"
+	"hash/adler32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	deltaOpCopy = "copy"
+	deltaOpData = "data"
+)
+
+var (
+	errDeltaChecksum   = errors.New("assembled image doesn't match the size and checksum of the recipe")
+	errDeltaDataLength = errors.New("uploaded blocks don't match the data length of the recipe")
+)
+
+// BlockSignature   Define the signature of one block of an image, weak is adler32 and strong is SHA-256
+type BlockSignature struct {
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+// DeltaRecipe   Define how a delta upload rebuilds an image from blocks of its base image and uploaded data
+type DeltaRecipe struct {
+	BlockSize int64     `json:"blockSize"`
+	Size      int64     `json:"size"`
+	Checksum  string    `json:"checksum"`
+	Ops       []DeltaOp `json:"ops"`
+}
+
+// DeltaOp   Define one step of a recipe, copy takes count base blocks from index,
+// data takes the next length bytes of the uploaded blocks
+type DeltaOp struct {
+	Type   string `json:"type"`
+	Index  int64  `json:"index,omitempty"`
+	Count  int64  `json:"count,omitempty"`
+	Length int64  `json:"length,omitempty"`
+}
+
+// Validate a recipe against the size of the base image, returns the number of uploaded bytes it needs
+func (r *DeltaRecipe) validate(baseSize int64) (int64, error) {
+	err := util.ValidateDeltaBlockSize(r.BlockSize)
+	if err != nil {
+		return 0, err
+	}
+	if storage.ValidateDigest(r.Checksum) != nil {
+		return 0, errors.New("checksum should be a lowercase hex sha256 value")
+	}
+	if r.Size <= 0 || r.Size > util.MaxAppPackageFile {
+		return 0, errors.New("size should be positive and not larger than max size")
+	}
+	if len(r.Ops) == 0 || len(r.Ops) > util.MaxDeltaOps {
+		return 0, errors.New("ops should have between 1 and " + strconv.Itoa(util.MaxDeltaOps) + " entries")
+	}
+	baseBlocks := (baseSize + r.BlockSize - 1) / r.BlockSize
+	var total, literal int64
+	for i := range r.Ops {
+		op := &r.Ops[i]
+		switch op.Type {
+		case deltaOpCopy:
+			if op.Count == 0 {
+				op.Count = 1
+			}
+			if op.Index < 0 || op.Count < 0 || op.Index+op.Count > baseBlocks {
+				return 0, errors.New("op " + strconv.Itoa(i) + " copies blocks outside of the base image")
+			}
+			total += r.copyLength(op, baseSize)
+		case deltaOpData:
+			if op.Length <= 0 {
+				return 0, errors.New("op " + strconv.Itoa(i) + " should have a positive length")
+			}
+			total += op.Length
+			literal += op.Length
+		default:
+			return 0, errors.New("op " + strconv.Itoa(i) + " should be of type copy or data")
+		}
+		if total > r.Size {
+			return 0, errors.New("ops produce more than size bytes")
+		}
+	}
+	if total != r.Size {
+		return 0, errors.New("ops produce " + strconv.FormatInt(total, 10) + " bytes instead of size")
+	}
+	return literal, nil
+}
+
+// Length of the base image range a copy op takes, the last base block may be short
+func (r *DeltaRecipe) copyLength(op *DeltaOp, baseSize int64) int64 {
+	end := (op.Index + op.Count) * r.BlockSize
+	if end > baseSize {
+		end = baseSize
+	}
+	return end - op.Index*r.BlockSize
+}
+
+// imageContent reads the original bytes of a stored image
+type imageContent interface {
+	io.ReaderAt
+	Size() int64
+	Close() error
+}
+
+// Open the original bytes of an image, images compressed on upload are extracted to a temporary file
+func openImageContent(image *models.ImageDB) (imageContent, error) {
+	if image.Chunked {
+		return nil, errors.New("chunked images are opened from their chunk list")
+	}
+	path := image.StorageMedium + image.SaveFileName
+	if image.Codec == codec.None || filepath.Ext(image.FileName) == ".zip" {
+		return openStoredFile(path, image.Encrypted)
+	}
+
+	reader, err := openStoredZip(path, image.Encrypted)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	if len(reader.File) == 0 {
+		return nil, errors.New("zip file has no entry")
+	}
+	entry, err := reader.File[0].Open()
+	if err != nil {
+		return nil, err
+	}
+	defer entry.Close()
+	temp := image.StorageMedium + createImageID() + ".delta"
+	encrypted := util.EncryptionEnabled()
+	w, err := createStoredFile(temp, encrypted)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(w, entry)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	var content *storedFile
+	if err == nil {
+		content, err = openStoredFile(temp, encrypted)
+	}
+	if err != nil {
+		_ = os.Remove(temp)
+		return nil, err
+	}
+	content.temp = true
+	return content, nil
+}
+
+// Open the original bytes of an image wherever it is stored
+func (c *BaseController) openStoredImage(image *models.ImageDB) (imageContent, error) {
+	if !image.Chunked {
+		return openImageContent(image)
+	}
+	chunks, err := queryImageChunks(c.Db, image.ImageId)
+	if err != nil {
+		return nil, err
+	}
+	reader := newChunkReaderAt(chunks)
+	if reader.Size() != image.Size {
+		_ = reader.Close()
+		return nil, errChunkMissing
+	}
+	return reader, nil
+}
+
+// Compute the signatures of consecutive blocks of an image, the last block may be short
+func blockSignatures(content imageContent, blockSize int64) ([]BlockSignature, error) {
+	signatures := make([]BlockSignature, 0, (content.Size()+blockSize-1)/blockSize)
+	buf := make([]byte, blockSize)
+	for off := int64(0); off < content.Size(); off += blockSize {
+		n, err := content.ReadAt(buf, off)
+		if err != nil && !(err == io.EOF && off+int64(n) == content.Size()) {
+			return nil, err
+		}
+		strong := sha256.Sum256(buf[:n])
+		signatures = append(signatures, BlockSignature{
+			Weak:   adler32.Checksum(buf[:n]),
+			Strong: hex.EncodeToString(strong[:]),
+		})
+	}
+	return signatures, nil
+}
+
+// Rebuild an image from a recipe into out, the result must match the size and checksum of the recipe.
+// Returns the number of bytes taken from the base image.
+func assembleDelta(recipe *DeltaRecipe, base imageContent, data io.Reader, out io.Writer) (int64, error) {
+	h := sha256.New()
+	w := io.MultiWriter(out, h)
+	var reused int64
+	var err error
+	for i := range recipe.Ops {
+		op := &recipe.Ops[i]
+		if op.Type == deltaOpCopy {
+			length := recipe.copyLength(op, base.Size())
+			_, err = io.Copy(w, io.NewSectionReader(base, op.Index*recipe.BlockSize, length))
+			reused += length
+		} else if data == nil {
+			err = errDeltaDataLength
+		} else {
+			_, err = io.CopyN(w, data, op.Length)
+			if err == io.EOF {
+				err = errDeltaDataLength
+			}
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if data != nil {
+		if n, _ := data.Read(make([]byte, 1)); n > 0 {
+			return 0, errDeltaDataLength
+		}
+	}
+	if hex.EncodeToString(h.Sum(nil)) != recipe.Checksum {
+		return 0, errDeltaChecksum
+	}
+	return reused, nil
+}
+
+// Query a base image the caller may read and which is available, the error response is written otherwise
+func (c *UploadController) queryDeltaBase(clientIp string) (*models.ImageDB, bool) {
+	base, ok := c.queryImage(clientIp, c.Ctx.Input.Param(":imageId"), "fail to query database")
+	if !ok || !c.checkImageAccess(clientIp, base, accessRead) {
+		return nil, false
+	}
+	if !imageAvailable(base) {
+		c.HandleApiError(clientIp, util.StatusNotFound, "image is not available",
+			util.ErrImageNotAvailable.WithDetails("image status is "+base.Status))
+		return nil, false
+	}
+	return base, true
+}
+
+// @Title Signatures
+// @Description block signatures of an image, a delta upload against it sends only blocks not matching them
+// @Param   imageId     path   string  true   "imageId"
+// @Param   userId      query  string  false  "caller"
+// @Param   tenantId    query  string  false  "tenant of the caller"
+// @Param   blockSize   query  int     false  "block size in bytes, a power of two, 1 MiB by default"
+// @Success 200 ok
+// @Failure 400 bad request
+// @router /image-management/v1/images/:imageId/signatures [get]
+func (c *UploadController) Signatures() {
+	c.logger().Info("Signatures request received.")
+	clientIp := c.Ctx.Input.IP()
+	err := util.ValidateSrcAddress(clientIp)
+	if err != nil {
+		c.HandleApiError(clientIp, util.BadRequest, util.ClientIpaddressInvalid, util.ErrInvalidClientIp)
+		return
+	}
+	c.displayReceivedMsg(clientIp)
+	blockSize, err := c.GetInt64("blockSize", util.DefaultDeltaBlockSize)
+	if err == nil {
+		err = util.ValidateDeltaBlockSize(blockSize)
+	}
+	if err != nil {
+		c.HandleApiError(clientIp, util.BadRequest, err.Error(), util.ErrInvalidParameter.WithDetails(err.Error()))
+		return
+	}
+	base, ok := c.queryDeltaBase(clientIp)
+	if !ok {
+		return
+	}
+
+	tr, err := transfer.Begin(transfer.Download, base.ImageId)
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusServiceUnavailable, err.Error(), util.ErrServiceShuttingDown)
+		return
+	}
+	defer transfer.End(tr)
+	content, err := c.openStoredImage(base)
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to read image",
+			util.ErrImageFileMissing.WithDetails(err.Error()))
+		return
+	}
+	defer content.Close()
+	signatures, err := blockSignatures(content, blockSize)
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to read image",
+			util.ErrStorageFailure.WithDetails(err.Error()))
+		return
+	}
+	signaturesResp, err := json.Marshal(map[string]interface{}{
+		"imageId":   base.ImageId,
+		"checksum":  base.Checksum,
+		"size":      content.Size(),
+		"blockSize": blockSize,
+		"blocks":    signatures,
+	})
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to return signatures", util.ErrInternal)
+		return
+	}
+	_, _ = c.Ctx.ResponseWriter.Write(signaturesResp)
+}
+
+// @Title DeltaUpload
+// @Description upload a new image as blocks of an existing image plus the data missing from it
+// @Param   imageId     path       string  true   "imageId of the base image"
+// @Param   userId      form-data  string  true   "userId"
+// @Param   priority    form-data  string  true   "priority"
+// @Param   recipe      form-data  string  true   "json recipe of copy and data ops, with blockSize, size and checksum"
+// @Param   blocks      form-data  file    false  "data of the data ops, concatenated in recipe order"
+// @Param   fileName    form-data  string  false  "file name of the new image, the base file name by default"
+// @Param   imageName   form-data  string  false  "publish the upload as the next revision of this logical image"
+// @Success 200 ok
+// @Failure 400 bad request
+// @router /image-management/v1/images/:imageId/action/delta-upload [post]
+func (c *UploadController) DeltaUpload() {
+	c.logger().Info("Delta upload request received.")
+	c.auditAs(util.AuditActionUpload)
+	clientIp := c.Ctx.Input.IP()
+	err := util.ValidateSrcAddress(clientIp)
+	if err != nil {
+		c.HandleApiError(clientIp, util.BadRequest, util.ClientIpaddressInvalid, util.ErrInvalidClientIp)
+		return
+	}
+	c.displayReceivedMsg(clientIp)
+	base, ok := c.queryDeltaBase(clientIp)
+	if !ok {
+		return
+	}
+	recipe := &DeltaRecipe{}
+	err = json.Unmarshal([]byte(c.GetString(util.DeltaRecipe)), recipe)
+	if err != nil {
+		c.HandleApiError(clientIp, util.BadRequest, "recipe should be a json object",
+			util.ErrInvalidParameter.WithDetails(err.Error()))
+		return
+	}
+	filename := c.GetString("fileName", base.FileName)
+	err = util.ValidateFileExtension(filename)
+	if err != nil || len(filename) > util.MaxFileNameSize || strings.ContainsAny(filename, `/\`) {
+		c.HandleApiError(clientIp, util.BadRequest,
+			"File shouldn't contains any extension or filename is larger than max size", util.ErrUnsupportedFileType)
+		return
+	}
+	userId := c.GetString(util.UserId)
+	tenantId := c.GetString(util.TenantId)
+	storageMedium := c.getStorageMedium(c.GetString(util.Priority))
+	if storageMedium != util.LocalStoragePath {
+		c.HandleApiError(clientIp, util.BadRequest, errStorageNotSupported.Error(),
+			util.ErrStorageNotSupported.WithDetails("delta uploads are stored locally"))
+		return
+	}
+	metadata, err := c.metadataFromForm()
+	if err != nil {
+		c.HandleApiError(clientIp, util.BadRequest, err.Error(), util.ErrInvalidParameter.WithDetails(err.Error()))
+		return
+	}
+	imageName := c.GetString(util.ImageName)
+	if imageName != "" && !c.checkImageNameUsable(clientIp, imageName) {
+		return
+	}
+	// the recipe is checked against the recorded size of the base first, so an invalid recipe doesn't extract
+	// a compressed base. Images of older releases don't record their size and are checked once opened.
+	var literal int64
+	validated := false
+	if base.Size > 0 {
+		literal, err = recipe.validate(base.Size)
+		if err != nil {
+			c.HandleApiError(clientIp, util.BadRequest, err.Error(), util.ErrInvalidParameter.WithDetails(err.Error()))
+			return
+		}
+		validated = true
+	}
+
+	imageId := createImageID()
+	c.Ctx.Input.SetData(util.ImageIdKey, imageId)
+	tr, err := transfer.Begin(transfer.Upload, imageId)
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusServiceUnavailable, err.Error(), util.ErrServiceShuttingDown)
+		return
+	}
+	defer transfer.End(tr)
+	content, err := c.openStoredImage(base)
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to read base image",
+			util.ErrImageFileMissing.WithDetails(err.Error()))
+		return
+	}
+	defer content.Close()
+	if !validated {
+		literal, err = recipe.validate(content.Size())
+		if err != nil {
+			c.HandleApiError(clientIp, util.BadRequest, err.Error(), util.ErrInvalidParameter.WithDetails(err.Error()))
+			return
+		}
+	}
+	var data io.Reader
+	if blocks, _, err := c.GetFile(util.DeltaBlocks); err == nil {
+		defer blocks.Close()
+		data = blocks
+	} else if literal > 0 {
+		c.HandleApiError(clientIp, util.BadRequest, "blocks are required by the data ops of the recipe",
+			util.ErrInvalidFile.WithDetails(err.Error()))
+		return
+	}
+
+	saveFileName := imageId + filename
+	newSaveFileName := strings.TrimSuffix(saveFileName, filepath.Ext(filename))
+	// the new image inherits the descriptive metadata of its base, form fields override it
+	fileRecord := &models.ImageDB{
+		ImageId:       imageId,
+		FileName:      filename,
+		UserId:        userId,
+		TenantId:      tenantId,
+		SaveFileName:  saveFileName,
+		StorageMedium: storageMedium,
+		UploadTime:    time.Now(),
+		Status:        util.ImageStatusUploading,
+		DisplayName:   base.DisplayName,
+		Description:   base.Description,
+		OsType:        base.OsType,
+		OsVersion:     base.OsVersion,
+		Architecture:  base.Architecture,
+		DiskFormat:    util.DiskFormatFromFileName(filename),
+		MinDiskGB:     base.MinDiskGB,
+		MinRamMB:      base.MinRamMB,
+		Visibility:    util.GetDefaultVisibility(),
+	}
+	metadata.applyTo(fileRecord)
+	err = c.insertOrUpdateFileRecord(fileRecord)
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to insert imageID, filename, userID to database",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return
+	}
+	tempPaths := []string{storageMedium + saveFileName}
+	if filepath.Ext(filename) != ".zip" {
+		tempPaths = append(tempPaths, storageMedium+newSaveFileName+".zip")
+	}
+	// the image is stored while it is assembled, a checksum mismatch fails the stream before it is committed
+	pr, pw := io.Pipe()
+	assembled := make(chan int64, 1)
+	go func() {
+		reused, err := assembleDelta(recipe, content, data, pw)
+		_ = pw.CloseWithError(err)
+		assembled <- reused
+	}()
+	err = c.storeImage(fileRecord, storageMedium, saveFileName, newSaveFileName, tr.Reader(pr))
+	_ = pr.CloseWithError(err)
+	reused := <-assembled
+	if err != nil {
+		c.failUpload(*fileRecord, tempPaths)
+		if err == errDeltaChecksum || err == errDeltaDataLength {
+			c.HandleApiError(clientIp, util.BadRequest, err.Error(), util.ErrChecksumMismatch.WithDetails(err.Error()))
+		} else if err == transfer.ErrInterrupted {
+			c.HandleApiError(clientIp, util.StatusServiceUnavailable, err.Error(), util.ErrServiceShuttingDown)
+		} else {
+			c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to assemble image",
+				util.ErrStorageFailure.WithDetails(err.Error()))
+		}
+		return
+	}
+	if !c.applySignature(clientIp, fileRecord) {
+		c.failUpload(*fileRecord, tempPaths)
+		return
+	}
+	// tags are written before the image is activated, so it is never listed without them
+	if metadata.Tags != nil {
+		err = c.replaceImageTags(imageId, *metadata.Tags)
+		if err != nil {
+			c.failUpload(*fileRecord, tempPaths)
+			c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to save image tags",
+				util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+			return
+		}
+	}
+	fileRecord.Status = util.ImageStatusActive
+	c.scanImage(fileRecord)
+	err = c.insertOrUpdateFileRecord(fileRecord)
+	if err != nil {
+		c.failUpload(*fileRecord, nil)
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to insert imageID, filename, userID to database",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return
+	}
+	uploadDetails := map[string]string{
+		"imageId":         imageId,
+		"fileName":        filename,
+		"uploadTime":      fileRecord.UploadTime.Format("2006-01-02 15:04:05"),
+		"userId":          userId,
+		"storageMedium":   storageMedium,
+		"checksum":        fileRecord.Checksum,
+		"signer":          fileRecord.Signer,
+		"signatureStatus": fileRecord.SignatureStatus,
+		"scanStatus":      scanStatus(fileRecord),
+		"baseImageId":     base.ImageId,
+		"reusedBytes":     strconv.FormatInt(reused, 10),
+		"uploadedBytes":   strconv.FormatInt(literal, 10),
+	}
+	// an upload which can't be published is rolled back, so the client isn't left with an image it didn't ask for
+	if imageName != "" && fileRecord.Status != util.ImageStatusQuarantined &&
+		!c.publishUpload(clientIp, imageName, fileRecord, uploadDetails) {
+		c.failUpload(*fileRecord, nil)
+		return
+	}
+	c.recordAudit(util.AuditActionUpload, imageId, util.AuditOutcomeSuccess,
+		"file="+filename+" size="+strconv.FormatInt(recipe.Size, 10)+" base="+base.ImageId+
+			" uploaded="+strconv.FormatInt(literal, 10))
+	if !c.checkQuarantine(clientIp, fileRecord) {
+		return
+	}
+	uploadResp, err := json.Marshal(uploadDetails)
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to return upload details", util.ErrInternal)
+		return
+	}
+	_, _ = c.Ctx.ResponseWriter.Write(uploadResp)
+}
@@ -0,0 +1,218 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fileSystem/util"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const testBlockSize = 4096
+
+// memContent   In-memory image content
+type memContent struct {
+	*bytes.Reader
+}
+
+func (m memContent) Close() error {
+	return nil
+}
+
+// A base image of two full blocks and a short one
+func newTestBase() memContent {
+	data := make([]byte, 2*testBlockSize+testBlockSize/2)
+	rand.New(rand.NewSource(1)).Read(data)
+	return memContent{bytes.NewReader(data)}
+}
+
+func checksumOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// A recipe taking the second block, then literal data and the short last block of the base
+func newTestRecipe(base memContent, literal string) (*DeltaRecipe, []byte) {
+	full := make([]byte, base.Size())
+	_, _ = base.ReadAt(full, 0)
+	var image []byte
+	image = append(image, full[testBlockSize:2*testBlockSize]...)
+	image = append(image, literal...)
+	image = append(image, full[2*testBlockSize:]...)
+	return &DeltaRecipe{
+		BlockSize: testBlockSize,
+		Size:      int64(len(image)),
+		Checksum:  checksumOf(image),
+		Ops: []DeltaOp{
+			{Type: deltaOpCopy, Index: 1},
+			{Type: deltaOpData, Length: int64(len(literal))},
+			{Type: deltaOpCopy, Index: 2, Count: 1},
+		},
+	}, image
+}
+
+func TestDeltaRecipeValidate(t *testing.T) {
+	base := newTestBase()
+	recipe, _ := newTestRecipe(base, "hello")
+	literal, err := recipe.validate(base.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if literal != 5 {
+		t.Fatalf("got %d literal bytes, want 5", literal)
+	}
+	if recipe.Ops[0].Count != 1 {
+		t.Fatalf("copy without count should take one block, got %d", recipe.Ops[0].Count)
+	}
+}
+
+func TestDeltaRecipeValidateRejects(t *testing.T) {
+	base := newTestBase()
+	tests := []struct {
+		name   string
+		change func(r *DeltaRecipe)
+		err    string
+	}{
+		{"block size", func(r *DeltaRecipe) { r.BlockSize = 5000 }, "blockSize"},
+		{"checksum", func(r *DeltaRecipe) { r.Checksum = strings.ToUpper(r.Checksum) }, "checksum"},
+		{"size", func(r *DeltaRecipe) { r.Size = 0 }, "size should be positive"},
+		{"no ops", func(r *DeltaRecipe) { r.Ops = nil }, "ops should have"},
+		{"copy past base", func(r *DeltaRecipe) { r.Ops[2].Count = 2 }, "outside of the base image"},
+		{"negative index", func(r *DeltaRecipe) { r.Ops[0].Index = -1 }, "outside of the base image"},
+		{"empty data", func(r *DeltaRecipe) { r.Ops[1].Length = 0 }, "positive length"},
+		{"unknown op", func(r *DeltaRecipe) { r.Ops[1].Type = "move" }, "copy or data"},
+		{"too long", func(r *DeltaRecipe) { r.Size-- }, "more than size"},
+		{"too short", func(r *DeltaRecipe) { r.Size++ }, "instead of size"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recipe, _ := newTestRecipe(base, "hello")
+			tt.change(recipe)
+			_, err := recipe.validate(base.Size())
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestBlockSignaturesIncludeShortLastBlock(t *testing.T) {
+	base := newTestBase()
+	signatures, err := blockSignatures(base, testBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signatures) != 3 {
+		t.Fatalf("got %d signatures, want 3", len(signatures))
+	}
+	last := make([]byte, testBlockSize/2)
+	_, _ = base.ReadAt(last, 2*testBlockSize)
+	if signatures[2].Strong != checksumOf(last) {
+		t.Fatal("last signature doesn't cover the short block")
+	}
+}
+
+func TestAssembleDelta(t *testing.T) {
+	base := newTestBase()
+	recipe, image := newTestRecipe(base, "hello")
+	if _, err := recipe.validate(base.Size()); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	reused, err := assembleDelta(recipe, base, strings.NewReader("hello"), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), image) {
+		t.Fatal("assembled image differs")
+	}
+	if reused != int64(len(image))-5 {
+		t.Fatalf("got %d reused bytes, want %d", reused, len(image)-5)
+	}
+}
+
+func TestAssembleDeltaRejectsMismatchedData(t *testing.T) {
+	base := newTestBase()
+	for data, want := range map[string]error{
+		"hell":   errDeltaDataLength,
+		"hello!": errDeltaDataLength,
+		"jello":  errDeltaChecksum,
+	} {
+		recipe, _ := newTestRecipe(base, "hello")
+		if _, err := recipe.validate(base.Size()); err != nil {
+			t.Fatal(err)
+		}
+		_, err := assembleDelta(recipe, base, strings.NewReader(data), &bytes.Buffer{})
+		if err != want {
+			t.Fatalf("data %q: got %v, want %v", data, err, want)
+		}
+	}
+}
+
+func TestAssembleDeltaWithoutData(t *testing.T) {
+	base := newTestBase()
+	recipe, _ := newTestRecipe(base, "hello")
+	if _, err := recipe.validate(base.Size()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := assembleDelta(recipe, base, nil, &bytes.Buffer{}); err != errDeltaDataLength {
+		t.Fatalf("got %v without data, want %v", err, errDeltaDataLength)
+	}
+}
+
+func postDelta(db *fakeDb, baseId string, recipe *DeltaRecipe) (int, string) {
+	encoded, _ := json.Marshal(recipe)
+	c := &UploadController{BaseController{Db: db}}
+	_, rw := newTestRequest(c, http.MethodPost, "/image-management/v1/images/"+baseId+"/action/delta-upload?"+
+		url.Values{util.DeltaRecipe: {string(encoded)}}.Encode(), nil, map[string]string{":imageId": baseId})
+	c.DeltaUpload()
+	return rw.Code, rw.Body.String()
+}
+
+func TestDeltaUploadValidatesBaseWithoutRecordedSize(t *testing.T) {
+	root := useTestStores(t)
+	db := newFakeDb()
+	insertDownloadImage(t, db, root, "base", "disk.img", "default:none")
+	// images of older releases don't record their size
+	_, err := db.UpdateWithFilters("image_d_b", map[string]interface{}{"image_id__exact": "base"},
+		map[string]interface{}{"size": int64(0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := append(append([]byte{}, testImageContent[:testBlockSize]...), "hello"...)
+	recipe := &DeltaRecipe{BlockSize: testBlockSize, Size: int64(len(image)), Checksum: checksumOf(image),
+		Ops: []DeltaOp{{Type: deltaOpCopy, Index: 0}, {Type: deltaOpData, Length: 5}}}
+	outside := *recipe
+	outside.Ops = []DeltaOp{{Type: deltaOpCopy, Index: int64(len(testImageContent)) / testBlockSize},
+		{Type: deltaOpData, Length: 5}}
+
+	if code, body := postDelta(db, "base", &outside); code != util.BadRequest ||
+		!strings.Contains(body, "outside of the base image") {
+		t.Fatalf("got status %d and %q for a recipe copying outside the base", code, body)
+	}
+	if code, body := postDelta(db, "base", recipe); code != util.BadRequest ||
+		!strings.Contains(body, "blocks are required") {
+		t.Fatalf("got status %d and %q for data ops without blocks", code, body)
+	}
+}
@@ -22,12 +22,17 @@ package controllers
 import (
 	"archive/zip"
 	"fileSystem/models"
+	"fileSystem/pkg/codec"
+	"fileSystem/pkg/transfer"
 	"fileSystem/util"
-	log "github.com/sirupsen/logrus"
 	"io"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // DownloadController   Define the download controller
@@ -38,7 +43,7 @@ type DownloadController struct {
 // @Title PathCheck
 // @Description check file in path is existed or not
 // @Param   Source Zip File Path    string
-func (this *DownloadController) PathCheck(path string) bool {
+func (this *BaseController) PathCheck(path string) bool {
 	_, err := os.Stat(path)
 	if err == nil {
 		return true
@@ -49,100 +54,92 @@ func (this *DownloadController) PathCheck(path string) bool {
 	return false
 }
 
-// @Title DeCompress
-// @Description Decompress file
-// @Param   Source Zip File Path    string
-// @Param   Destination File Path    string
-func DeCompress(zipFile, dest string) ([]string, error) {
-	var res []string
-	reader, err := zip.OpenReader(zipFile)
-	if err != nil {
-		return nil, err
+// Describe a download for the audit log, range requests are recorded as partial downloads
+func (this *BaseController) downloadAuditDetails(downloadName string) string {
+	details := "file=" + downloadName
+	if rangeHeader := this.Ctx.Input.Header("Range"); rangeHeader != "" {
+		details += " partial=true range=" + rangeHeader
 	}
-	defer reader.Close()
-	for _, file := range reader.File {
-		rc, err := file.Open()
-		if err != nil {
-			return nil, err
-		}
-		defer rc.Close()
-		filename := dest + "/" + file.Name
-		err = os.MkdirAll(getDir(filename), 0755)
-		if err != nil {
-			return nil, err
-		}
-
-		if len(filename)-1 == strings.LastIndex(filename, "/") {
-			continue
-		}
-		w, err := os.Create(filename)
-		if err != nil {
-			return nil, err
-		}
-		defer w.Close()
-		_, err = io.Copy(w, rc)
-		res = append(res, filename)
-		if err != nil {
-			return nil, err
-		}
-	}
-	return res, nil
-}
-
-//Helper function to get file path
-func getDir(path string) string {
-	return subString(path, 0, strings.LastIndex(path, "/"))
-}
-
-//Helper function to get substring
-func subString(str string, start, end int) string {
-	rs := []rune(str)
-	length := len(rs)
-
-	if start < 0 || start > length {
-		panic("start is wrong")
-	}
-
-	if end < start || end > length {
-		panic("end is wrong")
-	}
-
-	return string(rs[start:end])
+	return details
 }
 
 // @Title Get
 // @Description Download file
 // @Param   imageId        path 	string	true   "imageId"
+// @Param   isZip          query 	string	false  "true to download the stored zip"
+// @Param   format         query 	string	false  "zip, tar, tar.gz, tar.zst or gzip"
+// @Param   entry          query 	string	false  "path of the package file to download, the largest image by default"
 // @Success 200 ok
 // @Failure 400 bad request
 // @router /imagemanagement/v1/download [get]
 func (this *DownloadController) Get() {
-	log.Info("Download get request received.")
+	this.logger().Info("Download get request received.")
+	this.auditAs(util.AuditActionDownload)
 
 	clientIp := this.Ctx.Input.IP()
 	err := util.ValidateSrcAddress(clientIp)
 	if err != nil {
-		this.HandleLoggingForError(clientIp, util.BadRequest, util.ClientIpaddressInvalid)
+		this.HandleApiError(clientIp, util.BadRequest, util.ClientIpaddressInvalid, util.ErrInvalidClientIp)
 		return
 	}
 
 	this.displayReceivedMsg(clientIp)
 
-	var imageFileDb models.ImageDB
-
 	imageId := this.Ctx.Input.Param(":imageId")
 
-	_, err = this.Db.QueryTable("image_d_b", &imageFileDb, "image_id__exact", imageId)
+	imageFileDb, ok := this.queryImage(clientIp, imageId, "fail to query database")
+	if !ok {
+		return
+	}
+	this.serveImage(clientIp, imageFileDb)
+}
+
+// Serve the requested or default entry of an image, its stored package when isZip=true or format=zip is requested,
+// or a tar, tar.gz, tar.zst or gzip of it for the other formats
+func (this *BaseController) serveImage(clientIp string, imageFileDb *models.ImageDB) {
+	imageId := imageFileDb.ImageId
+	format, err := this.downloadFormat()
+	if err != nil {
+		this.HandleApiError(clientIp, util.BadRequest, err.Error(), util.ErrInvalidParameter.WithDetails(err.Error()))
+		return
+	}
+	if !this.checkImageAccess(clientIp, imageFileDb, accessRead) {
+		return
+	}
+	if !imageAvailable(imageFileDb) {
+		this.HandleApiError(clientIp, util.StatusNotFound, "image is not available for download",
+			util.ErrImageNotAvailable.WithDetails("image status is "+imageFileDb.Status))
+		return
+	}
+	if !this.checkSignaturePolicy(clientIp, imageFileDb) {
+		return
+	}
 
-	//err = this.Db.QueryForDownload("image_d_b", &imageFileDb, imageId) //表名
+	tr, err := transfer.Begin(transfer.Download, imageId)
 	if err != nil {
-		this.HandleLoggingForError(clientIp, util.StatusNotFound, "fail to query database")
+		this.HandleApiError(clientIp, util.StatusServiceUnavailable, err.Error(), util.ErrServiceShuttingDown)
 		return
 	}
+	defer transfer.End(tr)
 
 	filePath := imageFileDb.StorageMedium
 	if !this.PathCheck(filePath) {
-		this.HandleLoggingForError(clientIp, util.StatusNotFound, "file path doesn't exist")
+		this.HandleApiError(clientIp, util.StatusNotFound, "file path doesn't exist", util.ErrImageFileMissing)
+		return
+	}
+
+	if format != "" && format != util.FormatZip {
+		this.serveArchive(clientIp, imageFileDb, format)
+		return
+	}
+
+	if imageFileDb.Chunked || imageFileDb.Codec == codec.None {
+		err = checkUnzippedEntry(imageFileDb, this.Ctx.Input.Query("entry"))
+		if err != nil {
+			this.handleEntryError(clientIp, err)
+			return
+		}
+		this.serveUnzippedImage(clientIp, imageFileDb, format)
 		return
 	}
 
@@ -151,26 +148,150 @@ func (this *DownloadController) Get() {
 
 	downloadPath := filePath + fileName
 
-	if this.Ctx.Input.Query("isZip") == "true" {
+	if format == util.FormatZip {
 		downloadName := strings.TrimSuffix(originalName, filepath.Ext(originalName)) + ".zip"
-		this.Ctx.Output.Download(downloadPath, downloadName)
+		stored, err := openStoredFile(downloadPath, imageFileDb.Encrypted)
+		if err != nil {
+			this.HandleApiError(clientIp, util.StatusInternalServerError, "fail to read image",
+				util.ErrImageFileMissing.WithDetails(err.Error()))
+			return
+		}
+		this.markDownloaded(imageId)
+		this.recordAudit(util.AuditActionDownload, imageId, util.AuditOutcomeSuccess, this.downloadAuditDetails(downloadName))
+		this.serveStoredFile(stored, downloadName, imageFileDb.UploadTime)
 	} else {
-		saveName := strings.TrimSuffix(originalName, filepath.Ext(originalName))
-		arr, err := DeCompress(downloadPath, filePath+saveName)
+		reader, entry, downloadName, err := openImageEntry(imageFileDb, this.Ctx.Input.Query("entry"))
+		if err != nil {
+			this.handleEntryError(clientIp, err)
+			return
+		}
+		defer reader.Close()
+		expected, err := entryDigest(imageFileDb, reader.File, entry)
+		if err != nil {
+			this.HandleApiError(clientIp, util.StatusInternalServerError, "fail to read manifest",
+				util.ErrDecompressFailed.WithDetails(err.Error()))
+			return
+		}
+		rc, err := entry.Open()
 		if err != nil {
-			this.HandleLoggingForError(clientIp, util.StatusInternalServerError, util.FailedToDecompress)
+			this.HandleApiError(clientIp, util.StatusInternalServerError, util.FailedToDecompress,
+				util.ErrDecompressFailed.WithDetails(err.Error()))
 			return
 		}
+		defer rc.Close()
+		this.markDownloaded(imageId)
+		this.recordAudit(util.AuditActionDownload, imageId, util.AuditOutcomeSuccess, this.downloadAuditDetails(downloadName))
+		this.serveEntry(reader, entry, rc, downloadName, expected, imageFileDb.UploadTime)
+	}
+}
 
-		downloadPath = arr[0]
-		originalName = subString(downloadPath, strings.LastIndex(downloadPath, "/")+1, len(downloadPath))
-		this.Ctx.Output.Download(downloadPath, originalName)
+// Serve a zip entry from rc as it is decompressed, its digest is checked as it is read. Range requests of entries
+// stored without compression read the part they cover from the stored file, other entries are sent in full.
+func (this *BaseController) serveEntry(reader *storedZip, entry *zip.File, rc io.Reader, downloadName, expected string,
+	modTime time.Time) {
+	this.setDownloadHeaders(downloadName, "application/octet-stream")
+	if this.Ctx.Input.Header("Range") != "" && entry.Method == zip.Store {
+		offset, err := entry.DataOffset()
+		if err == nil {
+			http.ServeContent(this.Ctx.ResponseWriter, this.Ctx.Request, downloadName, modTime,
+				io.NewSectionReader(reader.file, offset, int64(entry.UncompressedSize64)))
+			return
+		}
+	}
+	this.Ctx.Output.Header("Content-Length", strconv.FormatUint(entry.UncompressedSize64, 10))
+	this.Ctx.ResponseWriter.WriteHeader(http.StatusOK)
+	err := copyVerified(this.Ctx.ResponseWriter, verifyingReader(rc, entry.Name, expected))
+	if err != nil {
+		// the response has started, the client sees a truncated image
+		this.logger().Error("fail to stream entry " + entry.Name + ": " + err.Error())
+	}
+}
 
-		err = os.RemoveAll(filePath + saveName)
+// Copy r to w holding back the last block read until r ends without error, so the client of a corrupt entry
+// sees a truncated body rather than all of its content
+func copyVerified(w io.Writer, r io.Reader) error {
+	buf := make([]byte, 32*1024)
+	var pending []byte
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, writeErr := w.Write(pending); writeErr != nil {
+				return writeErr
+			}
+			pending = append(pending[:0], buf[:n]...)
+		}
+		if err == io.EOF {
+			_, err = w.Write(pending)
+			return err
+		}
 		if err != nil {
-			this.HandleLoggingForError(clientIp, util.StatusInternalServerError, util.FailedToDeleteCache)
-			return
+			return err
 		}
 	}
+}
+
+// Serve a stored file and close it, encrypted files are decrypted as they are sent.
+// Range requests only read the part they cover.
+func (this *BaseController) serveStoredFile(stored *storedFile, downloadName string, modTime time.Time) {
+	defer stored.Close()
+	this.setDownloadHeaders(downloadName, "application/octet-stream")
+	http.ServeContent(this.Ctx.ResponseWriter, this.Ctx.Request, downloadName, modTime,
+		io.NewSectionReader(stored, 0, stored.Size()))
+}
+
+// Set the headers of a file download the same way beego does for files on disk
+func (this *BaseController) setDownloadHeaders(downloadName, contentType string) {
+	fn := url.PathEscape(downloadName)
+	if downloadName == fn {
+		fn = "filename=" + fn
+	} else {
+		fn = "filename=" + downloadName + "; filename*=utf-8''" + fn
+	}
+	this.Ctx.Output.Header("Content-Disposition", "attachment; "+fn)
+	this.Ctx.Output.Header("Content-Description", "File Transfer")
+	this.Ctx.Output.Header("Content-Type", contentType)
+	this.Ctx.Output.Header("Content-Transfer-Encoding", "binary")
+}
+
+// Serve an image stored without a zip, reassembled from its chunks or read from its blob.
+// Range requests only read the part they cover.
+func (this *BaseController) serveUnzippedImage(clientIp string, imageFileDb *models.ImageDB, format string) {
+	reader, err := this.openStoredImage(imageFileDb)
+	if err != nil {
+		this.HandleApiError(clientIp, util.StatusInternalServerError, "fail to read image",
+			util.ErrImageFileMissing.WithDetails(err.Error()))
+		return
+	}
+	defer reader.Close()
+	imageId := imageFileDb.ImageId
+	originalName := imageFileDb.FileName
+	content := io.NewSectionReader(reader, 0, reader.Size())
+
+	if format != util.FormatZip {
+		this.markDownloaded(imageId)
+		this.recordAudit(util.AuditActionDownload, imageId, util.AuditOutcomeSuccess, this.downloadAuditDetails(originalName))
+		this.setDownloadHeaders(originalName, "application/octet-stream")
+		http.ServeContent(this.Ctx.ResponseWriter, this.Ctx.Request, originalName, imageFileDb.UploadTime, content)
+		return
+	}
 
+	// the zip is compressed while it is sent, so its size isn't known up front and ranges aren't supported
+	downloadName := strings.TrimSuffix(originalName, filepath.Ext(originalName)) + ".zip"
+	this.markDownloaded(imageId)
+	this.recordAudit(util.AuditActionDownload, imageId, util.AuditOutcomeSuccess, this.downloadAuditDetails(downloadName))
+	this.setDownloadHeaders(downloadName, "application/zip")
+	zw := codec.Default.NewZipWriter(this.Ctx.ResponseWriter, util.CompressionWorkers())
+	header := &zip.FileHeader{Name: originalName, Method: zip.Deflate, Modified: imageFileDb.UploadTime}
+	header.SetMode(0644)
+	w, err := zw.CreateHeader(header)
+	if err == nil {
+		_, err = io.Copy(w, content)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		// the response has started, the client sees a truncated zip
+		this.logger().Error("fail to stream zip of image " + imageId + ": " + err.Error())
+	}
 }
@@ -0,0 +1,249 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fileSystem/pkg/envelope"
+	"fileSystem/util"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+var testImageContent = bytes.Repeat([]byte("disk block "), 4096)
+
+// Upload an image into the test stores with the given compression policy and seed its active record
+func insertDownloadImage(t *testing.T, db *fakeDb, root, imageId, filename, policy string) {
+	setTestConfig(t, "compressionPolicy", policy)
+	record, _ := storeTestImage(t, db, imageId, filename, testImageContent)
+	record.StorageMedium = root
+	record.Status = util.ImageStatusActive
+	record.UploadTime = time.Date(2021, 7, 1, 10, 0, 0, 0, time.UTC)
+	db.insert(record)
+}
+
+func downloadImage(db *fakeDb, imageId, query string, header http.Header) *httptest.ResponseRecorder {
+	c := &DownloadController{BaseController{Db: db}}
+	req, rw := newTestRequest(c, http.MethodGet, "/image-management/v1/images/"+imageId+"/action/download?"+query,
+		nil, map[string]string{":imageId": imageId})
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	c.Get()
+	return rw
+}
+
+// Read the single file of a tar, returns its name and content
+func readTar(t *testing.T, r io.Reader) (string, []byte) {
+	tr := tar.NewReader(r)
+	header, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadAll(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tr.Next(); err != io.EOF {
+		t.Fatalf("tar has more than one file: %v", err)
+	}
+	return header.Name, content
+}
+
+func TestDownloadArchiveFormats(t *testing.T) {
+	root := useTestStores(t)
+	db := newFakeDb()
+	insertDownloadImage(t, db, root, "zipped", "disk.img", "default:deflate")
+	insertDownloadImage(t, db, root, "unzipped", "disk.img", "default:none")
+
+	for _, imageId := range []string{"zipped", "unzipped"} {
+		for _, format := range []string{util.FormatTar, util.FormatTarGz, util.FormatTarZst, util.FormatGzip} {
+			t.Run(imageId+" "+format, func(t *testing.T) {
+				rw := downloadImage(db, imageId, "format="+format, nil)
+				if rw.Code != util.StatusOK {
+					t.Fatalf("got status %d: %s", rw.Code, rw.Body.String())
+				}
+				var name string
+				var content []byte
+				switch format {
+				case util.FormatTar:
+					name, content = readTar(t, rw.Body)
+				case util.FormatTarZst:
+					zr, err := zstd.NewReader(rw.Body)
+					if err != nil {
+						t.Fatal(err)
+					}
+					defer zr.Close()
+					name, content = readTar(t, zr)
+				default:
+					gr, err := gzip.NewReader(rw.Body)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if format == util.FormatGzip {
+						name = gr.Name
+						content, err = ioutil.ReadAll(gr)
+						if err != nil {
+							t.Fatal(err)
+						}
+					} else {
+						name, content = readTar(t, gr)
+					}
+				}
+				if name != "disk.img" || !bytes.Equal(content, testImageContent) {
+					t.Fatalf("got file %q of %d bytes", name, len(content))
+				}
+			})
+		}
+	}
+}
+
+func TestDownloadServesImage(t *testing.T) {
+	root := useTestStores(t)
+	db := newFakeDb()
+	insertDownloadImage(t, db, root, "zipped", "disk.img", "default:deflate")
+	insertDownloadImage(t, db, root, "unzipped", "disk.img", "default:none")
+
+	for _, imageId := range []string{"zipped", "unzipped"} {
+		rw := downloadImage(db, imageId, "", nil)
+		if rw.Code != util.StatusOK || !bytes.Equal(rw.Body.Bytes(), testImageContent) {
+			t.Fatalf("%s: got status %d and %d bytes", imageId, rw.Code, rw.Body.Len())
+		}
+	}
+	insertDownloadImage(t, db, root, "stored", "disk.img", "default:store")
+	for _, imageId := range []string{"unzipped", "stored"} {
+		rw := downloadImage(db, imageId, "", http.Header{"Range": {"bytes=0-9"}})
+		if rw.Code != http.StatusPartialContent || rw.Body.String() != string(testImageContent[:10]) {
+			t.Fatalf("%s: got status %d and body %q for a range", imageId, rw.Code, rw.Body.String())
+		}
+	}
+	// compressed entries can't be read from an offset, the whole image is sent
+	rw := downloadImage(db, "zipped", "", http.Header{"Range": {"bytes=0-9"}})
+	if rw.Code != util.StatusOK || !bytes.Equal(rw.Body.Bytes(), testImageContent) {
+		t.Fatalf("got status %d and %d bytes for a range of a compressed image", rw.Code, rw.Body.Len())
+	}
+	if rw = downloadImage(db, "zipped", "format=rar", nil); rw.Code != util.BadRequest {
+		t.Fatalf("got status %d for an unknown format, want %d", rw.Code, util.BadRequest)
+	}
+	if image := readImage(t, db, "zipped"); image.LastDownloadTime.IsZero() {
+		t.Fatal("download time wasn't recorded")
+	}
+}
+
+// Enable encryption of stored files with a key file of one master key
+func useTestEncryption(t *testing.T) {
+	path := newTestDir(t) + "master.keys"
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("k"), 32))
+	if err := ioutil.WriteFile(path, []byte("k1="+key+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	setTestConfig(t, "encryptionEnabled", "true")
+	setTestConfig(t, "encryptionKeyFile", path)
+}
+
+func TestDownloadEncryptedImage(t *testing.T) {
+	root := useTestStores(t)
+	useTestEncryption(t)
+	db := newFakeDb()
+	insertDownloadImage(t, db, root, "zipped", "disk.img", "default:deflate")
+	insertDownloadImage(t, db, root, "unzipped", "disk.img", "default:none")
+
+	for _, imageId := range []string{"zipped", "unzipped"} {
+		image := readImage(t, db, imageId)
+		f, err := os.Open(blobStore.Path(image.BlobDigest))
+		if err != nil {
+			t.Fatal(err)
+		}
+		encrypted, err := envelope.IsEncrypted(f)
+		_ = f.Close()
+		if err != nil || !encrypted || !image.Encrypted {
+			t.Fatalf("%s: stored file is encrypted %v, recorded %v, %v", imageId, encrypted, image.Encrypted, err)
+		}
+		rw := downloadImage(db, imageId, "", nil)
+		if rw.Code != util.StatusOK || !bytes.Equal(rw.Body.Bytes(), testImageContent) {
+			t.Fatalf("%s: got status %d and %d bytes", imageId, rw.Code, rw.Body.Len())
+		}
+	}
+	rw := downloadImage(db, "unzipped", "", http.Header{"Range": {"bytes=10-19"}})
+	if rw.Code != http.StatusPartialContent || rw.Body.String() != string(testImageContent[10:20]) {
+		t.Fatalf("got status %d and body %q for a range", rw.Code, rw.Body.String())
+	}
+}
+
+func TestDownloadRequiresAvailableImage(t *testing.T) {
+	root := useTestStores(t)
+	db := newFakeDb()
+	insertDownloadImage(t, db, root, "image1", "disk.img", "default:deflate")
+	_, _ = db.UpdateWithFilters("image_d_b", map[string]interface{}{"image_id__exact": "image1"},
+		map[string]interface{}{"status": util.ImageStatusTrashed})
+	if rw := downloadImage(db, "image1", "format=tar", nil); rw.Code != util.StatusNotFound {
+		t.Fatalf("got status %d for a trashed image, want %d", rw.Code, util.StatusNotFound)
+	}
+}
+
+// Check a downloaded zip holds the image, next to the manifest of packages generated on upload
+func checkZipDownload(t *testing.T, body []byte, wantName string) {
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []*zip.File
+	for _, file := range zr.File {
+		if file.Name != util.ManifestEntryName {
+			files = append(files, file)
+		}
+	}
+	if len(files) != 1 || files[0].Name != wantName {
+		t.Fatalf("got %d zip entries besides the manifest", len(files))
+	}
+	r, err := files[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if content, _ := ioutil.ReadAll(r); !bytes.Equal(content, testImageContent) {
+		t.Fatal("zip entry differs from the image")
+	}
+}
+
+func TestDownloadZip(t *testing.T) {
+	root := useTestStores(t)
+	db := newFakeDb()
+	insertDownloadImage(t, db, root, "zipped", "disk.img", "default:deflate")
+	insertDownloadImage(t, db, root, "unzipped", "disk.img", "default:none")
+
+	rw := downloadImage(db, "zipped", "isZip=true", nil)
+	if rw.Code != util.StatusOK {
+		t.Fatalf("got status %d: %s", rw.Code, rw.Body.String())
+	}
+	checkZipDownload(t, rw.Body.Bytes(), "disk.img")
+	rw = downloadImage(db, "unzipped", "format=zip", nil)
+	if rw.Code != util.StatusOK {
+		t.Fatalf("got status %d: %s", rw.Code, rw.Body.String())
+	}
+	checkZipDownload(t, rw.Body.Bytes(), "disk.img")
+}
@@ -0,0 +1,224 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// @Title  controllers
+// @Description  entries of stored packages and selection of the entry a download serves
+// @Author  GuoZhen Gao (2021/6/30 10:40)
+package controllers
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fileSystem/models"
+	"fileSystem/pkg/codec"
+	"fileSystem/pkg/transfer"
+	"fileSystem/util"
+	"fmt"
+	"path/filepath"
+)
+
+var errEntryNotFound = errors.New("entry doesn't exist in the package")
+
+// PackageEntry   Define a file of a stored image package, default marks the file served when no entry is requested
+type PackageEntry struct {
+	Name           string `json:"name"`
+	Size           uint64 `json:"size"`
+	CompressedSize uint64 `json:"compressedSize"`
+	Crc32          string `json:"crc32,omitempty"`
+	Default        bool   `json:"default"`
+}
+
+// Report whether an image was uploaded as a zip package, which may hold several files
+func isPackage(image *models.ImageDB) bool {
+	return filepath.Ext(image.FileName) == ".zip"
+}
+
+// Pick the file a package serves by default, the largest disk image or the largest file when it has none
+func defaultEntry(files []*zip.File) *zip.File {
+	var largest, largestImage *zip.File
+	for _, file := range files {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		if largest == nil || file.UncompressedSize64 > largest.UncompressedSize64 {
+			largest = file
+		}
+		if util.IsImageFileName(file.Name) &&
+			(largestImage == nil || file.UncompressedSize64 > largestImage.UncompressedSize64) {
+			largestImage = file
+		}
+	}
+	if largestImage != nil {
+		return largestImage
+	}
+	return largest
+}
+
+// Find a package file by its path in the package, the default file when the path is empty
+func selectEntry(files []*zip.File, name string) (*zip.File, error) {
+	if name == "" {
+		if file := defaultEntry(files); file != nil {
+			return file, nil
+		}
+		return nil, errors.New("zip file has no entry")
+	}
+	for _, file := range files {
+		if file.Name == name && !file.FileInfo().IsDir() {
+			return file, nil
+		}
+	}
+	return nil, errEntryNotFound
+}
+
+// Check the requested entry of an image stored without a zip, its only entry is the original file
+func checkUnzippedEntry(image *models.ImageDB, name string) error {
+	if name != "" && name != image.FileName {
+		return errEntryNotFound
+	}
+	return nil
+}
+
+// Open the zip of an image and select the requested entry, returns the name the entry is downloaded as.
+// Images compressed on upload have one entry, which older releases stored under a fixed name.
+func openImageEntry(image *models.ImageDB, name string) (*storedZip, *zip.File, string, error) {
+	reader, err := openStoredZip(image.StorageMedium+image.SaveFileName, image.Encrypted)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	var file *zip.File
+	downloadName := image.FileName
+	switch {
+	case isPackage(image):
+		file, err = selectEntry(reader.File, name)
+		if err == nil {
+			downloadName = filepath.Base(file.Name)
+		}
+	case len(reader.File) == 0:
+		err = errors.New("zip file has no entry")
+	default:
+		file, err = reader.File[0], checkUnzippedEntry(image, name)
+	}
+	if err != nil {
+		_ = reader.Close()
+		return nil, nil, "", err
+	}
+	return reader, file, downloadName, nil
+}
+
+// List the entries of an image, images which aren't packages have their original file as only entry
+func imageEntries(image *models.ImageDB) ([]PackageEntry, error) {
+	if image.Chunked || image.Codec == codec.None {
+		return []PackageEntry{{Name: image.FileName, Size: uint64(image.Size), CompressedSize: uint64(image.Size),
+			Default: true}}, nil
+	}
+	reader, err := openStoredZip(image.StorageMedium+image.SaveFileName, image.Encrypted)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	if len(reader.File) == 0 {
+		return nil, errors.New("zip file has no entry")
+	}
+	files, defaultFile := reader.File, reader.File[0]
+	if isPackage(image) {
+		defaultFile = defaultEntry(files)
+	} else {
+		files = files[:1]
+	}
+	entries := make([]PackageEntry, 0, len(files))
+	for _, file := range files {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		entry := PackageEntry{
+			Name:           file.Name,
+			Size:           file.UncompressedSize64,
+			CompressedSize: file.CompressedSize64,
+			Crc32:          fmt.Sprintf("%08x", file.CRC32),
+			Default:        file == defaultFile,
+		}
+		if !isPackage(image) {
+			entry.Name = image.FileName
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// @Title Entries
+// @Description list the files of an image package, a download serves one of them with the entry parameter
+// @Param   imageId     path   string  true   "imageId"
+// @Param   userId      query  string  false  "caller"
+// @Param   tenantId    query  string  false  "tenant of the caller"
+// @Success 200 ok
+// @Failure 403 forbidden
+// @Failure 404 not found
+// @router /image-management/v1/images/:imageId/entries [get]
+func (this *DownloadController) Entries() {
+	this.logger().Info("Entries request received.")
+	clientIp := this.Ctx.Input.IP()
+	err := util.ValidateSrcAddress(clientIp)
+	if err != nil {
+		this.HandleApiError(clientIp, util.BadRequest, util.ClientIpaddressInvalid, util.ErrInvalidClientIp)
+		return
+	}
+	this.displayReceivedMsg(clientIp)
+
+	image, ok := this.queryImage(clientIp, this.Ctx.Input.Param(":imageId"), "fail to query database")
+	if !ok || !this.checkImageAccess(clientIp, image, accessRead) {
+		return
+	}
+	if !imageAvailable(image) {
+		this.HandleApiError(clientIp, util.StatusNotFound, "image is not available",
+			util.ErrImageNotAvailable.WithDetails("image status is "+image.Status))
+		return
+	}
+
+	tr, err := transfer.Begin(transfer.Download, image.ImageId)
+	if err != nil {
+		this.HandleApiError(clientIp, util.StatusServiceUnavailable, err.Error(), util.ErrServiceShuttingDown)
+		return
+	}
+	defer transfer.End(tr)
+	entries, err := imageEntries(image)
+	if err != nil {
+		this.HandleApiError(clientIp, util.StatusInternalServerError, util.FailedToDecompress,
+			util.ErrDecompressFailed.WithDetails(err.Error()))
+		return
+	}
+	entriesResp, err := json.Marshal(map[string]interface{}{
+		"imageId": image.ImageId,
+		"package": isPackage(image),
+		"entries": entries,
+	})
+	if err != nil {
+		this.HandleApiError(clientIp, util.StatusInternalServerError, "fail to return entries", util.ErrInternal)
+		return
+	}
+	_, _ = this.Ctx.ResponseWriter.Write(entriesResp)
+}
+
+// Write the error response of an entry which can't be opened
+func (this *BaseController) handleEntryError(clientIp string, err error) {
+	if err == errEntryNotFound {
+		this.HandleApiError(clientIp, util.StatusNotFound, err.Error(),
+			util.ErrEntryNotFound.WithDetails("entry "+this.Ctx.Input.Query("entry")))
+		return
+	}
+	this.HandleApiError(clientIp, util.StatusInternalServerError, util.FailedToDecompress,
+		util.ErrDecompressFailed.WithDetails(err.Error()))
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fileSystem/util"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Build a package holding a readme larger than its disk images
+func newTestPackage(t *testing.T) ([]byte, map[string][]byte) {
+	files := map[string][]byte{
+		"docs/README.txt": bytes.Repeat([]byte("read me "), 2048),
+		"disk.qcow2":      bytes.Repeat([]byte("qcow2 "), 1024),
+		"extra/small.img": []byte("small image"),
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	if _, err := zw.Create("docs/"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"docs/README.txt", "disk.qcow2", "extra/small.img"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = w.Write(files[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), files
+}
+
+func insertTestPackage(t *testing.T, db *fakeDb, root, imageId string) map[string][]byte {
+	content, files := newTestPackage(t)
+	record, _ := storeTestImage(t, db, imageId, "package.zip", content)
+	record.StorageMedium = root
+	record.Status = util.ImageStatusActive
+	db.insert(record)
+	return files
+}
+
+func listEntries(t *testing.T, db *fakeDb, imageId string) (bool, []PackageEntry) {
+	c := &DownloadController{BaseController{Db: db}}
+	_, rw := newTestRequest(c, http.MethodGet, "/image-management/v1/images/"+imageId+"/entries", nil,
+		map[string]string{":imageId": imageId})
+	c.Entries()
+	if rw.Code != util.StatusOK {
+		t.Fatalf("got status %d: %s", rw.Code, rw.Body.String())
+	}
+	var result struct {
+		Package bool           `json:"package"`
+		Entries []PackageEntry `json:"entries"`
+	}
+	if err := json.Unmarshal(rw.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	return result.Package, result.Entries
+}
+
+func TestListPackageEntries(t *testing.T) {
+	root := useTestStores(t)
+	db := newFakeDb()
+	insertTestPackage(t, db, root, "package1")
+
+	isPackage, entries := listEntries(t, db, "package1")
+	if !isPackage || len(entries) != 3 {
+		t.Fatalf("got package %v with entries %+v", isPackage, entries)
+	}
+	for _, entry := range entries {
+		if entry.Default != (entry.Name == "disk.qcow2") {
+			t.Fatalf("entry %s has default %v", entry.Name, entry.Default)
+		}
+		if entry.Name == "disk.qcow2" && entry.Size != 6*1024 {
+			t.Fatalf("got size %d for disk.qcow2", entry.Size)
+		}
+	}
+
+	insertDownloadImage(t, db, root, "image1", "disk.img", "default:deflate")
+	isPackage, entries = listEntries(t, db, "image1")
+	if isPackage || len(entries) != 1 || entries[0].Name != "disk.img" || !entries[0].Default {
+		t.Fatalf("got package %v with entries %+v", isPackage, entries)
+	}
+}
+
+func TestDownloadPackageEntry(t *testing.T) {
+	root := useTestStores(t)
+	db := newFakeDb()
+	files := insertTestPackage(t, db, root, "package1")
+
+	rw := downloadImage(db, "package1", "", nil)
+	if rw.Code != util.StatusOK || !bytes.Equal(rw.Body.Bytes(), files["disk.qcow2"]) {
+		t.Fatalf("default download got status %d and %d bytes", rw.Code, rw.Body.Len())
+	}
+	if disposition := rw.Header().Get("Content-Disposition"); !strings.Contains(disposition, "disk.qcow2") {
+		t.Fatalf("got Content-Disposition %q", disposition)
+	}
+	rw = downloadImage(db, "package1", "entry=docs/README.txt", nil)
+	if rw.Code != util.StatusOK || !bytes.Equal(rw.Body.Bytes(), files["docs/README.txt"]) {
+		t.Fatalf("entry download got status %d and %d bytes", rw.Code, rw.Body.Len())
+	}
+	rw = downloadImage(db, "package1", "entry=extra/small.img&format=tar", nil)
+	if name, content := readTar(t, rw.Body); name != "small.img" || !bytes.Equal(content, files["extra/small.img"]) {
+		t.Fatalf("tar of an entry got file %q", name)
+	}
+	for _, query := range []string{"entry=missing.img", "entry=docs/", "entry=missing.img&format=tar"} {
+		if rw = downloadImage(db, "package1", query, nil); rw.Code != util.StatusNotFound {
+			t.Fatalf("%s got status %d, want %d", query, rw.Code, util.StatusNotFound)
+		}
+	}
+}
+
+func TestDownloadEntryOfSingleImage(t *testing.T) {
+	root := useTestStores(t)
+	db := newFakeDb()
+	insertDownloadImage(t, db, root, "zipped", "disk.img", "default:deflate")
+	insertDownloadImage(t, db, root, "unzipped", "disk.img", "default:none")
+	for _, imageId := range []string{"zipped", "unzipped"} {
+		if rw := downloadImage(db, imageId, "entry=disk.img", nil); rw.Code != util.StatusOK ||
+			!bytes.Equal(rw.Body.Bytes(), testImageContent) {
+			t.Fatalf("%s: got status %d for its own entry", imageId, rw.Code)
+		}
+		if rw := downloadImage(db, imageId, "entry=other.img", nil); rw.Code != util.StatusNotFound {
+			t.Fatalf("%s: got status %d for another entry, want %d", imageId, rw.Code, util.StatusNotFound)
+		}
+	}
+}
+
+func TestDefaultEntryFallsBackToLargestFile(t *testing.T) {
+	files := []*zip.File{
+		{FileHeader: zip.FileHeader{Name: "notes.txt", UncompressedSize64: 10}},
+		{FileHeader: zip.FileHeader{Name: "data.bin", UncompressedSize64: 20}},
+		{FileHeader: zip.FileHeader{Name: "dir/", UncompressedSize64: 30}},
+	}
+	if file := defaultEntry(files); file == nil || file.Name != "data.bin" {
+		t.Fatalf("got default entry %v, want data.bin", file)
+	}
+	if _, err := selectEntry(nil, ""); err == nil {
+		t.Fatal("empty package has a default entry")
+	}
+}
@@ -0,0 +1,193 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// @Title  controllers
+// @Description  liveness and readiness api for filesystem
+// @Author  GuoZhen Gao (2021/6/30 10:40)
+package controllers
+
+import (
+	"fileSystem/pkg/transfer"
+	"fileSystem/pkg/worker"
+	"fileSystem/util"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+)
+
+var startTime = time.Now()
+
+// HealthController   Define the controller to report service health
+type HealthController struct {
+	BaseController
+}
+
+// HealthCheck   Define the result of a single readiness check
+type HealthCheck struct {
+	Name    string      `json:"name"`
+	Status  string      `json:"status"`
+	Message string      `json:"message,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// HealthReport   Define the health report returned to probes
+type HealthReport struct {
+	Status    string        `json:"status"`
+	Timestamp string        `json:"timestamp"`
+	Uptime    string        `json:"uptime"`
+	Checks    []HealthCheck `json:"checks,omitempty"`
+}
+
+func newHealthReport() *HealthReport {
+	return &HealthReport{
+		Status:    util.StatusUp,
+		Timestamp: time.Now().Format(time.RFC3339),
+		Uptime:    time.Since(startTime).Round(time.Second).String(),
+	}
+}
+
+// Add a check and downgrade the overall status when it failed
+func (r *HealthReport) addCheck(check HealthCheck) {
+	if check.Status != util.StatusUp {
+		r.Status = util.StatusDown
+	}
+	r.Checks = append(r.Checks, check)
+}
+
+// Write health report
+func (c *HealthController) writeReport(report *HealthReport) {
+	code := util.StatusOK
+	if report.Status != util.StatusUp {
+		code = util.StatusServiceUnavailable
+		c.logger().Warn("Readiness check failed for Resource [" + c.Ctx.Input.URL() + "]")
+	}
+	c.Data["json"] = report
+	c.Ctx.Output.SetStatus(code)
+	c.ServeJSON()
+}
+
+func (c *HealthController) checkLifecycle() HealthCheck {
+	check := HealthCheck{Name: "lifecycle", Status: util.StatusUp}
+	if transfer.Draining() {
+		check.Status = util.StatusDown
+		check.Message = transfer.ErrDraining.Error()
+	}
+	check.Details = map[string]int{"activeTransfers": transfer.ActiveCount()}
+	return check
+}
+
+func (c *HealthController) checkDatabase() HealthCheck {
+	check := HealthCheck{Name: "database", Status: util.StatusUp}
+	if c.Db == nil {
+		check.Status = util.StatusDown
+		check.Message = "database adapter is not initialized"
+		return check
+	}
+	begin := time.Now()
+	err := c.Db.Ping()
+	if err != nil {
+		check.Status = util.StatusDown
+		check.Message = "fail to query database: " + err.Error()
+		return check
+	}
+	check.Details = map[string]string{"latency": time.Since(begin).String()}
+	return check
+}
+
+func (c *HealthController) checkStorage() HealthCheck {
+	check := HealthCheck{Name: "storage", Status: util.StatusUp}
+	path := util.LocalStoragePath
+
+	err := createDirectory(path)
+	if err != nil {
+		check.Status = util.StatusDown
+		check.Message = "storage path doesn't exist and can't be created"
+		return check
+	}
+	probe, err := ioutil.TempFile(path, ".health-")
+	if err != nil {
+		check.Status = util.StatusDown
+		check.Message = "storage path is not writable"
+		return check
+	}
+	_ = probe.Close()
+	_ = os.Remove(probe.Name())
+
+	total, free, err := util.GetDiskSpace(path)
+	if err != nil {
+		// writability is the hard requirement, free space is reported when available
+		check.Message = err.Error()
+		return check
+	}
+	minFreeMB := util.GetAppConfigInt64("storageMinFreeMB", util.DefaultMinFreeMB)
+	minFreePercent := util.GetAppConfigInt64("storageMinFreePercent", util.DefaultMinFreePercent)
+	freeMB := int64(free / (1024 * 1024))
+	var freePercent int64
+	if total > 0 {
+		freePercent = int64(free * 100 / total)
+	}
+	check.Details = map[string]string{
+		"path":           path,
+		"freeMB":         strconv.FormatInt(freeMB, 10),
+		"freePercent":    strconv.FormatInt(freePercent, 10),
+		"minFreeMB":      strconv.FormatInt(minFreeMB, 10),
+		"minFreePercent": strconv.FormatInt(minFreePercent, 10),
+	}
+	if freeMB < minFreeMB || freePercent < minFreePercent {
+		check.Status = util.StatusDown
+		check.Message = "free space of storage path is below threshold"
+	}
+	return check
+}
+
+func (c *HealthController) checkWorkers() HealthCheck {
+	check := HealthCheck{Name: "workers", Status: util.StatusUp}
+	states := worker.States()
+	for _, state := range states {
+		if !state.Running || state.Stalled {
+			check.Status = util.StatusDown
+			check.Message = "worker " + state.Name + " is not running"
+			break
+		}
+	}
+	check.Details = states
+	return check
+}
+
+// @Title Live
+// @Description liveness probe, only reports the process is serving requests
+// @Success 200 ok
+// @router /health/live [get]
+func (c *HealthController) Live() {
+	c.logger().Debug("Liveness probe request received.")
+	c.writeReport(newHealthReport())
+}
+
+// @Title Ready
+// @Description readiness probe, checks database, storage and background workers
+// @Success 200 ok
+// @Failure 503 service unavailable
+// @router /health/ready [get]
+func (c *HealthController) Ready() {
+	c.logger().Debug("Readiness probe request received.")
+	report := newHealthReport()
+	report.addCheck(c.checkLifecycle())
+	report.addCheck(c.checkDatabase())
+	report.addCheck(c.checkStorage())
+	report.addCheck(c.checkWorkers())
+	c.writeReport(report)
+}
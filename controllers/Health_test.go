@@ -0,0 +1,98 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fileSystem/util"
+	"net/http"
+	"testing"
+)
+
+func decodeHealthReport(t *testing.T, body []byte) HealthReport {
+	t.Helper()
+	var report HealthReport
+	if err := json.Unmarshal(body, &report); err != nil {
+		t.Fatalf("invalid health report %q: %v", body, err)
+	}
+	return report
+}
+
+func TestLiveReportsUp(t *testing.T) {
+	c := &HealthController{BaseController{Db: newFakeDb()}}
+	_, rw := newTestRequest(c, http.MethodGet, "/health/live", nil, nil)
+	c.Live()
+
+	if rw.Code != util.StatusOK {
+		t.Fatalf("got status %d, want %d", rw.Code, util.StatusOK)
+	}
+	report := decodeHealthReport(t, rw.Body.Bytes())
+	if report.Status != util.StatusUp || len(report.Checks) != 0 {
+		t.Fatalf("unexpected liveness report %+v", report)
+	}
+}
+
+func TestReadyReportsDatabaseDown(t *testing.T) {
+	db := newFakeDb()
+	db.pingErr = errors.New("connection refused")
+	c := &HealthController{BaseController{Db: db}}
+	_, rw := newTestRequest(c, http.MethodGet, "/health/ready", nil, nil)
+	c.Ready()
+
+	if rw.Code != util.StatusServiceUnavailable {
+		t.Fatalf("got status %d, want %d", rw.Code, util.StatusServiceUnavailable)
+	}
+	report := decodeHealthReport(t, rw.Body.Bytes())
+	if report.Status != util.StatusDown {
+		t.Fatalf("got report status %q, want %q", report.Status, util.StatusDown)
+	}
+	for _, check := range report.Checks {
+		if check.Name == "database" {
+			if check.Status != util.StatusDown || check.Message != "fail to query database: connection refused" {
+				t.Fatalf("unexpected database check %+v", check)
+			}
+			return
+		}
+	}
+	t.Fatal("readiness report has no database check")
+}
+
+func TestCheckDatabase(t *testing.T) {
+	c := &HealthController{BaseController{Db: newFakeDb()}}
+	if check := c.checkDatabase(); check.Status != util.StatusUp {
+		t.Fatalf("reachable database reported %+v", check)
+	}
+
+	c.Db = nil
+	if check := c.checkDatabase(); check.Status != util.StatusDown {
+		t.Fatalf("missing database adapter reported %+v", check)
+	}
+}
+
+func TestReportDowngradesOnFailedCheck(t *testing.T) {
+	report := newHealthReport()
+	report.addCheck(HealthCheck{Name: "a", Status: util.StatusUp})
+	if report.Status != util.StatusUp {
+		t.Fatalf("got %q after a passing check", report.Status)
+	}
+	report.addCheck(HealthCheck{Name: "b", Status: util.StatusDown})
+	report.addCheck(HealthCheck{Name: "c", Status: util.StatusUp})
+	if report.Status != util.StatusDown || len(report.Checks) != 3 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+}
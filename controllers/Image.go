@@ -21,10 +21,10 @@ package controllers
 
 import (
 	"encoding/json"
-	"fileSystem/models"
 	"fileSystem/util"
-	log "github.com/sirupsen/logrus"
-	"os"
+	"io"
+	"strconv"
+	"strings"
 )
 
 // DownloadController   Define the Image controller to control query and delete
@@ -39,105 +39,233 @@ type ImageController struct {
 // @Failure 400 bad request
 // @router /image-management/v1/images/:imageId [GET]
 func (this *ImageController) Get() {
-	log.Info("Query for local image get request received.")
+	this.logger().Info("Query for local image get request received.")
 
 	clientIp := this.Ctx.Input.IP()
 	err := util.ValidateSrcAddress(clientIp)
 	if err != nil {
-		this.HandleLoggingForError(clientIp, util.BadRequest, util.ClientIpaddressInvalid)
+		this.HandleApiError(clientIp, util.BadRequest, util.ClientIpaddressInvalid, util.ErrInvalidClientIp)
 		return
 	}
 
 	this.displayReceivedMsg(clientIp)
 
-	var imageFileDb models.ImageDB
-
 	imageId := this.Ctx.Input.Param(":imageId")
 	if imageId == "" {
-		this.HandleLoggingForError(clientIp, util.StatusNotFound, "imageId is not right")
+		this.HandleApiError(clientIp, util.StatusNotFound, "imageId is not right",
+			util.ErrInvalidParameter.WithDetails("imageId is empty"))
 		return
 	}
 
-	_, err = this.Db.QueryTable("image_d_b", &imageFileDb, "image_id__exact", imageId)
+	imageFileDb, ok := this.queryImage(clientIp, imageId, "fail to query this imageId in database")
+	if !ok {
+		return
+	}
+	if !this.checkImageAccess(clientIp, imageFileDb, accessRead) {
+		return
+	}
 
+	tags, err := this.queryImageTags(imageId)
 	if err != nil {
-		this.HandleLoggingForError(clientIp, util.StatusNotFound, "fail to query this imageId in database")
+		this.HandleApiError(clientIp, util.StatusNotFound, "fail to query this imageId in database",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
 		return
 	}
 
-	filename := imageFileDb.SaveFileName
-	uploadTime := imageFileDb.UploadTime.Format("2006-01-02 15:04:05")
-	userId := imageFileDb.UserId
-	storageMedium := imageFileDb.StorageMedium
-
-	uploadResp, err := json.Marshal(map[string]string{
-		"imageId":       imageId,
-		"fileName":      filename,
-		"uploadTime":    uploadTime,
-		"userId":        userId,
-		"storageMedium": storageMedium,
-	})
+	uploadResp, err := json.Marshal(newImageDetail(imageFileDb, tags))
 
 	if err != nil {
-		this.HandleLoggingForError(clientIp, util.StatusInternalServerError, "fail to return query details")
+		this.HandleApiError(clientIp, util.StatusInternalServerError, "fail to return query details", util.ErrInternal)
 		return
 	}
 
+	this.Ctx.Output.Header("ETag", imageETag(imageFileDb))
 	_, _ = this.Ctx.ResponseWriter.Write(uploadResp)
 
 }
 
-// @Title Delete
-// @Description perform local image delete operation
+// @Title Patch
+// @Description update editable metadata of an image, If-Match is checked against the ETag when given
 // @Param	imageId 	string
+// @Param	If-Match 	header	string	false	"ETag returned by query"
+// @Param	body 		body	ImageMetadataPatch	true	"fields to change"
 // @Success 200 ok
 // @Failure 400 bad request
-// @router /image-management/v1/images/:imageId [DELETE]
-func (this *ImageController) Delete() {
-	log.Info("Delete local image package request received.")
+// @Failure 412 precondition failed
+// @router /image-management/v1/images/:imageId [PATCH]
+func (this *ImageController) Patch() {
+	this.logger().Info("Update image metadata request received.")
+	this.auditAs(util.AuditActionUpdate)
 	clientIp := this.Ctx.Input.IP()
 	err := util.ValidateSrcAddress(clientIp)
 	if err != nil {
-		this.HandleLoggingForError(clientIp, util.BadRequest, util.ClientIpaddressInvalid)
+		this.HandleApiError(clientIp, util.BadRequest, util.ClientIpaddressInvalid, util.ErrInvalidClientIp)
 		return
 	}
 
 	this.displayReceivedMsg(clientIp)
 
-	var imageFileDb models.ImageDB
-
 	imageId := this.Ctx.Input.Param(":imageId")
+	imageFileDb, ok := this.queryImage(clientIp, imageId, "fail to query this imageId in database")
+	if !ok {
+		return
+	}
+	if !imageAvailable(imageFileDb) {
+		this.HandleApiError(clientIp, util.StatusConflict, "image is not available",
+			util.ErrImageNotAvailable.WithDetails("image status is "+imageFileDb.Status))
+		return
+	}
 
-	_, err = this.Db.QueryTable("image_d_b", &imageFileDb, "image_id__exact", imageId)
-
+	var patch ImageMetadataPatch
+	decoder := json.NewDecoder(io.LimitReader(this.Ctx.Request.Body, util.MaxMetadataBodySize))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&patch)
+	if err != nil {
+		this.HandleApiError(clientIp, util.BadRequest, "request body is invalid",
+			util.ErrInvalidParameter.WithDetails(err.Error()))
+		return
+	}
+	err = patch.validate()
 	if err != nil {
-		this.HandleLoggingForError(clientIp, util.StatusNotFound, "fail to query this imageId in database")
+		this.HandleApiError(clientIp, util.BadRequest, err.Error(), util.ErrInvalidParameter.WithDetails(err.Error()))
+		return
+	}
+	required := accessReadWrite
+	if patch.Visibility != nil {
+		// only the owner decides who else can see the image
+		required = accessOwner
+	}
+	if !this.isLegacyCaller() && !this.checkImageAccess(clientIp, imageFileDb, required) {
 		return
 	}
 
-	filename := imageFileDb.SaveFileName
-	storageMedium := imageFileDb.StorageMedium
+	ifMatch := this.Ctx.Input.Header("If-Match")
+	if ifMatch != "" && ifMatch != "*" && ifMatch != imageETag(imageFileDb) {
+		this.HandleApiError(clientIp, util.StatusPreconditionFailed, "image was modified, ETag doesn't match",
+			util.ErrPreconditionFailed.WithDetails("current ETag is "+imageETag(imageFileDb)))
+		return
+	}
 
-	file := storageMedium + filename
+	changed, err := this.updateImageMetadata(imageFileDb, &patch)
+	if err == errConcurrentModification {
+		this.HandleApiError(clientIp, util.StatusPreconditionFailed, "image was modified, ETag doesn't match",
+			util.ErrPreconditionFailed.WithDetails(err.Error()))
+		return
+	}
+	if err != nil {
+		this.HandleApiError(clientIp, util.StatusInternalServerError, "fail to update image metadata",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return
+	}
+	this.recordAudit(util.AuditActionUpdate, imageId, util.AuditOutcomeSuccess, "fields="+strings.Join(changed, ","))
 
-	err = os.Remove(file)
+	imageFileDb, ok = this.queryImage(clientIp, imageId, "fail to query this imageId in database")
+	if !ok {
+		return
+	}
+	tags, err := this.queryImageTags(imageId)
+	if err != nil {
+		this.HandleApiError(clientIp, util.StatusInternalServerError, "fail to query this imageId in database",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return
+	}
+	updateResp, err := json.Marshal(newImageDetail(imageFileDb, tags))
+	if err != nil {
+		this.HandleApiError(clientIp, util.StatusInternalServerError, "fail to return update details", util.ErrInternal)
+		return
+	}
+	this.Ctx.Output.Header("ETag", imageETag(imageFileDb))
+	_, _ = this.Ctx.ResponseWriter.Write(updateResp)
+}
 
-	fileRecord := &models.ImageDB{
-		ImageId: imageId,
+// Check no alias points to the revision backed by the image, so aliases never resolve to a deleted image
+func (this *ImageController) checkImageNotAliased(clientIp, imageId string) bool {
+	revision, aliases, err := imageAliases(this.Db, imageId)
+	if err != nil {
+		this.HandleApiError(clientIp, util.StatusInternalServerError, "fail to query database",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return false
+	}
+	if len(aliases) > 0 {
+		details := revision.Name + " revision " + strconv.FormatInt(revision.Revision, 10) +
+			" is aliased as " + strings.Join(aliases, ",")
+		this.HandleApiError(clientIp, util.StatusConflict, "image is referenced by an alias, "+details,
+			util.ErrImageInUse.WithDetails(details))
+		return false
 	}
+	return true
+}
 
-	err = this.Db.DeleteData(fileRecord, "image_id")
-	if err != nil && err.Error() != util.LastInsertIdNotSupported {
-		this.HandleLoggingForError(clientIp, util.StatusInternalServerError, err.Error())
+// @Title Delete
+// @Description move an image to trash, it can be restored until the trash retention expires
+// @Param	imageId 	string
+// @Success 200 ok
+// @Failure 400 bad request
+// @router /image-management/v1/images/:imageId [DELETE]
+func (this *ImageController) Delete() {
+	this.logger().Info("Delete local image package request received.")
+	this.auditAs(util.AuditActionDelete)
+	clientIp := this.Ctx.Input.IP()
+	err := util.ValidateSrcAddress(clientIp)
+	if err != nil {
+		this.HandleApiError(clientIp, util.BadRequest, util.ClientIpaddressInvalid, util.ErrInvalidClientIp)
 		return
 	}
 
-	if err != nil {
-		this.HandleLoggingForError(clientIp, util.StatusInternalServerError, "fail to delete package in vm")
+	this.displayReceivedMsg(clientIp)
+
+	imageId := this.Ctx.Input.Param(":imageId")
+
+	imageFileDb, ok := this.queryImage(clientIp, imageId, "fail to query this imageId in database")
+	if !ok {
 		return
-	} else {
+	}
+	// v1 clients of older releases delete images without naming the caller
+	if !this.isLegacyCaller() && !this.checkImageAccess(clientIp, imageFileDb, accessOwner) {
+		return
+	}
+
+	if imageFileDb.Status == util.ImageStatusTrashed {
+		this.HandleApiError(clientIp, util.StatusConflict, "image is already in trash",
+			util.ErrImageNotAvailable.WithDetails("image status is "+imageFileDb.Status))
+		return
+	}
+	// the upload still writes the image, it fails the upload when removed underneath it
+	if imageFileDb.Status == util.ImageStatusUploading {
+		this.HandleApiError(clientIp, util.StatusConflict, "image is still being uploaded",
+			util.ErrImageNotAvailable.WithDetails("image status is "+imageFileDb.Status))
+		return
+	}
+	if !this.checkImageNotAliased(clientIp, imageId) {
+		return
+	}
+
+	if imageFileDb.Status == util.ImageStatusFailed || imageFileDb.Status == util.ImageStatusQuarantined {
+		// failed uploads and quarantined images have nothing worth restoring
+		err = purgeImage(this.Db, imageFileDb)
+		if err != nil {
+			this.HandleApiError(clientIp, util.StatusInternalServerError, err.Error(),
+				util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+			return
+		}
+		this.recordAudit(util.AuditActionDelete, imageId, util.AuditOutcomeSuccess, "file="+imageFileDb.FileName)
 		this.Ctx.WriteString("delete success")
-		log.Info("delete file from " + storageMedium)
+		return
 	}
 
+	err = trashImage(this.Db, imageFileDb, this.GetString(util.UserId))
+	if err == errConcurrentModification {
+		this.HandleApiError(clientIp, util.StatusPreconditionFailed, "image was modified, try again",
+			util.ErrPreconditionFailed.WithDetails(err.Error()))
+		return
+	}
+	if err != nil {
+		this.HandleApiError(clientIp, util.StatusInternalServerError, err.Error(),
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return
+	}
+	this.recordAudit(util.AuditActionDelete, imageId, util.AuditOutcomeSuccess,
+		"file="+imageFileDb.FileName+" trashed=true")
+	this.Ctx.WriteString("delete success")
+	this.logger().Info("moved image " + imageId + " to trash")
 }
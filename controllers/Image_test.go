@@ -0,0 +1,118 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"fileSystem/models"
+	"fileSystem/util"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func newPatchTestDb() *fakeDb {
+	db := newFakeDb()
+	db.insert(&models.ImageDB{ImageId: "image1", UserId: "owner", Status: util.ImageStatusActive,
+		Description: "before", ResourceVersion: 3})
+	db.insert(&models.ImageTag{ImageId: "image1", Tag: "old"})
+	return db
+}
+
+func patchImage(db *fakeDb, ifMatch, body string) (int, string) {
+	c := &ImageController{BaseController{Db: db}}
+	req, rw := newTestRequest(c, http.MethodPatch, "/image-management/v1/images/image1?userId=owner",
+		strings.NewReader(body),
+		map[string]string{":imageId": "image1"})
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	c.Patch()
+	return rw.Code, rw.Header().Get("ETag")
+}
+
+func readImage(t *testing.T, db *fakeDb, imageId string) *models.ImageDB {
+	t.Helper()
+	image := &models.ImageDB{ImageId: imageId}
+	if err := db.ReadData(image); err != nil {
+		t.Fatal(err)
+	}
+	return image
+}
+
+func TestPatchRejectsStaleETag(t *testing.T) {
+	db := newPatchTestDb()
+	if code, _ := patchImage(db, `"2"`, `{"description":"after"}`); code != util.StatusPreconditionFailed {
+		t.Fatalf("got status %d, want %d", code, util.StatusPreconditionFailed)
+	}
+	if image := readImage(t, db, "image1"); image.Description != "before" || image.ResourceVersion != 3 {
+		t.Fatalf("stale patch changed the image: %+v", image)
+	}
+}
+
+func TestPatchWithMatchingETagBumpsVersion(t *testing.T) {
+	db := newPatchTestDb()
+	code, etag := patchImage(db, `"3"`, `{"description":"after","tags":["a","b"]}`)
+	if code != util.StatusOK || etag != `"4"` {
+		t.Fatalf("got status %d and ETag %s", code, etag)
+	}
+	image := readImage(t, db, "image1")
+	if image.Description != "after" || image.ResourceVersion != 4 || image.UpdateTime.IsZero() {
+		t.Fatalf("patch wasn't applied: %+v", image)
+	}
+	c := &BaseController{Db: db}
+	if tags, _ := c.queryImageTags("image1"); strings.Join(tags, ",") != "a,b" {
+		t.Fatalf("got tags %v, want [a b]", tags)
+	}
+
+	// the ETag returned before the first patch is stale now
+	if code, _ = patchImage(db, `"3"`, `{"description":"again"}`); code != util.StatusPreconditionFailed {
+		t.Fatalf("got status %d for a reused ETag, want %d", code, util.StatusPreconditionFailed)
+	}
+}
+
+func TestPatchWithoutIfMatch(t *testing.T) {
+	db := newPatchTestDb()
+	if code, etag := patchImage(db, "", `{"description":"after"}`); code != util.StatusOK || etag != `"4"` {
+		t.Fatalf("got status %d and ETag %s", code, etag)
+	}
+}
+
+func TestPatchRejectsUnknownField(t *testing.T) {
+	db := newPatchTestDb()
+	if code, _ := patchImage(db, "", `{"fileName":"other.zip"}`); code != util.BadRequest {
+		t.Fatalf("got status %d, want %d", code, util.BadRequest)
+	}
+}
+
+func TestUpdateImageMetadataDetectsConcurrentChange(t *testing.T) {
+	db := newPatchTestDb()
+	c := &BaseController{Db: db}
+	first, second := readImage(t, db, "image1"), readImage(t, db, "image1")
+	description := "first"
+	if _, err := c.updateImageMetadata(first, &ImageMetadataPatch{Description: &description}); err != nil {
+		t.Fatal(err)
+	}
+
+	description = "second"
+	_, err := c.updateImageMetadata(second, &ImageMetadataPatch{Description: &description})
+	if err != errConcurrentModification {
+		t.Fatalf("got %v, want errConcurrentModification", err)
+	}
+	if image := readImage(t, db, "image1"); image.Description != "first" || image.ResourceVersion != 4 {
+		t.Fatalf("lost update: %+v", image)
+	}
+}
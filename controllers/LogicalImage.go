@@ -0,0 +1,735 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// @Title  controllers
+// @Description  logical image versioning api for filesystem
+// @Author  GuoZhen Gao (2021/6/30 10:40)
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fileSystem/models"
+	"fileSystem/util"
+	"io"
+	"strconv"
+	"time"
+)
+
+var errRevisionExists = errors.New("image is already a revision of a logical image")
+
+// LogicalImageController   Define the controller to manage logical images, their revisions and aliases
+type LogicalImageController struct {
+	BaseController
+}
+
+// RevisionRequest   Define the body to publish an uploaded image as the next revision
+type RevisionRequest struct {
+	ImageId string `json:"imageId"`
+}
+
+// AliasRequest   Define the body to point an alias at a revision
+type AliasRequest struct {
+	Revision int64 `json:"revision"`
+}
+
+// LogicalImageDetail   Define the logical image returned by query apis
+type LogicalImageDetail struct {
+	Name           string                  `json:"name"`
+	UserId         string                  `json:"userId"`
+	TenantId       string                  `json:"tenantId"`
+	LatestRevision int64                   `json:"latestRevision"`
+	CreateTime     string                  `json:"createTime"`
+	Aliases        map[string]int64        `json:"aliases"`
+	Revisions      []*models.ImageRevision `json:"revisions"`
+}
+
+// Report whether the caller may publish revisions and move aliases of a logical image
+func (c *BaseController) canManageLogicalImage(logical *models.LogicalImage) bool {
+	userId := c.GetString(util.UserId)
+	return c.isAdmin() || (userId != "" && userId == logical.UserId)
+}
+
+// Query a logical image, nil is returned when it doesn't exist
+func (c *BaseController) findLogicalImage(name string) (*models.LogicalImage, error) {
+	var logicals []*models.LogicalImage
+	num, err := c.Db.QueryTable("logical_image", &logicals, "name__exact", name)
+	if err != nil || num == 0 {
+		return nil, err
+	}
+	return logicals[0], nil
+}
+
+// Query the logical image named in the path, the error response is written when it can't be returned
+func (c *LogicalImageController) queryLogicalImage(clientIp string) (*models.LogicalImage, bool) {
+	name := c.Ctx.Input.Param(":name")
+	logical, err := c.findLogicalImage(name)
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to query database",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return nil, false
+	}
+	if logical == nil {
+		c.HandleApiError(clientIp, util.StatusNotFound, "logical image doesn't exist",
+			util.ErrLogicalImageNotFound.WithDetails("name "+name))
+		return nil, false
+	}
+	return logical, true
+}
+
+// Query the logical image named in the path and check the caller manages it
+func (c *LogicalImageController) queryManagedLogicalImage(clientIp string) (*models.LogicalImage, bool) {
+	logical, ok := c.queryLogicalImage(clientIp)
+	if !ok {
+		return nil, false
+	}
+	if !c.canManageLogicalImage(logical) {
+		c.HandleApiError(clientIp, util.StatusForbidden, "no permission to manage this logical image",
+			util.ErrForbidden.WithDetails("name "+logical.Name))
+		return nil, false
+	}
+	return logical, true
+}
+
+// Point an alias of a logical image at a revision, creating the alias when needed
+func (c *BaseController) setImageAlias(name, alias string, revision int64) error {
+	num, err := c.Db.UpdateWithFilters("image_alias", map[string]interface{}{
+		"name__exact":  name,
+		"alias__exact": alias,
+	}, map[string]interface{}{"revision": revision, "update_time": time.Now()})
+	if err != nil || num > 0 {
+		return err
+	}
+	err = c.Db.InsertData(&models.ImageAlias{Name: name, Alias: alias, Revision: revision})
+	if err != nil && err.Error() != util.LastInsertIdNotSupported {
+		return err
+	}
+	return nil
+}
+
+// Publish an image as the next revision of a logical image and move latest to it,
+// the logical image is created and owned by the image owner when it doesn't exist
+func (c *BaseController) addImageRevision(name string, image *models.ImageDB) (*models.ImageRevision, error) {
+	var existing []*models.ImageRevision
+	num, err := c.Db.QueryTable("image_revision", &existing, "image_id__exact", image.ImageId)
+	if err != nil {
+		return nil, err
+	}
+	if num > 0 {
+		return nil, errRevisionExists
+	}
+	logical, err := c.findLogicalImage(name)
+	if err != nil {
+		return nil, err
+	}
+	if logical == nil {
+		logical = &models.LogicalImage{Name: name, UserId: image.UserId, TenantId: image.TenantId}
+		err = c.Db.InsertData(logical)
+		if err != nil && err.Error() != util.LastInsertIdNotSupported {
+			created, queryErr := c.findLogicalImage(name)
+			if queryErr == nil && created != nil {
+				// another request created the logical image first
+				return nil, errConcurrentModification
+			}
+			return nil, err
+		}
+	}
+
+	// the revision is inserted before latest_revision is moved, so latest_revision never names a missing
+	// revision. Revision numbers are unique within a logical image, a concurrent publish fails the insert.
+	revision := &models.ImageRevision{Name: name, Revision: logical.LatestRevision + 1, ImageId: image.ImageId}
+	err = c.Db.InsertData(revision)
+	if err != nil && err.Error() != util.LastInsertIdNotSupported {
+		claimed, countErr := c.Db.QueryCountWithFilters("image_revision", map[string]interface{}{
+			"name__exact":     name,
+			"revision__exact": revision.Revision,
+		})
+		if countErr == nil && claimed > 0 {
+			return nil, errConcurrentModification
+		}
+		return nil, err
+	}
+	num, err = c.Db.UpdateWithFilters("logical_image", map[string]interface{}{
+		"name__exact":            name,
+		"latest_revision__exact": logical.LatestRevision,
+	}, map[string]interface{}{"latest_revision": revision.Revision})
+	if err == nil && num == 0 {
+		err = errConcurrentModification
+	}
+	if err != nil {
+		c.removeImageRevision(image.ImageId)
+		return nil, err
+	}
+	err = c.setImageAlias(name, util.AliasLatest, revision.Revision)
+	if err != nil {
+		// latest_revision is moved back first, so it never names the removed revision
+		_, restoreErr := c.Db.UpdateWithFilters("logical_image", map[string]interface{}{
+			"name__exact":            name,
+			"latest_revision__exact": revision.Revision,
+		}, map[string]interface{}{"latest_revision": logical.LatestRevision})
+		if restoreErr != nil {
+			c.logger().Error("fail to restore latest revision of logical image " + name + ": " + restoreErr.Error())
+			return nil, err
+		}
+		c.removeImageRevision(image.ImageId)
+		return nil, err
+	}
+	return revision, nil
+}
+
+// Remove the revision of an image whose publish failed
+func (c *BaseController) removeImageRevision(imageId string) {
+	_, err := c.Db.DeleteWithFilters("image_revision", map[string]interface{}{"image_id__exact": imageId})
+	if err != nil {
+		c.logger().Error("fail to remove unpublished revision of image " + imageId + ": " + err.Error())
+	}
+}
+
+// Resolve a revision number or alias of a logical image, nil is returned when nothing matches
+func (c *BaseController) resolveImageVersion(name, version string) (*models.ImageRevision, error) {
+	revision, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		var aliases []*models.ImageAlias
+		num, err := c.Db.QueryTableWithFilters("image_alias", &aliases, map[string]interface{}{
+			"name__exact":  name,
+			"alias__exact": version,
+		}, nil, 0, 0)
+		if err != nil || num == 0 {
+			return nil, err
+		}
+		revision = aliases[0].Revision
+	}
+	var revisions []*models.ImageRevision
+	num, err := c.Db.QueryTableWithFilters("image_revision", &revisions, map[string]interface{}{
+		"name__exact":     name,
+		"revision__exact": revision,
+	}, nil, 0, 0)
+	if err != nil || num == 0 {
+		return nil, err
+	}
+	return revisions[0], nil
+}
+
+// Query the image of the version named in the path, the error response is written when it can't be returned
+func (c *LogicalImageController) queryVersionImage(clientIp string) (*models.ImageRevision, *models.ImageDB, bool) {
+	name := c.Ctx.Input.Param(":name")
+	version := c.Ctx.Input.Param(":version")
+	revision, err := c.resolveImageVersion(name, version)
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to query database",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return nil, nil, false
+	}
+	if revision == nil {
+		c.HandleApiError(clientIp, util.StatusNotFound, "revision doesn't exist",
+			util.ErrRevisionNotFound.WithDetails(name+":"+version))
+		return nil, nil, false
+	}
+	c.Ctx.Input.SetData(util.ImageIdKey, revision.ImageId)
+	image, ok := c.queryImage(clientIp, revision.ImageId, "fail to query this imageId in database")
+	if !ok {
+		return nil, nil, false
+	}
+	return revision, image, true
+}
+
+// Query the names of the logical images having a revision whose image the caller may read
+func (c *BaseController) readableLogicalImageNames() ([]string, error) {
+	var revisions []*models.ImageRevision
+	_, err := c.Db.QueryTableWithFilters("image_revision", &revisions, map[string]interface{}{}, nil, 0, 0)
+	if err != nil || len(revisions) == 0 {
+		return nil, err
+	}
+	imageIds := make([]string, 0, len(revisions))
+	for _, revision := range revisions {
+		imageIds = append(imageIds, revision.ImageId)
+	}
+	readable, err := c.readableConditions()
+	if err != nil {
+		return nil, err
+	}
+	var images []*models.ImageDB
+	_, err = c.Db.QueryTableWithConditions("image_d_b", &images, map[string]interface{}{"image_id__in": imageIds},
+		readable, nil, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	readableIds := map[string]bool{}
+	for _, image := range images {
+		readableIds[image.ImageId] = true
+	}
+	seen := map[string]bool{}
+	names := make([]string, 0, len(revisions))
+	for _, revision := range revisions {
+		if readableIds[revision.ImageId] && !seen[revision.Name] {
+			seen[revision.Name] = true
+			names = append(names, revision.Name)
+		}
+	}
+	return names, nil
+}
+
+// Query the revisions whose images the caller may read, keyed by logical image name
+func (c *BaseController) readableRevisions(names []string) (map[string][]*models.ImageRevision, error) {
+	readable := map[string][]*models.ImageRevision{}
+	if len(names) == 0 {
+		return readable, nil
+	}
+	var revisions []*models.ImageRevision
+	_, err := c.Db.QueryTableWithFilters("image_revision", &revisions,
+		map[string]interface{}{"name__in": names}, []string{"name", "revision"}, 0, 0)
+	if err != nil || len(revisions) == 0 {
+		return readable, err
+	}
+	imageIds := make([]string, 0, len(revisions))
+	for _, revision := range revisions {
+		imageIds = append(imageIds, revision.ImageId)
+	}
+	var images []*models.ImageDB
+	_, err = c.Db.QueryTableWithFilters("image_d_b", &images,
+		map[string]interface{}{"image_id__in": imageIds}, nil, 0, 0)
+	if err == nil {
+		images, err = c.filterReadableImages(images)
+	}
+	if err != nil {
+		return nil, err
+	}
+	readableIds := map[string]bool{}
+	for _, image := range images {
+		readableIds[image.ImageId] = true
+	}
+	for _, revision := range revisions {
+		if readableIds[revision.ImageId] {
+			readable[revision.Name] = append(readable[revision.Name], revision)
+		}
+	}
+	return readable, nil
+}
+
+// Decode a json request body into value, the error response is written when it is invalid
+func (c *LogicalImageController) decodeBody(clientIp string, value interface{}) bool {
+	decoder := json.NewDecoder(io.LimitReader(c.Ctx.Request.Body, util.MaxMetadataBodySize))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(value)
+	if err != nil {
+		c.HandleApiError(clientIp, util.BadRequest, "request body is invalid",
+			util.ErrInvalidParameter.WithDetails(err.Error()))
+		return false
+	}
+	return true
+}
+
+// Write a response as json
+func (c *LogicalImageController) writeJson(clientIp string, value interface{}) {
+	resp, err := json.Marshal(value)
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to return logical image details",
+			util.ErrInternal)
+		return
+	}
+	_, _ = c.Ctx.ResponseWriter.Write(resp)
+}
+
+// Validate the client ip of the request, the error response is written when it is invalid
+func (c *LogicalImageController) validateClient() (string, bool) {
+	clientIp := c.Ctx.Input.IP()
+	err := util.ValidateSrcAddress(clientIp)
+	if err != nil {
+		c.HandleApiError(clientIp, util.BadRequest, util.ClientIpaddressInvalid, util.ErrInvalidClientIp)
+		return clientIp, false
+	}
+	c.displayReceivedMsg(clientIp)
+	return clientIp, true
+}
+
+// @Title List
+// @Description list logical images which have revisions readable by the caller
+// @Param   limit         query  int     false  "limit"
+// @Param   offset        query  int     false  "offset"
+// @Success 200 ok
+// @router /image-management/v1/logical-images [GET]
+func (c *LogicalImageController) List() {
+	c.logger().Info("Logical image list request received.")
+	clientIp, ok := c.validateClient()
+	if !ok {
+		return
+	}
+	limit, offset, ok := c.listPage(clientIp)
+	if !ok {
+		return
+	}
+
+	// logical images the caller manages or has a readable revision of are listed, admins manage all of them
+	var anyOf []map[string]interface{}
+	if !c.isAdmin() {
+		names, err := c.readableLogicalImageNames()
+		if err != nil {
+			c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to query database",
+				util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+			return
+		}
+		anyOf = []map[string]interface{}{}
+		if userId := c.GetString(util.UserId); userId != "" {
+			anyOf = append(anyOf, map[string]interface{}{"user_id__exact": userId})
+		}
+		if len(names) > 0 {
+			anyOf = append(anyOf, map[string]interface{}{"name__in": names})
+		}
+		if len(anyOf) == 0 {
+			c.writeJson(clientIp, map[string]interface{}{
+				"total":         0,
+				"logicalImages": []*models.LogicalImage{},
+			})
+			return
+		}
+	}
+	logicals := []*models.LogicalImage{}
+	filters := map[string]interface{}{}
+	total, err := c.Db.QueryCountWithConditions("logical_image", filters, anyOf)
+	if err == nil {
+		_, err = c.Db.QueryTableWithConditions("logical_image", &logicals, filters, anyOf, []string{"name"},
+			limit, offset)
+	}
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to query database",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return
+	}
+	c.writeJson(clientIp, map[string]interface{}{
+		"total":         total,
+		"logicalImages": logicals,
+	})
+}
+
+// @Title Get
+// @Description query a logical image with its aliases and the revisions readable by the caller
+// @Param	name 	string
+// @Success 200 ok
+// @Failure 404 not found
+// @router /image-management/v1/logical-images/:name [GET]
+func (c *LogicalImageController) Get() {
+	c.logger().Info("Query logical image request received.")
+	clientIp, ok := c.validateClient()
+	if !ok {
+		return
+	}
+	logical, ok := c.queryLogicalImage(clientIp)
+	if !ok {
+		return
+	}
+	readable, err := c.readableRevisions([]string{logical.Name})
+	var aliases []*models.ImageAlias
+	if err == nil {
+		_, err = c.Db.QueryTableWithFilters("image_alias", &aliases,
+			map[string]interface{}{"name__exact": logical.Name}, []string{"alias"}, 0, 0)
+	}
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to query database",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return
+	}
+	revisions := readable[logical.Name]
+	if len(revisions) == 0 && !c.canManageLogicalImage(logical) {
+		c.HandleApiError(clientIp, util.StatusNotFound, "logical image doesn't exist",
+			util.ErrLogicalImageNotFound.WithDetails("name "+logical.Name))
+		return
+	}
+	if revisions == nil {
+		revisions = []*models.ImageRevision{}
+	}
+	detail := &LogicalImageDetail{
+		Name:           logical.Name,
+		UserId:         logical.UserId,
+		TenantId:       logical.TenantId,
+		LatestRevision: logical.LatestRevision,
+		CreateTime:     logical.CreateTime.Format("2006-01-02 15:04:05"),
+		Aliases:        map[string]int64{},
+		Revisions:      revisions,
+	}
+	for _, alias := range aliases {
+		detail.Aliases[alias.Alias] = alias.Revision
+	}
+	c.writeJson(clientIp, detail)
+}
+
+// @Title Delete
+// @Description delete a logical image with its revisions and aliases, the images themselves are kept
+// @Param	name 	string
+// @Success 200 ok
+// @Failure 403 forbidden
+// @Failure 404 not found
+// @router /image-management/v1/logical-images/:name [DELETE]
+func (c *LogicalImageController) Delete() {
+	c.logger().Info("Delete logical image request received.")
+	c.auditAs(util.AuditActionRevision)
+	clientIp, ok := c.validateClient()
+	if !ok {
+		return
+	}
+	logical, ok := c.queryManagedLogicalImage(clientIp)
+	if !ok {
+		return
+	}
+	for _, table := range []string{"image_alias", "image_revision", "logical_image"} {
+		_, err := c.Db.DeleteWithFilters(table, map[string]interface{}{"name__exact": logical.Name})
+		if err != nil {
+			c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to delete logical image",
+				util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+			return
+		}
+	}
+	c.recordAudit(util.AuditActionRevision, "", util.AuditOutcomeSuccess, "name="+logical.Name+" deleted=true")
+	c.Ctx.WriteString("delete success")
+}
+
+// @Title AddRevision
+// @Description publish an uploaded image as the next revision of a logical image and move latest to it,
+// the logical image is created when it doesn't exist
+// @Param	name 	string
+// @Param	body 	body	RevisionRequest	true	"image to publish"
+// @Success 200 ok
+// @Failure 400 bad request
+// @Failure 403 forbidden
+// @Failure 409 conflict
+// @router /image-management/v1/logical-images/:name/revisions [POST]
+func (c *LogicalImageController) AddRevision() {
+	c.logger().Info("Add logical image revision request received.")
+	c.auditAs(util.AuditActionRevision)
+	clientIp, ok := c.validateClient()
+	if !ok {
+		return
+	}
+	name := c.Ctx.Input.Param(":name")
+	err := util.ValidateImageName(name)
+	if err != nil {
+		c.HandleApiError(clientIp, util.BadRequest, err.Error(), util.ErrInvalidParameter.WithDetails(err.Error()))
+		return
+	}
+	var request RevisionRequest
+	if !c.decodeBody(clientIp, &request) {
+		return
+	}
+	c.Ctx.Input.SetData(util.ImageIdKey, request.ImageId)
+	image, ok := c.queryImage(clientIp, request.ImageId, "fail to query this imageId in database")
+	if !ok {
+		return
+	}
+	if !c.checkImageAccess(clientIp, image, accessOwner) {
+		return
+	}
+	if !imageAvailable(image) {
+		c.HandleApiError(clientIp, util.StatusConflict, "image is not available",
+			util.ErrImageNotAvailable.WithDetails("image status is "+image.Status))
+		return
+	}
+	logical, err := c.findLogicalImage(name)
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to query database",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return
+	}
+	if logical != nil && !c.canManageLogicalImage(logical) {
+		c.HandleApiError(clientIp, util.StatusForbidden, "no permission to manage this logical image",
+			util.ErrForbidden.WithDetails("name "+name))
+		return
+	}
+
+	revision, err := c.addImageRevision(name, image)
+	if err == errRevisionExists || err == errConcurrentModification {
+		c.HandleApiError(clientIp, util.StatusConflict, err.Error(), util.ErrImageInUse.WithDetails(err.Error()))
+		return
+	}
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to add revision",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return
+	}
+	c.recordAudit(util.AuditActionRevision, image.ImageId, util.AuditOutcomeSuccess,
+		"name="+name+" revision="+strconv.FormatInt(revision.Revision, 10))
+	c.writeJson(clientIp, revision)
+}
+
+// @Title PutAlias
+// @Description point an alias of a logical image at a revision, latest is moved by new revisions only
+// @Param	name 	string
+// @Param	alias 	string
+// @Param	body 	body	AliasRequest	true	"revision"
+// @Success 200 ok
+// @Failure 400 bad request
+// @Failure 403 forbidden
+// @Failure 404 not found
+// @router /image-management/v1/logical-images/:name/aliases/:alias [PUT]
+func (c *LogicalImageController) PutAlias() {
+	c.logger().Info("Set logical image alias request received.")
+	c.auditAs(util.AuditActionAlias)
+	clientIp, ok := c.validateClient()
+	if !ok {
+		return
+	}
+	alias := c.Ctx.Input.Param(":alias")
+	err := util.ValidateAlias(alias)
+	if err == nil && alias == util.AliasLatest {
+		err = errors.New("alias latest always points to the newest revision")
+	}
+	if err != nil {
+		c.HandleApiError(clientIp, util.BadRequest, err.Error(), util.ErrInvalidParameter.WithDetails(err.Error()))
+		return
+	}
+	logical, ok := c.queryManagedLogicalImage(clientIp)
+	if !ok {
+		return
+	}
+	var request AliasRequest
+	if !c.decodeBody(clientIp, &request) {
+		return
+	}
+	revision, err := c.resolveImageVersion(logical.Name, strconv.FormatInt(request.Revision, 10))
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to query database",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return
+	}
+	if revision == nil {
+		c.HandleApiError(clientIp, util.StatusNotFound, "revision doesn't exist",
+			util.ErrRevisionNotFound.WithDetails(logical.Name+":"+strconv.FormatInt(request.Revision, 10)))
+		return
+	}
+	image, ok := c.queryImage(clientIp, revision.ImageId, "fail to query this imageId in database")
+	if !ok {
+		return
+	}
+	if !imageAvailable(image) {
+		c.HandleApiError(clientIp, util.StatusConflict, "image is not available",
+			util.ErrImageNotAvailable.WithDetails("image status is "+image.Status))
+		return
+	}
+	err = c.setImageAlias(logical.Name, alias, revision.Revision)
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to save alias",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return
+	}
+	c.recordAudit(util.AuditActionAlias, revision.ImageId, util.AuditOutcomeSuccess,
+		"name="+logical.Name+" alias="+alias+" revision="+strconv.FormatInt(revision.Revision, 10))
+	c.writeJson(clientIp, map[string]interface{}{
+		"name":     logical.Name,
+		"alias":    alias,
+		"revision": revision.Revision,
+	})
+}
+
+// @Title DeleteAlias
+// @Description remove an alias of a logical image, latest can't be removed
+// @Param	name 	string
+// @Param	alias 	string
+// @Success 200 ok
+// @Failure 403 forbidden
+// @Failure 404 not found
+// @router /image-management/v1/logical-images/:name/aliases/:alias [DELETE]
+func (c *LogicalImageController) DeleteAlias() {
+	c.logger().Info("Delete logical image alias request received.")
+	c.auditAs(util.AuditActionAlias)
+	clientIp, ok := c.validateClient()
+	if !ok {
+		return
+	}
+	alias := c.Ctx.Input.Param(":alias")
+	if alias == util.AliasLatest {
+		c.HandleApiError(clientIp, util.BadRequest, "alias latest can't be removed",
+			util.ErrInvalidParameter.WithDetails("alias latest can't be removed"))
+		return
+	}
+	logical, ok := c.queryManagedLogicalImage(clientIp)
+	if !ok {
+		return
+	}
+	num, err := c.Db.DeleteWithFilters("image_alias", map[string]interface{}{
+		"name__exact":  logical.Name,
+		"alias__exact": alias,
+	})
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to delete alias",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return
+	}
+	if num == 0 {
+		c.HandleApiError(clientIp, util.StatusNotFound, "alias doesn't exist",
+			util.ErrRevisionNotFound.WithDetails(logical.Name+":"+alias))
+		return
+	}
+	c.recordAudit(util.AuditActionAlias, "", util.AuditOutcomeSuccess, "name="+logical.Name+" alias="+alias+" deleted=true")
+	c.Ctx.WriteString("delete success")
+}
+
+// @Title GetVersion
+// @Description query the image of a logical image revision or alias
+// @Param	name 	string
+// @Param	version 	string	"revision number or alias"
+// @Success 200 ok
+// @Failure 403 forbidden
+// @Failure 404 not found
+// @router /image-management/v1/logical-images/:name/versions/:version [GET]
+func (c *LogicalImageController) GetVersion() {
+	c.logger().Info("Query logical image version request received.")
+	clientIp, ok := c.validateClient()
+	if !ok {
+		return
+	}
+	revision, image, ok := c.queryVersionImage(clientIp)
+	if !ok {
+		return
+	}
+	if !c.checkImageAccess(clientIp, image, accessRead) {
+		return
+	}
+	tags, err := c.queryImageTags(image.ImageId)
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to query this imageId in database",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return
+	}
+	c.Ctx.Output.Header("ETag", imageETag(image))
+	c.writeJson(clientIp, map[string]interface{}{
+		"name":     revision.Name,
+		"revision": revision.Revision,
+		"image":    newImageDetail(image, tags),
+	})
+}
+
+// @Title DownloadVersion
+// @Description download the image of a logical image revision or alias
+// @Param	name 	string
+// @Param	version 	string	"revision number or alias"
+// @Param	isZip 	query	string	false	"true to download the stored zip"
+// @Param	format 	query	string	false	"zip, tar, tar.gz, tar.zst or gzip"
+// @Param	entry 	query	string	false	"path of the package file to download"
+// @Success 200 ok
+// @Failure 403 forbidden
+// @Failure 404 not found
+// @router /image-management/v1/logical-images/:name/versions/:version/action/download [GET]
+func (c *LogicalImageController) DownloadVersion() {
+	c.logger().Info("Download logical image version request received.")
+	c.auditAs(util.AuditActionDownload)
+	clientIp, ok := c.validateClient()
+	if !ok {
+		return
+	}
+	_, image, ok := c.queryVersionImage(clientIp)
+	if !ok {
+		return
+	}
+	c.serveImage(clientIp, image)
+}
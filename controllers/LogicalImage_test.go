@@ -0,0 +1,308 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fileSystem/models"
+	"fileSystem/util"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func newLogicalTestDb() *fakeDb {
+	db := newFakeDb()
+	db.insert(&models.ImageDB{ImageId: "image1", UserId: "owner", Visibility: util.VisibilityPublic})
+	db.insert(&models.ImageDB{ImageId: "image2", UserId: "owner", Visibility: util.VisibilityPublic})
+	db.insert(&models.ImageDB{ImageId: "private1", UserId: "owner", Visibility: util.VisibilityPrivate})
+	db.insert(&models.ImageDB{ImageId: "other1", UserId: "other", Visibility: util.VisibilityPublic})
+	return db
+}
+
+// Serve a logical image api request, action runs the controller method under test
+func serveLogical(db *fakeDb, method, url, body string, params map[string]string,
+	action func(c *LogicalImageController)) (int, string) {
+	c := &LogicalImageController{BaseController{Db: db}}
+	_, rw := newTestRequest(c, method, url, strings.NewReader(body), params)
+	action(c)
+	return rw.Code, rw.Body.String()
+}
+
+// Publish an image as the next revision of a logical image as the given user
+func publishRevision(db *fakeDb, name, imageId, userId string) (int, string) {
+	return serveLogical(db, http.MethodPost, "/image-management/v1/logical-images/"+name+"/revisions?userId="+userId,
+		`{"imageId":"`+imageId+`"}`, map[string]string{":name": name}, (*LogicalImageController).AddRevision)
+}
+
+// Resolve a version of a logical image, returns the status and the image id
+func getVersion(t *testing.T, db *fakeDb, name, version string) (int, string) {
+	code, body := serveLogical(db, http.MethodGet,
+		"/image-management/v1/logical-images/"+name+"/versions/"+version, "",
+		map[string]string{":name": name, ":version": version}, (*LogicalImageController).GetVersion)
+	if code != util.StatusOK {
+		return code, ""
+	}
+	var result struct {
+		Image struct {
+			ImageId string `json:"imageId"`
+		} `json:"image"`
+	}
+	if err := json.Unmarshal([]byte(body), &result); err != nil {
+		t.Fatal(err)
+	}
+	return code, result.Image.ImageId
+}
+
+// Point an alias at a revision as the owner
+func putAlias(db *fakeDb, name, alias, body string) (int, string) {
+	return serveLogical(db, http.MethodPut,
+		"/image-management/v1/logical-images/"+name+"/aliases/"+alias+"?userId=owner", body,
+		map[string]string{":name": name, ":alias": alias}, (*LogicalImageController).PutAlias)
+}
+
+func TestAddRevisionMovesLatest(t *testing.T) {
+	db := newLogicalTestDb()
+	for i, imageId := range []string{"image1", "image2"} {
+		code, body := publishRevision(db, "ubuntu", imageId, "owner")
+		if code != util.StatusOK {
+			t.Fatalf("got status %d: %s", code, body)
+		}
+		var revision models.ImageRevision
+		if err := json.Unmarshal([]byte(body), &revision); err != nil {
+			t.Fatal(err)
+		}
+		if revision.Revision != int64(i+1) {
+			t.Fatalf("got revision %d for %s, want %d", revision.Revision, imageId, i+1)
+		}
+		if _, got := getVersion(t, db, "ubuntu", util.AliasLatest); got != imageId {
+			t.Fatalf("latest resolves to %q, want %q", got, imageId)
+		}
+	}
+	if _, got := getVersion(t, db, "ubuntu", "1"); got != "image1" {
+		t.Fatalf("revision 1 resolves to %q, want image1", got)
+	}
+	if code, _ := getVersion(t, db, "ubuntu", "3"); code != util.StatusNotFound {
+		t.Fatalf("got status %d for a missing revision, want %d", code, util.StatusNotFound)
+	}
+}
+
+func TestAddRevisionRejectsRepublish(t *testing.T) {
+	db := newLogicalTestDb()
+	if code, body := publishRevision(db, "ubuntu", "image1", "owner"); code != util.StatusOK {
+		t.Fatalf("got status %d: %s", code, body)
+	}
+	if code, _ := publishRevision(db, "centos", "image1", "owner"); code != util.StatusConflict {
+		t.Fatalf("got status %d republishing an image, want %d", code, util.StatusConflict)
+	}
+}
+
+func TestAddRevisionRollsBackFailedAlias(t *testing.T) {
+	db := newLogicalTestDb()
+	if code, body := publishRevision(db, "ubuntu", "image1", "owner"); code != util.StatusOK {
+		t.Fatalf("got status %d: %s", code, body)
+	}
+	db.insertErrs = map[string]error{"image_alias": errors.New("disk full")}
+	// latest is updated in place, so the alias of a new logical image fails to be created
+	if code, _ := publishRevision(db, "centos", "image2", "owner"); code != util.StatusInternalServerError {
+		t.Fatalf("got status %d when latest couldn't be set, want %d", code, util.StatusInternalServerError)
+	}
+	var revisions []*models.ImageRevision
+	if num, _ := db.QueryTable("image_revision", &revisions, "name__exact", "centos"); num != 0 {
+		t.Fatalf("%d revisions left after the publish failed", num)
+	}
+	var logical []*models.LogicalImage
+	if db.QueryTable("logical_image", &logical, "name__exact", "centos"); logical[0].LatestRevision != 0 {
+		t.Fatalf("latest revision left at %d, want 0", logical[0].LatestRevision)
+	}
+	db.insertErrs = nil
+	if code, body := publishRevision(db, "centos", "image2", "owner"); code != util.StatusOK {
+		t.Fatalf("got status %d publishing again: %s", code, body)
+	}
+}
+
+func TestAddRevisionReportsLogicalImageInsertError(t *testing.T) {
+	db := newLogicalTestDb()
+	db.insertErrs = map[string]error{"logical_image": errors.New("disk full")}
+	// no logical image was created, so the failure isn't reported as a concurrent publish
+	if code, body := publishRevision(db, "ubuntu", "image1", "owner"); code != util.StatusInternalServerError {
+		t.Fatalf("got status %d: %s, want %d", code, body, util.StatusInternalServerError)
+	}
+}
+
+func TestAddRevisionRequiresOwner(t *testing.T) {
+	db := newLogicalTestDb()
+	if code, body := publishRevision(db, "ubuntu", "image1", "owner"); code != util.StatusOK {
+		t.Fatalf("got status %d: %s", code, body)
+	}
+	if code, _ := publishRevision(db, "ubuntu", "image2", "other"); code != util.StatusForbidden {
+		t.Fatalf("got status %d publishing another user's image, want %d", code, util.StatusForbidden)
+	}
+	if code, _ := publishRevision(db, "ubuntu", "other1", "other"); code != util.StatusForbidden {
+		t.Fatalf("got status %d publishing to another user's logical image, want %d", code, util.StatusForbidden)
+	}
+}
+
+func TestAliases(t *testing.T) {
+	db := newLogicalTestDb()
+	publishRevision(db, "ubuntu", "image1", "owner")
+	publishRevision(db, "ubuntu", "image2", "owner")
+
+	if code, body := putAlias(db, "ubuntu", "stable", `{"revision":1}`); code != util.StatusOK {
+		t.Fatalf("got status %d: %s", code, body)
+	}
+	if _, got := getVersion(t, db, "ubuntu", "stable"); got != "image1" {
+		t.Fatalf("stable resolves to %q, want image1", got)
+	}
+	if code, body := putAlias(db, "ubuntu", "stable", `{"revision":2}`); code != util.StatusOK {
+		t.Fatalf("got status %d: %s", code, body)
+	}
+	if _, got := getVersion(t, db, "ubuntu", "stable"); got != "image2" {
+		t.Fatalf("moved stable resolves to %q, want image2", got)
+	}
+	if code, _ := putAlias(db, "ubuntu", util.AliasLatest, `{"revision":1}`); code != util.BadRequest {
+		t.Fatalf("got status %d moving latest, want %d", code, util.BadRequest)
+	}
+	if code, _ := putAlias(db, "ubuntu", "beta", `{"revision":5}`); code != util.StatusNotFound {
+		t.Fatalf("got status %d for a missing revision, want %d", code, util.StatusNotFound)
+	}
+
+	deleteAlias := func(alias string) int {
+		code, _ := serveLogical(db, http.MethodDelete,
+			"/image-management/v1/logical-images/ubuntu/aliases/"+alias+"?userId=owner", "",
+			map[string]string{":name": "ubuntu", ":alias": alias}, (*LogicalImageController).DeleteAlias)
+		return code
+	}
+	if code := deleteAlias(util.AliasLatest); code != util.BadRequest {
+		t.Fatalf("got status %d removing latest, want %d", code, util.BadRequest)
+	}
+	if code := deleteAlias("stable"); code != util.StatusOK {
+		t.Fatalf("got status %d removing stable", code)
+	}
+	if code, _ := getVersion(t, db, "ubuntu", "stable"); code != util.StatusNotFound {
+		t.Fatalf("got status %d for a removed alias, want %d", code, util.StatusNotFound)
+	}
+	if code := deleteAlias("stable"); code != util.StatusNotFound {
+		t.Fatalf("got status %d removing a missing alias, want %d", code, util.StatusNotFound)
+	}
+}
+
+func TestLogicalImageVisibility(t *testing.T) {
+	db := newLogicalTestDb()
+	publishRevision(db, "ubuntu", "image1", "owner")
+	publishRevision(db, "secret", "private1", "owner")
+
+	list := func(userId string) []string {
+		code, body := serveLogical(db, http.MethodGet, "/image-management/v1/logical-images?userId="+userId, "",
+			nil, (*LogicalImageController).List)
+		if code != util.StatusOK {
+			t.Fatalf("got status %d: %s", code, body)
+		}
+		var result struct {
+			LogicalImages []*models.LogicalImage `json:"logicalImages"`
+		}
+		if err := json.Unmarshal([]byte(body), &result); err != nil {
+			t.Fatal(err)
+		}
+		names := make([]string, 0, len(result.LogicalImages))
+		for _, logical := range result.LogicalImages {
+			names = append(names, logical.Name)
+		}
+		return names
+	}
+	if got := list("owner"); !sameIds(got, "secret", "ubuntu") {
+		t.Fatalf("owner lists %v", got)
+	}
+	if got := list("other"); !sameIds(got, "ubuntu") {
+		t.Fatalf("other user lists %v", got)
+	}
+
+	get := func(name, userId string) int {
+		code, _ := serveLogical(db, http.MethodGet, "/image-management/v1/logical-images/"+name+"?userId="+userId, "",
+			map[string]string{":name": name}, (*LogicalImageController).Get)
+		return code
+	}
+	if code := get("secret", "owner"); code != util.StatusOK {
+		t.Fatalf("got status %d for the owner", code)
+	}
+	if code := get("secret", "other"); code != util.StatusNotFound {
+		t.Fatalf("got status %d for an unreadable logical image, want %d", code, util.StatusNotFound)
+	}
+}
+
+func TestListLogicalImagesPaginates(t *testing.T) {
+	db := newLogicalTestDb()
+	publishRevision(db, "ubuntu", "image1", "owner")
+	publishRevision(db, "centos", "image2", "owner")
+	publishRevision(db, "secret", "private1", "owner")
+	publishRevision(db, "other", "other1", "other")
+
+	code, body := serveLogical(db, http.MethodGet, "/image-management/v1/logical-images?userId=other&limit=2&offset=1",
+		"", nil, (*LogicalImageController).List)
+	var result struct {
+		Total         int64                  `json:"total"`
+		LogicalImages []*models.LogicalImage `json:"logicalImages"`
+	}
+	if err := json.Unmarshal([]byte(body), &result); code != util.StatusOK || err != nil {
+		t.Fatalf("got status %d: %s", code, body)
+	}
+	// other sees its own logical image and the two with public revisions, in name order
+	if result.Total != 3 || len(result.LogicalImages) != 2 || result.LogicalImages[0].Name != "other" ||
+		result.LogicalImages[1].Name != "ubuntu" {
+		t.Fatalf("got %s, want other and ubuntu of 3 logical images", body)
+	}
+}
+
+func TestDeleteLogicalImageKeepsImages(t *testing.T) {
+	db := newLogicalTestDb()
+	publishRevision(db, "ubuntu", "image1", "owner")
+	remove := func(userId string) int {
+		code, _ := serveLogical(db, http.MethodDelete, "/image-management/v1/logical-images/ubuntu?userId="+userId, "",
+			map[string]string{":name": "ubuntu"}, (*LogicalImageController).Delete)
+		return code
+	}
+	if code := remove("other"); code != util.StatusForbidden {
+		t.Fatalf("got status %d for another user, want %d", code, util.StatusForbidden)
+	}
+	if code := remove("owner"); code != util.StatusOK {
+		t.Fatalf("got status %d for the owner", code)
+	}
+	for _, table := range []string{"logical_image", "image_revision", "image_alias"} {
+		if rows := db.tables[table]; len(rows) != 0 {
+			t.Fatalf("%d rows left in %s", len(rows), table)
+		}
+	}
+	if len(db.tables["image_d_b"]) != 4 {
+		t.Fatalf("images were removed with the logical image")
+	}
+}
+
+func TestDeleteAliasedImageConflicts(t *testing.T) {
+	db := newLogicalTestDb()
+	publishRevision(db, "ubuntu", "image1", "owner")
+	c := &ImageController{BaseController{Db: db}}
+	_, rw := newTestRequest(c, http.MethodDelete, "/image-management/v1/images/image1?userId=owner", nil,
+		map[string]string{":imageId": "image1"})
+	c.Delete()
+	if rw.Code != util.StatusConflict {
+		t.Fatalf("got status %d deleting an aliased image, want %d", rw.Code, util.StatusConflict)
+	}
+	if len(db.tables["image_revision"]) != 1 {
+		t.Fatalf("revision of an aliased image was removed")
+	}
+}
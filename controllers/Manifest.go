@@ -0,0 +1,353 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// @Title  controllers
+// @Description  integrity manifests embedded in image packages and their verification
+// @Author  GuoZhen Gao (2021/6/30 10:40)
+package controllers
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fileSystem/models"
+	"fileSystem/pkg/codec"
+	"fileSystem/pkg/envelope"
+	"fileSystem/pkg/manifest"
+	"fileSystem/pkg/transfer"
+	"fileSystem/util"
+	"hash"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// corruptionError reports a file whose digest doesn't match the manifest or recorded checksum
+type corruptionError struct {
+	source string
+}
+
+func (e *corruptionError) Error() string {
+	return "digest of " + e.source + " doesn't match the manifest"
+}
+
+// digestReader hashes what is read and fails at the end of the stream when the digest isn't the expected one
+type digestReader struct {
+	r        io.Reader
+	hash     hash.Hash
+	source   string
+	expected string
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(d.hash.Sum(nil)) != d.expected {
+		return n, &corruptionError{source: d.source}
+	}
+	return n, err
+}
+
+// Wrap a package file so reading it to the end verifies it, files the manifest doesn't list are read as is
+func verifyingReader(r io.Reader, source, expected string) io.Reader {
+	if expected == "" {
+		return r
+	}
+	return &digestReader{r: r, hash: sha256.New(), source: source, expected: expected}
+}
+
+// Add the manifest of an image entry to a package with a fixed time, so identical images keep identical zips
+func writeManifestEntry(w *zip.Writer, entryName, checksum string) error {
+	m := &manifest.Manifest{}
+	m.Add(entryName, checksum)
+	header := &zip.FileHeader{
+		Name:     util.ManifestEntryName,
+		Method:   zip.Deflate,
+		Modified: time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	header.SetMode(0644)
+	writer, err := w.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(m.Bytes())
+	return err
+}
+
+// Read the manifest of a package, nil when it has none
+func readManifest(files []*zip.File) (*manifest.Manifest, error) {
+	for _, file := range files {
+		if file.Name != util.ManifestEntryName {
+			continue
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		data, err := ioutil.ReadAll(io.LimitReader(rc, util.MaxMetadataBodySize))
+		if err != nil {
+			return nil, err
+		}
+		return manifest.Parse(data)
+	}
+	return nil, nil
+}
+
+// Read the manifest of an image, nil when it has none. Packages created on upload embed theirs, the one of an
+// uploaded zip is recorded on the image since a manifest inside the zip is content of the user.
+func storedManifest(image *models.ImageDB, files []*zip.File) (*manifest.Manifest, error) {
+	if !isPackage(image) {
+		return readManifest(files)
+	}
+	if image.Manifest == "" {
+		return nil, nil
+	}
+	return manifest.Parse([]byte(image.Manifest))
+}
+
+// Get the digest the manifest lists for the file of an image, empty when it isn't listed
+func entryDigest(image *models.ImageDB, files []*zip.File, file *zip.File) (string, error) {
+	m, err := storedManifest(image, files)
+	if err != nil || m == nil {
+		return "", err
+	}
+	digest, _ := m.Hash(file.Name)
+	return digest, nil
+}
+
+// Build the manifest of the files of an uploaded zip, so entries downloaded from it are verified like the
+// image of a package created on upload
+func packageManifest(path string, encrypted bool) (string, error) {
+	reader, err := openStoredZip(path, encrypted)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	m := &manifest.Manifest{}
+	for _, file := range reader.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return "", err
+		}
+		digest, err := sha256Hex(rc)
+		_ = rc.Close()
+		if err != nil {
+			return "", err
+		}
+		m.Add(file.Name, digest)
+	}
+	return string(m.Bytes()), nil
+}
+
+// Compute the SHA-256 of everything r returns
+func sha256Hex(r io.Reader) (string, error) {
+	h := sha256.New()
+	_, err := io.Copy(h, r)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Verify every file a manifest lists against the package
+func verifyManifest(files []*zip.File, m *manifest.Manifest) error {
+	byName := map[string]*zip.File{}
+	for _, file := range files {
+		byName[file.Name] = file
+	}
+	for _, entry := range m.Entries {
+		file, ok := byName[entry.Source]
+		if !ok || entry.Algorithm != manifest.AlgorithmSha256 {
+			return &corruptionError{source: entry.Source}
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return err
+		}
+		digest, err := sha256Hex(rc)
+		_ = rc.Close()
+		if err != nil {
+			return err
+		}
+		if digest != entry.Hash {
+			return &corruptionError{source: entry.Source}
+		}
+	}
+	return nil
+}
+
+// Report whether an image is stored as a zip which may have a manifest
+func hasManifest(image *models.ImageDB) bool {
+	return !image.Chunked && image.Codec != codec.None && (!isPackage(image) || image.Manifest != "")
+}
+
+// Verify an image against the manifest of its package, images without one against their recorded checksum.
+// A corruptionError is returned when the image doesn't match or its encrypted file doesn't decrypt.
+func (c *BaseController) verifyImage(image *models.ImageDB) (err error) {
+	defer func() {
+		if err == envelope.ErrCorrupt {
+			err = &corruptionError{source: image.FileName}
+		}
+	}()
+	if hasManifest(image) {
+		reader, err := openStoredZip(image.StorageMedium+image.SaveFileName, image.Encrypted)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		m, err := storedManifest(image, reader.File)
+		if err != nil {
+			return err
+		}
+		if m != nil {
+			return verifyManifest(reader.File, m)
+		}
+	}
+	if image.Checksum == "" {
+		// images stored before checksums were recorded have nothing to be verified against
+		return nil
+	}
+	content, err := c.openUploadedImage(image)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	digest, err := sha256Hex(content)
+	if err == nil && digest != image.Checksum {
+		err = &corruptionError{source: image.FileName}
+	}
+	return err
+}
+
+// Open the file an image was uploaded as, packages as the uploaded zip and other images as their original file
+func (c *BaseController) openUploadedImage(image *models.ImageDB) (io.ReadCloser, error) {
+	if isPackage(image) {
+		stored, err := c.openStoredImage(image)
+		if err != nil {
+			return nil, err
+		}
+		return &imageStream{Reader: io.NewSectionReader(stored, 0, stored.Size()), closers: []io.Closer{stored}}, nil
+	}
+	_, stream, _, err := c.openImageStream(image, "")
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Get the manifest of an image, images without an embedded one get a manifest of their recorded checksum
+func imageManifest(image *models.ImageDB) ([]byte, error) {
+	if isPackage(image) && image.Manifest != "" {
+		return []byte(image.Manifest), nil
+	}
+	if hasManifest(image) && !isPackage(image) {
+		reader, err := openStoredZip(image.StorageMedium+image.SaveFileName, image.Encrypted)
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		for _, file := range reader.File {
+			if file.Name == util.ManifestEntryName {
+				rc, err := file.Open()
+				if err != nil {
+					return nil, err
+				}
+				defer rc.Close()
+				return ioutil.ReadAll(io.LimitReader(rc, util.MaxMetadataBodySize))
+			}
+		}
+	}
+	if image.Checksum == "" {
+		return nil, nil
+	}
+	m := &manifest.Manifest{}
+	m.Add(image.FileName, image.Checksum)
+	return m.Bytes(), nil
+}
+
+// @Title Manifest
+// @Description the integrity manifest of an image in .mf format, verify=true checks the image against it first
+// @Param   imageId     path   string  true   "imageId"
+// @Param   userId      query  string  false  "caller"
+// @Param   tenantId    query  string  false  "tenant of the caller"
+// @Param   verify      query  bool    false  "verify the stored image against the manifest"
+// @Success 200 ok
+// @Failure 403 forbidden
+// @Failure 404 not found
+// @Failure 500 image is corrupt
+// @router /image-management/v1/images/:imageId/manifest [get]
+func (this *DownloadController) Manifest() {
+	this.logger().Info("Manifest request received.")
+	clientIp := this.Ctx.Input.IP()
+	err := util.ValidateSrcAddress(clientIp)
+	if err != nil {
+		this.HandleApiError(clientIp, util.BadRequest, util.ClientIpaddressInvalid, util.ErrInvalidClientIp)
+		return
+	}
+	this.displayReceivedMsg(clientIp)
+	verify, err := this.GetBool("verify", false)
+	if err != nil {
+		this.HandleApiError(clientIp, util.BadRequest, "verify should be true or false",
+			util.ErrInvalidParameter.WithDetails(err.Error()))
+		return
+	}
+
+	image, ok := this.queryImage(clientIp, this.Ctx.Input.Param(":imageId"), "fail to query database")
+	if !ok || !this.checkImageAccess(clientIp, image, accessRead) {
+		return
+	}
+	if !imageAvailable(image) {
+		this.HandleApiError(clientIp, util.StatusNotFound, "image is not available",
+			util.ErrImageNotAvailable.WithDetails("image status is "+image.Status))
+		return
+	}
+
+	tr, err := transfer.Begin(transfer.Download, image.ImageId)
+	if err != nil {
+		this.HandleApiError(clientIp, util.StatusServiceUnavailable, err.Error(), util.ErrServiceShuttingDown)
+		return
+	}
+	defer transfer.End(tr)
+	data, err := imageManifest(image)
+	if err != nil {
+		this.HandleApiError(clientIp, util.StatusInternalServerError, "fail to read manifest",
+			util.ErrStorageFailure.WithDetails(err.Error()))
+		return
+	}
+	if data == nil {
+		this.HandleApiError(clientIp, util.StatusNotFound, "image has no manifest", util.ErrManifestNotFound)
+		return
+	}
+	if verify {
+		err = this.verifyImage(image)
+		if _, corrupt := err.(*corruptionError); corrupt {
+			this.HandleApiError(clientIp, util.StatusInternalServerError, err.Error(),
+				util.ErrImageCorrupt.WithDetails(err.Error()))
+			return
+		}
+		if err != nil {
+			this.HandleApiError(clientIp, util.StatusInternalServerError, "fail to read image",
+				util.ErrStorageFailure.WithDetails(err.Error()))
+			return
+		}
+	}
+	this.Ctx.Output.Header("Content-Type", "text/plain; charset=utf-8")
+	_, _ = this.Ctx.ResponseWriter.Write(data)
+}
@@ -0,0 +1,258 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"archive/zip"
+	"bytes"
+	"fileSystem/models"
+	"fileSystem/pkg/manifest"
+	"fileSystem/util"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Build a zip holding an image entry and, when checksum isn't empty, a manifest listing it
+func newManifestPackage(t *testing.T, content, checksum string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	entry, err := w.Create("image.qcow2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = entry.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if checksum != "" {
+		if err = writeManifestEntry(w, "image.qcow2", checksum); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zipFiles(t *testing.T, data []byte) []*zip.File {
+	t.Helper()
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reader.File
+}
+
+func isCorruption(err error) bool {
+	_, ok := err.(*corruptionError)
+	return ok
+}
+
+func TestVerifyManifest(t *testing.T) {
+	files := zipFiles(t, newManifestPackage(t, "image", checksumOf([]byte("image"))))
+	m, err := readManifest(files)
+	if err != nil || m == nil {
+		t.Fatalf("got manifest %v, error %v", m, err)
+	}
+	if err = verifyManifest(files, m); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyManifestDetectsMismatch(t *testing.T) {
+	files := zipFiles(t, newManifestPackage(t, "image", checksumOf([]byte("other"))))
+	m, err := readManifest(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = verifyManifest(files, m); !isCorruption(err) {
+		t.Fatalf("got %v, want a corruption error", err)
+	}
+
+	// a file the manifest lists but the package lacks is corruption as well
+	m = &manifest.Manifest{}
+	m.Add("missing.qcow2", checksumOf([]byte("image")))
+	if err = verifyManifest(files, m); !isCorruption(err) {
+		t.Fatalf("got %v for a missing file, want a corruption error", err)
+	}
+}
+
+func TestReadManifestWithoutManifest(t *testing.T) {
+	m, err := readManifest(zipFiles(t, newManifestPackage(t, "image", "")))
+	if err != nil || m != nil {
+		t.Fatalf("got manifest %v, error %v", m, err)
+	}
+}
+
+func TestVerifyingReader(t *testing.T) {
+	digest := checksumOf([]byte("image"))
+	if _, err := ioutil.ReadAll(verifyingReader(strings.NewReader("image"), "a", digest)); err != nil {
+		t.Fatal(err)
+	}
+	_, err := ioutil.ReadAll(verifyingReader(strings.NewReader("imagf"), "a", digest))
+	if !isCorruption(err) {
+		t.Fatalf("got %v, want a corruption error", err)
+	}
+	if _, err = ioutil.ReadAll(verifyingReader(strings.NewReader("imagf"), "a", "")); err != nil {
+		t.Fatalf("file without digest wasn't read as is: %v", err)
+	}
+}
+
+func TestCopyVerifiedHoldsBackCorruptTail(t *testing.T) {
+	content := bytes.Repeat([]byte("disk block "), 10000)
+	var out bytes.Buffer
+	if err := copyVerified(&out, verifyingReader(bytes.NewReader(content), "a", checksumOf(content))); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), content) {
+		t.Fatalf("got %d bytes of a verified file, want %d", out.Len(), len(content))
+	}
+	out.Reset()
+	err := copyVerified(&out, verifyingReader(bytes.NewReader(content), "a", checksumOf([]byte("other"))))
+	if !isCorruption(err) || out.Len() >= len(content) {
+		t.Fatalf("got %d bytes and error %v for a corrupt file", out.Len(), err)
+	}
+}
+
+func TestVerifyImageAgainstEmbeddedManifest(t *testing.T) {
+	dir := newTestDir(t)
+	c := &BaseController{Db: newFakeDb()}
+
+	for _, tt := range []struct {
+		name     string
+		checksum string
+		corrupt  bool
+	}{
+		{"good.zip", checksumOf([]byte("image")), false},
+		{"bad.zip", checksumOf([]byte("other")), true},
+	} {
+		err := ioutil.WriteFile(filepath.Join(dir, tt.name), newManifestPackage(t, "image", tt.checksum), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		image := &models.ImageDB{FileName: "image.qcow2", StorageMedium: dir, SaveFileName: tt.name}
+		err = c.verifyImage(image)
+		if isCorruption(err) != tt.corrupt || (!tt.corrupt && err != nil) {
+			t.Fatalf("%s: got %v, want corruption %v", tt.name, err, tt.corrupt)
+		}
+	}
+}
+
+func getManifest(db *fakeDb, imageId, query string) (int, string) {
+	c := &DownloadController{BaseController{Db: db}}
+	_, rw := newTestRequest(c, http.MethodGet, "/image-management/v1/images/"+imageId+"/manifest?"+query, nil,
+		map[string]string{":imageId": imageId})
+	c.Manifest()
+	return rw.Code, rw.Body.String()
+}
+
+func TestManifestOfUploadedImage(t *testing.T) {
+	root := useTestStores(t)
+	db := newFakeDb()
+	insertDownloadImage(t, db, root, "image1", "disk.img", "default:deflate")
+
+	code, body := getManifest(db, "image1", "verify=true")
+	if code != util.StatusOK {
+		t.Fatalf("got status %d: %s", code, body)
+	}
+	m, err := manifest.Parse([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest, ok := m.Hash("disk.img"); !ok || digest != checksumOf(testImageContent) {
+		t.Fatalf("got manifest %q", body)
+	}
+	if code, _ = getManifest(db, "image1", "verify=maybe"); code != util.BadRequest {
+		t.Fatalf("got status %d for an invalid verify, want %d", code, util.BadRequest)
+	}
+}
+
+// Check the body of a download is shorter than its Content-Length, the way a corrupt entry is cut off
+func isTruncated(rw *httptest.ResponseRecorder) bool {
+	return rw.Header().Get("Content-Length") != strconv.Itoa(rw.Body.Len())
+}
+
+func TestDownloadDetectsCorruptEntry(t *testing.T) {
+	root := useTestStores(t)
+	db := newFakeDb()
+	image := &models.ImageDB{ImageId: "image1", FileName: "image.qcow2", StorageMedium: root,
+		SaveFileName: "image1.zip", Status: util.ImageStatusActive}
+	err := ioutil.WriteFile(root+image.SaveFileName, newManifestPackage(t, "image", checksumOf([]byte("other"))), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.insert(image)
+
+	if rw := downloadImage(db, "image1", "", nil); !isTruncated(rw) {
+		t.Fatalf("got %d bytes of a corrupt image, want a truncated body", rw.Body.Len())
+	}
+	if code, _ := getManifest(db, "image1", "verify=true"); code != util.StatusInternalServerError {
+		t.Fatalf("got status %d verifying a corrupt image, want %d", code, util.StatusInternalServerError)
+	}
+}
+
+func TestPackageManifestRecordedOnUpload(t *testing.T) {
+	root := useTestStores(t)
+	db := newFakeDb()
+	files := insertTestPackage(t, db, root, "package1")
+
+	image := readImage(t, db, "package1")
+	m, err := manifest.Parse([]byte(image.Manifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Entries) != len(files) {
+		t.Fatalf("got manifest %q, want the %d files of the package", image.Manifest, len(files))
+	}
+	for name, content := range files {
+		if digest, ok := m.Hash(name); !ok || digest != checksumOf(content) {
+			t.Fatalf("manifest lists %q for %s", digest, name)
+		}
+	}
+	if code, body := getManifest(db, "package1", "verify=true"); code != util.StatusOK || body != image.Manifest {
+		t.Fatalf("got status %d and manifest %q, want the recorded one", code, body)
+	}
+}
+
+func TestDownloadDetectsCorruptPackageEntry(t *testing.T) {
+	root := useTestStores(t)
+	db := newFakeDb()
+	insertTestPackage(t, db, root, "package1")
+	m := &manifest.Manifest{}
+	m.Add("disk.qcow2", checksumOf([]byte("other")))
+	_, err := db.UpdateWithFilters("image_d_b", map[string]interface{}{"image_id__exact": "package1"},
+		map[string]interface{}{"manifest": string(m.Bytes())})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rw := downloadImage(db, "package1", "", nil); !isTruncated(rw) {
+		t.Fatalf("got %d bytes of a corrupt entry, want a truncated body", rw.Body.Len())
+	}
+	if rw := downloadImage(db, "package1", "entry=docs/README.txt", nil); rw.Code != util.StatusOK || isTruncated(rw) {
+		t.Fatalf("got status %d and %d bytes for an entry the manifest doesn't list", rw.Code, rw.Body.Len())
+	}
+	if code, _ := getManifest(db, "package1", "verify=true"); code != util.StatusInternalServerError {
+		t.Fatalf("got status %d verifying a corrupt package, want %d", code, util.StatusInternalServerError)
+	}
+}
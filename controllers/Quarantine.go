@@ -0,0 +1,258 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// @Title  controllers
+// @Description  malware scanning of uploads, and the api to list, release and delete quarantined images
+// @Author  GuoZhen Gao (2021/6/30 10:40)
+package controllers
+
+import (
+	"encoding/json"
+	"fileSystem/models"
+	"fileSystem/pkg/scanner"
+	"fileSystem/util"
+	"io"
+	"time"
+)
+
+// QuarantineController   Define the admin controller of images quarantined by the malware scan
+type QuarantineController struct {
+	BaseController
+}
+
+// Get the scan status of an image, images uploaded without a scanner are unscanned
+func scanStatus(image *models.ImageDB) string {
+	if image.ScanStatus == "" {
+		return util.ScanUnscanned
+	}
+	return image.ScanStatus
+}
+
+// Create the configured scanner, nil when uploads aren't scanned
+func uploadScanner() (scanner.Scanner, error) {
+	timeout := util.GetAppConfigInt64("scanTimeoutSeconds", util.DefaultScanTimeoutSecs)
+	return scanner.New(util.GetAppConfig("malwareScanner"), util.GetAppConfig("scannerAddress"),
+		time.Duration(timeout)*time.Second)
+}
+
+// Scan a stored upload and record the outcome on the image, images found infected and images which couldn't
+// be scanned are quarantined. Images larger than the scanner takes are skipped without reading them.
+// Nothing is done when no scanner is configured.
+func (c *BaseController) scanImage(image *models.ImageDB) {
+	s, err := uploadScanner()
+	if s == nil && err == nil {
+		return
+	}
+	image.ScannedTime = time.Now()
+	maxSize := util.GetAppConfigInt64("scanMaxSizeMB", util.DefaultScanMaxSizeMB) << 20
+	if err == nil && maxSize > 0 && image.Size > maxSize {
+		image.ScanStatus, image.ScanResult = util.ScanSkipped, "image is larger than scanMaxSizeMB"
+		c.logger().Warn("image " + image.ImageId + " isn't scanned, it is larger than scanMaxSizeMB")
+		return
+	}
+	var result *scanner.Result
+	if err == nil {
+		var content io.ReadCloser
+		content, err = c.openUploadedImage(image)
+		if err == nil {
+			result, err = s.Scan(content)
+			_ = content.Close()
+		}
+	}
+	switch {
+	case err == scanner.ErrSizeLimit:
+		image.ScanStatus, image.ScanResult = util.ScanSkipped, err.Error()
+		c.logger().Warn("image " + image.ImageId + " isn't scanned: " + err.Error())
+	case err != nil:
+		image.ScanStatus, image.ScanResult = util.ScanFailed, err.Error()
+		c.logger().Error("fail to scan image " + image.ImageId + ": " + err.Error())
+	case result.Infected:
+		image.ScanStatus, image.ScanResult = util.ScanInfected, result.Signature
+		c.logger().Warn("malware " + result.Signature + " found in image " + image.ImageId)
+	default:
+		image.ScanStatus, image.ScanResult = util.ScanClean, ""
+	}
+	if image.ScanStatus == util.ScanInfected || image.ScanStatus == util.ScanFailed {
+		image.Status = util.ImageStatusQuarantined
+	}
+}
+
+// Report a quarantined upload to the client, returns false when the image was quarantined
+func (c *BaseController) checkQuarantine(clientIp string, image *models.ImageDB) bool {
+	if image.Status != util.ImageStatusQuarantined {
+		return true
+	}
+	c.recordAudit(util.AuditActionQuarantine, image.ImageId, util.AuditOutcomeSuccess,
+		"scan="+image.ScanStatus+" result="+image.ScanResult)
+	details := "imageId " + image.ImageId + " is quarantined: " + image.ScanResult
+	if image.ScanStatus == util.ScanInfected {
+		c.HandleApiError(clientIp, util.StatusUnprocessableEntity, "malware was found in the image, it is quarantined",
+			util.ErrImageInfected.WithDetails(details))
+	} else {
+		c.HandleApiError(clientIp, util.StatusServiceUnavailable, "image couldn't be scanned, it is quarantined",
+			util.ErrScanFailed.WithDetails(details))
+	}
+	return false
+}
+
+// Check the caller is an admin and query the quarantined image named in the path, the error response is
+// written when it can't be returned
+func (c *QuarantineController) queryQuarantinedImage(clientIp string) (*models.ImageDB, bool) {
+	if !c.isAdmin() {
+		c.HandleApiError(clientIp, util.StatusForbidden, "admin token is required", util.ErrForbidden)
+		return nil, false
+	}
+	image, ok := c.queryImage(clientIp, c.Ctx.Input.Param(":imageId"), "fail to query this imageId in database")
+	if !ok {
+		return nil, false
+	}
+	if image.Status != util.ImageStatusQuarantined {
+		c.HandleApiError(clientIp, util.StatusConflict, "image is not quarantined",
+			util.ErrImageNotAvailable.WithDetails("image status is "+image.Status))
+		return nil, false
+	}
+	return image, true
+}
+
+// @Title Get
+// @Description list quarantined images with their scan results, admin only
+// @Param   limit         query  int     false  "limit"
+// @Param   offset        query  int     false  "offset"
+// @Success 200 ok
+// @Failure 403 forbidden
+// @router /image-management/v1/quarantine [GET]
+func (c *QuarantineController) Get() {
+	c.logger().Info("Quarantine list request received.")
+	clientIp := c.Ctx.Input.IP()
+	err := util.ValidateSrcAddress(clientIp)
+	if err != nil {
+		c.HandleApiError(clientIp, util.BadRequest, util.ClientIpaddressInvalid, util.ErrInvalidClientIp)
+		return
+	}
+	c.displayReceivedMsg(clientIp)
+
+	if !c.isAdmin() {
+		c.HandleApiError(clientIp, util.StatusForbidden, "admin token is required", util.ErrForbidden)
+		return
+	}
+	limit, offset, ok := c.listPage(clientIp)
+	if !ok {
+		return
+	}
+	var images []*models.ImageDB
+	filters := map[string]interface{}{"status__exact": util.ImageStatusQuarantined}
+	total, err := c.Db.QueryCountWithFilters("image_d_b", filters)
+	if err == nil {
+		_, err = c.Db.QueryTableWithFilters("image_d_b", &images, filters, []string{"-scanned_time"}, limit, offset)
+	}
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to query database",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return
+	}
+	quarantined := make([]*ImageDetail, 0, len(images))
+	for _, image := range images {
+		quarantined = append(quarantined, newImageDetail(image, nil))
+	}
+	quarantineResp, err := json.Marshal(map[string]interface{}{
+		"total":  total,
+		"images": quarantined,
+	})
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to return quarantine list", util.ErrInternal)
+		return
+	}
+	_, _ = c.Ctx.ResponseWriter.Write(quarantineResp)
+}
+
+// @Title Release
+// @Description release a quarantined image after review so it can be downloaded, admin only.
+// The scan result is kept on the image.
+// @Param	imageId 	string
+// @Success 200 ok
+// @Failure 403 forbidden
+// @Failure 409 conflict
+// @router /image-management/v1/quarantine/:imageId/action/release [POST]
+func (c *QuarantineController) Release() {
+	c.logger().Info("Release image request received.")
+	c.auditAs(util.AuditActionRelease)
+	clientIp := c.Ctx.Input.IP()
+	err := util.ValidateSrcAddress(clientIp)
+	if err != nil {
+		c.HandleApiError(clientIp, util.BadRequest, util.ClientIpaddressInvalid, util.ErrInvalidClientIp)
+		return
+	}
+	c.displayReceivedMsg(clientIp)
+
+	image, ok := c.queryQuarantinedImage(clientIp)
+	if !ok {
+		return
+	}
+	num, err := c.Db.UpdateWithFilters("image_d_b", map[string]interface{}{
+		"image_id__exact":         image.ImageId,
+		"resource_version__exact": image.ResourceVersion,
+	}, map[string]interface{}{
+		"status":           util.ImageStatusActive,
+		"resource_version": image.ResourceVersion + 1,
+		"update_time":      time.Now(),
+	})
+	if err == nil && num == 0 {
+		err = errConcurrentModification
+	}
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to release image",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return
+	}
+	c.recordAudit(util.AuditActionRelease, image.ImageId, util.AuditOutcomeSuccess,
+		"scan="+image.ScanStatus+" result="+image.ScanResult)
+	c.Ctx.WriteString("release success")
+}
+
+// @Title Delete
+// @Description permanently remove a quarantined image, admin only
+// @Param	imageId 	string
+// @Success 200 ok
+// @Failure 403 forbidden
+// @Failure 409 conflict
+// @router /image-management/v1/quarantine/:imageId [DELETE]
+func (c *QuarantineController) Delete() {
+	c.logger().Info("Delete quarantined image request received.")
+	c.auditAs(util.AuditActionDelete)
+	clientIp := c.Ctx.Input.IP()
+	err := util.ValidateSrcAddress(clientIp)
+	if err != nil {
+		c.HandleApiError(clientIp, util.BadRequest, util.ClientIpaddressInvalid, util.ErrInvalidClientIp)
+		return
+	}
+	c.displayReceivedMsg(clientIp)
+
+	image, ok := c.queryQuarantinedImage(clientIp)
+	if !ok {
+		return
+	}
+	// quarantined images skip the trash, the file isn't kept any longer than needed
+	err = purgeImage(c.Db, image)
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to delete image",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return
+	}
+	c.recordAudit(util.AuditActionDelete, image.ImageId, util.AuditOutcomeSuccess,
+		"quarantined scan="+image.ScanStatus+" result="+image.ScanResult)
+	c.Ctx.WriteString("delete success")
+	c.logger().Info("deleted quarantined image " + image.ImageId)
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fileSystem/models"
+	"fileSystem/util"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// Set up a clamd daemon answering every stream with reply, the streamed content is sent on the channel
+func useFakeClamd(t *testing.T, reply string) <-chan []byte {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	received := make(chan []byte, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			var content bytes.Buffer
+			_, err = io.CopyN(ioutil.Discard, conn, int64(len("zINSTREAM\x00")))
+			for err == nil {
+				var size uint32
+				if err = binary.Read(conn, binary.BigEndian, &size); err != nil || size == 0 {
+					break
+				}
+				_, err = io.CopyN(&content, conn, int64(size))
+			}
+			received <- content.Bytes()
+			_, _ = conn.Write([]byte(reply + "\x00"))
+			_ = conn.Close()
+		}
+	}()
+	setTestConfig(t, "malwareScanner", "clamd")
+	setTestConfig(t, "scannerAddress", listener.Addr().String())
+	return received
+}
+
+func scanTestImage(db *fakeDb, image *models.ImageDB) {
+	c := &UploadController{BaseController{Db: db}}
+	newTestRequest(c, http.MethodPost, "/image-management/v1/images", nil, nil)
+	c.scanImage(image)
+}
+
+func TestScanImage(t *testing.T) {
+	root := useTestStores(t)
+	db := newFakeDb()
+	insertDownloadImage(t, db, root, "image1", "disk.img", "default:deflate")
+
+	for _, tt := range []struct {
+		reply, scanStatus, status string
+	}{
+		{"stream: OK", util.ScanClean, util.ImageStatusActive},
+		{"stream: Eicar-Test-Signature FOUND", util.ScanInfected, util.ImageStatusQuarantined},
+	} {
+		received := useFakeClamd(t, tt.reply)
+		image := readImage(t, db, "image1")
+		scanTestImage(db, image)
+		if image.ScanStatus != tt.scanStatus || image.Status != tt.status || image.ScannedTime.IsZero() {
+			t.Fatalf("got scan %s and status %s for %q", image.ScanStatus, image.Status, tt.reply)
+		}
+		if got := <-received; !bytes.Equal(got, testImageContent) {
+			t.Fatalf("scanner received %d bytes, want the %d bytes of the image", len(got), len(testImageContent))
+		}
+	}
+
+	// images larger than the scanner takes are skipped without reading them
+	setTestConfig(t, "scanMaxSizeMB", "1")
+	image := readImage(t, db, "image1")
+	image.Size = 2 << 20
+	scanTestImage(db, image)
+	if image.ScanStatus != util.ScanSkipped || image.Status != util.ImageStatusActive {
+		t.Fatalf("got scan %s and status %s for an image over the size limit", image.ScanStatus, image.Status)
+	}
+
+	setTestConfig(t, "scannerAddress", "127.0.0.1:1")
+	image = readImage(t, db, "image1")
+	scanTestImage(db, image)
+	if image.ScanStatus != util.ScanFailed || image.Status != util.ImageStatusQuarantined {
+		t.Fatalf("got scan %s and status %s without a daemon", image.ScanStatus, image.Status)
+	}
+}
+
+func serveQuarantine(db *fakeDb, method, url string, admin bool, params map[string]string,
+	action func(c *QuarantineController)) (int, string) {
+	c := &QuarantineController{BaseController{Db: db}}
+	req, rw := newTestRequest(c, method, url, nil, params)
+	if admin {
+		req.Header.Set(util.AdminTokenHeader, testAdminToken)
+	}
+	action(c)
+	return rw.Code, rw.Body.String()
+}
+
+func TestQuarantineReview(t *testing.T) {
+	useAdminToken(t)
+	db := newFakeDb()
+	for _, id := range []string{"image1", "image2"} {
+		insertStoredImage(t, db, &models.ImageDB{ImageId: id, Status: util.ImageStatusQuarantined,
+			ScanStatus: util.ScanInfected, ScanResult: "Eicar-Test-Signature", ResourceVersion: 1})
+	}
+	insertStoredImage(t, db, &models.ImageDB{ImageId: "image3", Status: util.ImageStatusActive})
+	list := func(c *QuarantineController) { c.Get() }
+
+	if code, _ := serveQuarantine(db, http.MethodGet, "/image-management/v1/quarantine", false, nil, list); code != util.StatusForbidden {
+		t.Fatalf("got status %d without admin token, want %d", code, util.StatusForbidden)
+	}
+	code, body := serveQuarantine(db, http.MethodGet, "/image-management/v1/quarantine", true, nil, list)
+	var resp struct {
+		Total  int            `json:"total"`
+		Images []*ImageDetail `json:"images"`
+	}
+	if err := json.Unmarshal([]byte(body), &resp); code != util.StatusOK || err != nil || resp.Total != 2 {
+		t.Fatalf("got status %d and %s, want the 2 quarantined images", code, body)
+	}
+	_, body = serveQuarantine(db, http.MethodGet, "/image-management/v1/quarantine?limit=1&offset=1", true, nil, list)
+	if err := json.Unmarshal([]byte(body), &resp); err != nil || resp.Total != 2 || len(resp.Images) != 1 {
+		t.Fatalf("got %s, want a page of 1 of 2 quarantined images", body)
+	}
+
+	params := map[string]string{":imageId": "image1"}
+	code, _ = serveQuarantine(db, http.MethodPost, "/image-management/v1/quarantine/image1/action/release", true,
+		params, func(c *QuarantineController) { c.Release() })
+	if image := readImage(t, db, "image1"); code != util.StatusOK || image.Status != util.ImageStatusActive ||
+		image.ScanStatus != util.ScanInfected {
+		t.Fatalf("got status %d and image %+v after release", code, image)
+	}
+	code, _ = serveQuarantine(db, http.MethodDelete, "/image-management/v1/quarantine/image1", true,
+		params, func(c *QuarantineController) { c.Delete() })
+	if code != util.StatusConflict {
+		t.Fatalf("got status %d deleting a released image, want %d", code, util.StatusConflict)
+	}
+
+	code, _ = serveQuarantine(db, http.MethodDelete, "/image-management/v1/quarantine/image2", true,
+		map[string]string{":imageId": "image2"}, func(c *QuarantineController) { c.Delete() })
+	if err := db.ReadData(&models.ImageDB{ImageId: "image2"}); code != util.StatusOK || err == nil {
+		t.Fatalf("got status %d and %v, want the quarantined image deleted", code, err)
+	}
+}
@@ -0,0 +1,454 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// @Title  controllers
+// @Description  image expiry and retention policy api for filesystem
+// @Author  GuoZhen Gao (2021/6/30 10:40)
+package controllers
+
+import (
+	"encoding/json"
+	"fileSystem/models"
+	"fileSystem/pkg/dbAdpater"
+	"fileSystem/pkg/worker"
+	"fileSystem/util"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"strconv"
+	"time"
+)
+
+// RetentionController   Define the controller to manage retention policies, admin only
+type RetentionController struct {
+	BaseController
+}
+
+// RetentionPolicyRequest   Define the body to create or replace a retention policy
+type RetentionPolicyRequest struct {
+	MaxIdleDays  int64 `json:"maxIdleDays"`
+	MaxRevisions int64 `json:"maxRevisions"`
+}
+
+// RetentionCandidate   Define an image the retention job moves to trash
+type RetentionCandidate struct {
+	ImageId  string `json:"imageId"`
+	FileName string `json:"fileName"`
+	UserId   string `json:"userId"`
+	TenantId string `json:"tenantId"`
+	Reason   string `json:"reason"`
+	PolicyId int64  `json:"policyId,omitempty"`
+	// set when the image matches but is kept, like revisions an alias points to
+	Skipped string `json:"skipped,omitempty"`
+
+	image *models.ImageDB
+}
+
+// Record the download time used by idle retention, a failed write never fails the download
+func (c *BaseController) markDownloaded(imageId string) {
+	_, err := c.Db.UpdateWithFilters("image_d_b", map[string]interface{}{"image_id__exact": imageId},
+		map[string]interface{}{"last_download_time": time.Now()})
+	if err != nil {
+		c.logger().Error("fail to record download time of image " + imageId + ": " + err.Error())
+	}
+}
+
+// Query the active images owned by the scope of a retention policy
+func retentionScopeImages(db dbAdpater.Database, policy *models.RetentionPolicy) ([]*models.ImageDB, error) {
+	ownerColumn := "user_id__exact"
+	if policy.Scope == util.GranteeTenant {
+		ownerColumn = "tenant_id__exact"
+	}
+	var images []*models.ImageDB
+	_, err := db.QueryTableWithFilters("image_d_b", &images, map[string]interface{}{
+		"status__in": []string{"", util.ImageStatusActive},
+		ownerColumn:  policy.ScopeId,
+	}, []string{"upload_time"}, 0, 0)
+	return images, err
+}
+
+// Get the images beyond the newest maxRevisions active revisions of the logical images owned by the scope
+func retentionOldRevisions(db dbAdpater.Database, policy *models.RetentionPolicy,
+	images []*models.ImageDB) ([]*models.ImageDB, error) {
+	ownerColumn := "user_id__exact"
+	if policy.Scope == util.GranteeTenant {
+		ownerColumn = "tenant_id__exact"
+	}
+	var logicals []*models.LogicalImage
+	_, err := db.QueryTableWithFilters("logical_image", &logicals,
+		map[string]interface{}{ownerColumn: policy.ScopeId}, nil, 0, 0)
+	if err != nil || len(logicals) == 0 {
+		return nil, err
+	}
+	names := make([]string, 0, len(logicals))
+	for _, logical := range logicals {
+		names = append(names, logical.Name)
+	}
+	var revisions []*models.ImageRevision
+	_, err = db.QueryTableWithFilters("image_revision", &revisions,
+		map[string]interface{}{"name__in": names}, []string{"name", "-revision"}, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	active := map[string]*models.ImageDB{}
+	for _, image := range images {
+		active[image.ImageId] = image
+	}
+	var old []*models.ImageDB
+	kept := map[string]int64{}
+	for _, revision := range revisions {
+		image, ok := active[revision.ImageId]
+		if !ok {
+			continue
+		}
+		if kept[revision.Name] < policy.MaxRevisions {
+			kept[revision.Name]++
+			continue
+		}
+		old = append(old, image)
+	}
+	return old, nil
+}
+
+// Mark candidates whose revision an alias points to, aliases must keep resolving
+func skipAliasedCandidates(db dbAdpater.Database, candidates []*RetentionCandidate) error {
+	if len(candidates) == 0 {
+		return nil
+	}
+	imageIds := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		imageIds = append(imageIds, candidate.ImageId)
+	}
+	var revisions []*models.ImageRevision
+	_, err := db.QueryTableWithFilters("image_revision", &revisions,
+		map[string]interface{}{"image_id__in": imageIds}, nil, 0, 0)
+	if err != nil || len(revisions) == 0 {
+		return err
+	}
+	names := make([]string, 0, len(revisions))
+	for _, revision := range revisions {
+		names = append(names, revision.Name)
+	}
+	var aliases []*models.ImageAlias
+	_, err = db.QueryTableWithFilters("image_alias", &aliases, map[string]interface{}{"name__in": names}, nil, 0, 0)
+	if err != nil {
+		return err
+	}
+	aliased := map[string]string{}
+	for _, alias := range aliases {
+		aliased[alias.Name+":"+strconv.FormatInt(alias.Revision, 10)] = alias.Alias
+	}
+	aliasedImages := map[string]string{}
+	for _, revision := range revisions {
+		if alias, ok := aliased[revision.Name+":"+strconv.FormatInt(revision.Revision, 10)]; ok {
+			aliasedImages[revision.ImageId] = alias
+		}
+	}
+	for _, candidate := range candidates {
+		if alias, ok := aliasedImages[candidate.ImageId]; ok {
+			candidate.Skipped = "aliased as " + alias
+		}
+	}
+	return nil
+}
+
+// Evaluate image expiry and every retention policy, an image matching several rules is reported once
+func evaluateRetention(db dbAdpater.Database, now time.Time) ([]*RetentionCandidate, error) {
+	var candidates []*RetentionCandidate
+	seen := map[string]bool{}
+	add := func(image *models.ImageDB, reason string, policyId int64) {
+		if seen[image.ImageId] {
+			return
+		}
+		seen[image.ImageId] = true
+		candidates = append(candidates, &RetentionCandidate{
+			ImageId:  image.ImageId,
+			FileName: image.FileName,
+			UserId:   image.UserId,
+			TenantId: image.TenantId,
+			Reason:   reason,
+			PolicyId: policyId,
+			image:    image,
+		})
+	}
+
+	var expired []*models.ImageDB
+	_, err := db.QueryTableWithFilters("image_d_b", &expired, map[string]interface{}{
+		"status__in":       []string{"", util.ImageStatusActive},
+		"expire_time__lte": now,
+	}, []string{"expire_time"}, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, image := range expired {
+		add(image, util.RetentionReasonExpired, 0)
+	}
+
+	var policies []*models.RetentionPolicy
+	_, err = db.QueryTableWithFilters("retention_policy", &policies, map[string]interface{}{}, []string{"id"}, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, policy := range policies {
+		images, err := retentionScopeImages(db, policy)
+		if err != nil {
+			return nil, err
+		}
+		if policy.MaxIdleDays > 0 {
+			cutoff := now.AddDate(0, 0, -int(policy.MaxIdleDays))
+			for _, image := range images {
+				lastUsed := image.UploadTime
+				if image.LastDownloadTime.After(lastUsed) {
+					lastUsed = image.LastDownloadTime
+				}
+				if lastUsed.Before(cutoff) {
+					add(image, util.RetentionReasonIdle, policy.Id)
+				}
+			}
+		}
+		if policy.MaxRevisions > 0 {
+			old, err := retentionOldRevisions(db, policy, images)
+			if err != nil {
+				return nil, err
+			}
+			for _, image := range old {
+				add(image, util.RetentionReasonRevisions, policy.Id)
+			}
+		}
+	}
+	err = skipAliasedCandidates(db, candidates)
+	if err != nil {
+		return nil, err
+	}
+	return candidates, nil
+}
+
+// NewRetentionJob   Create the background job moving expired and idle images to trash
+func NewRetentionJob(db dbAdpater.Database) worker.Job {
+	return func() error {
+		candidates, err := evaluateRetention(db, time.Now())
+		if err != nil {
+			return err
+		}
+		for _, candidate := range candidates {
+			if candidate.Skipped != "" {
+				continue
+			}
+			err = trashImage(db, candidate.image, util.RetentionTrashedBy)
+			if err == errConcurrentModification {
+				// the image changed since it was evaluated, the next run looks at it again
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			details := "trashed=true reason=" + candidate.Reason
+			if candidate.PolicyId != 0 {
+				details += " policyId=" + strconv.FormatInt(candidate.PolicyId, 10)
+			}
+			log.Info("retention moved image " + candidate.ImageId + " to trash, " + details)
+			writeAuditEvent(db, &models.AuditEvent{
+				Action:  util.AuditActionDelete,
+				ImageId: candidate.ImageId,
+				UserId:  util.RetentionTrashedBy,
+				Outcome: util.AuditOutcomeSuccess,
+				Details: details,
+			})
+		}
+		return nil
+	}
+}
+
+// Check the caller is an admin, the error response is written otherwise
+func (c *RetentionController) checkAdmin(clientIp string) bool {
+	err := util.ValidateSrcAddress(clientIp)
+	if err != nil {
+		c.HandleApiError(clientIp, util.BadRequest, util.ClientIpaddressInvalid, util.ErrInvalidClientIp)
+		return false
+	}
+	c.displayReceivedMsg(clientIp)
+	if !c.isAdmin() {
+		c.HandleApiError(clientIp, util.StatusForbidden, "admin token is required", util.ErrForbidden)
+		return false
+	}
+	return true
+}
+
+// Write a response as json
+func (c *RetentionController) writeJson(clientIp string, value interface{}) {
+	resp, err := json.Marshal(value)
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to return retention details", util.ErrInternal)
+		return
+	}
+	_, _ = c.Ctx.ResponseWriter.Write(resp)
+}
+
+// @Title Get
+// @Description list retention policies, admin only
+// @Success 200 ok
+// @Failure 403 forbidden
+// @router /image-management/v1/retention-policies [GET]
+func (c *RetentionController) Get() {
+	c.logger().Info("Retention policy list request received.")
+	clientIp := c.Ctx.Input.IP()
+	if !c.checkAdmin(clientIp) {
+		return
+	}
+	var policies []*models.RetentionPolicy
+	_, err := c.Db.QueryTableWithFilters("retention_policy", &policies, map[string]interface{}{}, []string{"id"}, 0, 0)
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to query database",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return
+	}
+	if policies == nil {
+		policies = []*models.RetentionPolicy{}
+	}
+	c.writeJson(clientIp, map[string]interface{}{
+		"total":    len(policies),
+		"policies": policies,
+	})
+}
+
+// @Title Put
+// @Description create or replace the retention policy of a user or tenant, admin only
+// @Param	scope 	string	"user or tenant"
+// @Param	scopeId 	string
+// @Param	body 	body	RetentionPolicyRequest	true	"limits, zero disables a limit"
+// @Success 200 ok
+// @Failure 400 bad request
+// @Failure 403 forbidden
+// @router /image-management/v1/retention-policies/:scope/:scopeId [PUT]
+func (c *RetentionController) Put() {
+	c.logger().Info("Set retention policy request received.")
+	clientIp := c.Ctx.Input.IP()
+	if !c.checkAdmin(clientIp) {
+		return
+	}
+	scope := c.Ctx.Input.Param(":scope")
+	scopeId := c.Ctx.Input.Param(":scopeId")
+	var request RetentionPolicyRequest
+	decoder := json.NewDecoder(io.LimitReader(c.Ctx.Request.Body, util.MaxMetadataBodySize))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&request)
+	if err == nil {
+		err = util.ValidateRetentionPolicy(scope, scopeId, request.MaxIdleDays, request.MaxRevisions)
+	}
+	if err != nil {
+		c.HandleApiError(clientIp, util.BadRequest, err.Error(), util.ErrInvalidParameter.WithDetails(err.Error()))
+		return
+	}
+
+	policy := &models.RetentionPolicy{
+		Scope:        scope,
+		ScopeId:      scopeId,
+		MaxIdleDays:  request.MaxIdleDays,
+		MaxRevisions: request.MaxRevisions,
+		UpdatedBy:    c.GetString(util.UserId),
+	}
+	num, err := c.Db.UpdateWithFilters("retention_policy", map[string]interface{}{
+		"scope__exact":    scope,
+		"scope_id__exact": scopeId,
+	}, map[string]interface{}{
+		"max_idle_days": policy.MaxIdleDays,
+		"max_revisions": policy.MaxRevisions,
+		"updated_by":    policy.UpdatedBy,
+		"update_time":   time.Now(),
+	})
+	if err == nil && num == 0 {
+		err = c.Db.InsertData(policy)
+	}
+	if err != nil && err.Error() != util.LastInsertIdNotSupported {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to save retention policy",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return
+	}
+	var saved []*models.RetentionPolicy
+	_, err = c.Db.QueryTableWithFilters("retention_policy", &saved, map[string]interface{}{
+		"scope__exact":    scope,
+		"scope_id__exact": scopeId,
+	}, nil, 0, 0)
+	if err != nil || len(saved) == 0 {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to query database",
+			util.ErrDatabaseUnavailable.WithDetails("retention policy of "+scope+" "+scopeId+" wasn't saved"))
+		return
+	}
+	policy = saved[0]
+	c.logger().Info("retention policy of " + scope + " " + scopeId + " set to maxIdleDays=" +
+		strconv.FormatInt(policy.MaxIdleDays, 10) + " maxRevisions=" + strconv.FormatInt(policy.MaxRevisions, 10))
+	c.writeJson(clientIp, policy)
+}
+
+// @Title Delete
+// @Description remove the retention policy of a user or tenant, admin only
+// @Param	scope 	string	"user or tenant"
+// @Param	scopeId 	string
+// @Success 200 ok
+// @Failure 403 forbidden
+// @Failure 404 not found
+// @router /image-management/v1/retention-policies/:scope/:scopeId [DELETE]
+func (c *RetentionController) Delete() {
+	c.logger().Info("Delete retention policy request received.")
+	clientIp := c.Ctx.Input.IP()
+	if !c.checkAdmin(clientIp) {
+		return
+	}
+	scope := c.Ctx.Input.Param(":scope")
+	scopeId := c.Ctx.Input.Param(":scopeId")
+	num, err := c.Db.DeleteWithFilters("retention_policy", map[string]interface{}{
+		"scope__exact":    scope,
+		"scope_id__exact": scopeId,
+	})
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to delete retention policy",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return
+	}
+	if num == 0 {
+		c.HandleApiError(clientIp, util.StatusNotFound, "retention policy doesn't exist",
+			util.ErrPolicyNotFound.WithDetails(scope+" "+scopeId))
+		return
+	}
+	c.Ctx.WriteString("delete success")
+}
+
+// @Title Report
+// @Description dry run of the retention job listing the images it would move to trash, admin only
+// @Success 200 ok
+// @Failure 403 forbidden
+// @router /image-management/v1/retention-report [GET]
+func (c *RetentionController) Report() {
+	c.logger().Info("Retention report request received.")
+	clientIp := c.Ctx.Input.IP()
+	if !c.checkAdmin(clientIp) {
+		return
+	}
+	now := time.Now()
+	candidates, err := evaluateRetention(c.Db, now)
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to evaluate retention policies",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return
+	}
+	if candidates == nil {
+		candidates = []*RetentionCandidate{}
+	}
+	c.writeJson(clientIp, map[string]interface{}{
+		"evaluatedAt": now.Format(time.RFC3339),
+		"total":       len(candidates),
+		"candidates":  candidates,
+	})
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"encoding/json"
+	"fileSystem/models"
+	"fileSystem/util"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Seed images covering every retention rule, now is the time they are evaluated at
+func newRetentionTestDb(now time.Time) *fakeDb {
+	db := newFakeDb()
+	old := now.AddDate(0, 0, -40)
+	db.insert(&models.ImageDB{ImageId: "expired", UserId: "user2", UploadTime: now,
+		ExpireTime: now.Add(-time.Hour)})
+	db.insert(&models.ImageDB{ImageId: "future", UserId: "user2", UploadTime: now,
+		ExpireTime: now.Add(time.Hour)})
+	db.insert(&models.ImageDB{ImageId: "idle", UserId: "user1", UploadTime: old})
+	db.insert(&models.ImageDB{ImageId: "downloaded", UserId: "user1", UploadTime: old,
+		LastDownloadTime: now.AddDate(0, 0, -1)})
+	db.insert(&models.ImageDB{ImageId: "recent", UserId: "user1", UploadTime: now})
+	db.insert(&models.ImageDB{ImageId: "trashed", UserId: "user1", UploadTime: old,
+		Status: util.ImageStatusTrashed, TrashedTime: now})
+	db.insert(&models.RetentionPolicy{Scope: util.GranteeUser, ScopeId: "user1", MaxIdleDays: 30})
+
+	// tenant1 keeps one revision of ubuntu, revision 1 is kept by its alias
+	for i, imageId := range []string{"rev1", "rev2", "rev3"} {
+		db.insert(&models.ImageDB{ImageId: imageId, TenantId: "tenant1", UploadTime: now,
+			Status: util.ImageStatusActive})
+		db.insert(&models.ImageRevision{Name: "ubuntu", Revision: int64(i + 1), ImageId: imageId})
+	}
+	db.insert(&models.LogicalImage{Name: "ubuntu", TenantId: "tenant1", LatestRevision: 3})
+	db.insert(&models.ImageAlias{Name: "ubuntu", Alias: "stable", Revision: 1})
+	db.insert(&models.RetentionPolicy{Scope: util.GranteeTenant, ScopeId: "tenant1", MaxRevisions: 1})
+	return db
+}
+
+// Describe candidates as imageId:reason, with the skip reason when they are kept
+func describeCandidates(candidates []*RetentionCandidate) []string {
+	var got []string
+	for _, candidate := range candidates {
+		description := candidate.ImageId + ":" + candidate.Reason
+		if candidate.Skipped != "" {
+			description += ":" + candidate.Skipped
+		}
+		got = append(got, description)
+	}
+	sort.Strings(got)
+	return got
+}
+
+func TestEvaluateRetention(t *testing.T) {
+	now := time.Now()
+	candidates, err := evaluateRetention(newRetentionTestDb(now), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := describeCandidates(candidates)
+	want := []string{
+		"expired:" + util.RetentionReasonExpired,
+		"idle:" + util.RetentionReasonIdle,
+		"rev1:" + util.RetentionReasonRevisions + ":aliased as stable",
+		"rev2:" + util.RetentionReasonRevisions,
+	}
+	if !sameIds(got, want...) {
+		t.Fatalf("got candidates %v, want %v", got, want)
+	}
+}
+
+func TestRetentionJobTrashesCandidates(t *testing.T) {
+	db := newRetentionTestDb(time.Now())
+	if err := NewRetentionJob(db)(); err != nil {
+		t.Fatal(err)
+	}
+	var trashed []string
+	for _, row := range db.tables["image_d_b"] {
+		image := row.Interface().(*models.ImageDB)
+		if image.Status == util.ImageStatusTrashed && image.ImageId != "trashed" {
+			if image.TrashedBy != util.RetentionTrashedBy {
+				t.Fatalf("image %s trashed by %q", image.ImageId, image.TrashedBy)
+			}
+			trashed = append(trashed, image.ImageId)
+		}
+	}
+	sort.Strings(trashed)
+	if !sameIds(trashed, "expired", "idle", "rev2") {
+		t.Fatalf("got trashed images %v", trashed)
+	}
+	if events := db.tables["audit_event"]; len(events) != 3 {
+		t.Fatalf("got %d audit events, want one per trashed image", len(events))
+	}
+}
+
+// Serve a retention api request, action runs the controller method under test
+func serveRetention(db *fakeDb, method, url, body string, admin bool, params map[string]string,
+	action func(c *RetentionController)) (int, string) {
+	c := &RetentionController{BaseController{Db: db}}
+	req, rw := newTestRequest(c, method, url, strings.NewReader(body), params)
+	if admin {
+		req.Header.Set(util.AdminTokenHeader, testAdminToken)
+	}
+	action(c)
+	return rw.Code, rw.Body.String()
+}
+
+func TestRetentionReportIsDryRun(t *testing.T) {
+	useAdminToken(t)
+	db := newRetentionTestDb(time.Now())
+	url := "/image-management/v1/retention-report"
+	if code, _ := serveRetention(db, http.MethodGet, url, "", false, nil,
+		(*RetentionController).Report); code != util.StatusForbidden {
+		t.Fatalf("got status %d without the admin token, want %d", code, util.StatusForbidden)
+	}
+	code, body := serveRetention(db, http.MethodGet, url, "", true, nil, (*RetentionController).Report)
+	if code != util.StatusOK {
+		t.Fatalf("got status %d: %s", code, body)
+	}
+	var report struct {
+		Total int `json:"total"`
+	}
+	if err := json.Unmarshal([]byte(body), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Total != 4 {
+		t.Fatalf("got %d candidates, want 4", report.Total)
+	}
+	if image := readImage(t, db, "expired"); image.Status == util.ImageStatusTrashed {
+		t.Fatalf("report moved an image to trash")
+	}
+}
+
+func TestPutRetentionPolicy(t *testing.T) {
+	useAdminToken(t)
+	db := newFakeDb()
+	params := map[string]string{":scope": util.GranteeUser, ":scopeId": "user1"}
+	url := "/image-management/v1/retention-policies/user/user1?userId=admin"
+	put := func(body string) (int, *models.RetentionPolicy) {
+		code, resp := serveRetention(db, http.MethodPut, url, body, true, params, (*RetentionController).Put)
+		var policy models.RetentionPolicy
+		if code == util.StatusOK {
+			if err := json.Unmarshal([]byte(resp), &policy); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return code, &policy
+	}
+
+	code, policy := put(`{"maxIdleDays":30}`)
+	if code != util.StatusOK || policy.MaxIdleDays != 30 || policy.UpdatedBy != "admin" {
+		t.Fatalf("got status %d and policy %+v", code, policy)
+	}
+	code, policy = put(`{"maxRevisions":2}`)
+	if code != util.StatusOK || policy.MaxIdleDays != 0 || policy.MaxRevisions != 2 {
+		t.Fatalf("got status %d and replaced policy %+v", code, policy)
+	}
+	if rows := db.tables["retention_policy"]; len(rows) != 1 {
+		t.Fatalf("got %d policies, want the replaced one only", len(rows))
+	}
+	for _, body := range []string{`{}`, `{"maxIdleDays":-1}`, `{"maxDays":1}`} {
+		if code, _ = put(body); code != util.BadRequest {
+			t.Fatalf("got status %d for %s, want %d", code, body, util.BadRequest)
+		}
+	}
+
+	remove := func() int {
+		code, _ := serveRetention(db, http.MethodDelete, url, "", true, params, (*RetentionController).Delete)
+		return code
+	}
+	if code = remove(); code != util.StatusOK {
+		t.Fatalf("got status %d removing the policy", code)
+	}
+	if code = remove(); code != util.StatusNotFound {
+		t.Fatalf("got status %d removing a missing policy, want %d", code, util.StatusNotFound)
+	}
+}
@@ -0,0 +1,314 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// @Title  controllers
+// @Description  background scrubber re-hashing stored images to find files corrupted on disk
+// @Author  GuoZhen Gao (2021/6/30 10:40)
+package controllers
+
+import (
+	"errors"
+	"fileSystem/models"
+	"fileSystem/pkg/dbAdpater"
+	"fileSystem/pkg/envelope"
+	"fileSystem/pkg/storage"
+	"fileSystem/pkg/worker"
+	"fileSystem/util"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ScrubStats   Define the counters of the integrity scrubber since the service started
+type ScrubStats struct {
+	Runs           int64  `json:"runs"`
+	ImagesVerified int64  `json:"imagesVerified"`
+	BytesVerified  int64  `json:"bytesVerified"`
+	CorruptImages  int64  `json:"corruptImages"`
+	Errors         int64  `json:"errors"`
+	LastRun        string `json:"lastRun,omitempty"`
+}
+
+var scrubStats struct {
+	sync.Mutex
+	ScrubStats
+}
+
+// Get a snapshot of the scrubber counters
+func currentScrubStats() ScrubStats {
+	scrubStats.Lock()
+	defer scrubStats.Unlock()
+	return scrubStats.ScrubStats
+}
+
+// errScrubInterrupted ends a scrub run past its deadline or of a stopping service, the image being verified
+// is verified again by a later run
+var errScrubInterrupted = errors.New("scrub run was interrupted")
+
+// rateLimiter keeps the bytes read by a scrub run under a rate, so scrubbing doesn't starve downloads of disk,
+// and the run within its deadline
+type rateLimiter struct {
+	bytesPerSecond int64
+	start          time.Time
+	deadline       time.Time
+	read           int64
+}
+
+// Wait until n more bytes may be read, returns errScrubInterrupted once the run should end
+func (l *rateLimiter) wait(n int) error {
+	l.read += int64(n)
+	if err := l.interrupted(); err != nil {
+		return err
+	}
+	if l.bytesPerSecond <= 0 {
+		return nil
+	}
+	due := time.Duration(float64(l.read) / float64(l.bytesPerSecond) * float64(time.Second))
+	if sleep := due - time.Since(l.start); sleep > 0 {
+		timer := time.NewTimer(sleep)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-worker.Stopping():
+			return errScrubInterrupted
+		}
+	}
+	return nil
+}
+
+// Check whether the run is past its deadline or the service is stopping
+func (l *rateLimiter) interrupted() error {
+	select {
+	case <-worker.Stopping():
+		return errScrubInterrupted
+	default:
+	}
+	if time.Now().After(l.deadline) {
+		return errScrubInterrupted
+	}
+	return nil
+}
+
+// limitedReader reads at the rate of its limiter
+type limitedReader struct {
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if waitErr := r.limiter.wait(n); waitErr != nil {
+		return n, waitErr
+	}
+	return n, err
+}
+
+// scrubber is one run of the scrubber, blobs and chunks shared by several images are hashed once per run
+type scrubber struct {
+	BaseController
+	limiter  *rateLimiter
+	verified map[string]error
+}
+
+// Report whether a verification error means the stored image is damaged rather than unreadable for now
+func isCorrupt(err error) bool {
+	if _, ok := err.(*corruptionError); ok {
+		return true
+	}
+	return err == envelope.ErrCorrupt || err == errChunkMissing || os.IsNotExist(err)
+}
+
+// Hash r at the rate limit and compare it with the expected digest
+func (s *scrubber) checkDigest(r io.Reader, source, expected string) error {
+	digest, err := sha256Hex(&limitedReader{r: r, limiter: s.limiter})
+	if err != nil {
+		return err
+	}
+	if digest != expected {
+		return &corruptionError{source: source}
+	}
+	return nil
+}
+
+// Verify a blob or chunk against the digest it is stored under
+func (s *scrubber) checkStored(kind string, store *storage.BlobStore, digest string, encrypted bool) error {
+	if err, ok := s.verified[kind+digest]; ok {
+		return err
+	}
+	f, err := openStoredFile(store.Path(digest), encrypted)
+	if err == nil {
+		err = s.checkDigest(io.NewSectionReader(f, 0, f.Size()), kind+" "+digest, digest)
+		_ = f.Close()
+	}
+	s.verified[kind+digest] = err
+	return err
+}
+
+// Verify the stored bytes of an image against the digests of its chunks or blob
+func (s *scrubber) verify(image *models.ImageDB) error {
+	switch {
+	case image.Chunked:
+		chunks, err := queryImageChunks(s.Db, image.ImageId)
+		if err != nil {
+			return err
+		}
+		var size int64
+		for _, chunk := range chunks {
+			err = s.checkStored("chunk", chunkStore, chunk.Digest, chunk.Encrypted)
+			if err != nil {
+				return err
+			}
+			size += chunk.Size
+		}
+		if size != image.Size {
+			return errChunkMissing
+		}
+		return nil
+	case image.BlobDigest != "":
+		return s.checkStored("blob", blobStore, image.BlobDigest, image.Encrypted)
+	default:
+		// images of older releases are stored outside the blob store and verified against their checksum
+		content, err := s.openUploadedImage(image)
+		if err != nil {
+			return err
+		}
+		defer content.Close()
+		return s.checkDigest(content, image.FileName, image.Checksum)
+	}
+}
+
+// Mark an image corrupt so it isn't downloaded, the image is left as it is when it changed in between
+func markCorrupt(db dbAdpater.Database, image *models.ImageDB, cause error) error {
+	num, err := db.UpdateWithFilters("image_d_b", map[string]interface{}{
+		"image_id__exact":         image.ImageId,
+		"resource_version__exact": image.ResourceVersion,
+	}, map[string]interface{}{
+		"status":           util.ImageStatusCorrupt,
+		"resource_version": image.ResourceVersion + 1,
+		"update_time":      time.Now(),
+	})
+	if err != nil || num == 0 {
+		return err
+	}
+	log.Error("image " + image.ImageId + " is corrupt: " + cause.Error())
+	writeAuditEvent(db, &models.AuditEvent{
+		Action:  util.AuditActionScrub,
+		ImageId: image.ImageId,
+		Outcome: util.AuditOutcomeFailure,
+		Details: "corrupt: " + cause.Error(),
+	})
+	return nil
+}
+
+// Query the available images due for verification, images never verified first and then the ones verified
+// longest ago. Images of older releases without checksum have nothing to be verified against.
+func queryScrubImages(db dbAdpater.Database, limit int64) ([]*models.ImageDB, error) {
+	available := []string{"", util.ImageStatusActive}
+	var images []*models.ImageDB
+	_, err := db.QueryTableWithFilters("image_d_b", &images, map[string]interface{}{
+		"status__in":                 available,
+		"checksum__gt":               "",
+		"last_verified_time__isnull": true,
+	}, []string{"upload_time"}, limit, 0)
+	if err != nil || int64(len(images)) >= limit {
+		return images, err
+	}
+	age := util.GetAppConfigInt64("scrubAgeHours", util.DefaultScrubAgeHours)
+	var verified []*models.ImageDB
+	_, err = db.QueryTableWithFilters("image_d_b", &verified, map[string]interface{}{
+		"status__in":              available,
+		"checksum__gt":            "",
+		"last_verified_time__lte": time.Now().Add(-time.Duration(age) * time.Hour),
+	}, []string{"last_verified_time"}, limit-int64(len(images)), 0)
+	return append(images, verified...), err
+}
+
+// NewScrubJob   Create the background job re-hashing stored images at a limited rate, images which don't
+// match their digests are marked corrupt. A run ends after scrubMaxRunMinutes or when the service stops,
+// the images left are verified by the next run.
+func NewScrubJob(db dbAdpater.Database) worker.Job {
+	return func() error {
+		limit := util.GetAppConfigInt64("scrubBatchSize", util.DefaultScrubBatchSize)
+		images, err := queryScrubImages(db, limit)
+		if err != nil {
+			return err
+		}
+		rate := util.GetAppConfigInt64("scrubRateMBps", util.DefaultScrubRateMBps)
+		start := time.Now()
+		s := &scrubber{
+			BaseController: BaseController{Db: db},
+			limiter: &rateLimiter{
+				bytesPerSecond: rate << 20,
+				start:          start,
+				deadline:       start.Add(util.GetAppConfigMinutes("scrubMaxRunMinutes", util.DefaultScrubMaxRunMins)),
+			},
+			verified: map[string]error{},
+		}
+		var verifiedCount, corruptCount, errorCount int64
+		interrupted := false
+		for _, image := range images {
+			err := s.limiter.interrupted()
+			if err == nil {
+				err = s.verify(image)
+			}
+			if err == errScrubInterrupted {
+				interrupted = true
+				break
+			}
+			switch {
+			case err == nil:
+				verifiedCount++
+				_, err = db.UpdateWithFilters("image_d_b", map[string]interface{}{"image_id__exact": image.ImageId},
+					map[string]interface{}{"last_verified_time": time.Now()})
+			case isCorrupt(err):
+				corruptCount++
+				err = markCorrupt(db, image, err)
+			}
+			if err != nil {
+				// an unreadable image is tried again on the next run
+				errorCount++
+				log.Error("fail to verify image " + image.ImageId + ": " + err.Error())
+			}
+		}
+
+		scrubStats.Lock()
+		scrubStats.Runs++
+		scrubStats.ImagesVerified += verifiedCount
+		scrubStats.BytesVerified += s.limiter.read
+		scrubStats.CorruptImages += corruptCount
+		scrubStats.Errors += errorCount
+		scrubStats.LastRun = time.Now().Format("2006-01-02 15:04:05")
+		scrubStats.Unlock()
+
+		details := "verified=" + strconv.FormatInt(verifiedCount, 10) +
+			" bytes=" + strconv.FormatInt(s.limiter.read, 10) +
+			" corrupt=" + strconv.FormatInt(corruptCount, 10) +
+			" errors=" + strconv.FormatInt(errorCount, 10) +
+			" interrupted=" + strconv.FormatBool(interrupted)
+		outcome := util.AuditOutcomeSuccess
+		if errorCount > 0 {
+			outcome = util.AuditOutcomeFailure
+		}
+		writeAuditEvent(db, &models.AuditEvent{Action: util.AuditActionScrub, Outcome: outcome, Details: details})
+		if len(images) > 0 {
+			log.Info("scrub run of " + strconv.Itoa(len(images)) + " images: " + details)
+		}
+		return nil
+	}
+}
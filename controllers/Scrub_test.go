@@ -0,0 +1,158 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"encoding/json"
+	"fileSystem/models"
+	"fileSystem/util"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Store a blob under the given digest, which doesn't match data for a corrupt blob
+func writeTestBlob(t *testing.T, digest string, data []byte) {
+	t.Helper()
+	if _, err := blobStore.Write(digest, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScrubJobMarksCorruptImages(t *testing.T) {
+	useTestStores(t)
+	setTestConfig(t, "scrubRateMBps", "0")
+	db := newFakeDb()
+	good, bad := checksumOf([]byte("good")), checksumOf([]byte("bad"))
+	writeTestBlob(t, good, []byte("good"))
+	writeTestBlob(t, bad, []byte("rotten"))
+	for _, image := range []*models.ImageDB{
+		{ImageId: "good", Status: util.ImageStatusActive, Checksum: "c1", BlobDigest: good},
+		{ImageId: "bad", Status: util.ImageStatusActive, Checksum: "c2", BlobDigest: bad, ResourceVersion: 1},
+		// nothing to verify an image of an older release without checksum against
+		{ImageId: "legacy", Status: util.ImageStatusActive, BlobDigest: bad},
+	} {
+		if err := db.InsertData(image); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := NewScrubJob(db)(); err != nil {
+		t.Fatal(err)
+	}
+
+	images := map[string]*models.ImageDB{}
+	for _, id := range []string{"good", "bad", "legacy"} {
+		images[id] = &models.ImageDB{ImageId: id}
+		if err := db.ReadData(images[id]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if images["good"].Status != util.ImageStatusActive || images["good"].LastVerifiedTime.IsZero() {
+		t.Fatalf("intact image wasn't recorded as verified: %+v", images["good"])
+	}
+	if images["bad"].Status != util.ImageStatusCorrupt || images["bad"].ResourceVersion != 2 {
+		t.Fatalf("corrupt image wasn't marked corrupt: %+v", images["bad"])
+	}
+	if images["legacy"].Status != util.ImageStatusActive || !images["legacy"].LastVerifiedTime.IsZero() {
+		t.Fatalf("image without checksum was scrubbed: %+v", images["legacy"])
+	}
+
+	var events []*models.AuditEvent
+	_, err := db.QueryTableWithFilters("audit_event", &events,
+		map[string]interface{}{"action__exact": util.AuditActionScrub}, []string{"id"}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].ImageId != "bad" || events[0].Outcome != util.AuditOutcomeFailure {
+		t.Fatalf("corrupt image wasn't audited: %+v", events)
+	}
+	run := events[1]
+	if run.Outcome != util.AuditOutcomeSuccess ||
+		!strings.HasPrefix(run.Details, "verified=1 bytes=10 corrupt=1 errors=0 interrupted=false") {
+		t.Fatalf("unexpected audit event of the run: %+v", run)
+	}
+}
+
+func TestScrubJobVerifiesOnlyImagesDue(t *testing.T) {
+	useTestStores(t)
+	setTestConfig(t, "scrubRateMBps", "0")
+	db := newFakeDb()
+	digest := checksumOf([]byte("good"))
+	writeTestBlob(t, digest, []byte("good"))
+	verified := time.Now().Add(-time.Hour)
+	err := db.InsertData(&models.ImageDB{ImageId: "recent", Checksum: "c", BlobDigest: digest,
+		LastVerifiedTime: verified})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = NewScrubJob(db)(); err != nil {
+		t.Fatal(err)
+	}
+	image := &models.ImageDB{ImageId: "recent"}
+	if err = db.ReadData(image); err != nil {
+		t.Fatal(err)
+	}
+	if !image.LastVerifiedTime.Equal(verified) {
+		t.Fatal("image verified within scrubAgeHours was verified again")
+	}
+}
+
+func TestRateLimiterStopsPastDeadline(t *testing.T) {
+	limiter := &rateLimiter{start: time.Now(), deadline: time.Now().Add(-time.Second)}
+	if err := limiter.wait(1); err != errScrubInterrupted {
+		t.Fatalf("got %v, want errScrubInterrupted", err)
+	}
+}
+
+func TestRateLimiterThrottles(t *testing.T) {
+	limiter := &rateLimiter{bytesPerSecond: 1 << 20, start: time.Now(), deadline: time.Now().Add(time.Minute)}
+	begin := time.Now()
+	if err := limiter.wait(100 << 10); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(begin); elapsed < 80*time.Millisecond {
+		t.Fatalf("100KB at 1MB/s took only %v", elapsed)
+	}
+}
+
+func TestListCorruptImagesRequiresAdmin(t *testing.T) {
+	useAdminToken(t)
+	db := newFakeDb()
+	db.insert(&models.ImageDB{ImageId: "good", Status: util.ImageStatusActive})
+	db.insert(&models.ImageDB{ImageId: "bad", Status: util.ImageStatusCorrupt})
+
+	c := &UploadController{BaseController{Db: db}}
+	_, rw := newTestRequest(c, http.MethodGet, "/image-management/v1/images?status=corrupt", nil, nil)
+	c.Get()
+	if rw.Code != util.StatusForbidden {
+		t.Fatalf("got status %d without admin token, want %d", rw.Code, util.StatusForbidden)
+	}
+	c = &UploadController{BaseController{Db: db}}
+	req, rw := newTestRequest(c, http.MethodGet, "/image-management/v1/images?status=corrupt", nil, nil)
+	req.Header.Set(util.AdminTokenHeader, testAdminToken)
+	c.Get()
+	var result struct {
+		Images []*ImageDetail `json:"images"`
+	}
+	if err := json.Unmarshal(rw.Body.Bytes(), &result); err != nil || len(result.Images) != 1 ||
+		result.Images[0].ImageId != "bad" {
+		t.Fatalf("got status %d and %s, want the corrupt image", rw.Code, rw.Body.String())
+	}
+}
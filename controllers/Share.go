@@ -0,0 +1,386 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// @Title  controllers
+// @Description  image visibility and sharing api for filesystem
+// @Author  GuoZhen Gao (2021/6/30 10:40)
+package controllers
+
+import (
+	"encoding/json"
+	"fileSystem/models"
+	"fileSystem/util"
+	"io"
+	"strconv"
+)
+
+// access levels of a caller to an image, ordered from least to most
+const (
+	accessNone = iota
+	accessRead
+	accessReadWrite
+	accessOwner
+)
+
+// ShareController   Define the controller to manage share grants of an image
+type ShareController struct {
+	BaseController
+}
+
+// ShareRequest   Define the body to grant access to an image
+type ShareRequest struct {
+	GranteeType string `json:"granteeType"`
+	GranteeId   string `json:"granteeId"`
+	Permission  string `json:"permission"`
+}
+
+// Get the visibility of an image, images without one use the configured default
+func effectiveVisibility(image *models.ImageDB) string {
+	if image.Visibility == "" {
+		return util.GetDefaultVisibility()
+	}
+	return image.Visibility
+}
+
+// Query the best permission granted to the caller for each of the images
+func (c *BaseController) callerGrants(imageIds []string) (map[string]string, error) {
+	grants := map[string]string{}
+	userId := c.GetString(util.UserId)
+	tenantId := c.GetString(util.TenantId)
+	if len(imageIds) == 0 || (userId == "" && tenantId == "") {
+		return grants, nil
+	}
+	var shares []*models.ImageShare
+	_, err := c.Db.QueryTableWithFilters("image_share", &shares, map[string]interface{}{
+		"image_id__in":   imageIds,
+		"grantee_id__in": []string{userId, tenantId},
+	}, nil, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, share := range shares {
+		matched := (share.GranteeType == util.GranteeUser && share.GranteeId == userId && userId != "") ||
+			(share.GranteeType == util.GranteeTenant && share.GranteeId == tenantId && tenantId != "")
+		if matched && grants[share.ImageId] != util.PermissionReadWrite {
+			grants[share.ImageId] = share.Permission
+		}
+	}
+	return grants, nil
+}
+
+// Get the caller's access to an image from ownership, visibility and the caller's grants
+func (c *BaseController) accessFromGrants(image *models.ImageDB, grants map[string]string) int {
+	if c.isAdmin() {
+		return accessOwner
+	}
+	userId := c.GetString(util.UserId)
+	if userId != "" && userId == image.UserId {
+		return accessOwner
+	}
+	visibility := effectiveVisibility(image)
+	if visibility == util.VisibilityPrivate {
+		return accessNone
+	}
+	access := accessNone
+	if visibility == util.VisibilityPublic {
+		access = accessRead
+	}
+	switch grants[image.ImageId] {
+	case util.PermissionReadWrite:
+		access = accessReadWrite
+	case util.PermissionRead:
+		if access < accessRead {
+			access = accessRead
+		}
+	}
+	return access
+}
+
+// Check the caller has at least the required access, the error response is written otherwise
+func (c *BaseController) checkImageAccess(clientIp string, image *models.ImageDB, required int) bool {
+	grants, err := c.callerGrants([]string{image.ImageId})
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to query database",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return false
+	}
+	if c.accessFromGrants(image, grants) < required {
+		c.HandleApiError(clientIp, util.StatusForbidden, "no permission to access this image",
+			util.ErrForbidden.WithDetails("imageId "+image.ImageId))
+		return false
+	}
+	return true
+}
+
+// Keep only the images the caller may read
+func (c *BaseController) filterReadableImages(images []*models.ImageDB) ([]*models.ImageDB, error) {
+	imageIds := make([]string, 0, len(images))
+	for _, image := range images {
+		imageIds = append(imageIds, image.ImageId)
+	}
+	grants, err := c.callerGrants(imageIds)
+	if err != nil {
+		return nil, err
+	}
+	readable := make([]*models.ImageDB, 0, len(images))
+	for _, image := range images {
+		if c.accessFromGrants(image, grants) >= accessRead {
+			readable = append(readable, image)
+		}
+	}
+	return readable, nil
+}
+
+// Report whether the request is a v1 request naming no caller, which keeps the behavior of releases before
+// visibility so existing clients aren't refused
+func (c *BaseController) isLegacyCaller() bool {
+	return !c.isApiV2() && c.GetString(util.UserId) == "" && c.GetString(util.TenantId) == ""
+}
+
+// Get the visibilities of images matching the given ones, images without visibility have the default one
+func visibilitiesMatching(visibilities ...string) []string {
+	matching := append([]string{}, visibilities...)
+	for _, visibility := range visibilities {
+		if visibility == util.GetDefaultVisibility() {
+			matching = append(matching, "")
+		}
+	}
+	return matching
+}
+
+// Build the conditions of the images the caller may read, any of them grants read access. They follow
+// accessFromGrants so image lists can be filtered and paginated by the database. Admins get no conditions.
+func (c *BaseController) readableConditions() ([]map[string]interface{}, error) {
+	if c.isAdmin() {
+		return nil, nil
+	}
+	conditions := []map[string]interface{}{
+		{"visibility__in": visibilitiesMatching(util.VisibilityPublic)},
+	}
+	userId := c.GetString(util.UserId)
+	tenantId := c.GetString(util.TenantId)
+	if userId != "" {
+		conditions = append(conditions, map[string]interface{}{"user_id__exact": userId})
+	}
+	if userId == "" && tenantId == "" {
+		return conditions, nil
+	}
+	var shares []*models.ImageShare
+	_, err := c.Db.QueryTableWithFilters("image_share", &shares,
+		map[string]interface{}{"grantee_id__in": []string{userId, tenantId}}, nil, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	granted := make([]string, 0, len(shares))
+	for _, share := range shares {
+		if (share.GranteeType == util.GranteeUser && share.GranteeId == userId && userId != "") ||
+			(share.GranteeType == util.GranteeTenant && share.GranteeId == tenantId && tenantId != "") {
+			granted = append(granted, share.ImageId)
+		}
+	}
+	if len(granted) > 0 {
+		// grants give no access to private images
+		conditions = append(conditions, map[string]interface{}{
+			"image_id__in":   granted,
+			"visibility__in": visibilitiesMatching(util.VisibilityShared, util.VisibilityPublic),
+		})
+	}
+	return conditions, nil
+}
+
+// Query the image and check the caller owns it, the error response is written otherwise
+func (c *ShareController) queryOwnedImage(clientIp string) (*models.ImageDB, bool) {
+	imageId := c.Ctx.Input.Param(":imageId")
+	image, ok := c.queryImage(clientIp, imageId, "fail to query this imageId in database")
+	if !ok {
+		return nil, false
+	}
+	if !c.checkImageAccess(clientIp, image, accessOwner) {
+		return nil, false
+	}
+	return image, true
+}
+
+// @Title Get
+// @Description list share grants of an image, owner only
+// @Param	imageId 	string
+// @Success 200 ok
+// @Failure 403 forbidden
+// @router /image-management/v1/images/:imageId/shares [GET]
+func (c *ShareController) Get() {
+	c.logger().Info("Query image shares request received.")
+	clientIp := c.Ctx.Input.IP()
+	err := util.ValidateSrcAddress(clientIp)
+	if err != nil {
+		c.HandleApiError(clientIp, util.BadRequest, util.ClientIpaddressInvalid, util.ErrInvalidClientIp)
+		return
+	}
+	c.displayReceivedMsg(clientIp)
+
+	image, ok := c.queryOwnedImage(clientIp)
+	if !ok {
+		return
+	}
+	var shares []*models.ImageShare
+	_, err = c.Db.QueryTableWithFilters("image_share", &shares,
+		map[string]interface{}{"image_id__exact": image.ImageId}, []string{"id"}, 0, 0)
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to query database",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return
+	}
+	if shares == nil {
+		shares = []*models.ImageShare{}
+	}
+	shareResp, err := json.Marshal(map[string]interface{}{
+		"imageId":    image.ImageId,
+		"visibility": effectiveVisibility(image),
+		"shares":     shares,
+	})
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to return share details", util.ErrInternal)
+		return
+	}
+	_, _ = c.Ctx.ResponseWriter.Write(shareResp)
+}
+
+// @Title Post
+// @Description grant a user or tenant read or read-write access to an image, owner only
+// @Param	imageId 	string
+// @Param	body 		body	ShareRequest	true	"grant"
+// @Success 200 ok
+// @Failure 400 bad request
+// @Failure 403 forbidden
+// @router /image-management/v1/images/:imageId/shares [POST]
+func (c *ShareController) Post() {
+	c.logger().Info("Share image request received.")
+	c.auditAs(util.AuditActionShare)
+	clientIp := c.Ctx.Input.IP()
+	err := util.ValidateSrcAddress(clientIp)
+	if err != nil {
+		c.HandleApiError(clientIp, util.BadRequest, util.ClientIpaddressInvalid, util.ErrInvalidClientIp)
+		return
+	}
+	c.displayReceivedMsg(clientIp)
+
+	image, ok := c.queryOwnedImage(clientIp)
+	if !ok {
+		return
+	}
+
+	var request ShareRequest
+	decoder := json.NewDecoder(io.LimitReader(c.Ctx.Request.Body, util.MaxMetadataBodySize))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&request)
+	if err != nil {
+		c.HandleApiError(clientIp, util.BadRequest, "request body is invalid",
+			util.ErrInvalidParameter.WithDetails(err.Error()))
+		return
+	}
+	err = util.ValidateShareGrant(request.GranteeType, request.GranteeId, request.Permission)
+	if err != nil {
+		c.HandleApiError(clientIp, util.BadRequest, err.Error(), util.ErrInvalidParameter.WithDetails(err.Error()))
+		return
+	}
+
+	var existing []*models.ImageShare
+	_, err = c.Db.QueryTableWithFilters("image_share", &existing, map[string]interface{}{
+		"image_id__exact":     image.ImageId,
+		"grantee_type__exact": request.GranteeType,
+		"grantee_id__exact":   request.GranteeId,
+	}, nil, 0, 0)
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to query database",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return
+	}
+	share := &models.ImageShare{
+		ImageId:     image.ImageId,
+		GranteeType: request.GranteeType,
+		GranteeId:   request.GranteeId,
+	}
+	if len(existing) > 0 {
+		share = existing[0]
+	}
+	share.Permission = request.Permission
+	share.GrantedBy = c.GetString(util.UserId)
+	if share.Id == 0 {
+		err = c.Db.InsertData(share)
+	} else {
+		err = c.Db.InsertOrUpdateData(share, "id")
+	}
+	if err != nil && err.Error() != util.LastInsertIdNotSupported {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to save share grant",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return
+	}
+	c.recordAudit(util.AuditActionShare, image.ImageId, util.AuditOutcomeSuccess,
+		request.GranteeType+"="+request.GranteeId+" permission="+request.Permission)
+
+	shareResp, err := json.Marshal(share)
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to return share details", util.ErrInternal)
+		return
+	}
+	_, _ = c.Ctx.ResponseWriter.Write(shareResp)
+}
+
+// @Title Delete
+// @Description revoke a share grant of an image, owner only
+// @Param	imageId 	string
+// @Param	shareId 	int
+// @Success 200 ok
+// @Failure 403 forbidden
+// @Failure 404 not found
+// @router /image-management/v1/images/:imageId/shares/:shareId [DELETE]
+func (c *ShareController) Delete() {
+	c.logger().Info("Revoke image share request received.")
+	c.auditAs(util.AuditActionUnshare)
+	clientIp := c.Ctx.Input.IP()
+	err := util.ValidateSrcAddress(clientIp)
+	if err != nil {
+		c.HandleApiError(clientIp, util.BadRequest, util.ClientIpaddressInvalid, util.ErrInvalidClientIp)
+		return
+	}
+	c.displayReceivedMsg(clientIp)
+
+	shareId, err := strconv.ParseInt(c.Ctx.Input.Param(":shareId"), 10, 64)
+	if err != nil {
+		c.HandleApiError(clientIp, util.BadRequest, "shareId is invalid", util.ErrInvalidParameter.WithDetails("shareId"))
+		return
+	}
+	image, ok := c.queryOwnedImage(clientIp)
+	if !ok {
+		return
+	}
+	num, err := c.Db.DeleteWithFilters("image_share", map[string]interface{}{
+		"id__exact":       shareId,
+		"image_id__exact": image.ImageId,
+	})
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to delete share grant",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return
+	}
+	if num == 0 {
+		c.HandleApiError(clientIp, util.StatusNotFound, "share doesn't exist",
+			util.ErrShareNotFound.WithDetails("shareId "+strconv.FormatInt(shareId, 10)))
+		return
+	}
+	c.recordAudit(util.AuditActionUnshare, image.ImageId, util.AuditOutcomeSuccess,
+		"shareId="+strconv.FormatInt(shareId, 10))
+	c.Ctx.WriteString("delete success")
+}
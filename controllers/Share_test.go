@@ -0,0 +1,171 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"encoding/json"
+	"fileSystem/models"
+	"fileSystem/util"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func newShareTestDb() *fakeDb {
+	db := newFakeDb()
+	db.insert(&models.ImageDB{ImageId: "image1", UserId: "owner", Visibility: util.VisibilityShared})
+	return db
+}
+
+// Serve a share api request of image1 as the given user
+func serveShare(db *fakeDb, method, query, body string, params map[string]string) (int, string) {
+	c := &ShareController{BaseController{Db: db}}
+	if params == nil {
+		params = map[string]string{}
+	}
+	params[":imageId"] = "image1"
+	_, rw := newTestRequest(c, method, "/image-management/v1/images/image1/shares?"+query,
+		strings.NewReader(body), params)
+	switch method {
+	case http.MethodPost:
+		c.Post()
+	case http.MethodDelete:
+		c.Delete()
+	default:
+		c.Get()
+	}
+	return rw.Code, rw.Body.String()
+}
+
+// Query image1 as the given user, returns the status
+func getImageAs(db *fakeDb, query string) int {
+	c := &ImageController{BaseController{Db: db}}
+	_, rw := newTestRequest(c, http.MethodGet, "/image-management/v1/images/image1?"+query, nil,
+		map[string]string{":imageId": "image1"})
+	c.Get()
+	return rw.Code
+}
+
+func TestAccessFromGrants(t *testing.T) {
+	useAdminToken(t)
+	tests := []struct {
+		name       string
+		query      string
+		admin      bool
+		visibility string
+		grant      string
+		want       int
+	}{
+		{"owner of private", "userId=owner", false, util.VisibilityPrivate, "", accessOwner},
+		{"admin", "", true, util.VisibilityPrivate, "", accessOwner},
+		{"private ignores grants", "userId=other", false, util.VisibilityPrivate, util.PermissionReadWrite,
+			accessNone},
+		{"shared without grant", "userId=other", false, util.VisibilityShared, "", accessNone},
+		{"shared read", "userId=other", false, util.VisibilityShared, util.PermissionRead, accessRead},
+		{"public", "", false, util.VisibilityPublic, "", accessRead},
+		{"public read-write", "userId=other", false, util.VisibilityPublic, util.PermissionReadWrite,
+			accessReadWrite},
+		{"default visibility", "", false, "", "", accessRead},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &BaseController{Db: newFakeDb()}
+			req, _ := newTestRequest(c, http.MethodGet, "/image-management/v1/images/image1?"+tt.query, nil, nil)
+			if tt.admin {
+				req.Header.Set(util.AdminTokenHeader, testAdminToken)
+			}
+			image := &models.ImageDB{ImageId: "image1", UserId: "owner", Visibility: tt.visibility}
+			got := c.accessFromGrants(image, map[string]string{"image1": tt.grant})
+			if got != tt.want {
+				t.Fatalf("got access %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShareGrantsAndRevokesAccess(t *testing.T) {
+	db := newShareTestDb()
+	if code := getImageAs(db, "userId=user2"); code != util.StatusForbidden {
+		t.Fatalf("got status %d before the grant, want %d", code, util.StatusForbidden)
+	}
+
+	code, body := serveShare(db, http.MethodPost, "userId=owner",
+		`{"granteeType":"user","granteeId":"user2","permission":"read"}`, nil)
+	if code != util.StatusOK {
+		t.Fatalf("got status %d: %s", code, body)
+	}
+	var share models.ImageShare
+	if err := json.Unmarshal([]byte(body), &share); err != nil {
+		t.Fatal(err)
+	}
+	if code = getImageAs(db, "userId=user2"); code != util.StatusOK {
+		t.Fatalf("got status %d after the grant, want %d", code, util.StatusOK)
+	}
+	if code = getImageAs(db, "userId=user3"); code != util.StatusForbidden {
+		t.Fatalf("got status %d for another user, want %d", code, util.StatusForbidden)
+	}
+
+	code, body = serveShare(db, http.MethodDelete, "userId=owner", "",
+		map[string]string{":shareId": "1"})
+	if code != util.StatusOK || share.Id != 1 {
+		t.Fatalf("got status %d revoking share %d: %s", code, share.Id, body)
+	}
+	if code = getImageAs(db, "userId=user2"); code != util.StatusForbidden {
+		t.Fatalf("got status %d after the revoke, want %d", code, util.StatusForbidden)
+	}
+}
+
+func TestShareByTenantUpdatesGrant(t *testing.T) {
+	db := newShareTestDb()
+	for _, permission := range []string{util.PermissionRead, util.PermissionReadWrite} {
+		code, body := serveShare(db, http.MethodPost, "userId=owner",
+			`{"granteeType":"tenant","granteeId":"tenant1","permission":"`+permission+`"}`, nil)
+		if code != util.StatusOK {
+			t.Fatalf("got status %d: %s", code, body)
+		}
+	}
+	var shares []*models.ImageShare
+	_, _ = db.QueryTableWithFilters("image_share", &shares, nil, nil, 0, 0)
+	if len(shares) != 1 || shares[0].Permission != util.PermissionReadWrite {
+		t.Fatalf("grant wasn't updated in place: %d grants", len(shares))
+	}
+	if code := getImageAs(db, "userId=user2&tenantId=tenant1"); code != util.StatusOK {
+		t.Fatalf("got status %d for a member of the tenant, want %d", code, util.StatusOK)
+	}
+}
+
+func TestShareRequiresOwner(t *testing.T) {
+	db := newShareTestDb()
+	db.insert(&models.ImageShare{ImageId: "image1", GranteeType: util.GranteeUser, GranteeId: "user2",
+		Permission: util.PermissionReadWrite})
+	code, _ := serveShare(db, http.MethodPost, "userId=user2",
+		`{"granteeType":"user","granteeId":"user3","permission":"read"}`, nil)
+	if code != util.StatusForbidden {
+		t.Fatalf("got status %d for a read-write grantee, want %d", code, util.StatusForbidden)
+	}
+	if code, _ = serveShare(db, http.MethodGet, "userId=user3", "", nil); code != util.StatusForbidden {
+		t.Fatalf("got status %d listing grants of another user's image, want %d", code, util.StatusForbidden)
+	}
+}
+
+func TestShareRejectsInvalidGrant(t *testing.T) {
+	code, _ := serveShare(newShareTestDb(), http.MethodPost, "userId=owner",
+		`{"granteeType":"group","granteeId":"g","permission":"read"}`, nil)
+	if code != util.BadRequest {
+		t.Fatalf("got status %d, want %d", code, util.BadRequest)
+	}
+}
@@ -0,0 +1,209 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// @Title  controllers
+// @Description  detached image signatures, their verification against the trust store and the download policy
+// @Author  GuoZhen Gao (2021/6/30 10:40)
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fileSystem/models"
+	"fileSystem/pkg/signing"
+	"fileSystem/util"
+	"io"
+	"time"
+)
+
+var errNoChecksum = errors.New("image has no checksum to verify a signature against")
+
+// trust store of uploads and downloads, read again only when its key files change
+var trustStore signing.TrustStoreCache
+
+// SignatureRequest   Define the detached signature of an image, base64 encoded, empty removes the signature
+type SignatureRequest struct {
+	Signature string `json:"signature"`
+}
+
+// Get the signature status of an image, images of older releases are unsigned
+func signatureStatus(image *models.ImageDB) string {
+	if image.SignatureStatus == "" {
+		return util.SignatureUnsigned
+	}
+	return image.SignatureStatus
+}
+
+// Verify a detached signature of the checksum of an image against the trust store and record the outcome on
+// the image. An empty signature leaves the image unsigned, one no trusted key verifies leaves it untrusted.
+func verifyImageSignature(image *models.ImageDB, encoded string) error {
+	if encoded == "" {
+		image.Signature, image.Signer, image.SignatureStatus = "", "", util.SignatureUnsigned
+		return nil
+	}
+	signature, err := signing.DecodeSignature(encoded)
+	if err != nil {
+		return err
+	}
+	digest, err := hex.DecodeString(image.Checksum)
+	if err != nil || len(digest) != sha256.Size {
+		return errNoChecksum
+	}
+	store, err := trustStore.Load(util.GetAppConfig("trustStorePath"))
+	if err != nil {
+		return err
+	}
+	image.Signature = base64.StdEncoding.EncodeToString(signature)
+	image.Signer, err = store.Verify(digest, signature)
+	if err == signing.ErrNoTrustedKey {
+		image.SignatureStatus = util.SignatureUntrusted
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	image.SignatureStatus = util.SignatureVerified
+	return nil
+}
+
+// Write the error response of a signature which couldn't be verified
+func (c *BaseController) handleSignatureError(clientIp string, err error) {
+	if err == signing.ErrMalformedSignature || err == errNoChecksum {
+		c.HandleApiError(clientIp, util.BadRequest, err.Error(), util.ErrInvalidSignature.WithDetails(err.Error()))
+		return
+	}
+	c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to load trust store",
+		util.ErrInternal.WithDetails(err.Error()))
+}
+
+// Verify the signature field of an upload, the error response is written otherwise
+func (c *BaseController) applySignature(clientIp string, image *models.ImageDB) bool {
+	err := verifyImageSignature(image, c.GetString(util.Signature))
+	if err != nil {
+		c.handleSignatureError(clientIp, err)
+		return false
+	}
+	return true
+}
+
+// Check an image may be downloaded under the signature policy, the error response is written otherwise.
+// Signatures are verified again, so removing a key from the trust store revokes the images it signed.
+func (c *BaseController) checkSignaturePolicy(clientIp string, image *models.ImageDB) bool {
+	if !util.RequireSignedImages() {
+		return true
+	}
+	verified := *image
+	err := verifyImageSignature(&verified, image.Signature)
+	if err != nil {
+		c.logger().Error("fail to verify signature of image " + image.ImageId + ": " + err.Error())
+	}
+	if err != nil || verified.SignatureStatus != util.SignatureVerified {
+		c.HandleApiError(clientIp, util.StatusForbidden, "image isn't signed by a trusted key",
+			util.ErrSignatureRequired.WithDetails("imageId "+image.ImageId+" signature is "+signatureStatus(&verified)))
+		return false
+	}
+	return true
+}
+
+// @Title PutSignature
+// @Description attach a detached signature to an image or replace it, owner only. The signature is verified
+// against the trust store, putting it again after the trust store changed verifies it again.
+// @Param	imageId 	string
+// @Param	body 	body	string	true	"json with the base64 signature, empty removes it"
+// @Success 200 ok
+// @Failure 400 bad request
+// @Failure 403 forbidden
+// @router /image-management/v1/images/:imageId/signature [PUT]
+func (this *ImageController) PutSignature() {
+	this.logger().Info("Put image signature request received.")
+	this.auditAs(util.AuditActionSign)
+	clientIp := this.Ctx.Input.IP()
+	err := util.ValidateSrcAddress(clientIp)
+	if err != nil {
+		this.HandleApiError(clientIp, util.BadRequest, util.ClientIpaddressInvalid, util.ErrInvalidClientIp)
+		return
+	}
+	this.displayReceivedMsg(clientIp)
+
+	imageId := this.Ctx.Input.Param(":imageId")
+	image, ok := this.queryImage(clientIp, imageId, "fail to query this imageId in database")
+	if !ok || !this.checkImageAccess(clientIp, image, accessOwner) {
+		return
+	}
+	if !imageAvailable(image) {
+		this.HandleApiError(clientIp, util.StatusConflict, "image is not available",
+			util.ErrImageNotAvailable.WithDetails("image status is "+image.Status))
+		return
+	}
+	var request SignatureRequest
+	decoder := json.NewDecoder(io.LimitReader(this.Ctx.Request.Body, util.MaxMetadataBodySize))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&request)
+	if err != nil {
+		this.HandleApiError(clientIp, util.BadRequest, "request body is invalid",
+			util.ErrInvalidParameter.WithDetails(err.Error()))
+		return
+	}
+	err = verifyImageSignature(image, request.Signature)
+	if err != nil {
+		this.handleSignatureError(clientIp, err)
+		return
+	}
+
+	num, err := this.Db.UpdateWithFilters("image_d_b", map[string]interface{}{
+		"image_id__exact":         imageId,
+		"resource_version__exact": image.ResourceVersion,
+	}, map[string]interface{}{
+		"signature":        image.Signature,
+		"signer":           image.Signer,
+		"signature_status": image.SignatureStatus,
+		"resource_version": image.ResourceVersion + 1,
+		"update_time":      time.Now(),
+	})
+	if err == nil && num == 0 {
+		this.HandleApiError(clientIp, util.StatusPreconditionFailed, "image was modified, try again",
+			util.ErrPreconditionFailed.WithDetails(errConcurrentModification.Error()))
+		return
+	}
+	if err != nil {
+		this.HandleApiError(clientIp, util.StatusInternalServerError, "fail to save signature",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return
+	}
+	this.recordAudit(util.AuditActionSign, imageId, util.AuditOutcomeSuccess,
+		"status="+image.SignatureStatus+" signer="+image.Signer)
+
+	image, ok = this.queryImage(clientIp, imageId, "fail to query this imageId in database")
+	if !ok {
+		return
+	}
+	tags, err := this.queryImageTags(imageId)
+	if err != nil {
+		this.HandleApiError(clientIp, util.StatusInternalServerError, "fail to query this imageId in database",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return
+	}
+	signResp, err := json.Marshal(newImageDetail(image, tags))
+	if err != nil {
+		this.HandleApiError(clientIp, util.StatusInternalServerError, "fail to return image details", util.ErrInternal)
+		return
+	}
+	this.Ctx.Output.Header("ETag", imageETag(image))
+	_, _ = this.Ctx.ResponseWriter.Write(signResp)
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fileSystem/models"
+	"fileSystem/util"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Set up a trust store holding the key of signer, returns the private key signing for it
+func useTestTrustStore(t *testing.T, signer string) ed25519.PrivateKey {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := newTestDir(t)
+	err = ioutil.WriteFile(filepath.Join(dir, signer+".pem"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTestConfig(t, "trustStorePath", dir)
+	return private
+}
+
+func signContent(key ed25519.PrivateKey, content []byte) string {
+	digest := sha256.Sum256(content)
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, digest[:]))
+}
+
+func putSignature(db *fakeDb, imageId, body string) (int, string) {
+	c := &ImageController{BaseController{Db: db}}
+	_, rw := newTestRequest(c, http.MethodPut, "/image-management/v1/images/"+imageId+"/signature?userId=owner",
+		strings.NewReader(body), map[string]string{":imageId": imageId})
+	c.PutSignature()
+	return rw.Code, rw.Body.String()
+}
+
+func TestPutSignature(t *testing.T) {
+	key := useTestTrustStore(t, "alice")
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := newFakeDb()
+	db.insert(&models.ImageDB{ImageId: "image1", UserId: "owner", Status: util.ImageStatusActive,
+		Checksum: checksumOf([]byte("image")), ResourceVersion: 1})
+
+	for _, tt := range []struct {
+		signature, status, signer string
+	}{
+		{signContent(key, []byte("image")), util.SignatureVerified, "alice"},
+		{signContent(otherKey, []byte("image")), util.SignatureUntrusted, ""},
+		{"", util.SignatureUnsigned, ""},
+	} {
+		if code, body := putSignature(db, "image1", `{"signature":"`+tt.signature+`"}`); code != util.StatusOK {
+			t.Fatalf("got status %d: %s", code, body)
+		}
+		image := readImage(t, db, "image1")
+		if image.SignatureStatus != tt.status || image.Signer != tt.signer {
+			t.Fatalf("got status %s signed by %q, want %s by %q", image.SignatureStatus, image.Signer, tt.status, tt.signer)
+		}
+	}
+	if code, _ := putSignature(db, "image1", `{"signature":"not base64!"}`); code != util.BadRequest {
+		t.Fatalf("got status %d for a malformed signature, want %d", code, util.BadRequest)
+	}
+}
+
+func TestDownloadRequiresSignedImage(t *testing.T) {
+	key := useTestTrustStore(t, "alice")
+	root := useTestStores(t)
+	db := newFakeDb()
+	insertDownloadImage(t, db, root, "image1", "disk.img", "default:none")
+	setTestConfig(t, "requireSignedImages", "true")
+
+	if rw := downloadImage(db, "image1", "", nil); rw.Code != util.StatusForbidden {
+		t.Fatalf("got status %d for an unsigned image, want %d", rw.Code, util.StatusForbidden)
+	}
+	_, err := db.UpdateWithFilters("image_d_b", map[string]interface{}{"image_id__exact": "image1"},
+		map[string]interface{}{"signature": signContent(key, testImageContent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rw := downloadImage(db, "image1", "", nil); rw.Code != util.StatusOK {
+		t.Fatalf("got status %d for a signed image, want %d", rw.Code, util.StatusOK)
+	}
+
+	// removing the key from the trust store revokes the image
+	useTestTrustStore(t, "bob")
+	if rw := downloadImage(db, "image1", "", nil); rw.Code != util.StatusForbidden {
+		t.Fatalf("got status %d for a revoked signature, want %d", rw.Code, util.StatusForbidden)
+	}
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// @Title  controllers
+// @Description  storage usage and deduplication statistics api for filesystem
+// @Author  GuoZhen Gao (2021/6/30 10:40)
+package controllers
+
+import (
+	"encoding/json"
+	"fileSystem/util"
+	"math"
+)
+
+// StorageController   Define the controller to report storage usage, admin only
+type StorageController struct {
+	BaseController
+}
+
+// StoreStats   Define the usage of the blob or chunk store
+type StoreStats struct {
+	Count           int64   `json:"count"`
+	StoredBytes     int64   `json:"storedBytes"`
+	ReferencedBytes int64   `json:"referencedBytes"`
+	DedupRatio      float64 `json:"dedupRatio"`
+}
+
+// Fill the dedup ratio, the bytes images refer to for each byte stored
+func (s *StoreStats) computeRatio() {
+	if s.StoredBytes > 0 {
+		s.DedupRatio = math.Round(float64(s.ReferencedBytes)/float64(s.StoredBytes)*100) / 100
+	}
+}
+
+// Query the usage of the blob and chunk stores
+func (c *StorageController) queryStats() (map[string]*StoreStats, error) {
+	blobs := &StoreStats{}
+	var err error
+	blobs.Count, blobs.StoredBytes, err = c.Db.QueryAggregate("blob", "size")
+	if err != nil {
+		return nil, err
+	}
+	_, blobs.ReferencedBytes, err = c.Db.QueryAggregate("blob", "size * ref_count")
+	if err != nil {
+		return nil, err
+	}
+	chunks := &StoreStats{}
+	chunks.Count, chunks.StoredBytes, err = c.Db.QueryAggregate("chunk", "size")
+	if err != nil {
+		return nil, err
+	}
+	_, chunks.ReferencedBytes, err = c.Db.QueryAggregate("image_chunk", "size")
+	if err != nil {
+		return nil, err
+	}
+	total := &StoreStats{
+		Count:           blobs.Count + chunks.Count,
+		StoredBytes:     blobs.StoredBytes + chunks.StoredBytes,
+		ReferencedBytes: blobs.ReferencedBytes + chunks.ReferencedBytes,
+	}
+	for _, stats := range []*StoreStats{blobs, chunks, total} {
+		stats.computeRatio()
+	}
+	return map[string]*StoreStats{"blobs": blobs, "chunks": chunks, "total": total}, nil
+}
+
+// @Title Get
+// @Description report stored and referenced bytes of the blob and chunk stores with dedup ratios and the
+// counters of the integrity scrubber, admin only
+// @Success 200 ok
+// @Failure 403 forbidden
+// @router /image-management/v1/storage/stats [GET]
+func (c *StorageController) Get() {
+	c.logger().Info("Storage stats request received.")
+	clientIp := c.Ctx.Input.IP()
+	err := util.ValidateSrcAddress(clientIp)
+	if err != nil {
+		c.HandleApiError(clientIp, util.BadRequest, util.ClientIpaddressInvalid, util.ErrInvalidClientIp)
+		return
+	}
+	c.displayReceivedMsg(clientIp)
+	if !c.isAdmin() {
+		c.HandleApiError(clientIp, util.StatusForbidden, "admin token is required", util.ErrForbidden)
+		return
+	}
+
+	stats, err := c.queryStats()
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to query database",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return
+	}
+	statsResp, err := json.Marshal(map[string]interface{}{
+		"chunkStoreEnabled": util.ChunkStoreEnabled(),
+		"blobs":             stats["blobs"],
+		"chunks":            stats["chunks"],
+		"total":             stats["total"],
+		"scrub":             currentScrubStats(),
+	})
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to return storage stats", util.ErrInternal)
+		return
+	}
+	_, _ = c.Ctx.ResponseWriter.Write(statsResp)
+}
@@ -0,0 +1,314 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// @Title  controllers
+// @Description  trash, restore and purge api for filesystem
+// @Author  GuoZhen Gao (2021/6/30 10:40)
+package controllers
+
+import (
+	"encoding/json"
+	"fileSystem/models"
+	"fileSystem/pkg/dbAdpater"
+	"fileSystem/pkg/worker"
+	"fileSystem/util"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"time"
+)
+
+// TrashController   Define the controller to list, restore and purge trashed images
+type TrashController struct {
+	BaseController
+}
+
+// TrashedImage   Define a trashed image with the time it will be purged
+type TrashedImage struct {
+	*ImageDetail
+	TrashedTime string `json:"trashedTime"`
+	TrashedBy   string `json:"trashedBy"`
+	PurgeTime   string `json:"purgeTime"`
+}
+
+// Get how long trashed images are kept
+func trashRetention() time.Duration {
+	return time.Duration(util.GetAppConfigInt64("trashRetentionHours", util.DefaultTrashRetentionHrs)) * time.Hour
+}
+
+// Remove the image file and every row belonging to the image
+func purgeImage(db dbAdpater.Database, image *models.ImageDB) error {
+	var err error
+	if image.Chunked {
+		err = releaseImageChunks(db, image.ImageId)
+		if err != nil {
+			return err
+		}
+	} else if image.BlobDigest != "" {
+		// the blob may be shared with other images, the collector removes it once unreferenced
+		err = releaseBlob(db, image.BlobDigest)
+		if err != nil {
+			return err
+		}
+	} else if image.SaveFileName != "" {
+		file := image.StorageMedium + image.SaveFileName
+		err = os.Remove(file)
+		if err != nil && !os.IsNotExist(err) {
+			log.Error("fail to remove image file " + file)
+		}
+	}
+	for _, table := range []string{"image_tag", "image_share", "image_revision"} {
+		_, err = db.DeleteWithFilters(table, map[string]interface{}{"image_id__exact": image.ImageId})
+		if err != nil {
+			log.Error("fail to delete " + table + " rows of image " + image.ImageId)
+		}
+	}
+	err = db.DeleteData(&models.ImageDB{ImageId: image.ImageId}, "image_id")
+	if err != nil && err.Error() != util.LastInsertIdNotSupported {
+		return err
+	}
+	return nil
+}
+
+// NewTrashPurgeJob   Create the background job purging images whose trash retention has expired
+func NewTrashPurgeJob(db dbAdpater.Database) worker.Job {
+	return func() error {
+		var images []*models.ImageDB
+		_, err := db.QueryTableWithFilters("image_d_b", &images, map[string]interface{}{
+			"status__exact":     util.ImageStatusTrashed,
+			"trashed_time__lte": time.Now().Add(-trashRetention()),
+		}, []string{"trashed_time"}, 0, 0)
+		if err != nil {
+			return err
+		}
+		for _, image := range images {
+			err = purgeImage(db, image)
+			if err != nil {
+				return err
+			}
+			log.Info("purged image " + image.ImageId + " trashed at " + image.TrashedTime.Format(time.RFC3339))
+			writeAuditEvent(db, &models.AuditEvent{
+				Action:  util.AuditActionPurge,
+				ImageId: image.ImageId,
+				Outcome: util.AuditOutcomeSuccess,
+				Details: "retention expired",
+			})
+		}
+		return nil
+	}
+}
+
+// Move an image to trash, trashedBy is recorded so owners can tell who deleted a shared image
+func trashImage(db dbAdpater.Database, image *models.ImageDB, trashedBy string) error {
+	num, err := db.UpdateWithFilters("image_d_b", map[string]interface{}{
+		"image_id__exact":         image.ImageId,
+		"resource_version__exact": image.ResourceVersion,
+	}, map[string]interface{}{
+		"status":           util.ImageStatusTrashed,
+		"trashed_time":     time.Now(),
+		"trashed_by":       trashedBy,
+		"resource_version": image.ResourceVersion + 1,
+	})
+	if err != nil {
+		return err
+	}
+	if num == 0 {
+		return errConcurrentModification
+	}
+	return nil
+}
+
+// Query the aliases pointing to the revision backed by the image
+func imageAliases(db dbAdpater.Database, imageId string) (*models.ImageRevision, []string, error) {
+	var revisions []*models.ImageRevision
+	num, err := db.QueryTable("image_revision", &revisions, "image_id__exact", imageId)
+	if err != nil || num == 0 {
+		return nil, nil, err
+	}
+	var aliases []*models.ImageAlias
+	_, err = db.QueryTableWithFilters("image_alias", &aliases, map[string]interface{}{
+		"name__exact":     revisions[0].Name,
+		"revision__exact": revisions[0].Revision,
+	}, []string{"alias"}, 0, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	names := make([]string, 0, len(aliases))
+	for _, alias := range aliases {
+		names = append(names, alias.Alias)
+	}
+	return revisions[0], names, nil
+}
+
+// Query the trashed image named in the path, the error response is written when it can't be returned
+func (c *TrashController) queryTrashedImage(clientIp string, required int) (*models.ImageDB, bool) {
+	imageId := c.Ctx.Input.Param(":imageId")
+	image, ok := c.queryImage(clientIp, imageId, "fail to query this imageId in database")
+	if !ok {
+		return nil, false
+	}
+	if !c.checkImageAccess(clientIp, image, required) {
+		return nil, false
+	}
+	if image.Status != util.ImageStatusTrashed {
+		c.HandleApiError(clientIp, util.StatusConflict, "image is not in trash",
+			util.ErrImageNotAvailable.WithDetails("image status is "+image.Status))
+		return nil, false
+	}
+	return image, true
+}
+
+// @Title Get
+// @Description list trashed images owned by the caller, admins see all of them
+// @Param   userId        query  string  false  "owner of the images"
+// @Param   limit         query  int     false  "limit"
+// @Param   offset        query  int     false  "offset"
+// @Success 200 ok
+// @router /image-management/v1/trash [GET]
+func (c *TrashController) Get() {
+	c.logger().Info("Trash list request received.")
+	clientIp := c.Ctx.Input.IP()
+	err := util.ValidateSrcAddress(clientIp)
+	if err != nil {
+		c.HandleApiError(clientIp, util.BadRequest, util.ClientIpaddressInvalid, util.ErrInvalidClientIp)
+		return
+	}
+	c.displayReceivedMsg(clientIp)
+
+	filters := map[string]interface{}{"status__exact": util.ImageStatusTrashed}
+	if !c.isAdmin() {
+		userId := c.GetString(util.UserId)
+		if userId == "" {
+			c.HandleApiError(clientIp, util.BadRequest, "userId is required",
+				util.ErrInvalidParameter.WithDetails("userId"))
+			return
+		}
+		filters["user_id__exact"] = userId
+	}
+	limit, offset, ok := c.listPage(clientIp)
+	if !ok {
+		return
+	}
+	var images []*models.ImageDB
+	total, err := c.Db.QueryCountWithFilters("image_d_b", filters)
+	if err == nil {
+		_, err = c.Db.QueryTableWithFilters("image_d_b", &images, filters, []string{"-trashed_time"}, limit, offset)
+	}
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to query database",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return
+	}
+	retention := trashRetention()
+	trashed := make([]*TrashedImage, 0, len(images))
+	for _, image := range images {
+		trashed = append(trashed, &TrashedImage{
+			ImageDetail: newImageDetail(image, nil),
+			TrashedTime: image.TrashedTime.Format("2006-01-02 15:04:05"),
+			TrashedBy:   image.TrashedBy,
+			PurgeTime:   image.TrashedTime.Add(retention).Format("2006-01-02 15:04:05"),
+		})
+	}
+	trashResp, err := json.Marshal(map[string]interface{}{
+		"total":  total,
+		"images": trashed,
+	})
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to return trash list", util.ErrInternal)
+		return
+	}
+	_, _ = c.Ctx.ResponseWriter.Write(trashResp)
+}
+
+// @Title Restore
+// @Description restore a trashed image, owner only
+// @Param	imageId 	string
+// @Success 200 ok
+// @Failure 403 forbidden
+// @Failure 409 conflict
+// @router /image-management/v1/images/:imageId/action/restore [POST]
+func (c *TrashController) Restore() {
+	c.logger().Info("Restore image request received.")
+	c.auditAs(util.AuditActionRestore)
+	clientIp := c.Ctx.Input.IP()
+	err := util.ValidateSrcAddress(clientIp)
+	if err != nil {
+		c.HandleApiError(clientIp, util.BadRequest, util.ClientIpaddressInvalid, util.ErrInvalidClientIp)
+		return
+	}
+	c.displayReceivedMsg(clientIp)
+
+	image, ok := c.queryTrashedImage(clientIp, accessOwner)
+	if !ok {
+		return
+	}
+	num, err := c.Db.UpdateWithFilters("image_d_b", map[string]interface{}{
+		"image_id__exact":         image.ImageId,
+		"resource_version__exact": image.ResourceVersion,
+	}, map[string]interface{}{
+		"status":           util.ImageStatusActive,
+		"trashed_time":     nil,
+		"trashed_by":       "",
+		"resource_version": image.ResourceVersion + 1,
+	})
+	if err == nil && num == 0 {
+		err = errConcurrentModification
+	}
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to restore image",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return
+	}
+	c.recordAudit(util.AuditActionRestore, image.ImageId, util.AuditOutcomeSuccess, "file="+image.FileName)
+	c.Ctx.WriteString("restore success")
+}
+
+// @Title Purge
+// @Description permanently remove a trashed image before its retention expires, admin only
+// @Param	imageId 	string
+// @Success 200 ok
+// @Failure 403 forbidden
+// @Failure 409 conflict
+// @router /image-management/v1/images/:imageId/action/purge [POST]
+func (c *TrashController) Purge() {
+	c.logger().Info("Purge image request received.")
+	c.auditAs(util.AuditActionPurge)
+	clientIp := c.Ctx.Input.IP()
+	err := util.ValidateSrcAddress(clientIp)
+	if err != nil {
+		c.HandleApiError(clientIp, util.BadRequest, util.ClientIpaddressInvalid, util.ErrInvalidClientIp)
+		return
+	}
+	c.displayReceivedMsg(clientIp)
+
+	if !c.isAdmin() {
+		c.HandleApiError(clientIp, util.StatusForbidden, "admin token is required", util.ErrForbidden)
+		return
+	}
+	image, ok := c.queryTrashedImage(clientIp, accessOwner)
+	if !ok {
+		return
+	}
+	err = purgeImage(c.Db, image)
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to purge image",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return
+	}
+	c.recordAudit(util.AuditActionPurge, image.ImageId, util.AuditOutcomeSuccess,
+		"trashedTime="+image.TrashedTime.Format(time.RFC3339)+" trashedBy="+image.TrashedBy)
+	c.Ctx.WriteString("purge success")
+	c.logger().Info("purged image " + image.ImageId + " from trash")
+}
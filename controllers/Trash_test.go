@@ -0,0 +1,241 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"encoding/json"
+	"fileSystem/models"
+	"fileSystem/util"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Seed an image stored in a temp dir, its file is created so purges can be checked
+func insertStoredImage(t *testing.T, db *fakeDb, image *models.ImageDB) string {
+	image.StorageMedium = newTestDir(t)
+	image.SaveFileName = image.ImageId + ".zip"
+	file := filepath.Join(image.StorageMedium, image.SaveFileName)
+	if err := ioutil.WriteFile(file, []byte("image"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db.insert(image)
+	return file
+}
+
+func deleteImageAs(db *fakeDb, imageId, query string) int {
+	c := &ImageController{BaseController{Db: db}}
+	_, rw := newTestRequest(c, http.MethodDelete, "/image-management/v1/images/"+imageId+"?"+query, nil,
+		map[string]string{":imageId": imageId})
+	c.Delete()
+	return rw.Code
+}
+
+// Serve a trash api request, action runs the controller method under test
+func serveTrash(db *fakeDb, url string, admin bool, params map[string]string,
+	action func(c *TrashController)) (int, string) {
+	c := &TrashController{BaseController{Db: db}}
+	req, rw := newTestRequest(c, http.MethodPost, url, nil, params)
+	if admin {
+		req.Header.Set(util.AdminTokenHeader, testAdminToken)
+	}
+	action(c)
+	return rw.Code, rw.Body.String()
+}
+
+func TestDeleteMovesImageToTrash(t *testing.T) {
+	db := newFakeDb()
+	file := insertStoredImage(t, db, &models.ImageDB{ImageId: "image1", UserId: "owner",
+		Status: util.ImageStatusActive, ResourceVersion: 1})
+
+	if code := deleteImageAs(db, "image1", "userId=owner"); code != util.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	image := readImage(t, db, "image1")
+	if image.Status != util.ImageStatusTrashed || image.TrashedBy != "owner" || image.TrashedTime.IsZero() {
+		t.Fatalf("image not trashed: status %q by %q at %v", image.Status, image.TrashedBy, image.TrashedTime)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Fatalf("trashed image file was removed: %v", err)
+	}
+	if code := deleteImageAs(db, "image1", "userId=owner"); code != util.StatusConflict {
+		t.Fatalf("got status %d deleting a trashed image, want %d", code, util.StatusConflict)
+	}
+
+	code, body := serveTrash(db, "/image-management/v1/trash?userId=owner", false, nil, (*TrashController).Get)
+	if code != util.StatusOK {
+		t.Fatalf("got status %d: %s", code, body)
+	}
+	var list struct {
+		Total  int             `json:"total"`
+		Images []*TrashedImage `json:"images"`
+	}
+	if err := json.Unmarshal([]byte(body), &list); err != nil {
+		t.Fatal(err)
+	}
+	if list.Total != 1 || list.Images[0].ImageId != "image1" || list.Images[0].TrashedBy != "owner" {
+		t.Fatalf("got trash list %s", body)
+	}
+	_, body = serveTrash(db, "/image-management/v1/trash?userId=owner&offset=1", false, nil, (*TrashController).Get)
+	if err := json.Unmarshal([]byte(body), &list); err != nil || list.Total != 1 || len(list.Images) != 0 {
+		t.Fatalf("got trash page %s past the last image", body)
+	}
+	_, body = serveTrash(db, "/image-management/v1/trash?userId=other", false, nil, (*TrashController).Get)
+	if err := json.Unmarshal([]byte(body), &list); err != nil || list.Total != 0 {
+		t.Fatalf("another user sees trash %s", body)
+	}
+}
+
+func TestRestoreTrashedImage(t *testing.T) {
+	db := newFakeDb()
+	db.insert(&models.ImageDB{ImageId: "image1", UserId: "owner", Status: util.ImageStatusTrashed,
+		TrashedTime: time.Now(), TrashedBy: "owner"})
+	db.insert(&models.ImageDB{ImageId: "image2", UserId: "owner", Status: util.ImageStatusActive})
+	restore := func(imageId, userId string) int {
+		code, _ := serveTrash(db, "/image-management/v1/images/"+imageId+"/action/restore?userId="+userId, false,
+			map[string]string{":imageId": imageId}, (*TrashController).Restore)
+		return code
+	}
+
+	if code := restore("image1", "other"); code != util.StatusForbidden {
+		t.Fatalf("got status %d for another user, want %d", code, util.StatusForbidden)
+	}
+	if code := restore("image2", "owner"); code != util.StatusConflict {
+		t.Fatalf("got status %d restoring an active image, want %d", code, util.StatusConflict)
+	}
+	if code := restore("image1", "owner"); code != util.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	image := readImage(t, db, "image1")
+	if image.Status != util.ImageStatusActive || image.TrashedBy != "" || !image.TrashedTime.IsZero() {
+		t.Fatalf("image not restored: status %q by %q at %v", image.Status, image.TrashedBy, image.TrashedTime)
+	}
+}
+
+func TestPurgeRequiresAdmin(t *testing.T) {
+	useAdminToken(t)
+	db := newFakeDb()
+	file := insertStoredImage(t, db, &models.ImageDB{ImageId: "image1", UserId: "owner",
+		Status: util.ImageStatusTrashed, TrashedTime: time.Now()})
+	db.insert(&models.ImageTag{ImageId: "image1", Tag: "base"})
+	purge := func(admin bool) int {
+		code, _ := serveTrash(db, "/image-management/v1/images/image1/action/purge?userId=owner", admin,
+			map[string]string{":imageId": "image1"}, (*TrashController).Purge)
+		return code
+	}
+
+	if code := purge(false); code != util.StatusForbidden {
+		t.Fatalf("got status %d for the owner, want %d", code, util.StatusForbidden)
+	}
+	if code := purge(true); code != util.StatusOK {
+		t.Fatalf("got status %d for an admin", code)
+	}
+	if len(db.tables["image_d_b"]) != 0 || len(db.tables["image_tag"]) != 0 {
+		t.Fatalf("rows of the purged image were kept")
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatalf("file of the purged image was kept: %v", err)
+	}
+}
+
+func TestDeleteFailedUploadPurges(t *testing.T) {
+	for _, status := range []string{util.ImageStatusFailed, util.ImageStatusQuarantined} {
+		db := newFakeDb()
+		file := insertStoredImage(t, db, &models.ImageDB{ImageId: "image1", UserId: "owner", Status: status})
+		if code := deleteImageAs(db, "image1", "userId=owner"); code != util.StatusOK {
+			t.Fatalf("got status %d deleting a %s image", code, status)
+		}
+		if len(db.tables["image_d_b"]) != 0 {
+			t.Fatalf("%s image was moved to trash", status)
+		}
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Fatalf("file of the %s image was kept: %v", status, err)
+		}
+	}
+}
+
+func TestDeleteUploadingImageConflicts(t *testing.T) {
+	db := newFakeDb()
+	insertStoredImage(t, db, &models.ImageDB{ImageId: "image1", UserId: "owner",
+		Status: util.ImageStatusUploading})
+	if code := deleteImageAs(db, "image1", "userId=owner"); code != util.StatusConflict {
+		t.Fatalf("got status %d deleting an upload in progress, want %d", code, util.StatusConflict)
+	}
+	if len(db.tables["image_d_b"]) != 1 {
+		t.Fatalf("upload in progress was removed")
+	}
+}
+
+func TestDeleteCorruptImageTrashes(t *testing.T) {
+	db := newFakeDb()
+	insertStoredImage(t, db, &models.ImageDB{ImageId: "image1", UserId: "owner",
+		Status: util.ImageStatusCorrupt})
+	if code := deleteImageAs(db, "image1", "userId=owner"); code != util.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	var images []*models.ImageDB
+	if db.QueryTable("image_d_b", &images, "image_id__exact", "image1"); len(images) != 1 ||
+		images[0].Status != util.ImageStatusTrashed {
+		t.Fatalf("corrupt image wasn't moved to trash: %v", images)
+	}
+}
+
+func TestTrashPurgeJobHonoursRetention(t *testing.T) {
+	db := newFakeDb()
+	expired := insertStoredImage(t, db, &models.ImageDB{ImageId: "expired", Status: util.ImageStatusTrashed,
+		TrashedTime: time.Now().Add(-trashRetention() - time.Hour)})
+	kept := insertStoredImage(t, db, &models.ImageDB{ImageId: "recent", Status: util.ImageStatusTrashed,
+		TrashedTime: time.Now().Add(-time.Hour)})
+	db.insert(&models.ImageDB{ImageId: "active", Status: util.ImageStatusActive})
+
+	if err := NewTrashPurgeJob(db)(); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, row := range db.tables["image_d_b"] {
+		ids = append(ids, row.Interface().(*models.ImageDB).ImageId)
+	}
+	if !sameIds(ids, "recent", "active") {
+		t.Fatalf("images left after purge %v", ids)
+	}
+	if _, err := os.Stat(expired); !os.IsNotExist(err) {
+		t.Fatalf("file of the expired image was kept: %v", err)
+	}
+	if _, err := os.Stat(kept); err != nil {
+		t.Fatalf("file of the recent image was removed: %v", err)
+	}
+	events := db.tables["audit_event"]
+	if len(events) != 1 || events[0].Interface().(*models.AuditEvent).Action != util.AuditActionPurge {
+		t.Fatalf("got %d audit events for the purge", len(events))
+	}
+}
+
+func TestV1DeleteWithoutCaller(t *testing.T) {
+	db := newFakeDb()
+	insertStoredImage(t, db, &models.ImageDB{ImageId: "image1", UserId: "owner",
+		Status: util.ImageStatusActive, ResourceVersion: 1})
+
+	if code := deleteImageAs(db, "image1", ""); code != util.StatusOK {
+		t.Fatalf("got status %d for a v1 delete without caller, want %d", code, util.StatusOK)
+	}
+	if image := readImage(t, db, "image1"); image.Status != util.ImageStatusTrashed {
+		t.Fatalf("got status %s, want %s", image.Status, util.ImageStatusTrashed)
+	}
+}
@@ -21,21 +21,33 @@ package controllers
 
 import (
 	"archive/zip"
-	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fileSystem/models"
+	"fileSystem/pkg/codec"
+	"fileSystem/pkg/transfer"
 	"fileSystem/util"
-	"fmt"
 	uuid "github.com/satori/go.uuid"
-	log "github.com/sirupsen/logrus"
+	"hash"
 	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
 
+var (
+	errStorageNotSupported = errors.New("sorry, this storage medium is not supported right now")
+	errFileTooLarge        = errors.New("file size is larger than max size")
+)
+
 // UploadController   Define the controller to control upload
 type UploadController struct {
 	BaseController
@@ -56,27 +68,204 @@ func createImageID() string {
 	return strings.Replace(uuId.String(), "-", "", -1)
 }
 
-func (c *UploadController) insertOrUpdateFileRecord(imageId, fileName, userId, saveFileName, storageMedium string) error {
-
-	fileRecord := &models.ImageDB{
-		ImageId:       imageId,
-		FileName:      fileName,
-		UserId:        userId,
-		SaveFileName:  saveFileName,
-		StorageMedium: storageMedium,
-	}
-
+func (c *UploadController) insertOrUpdateFileRecord(fileRecord *models.ImageDB) error {
 	err := c.Db.InsertOrUpdateData(fileRecord, "image_id")
 
 	if err != nil && err.Error() != "LastInsertId is not supported by this driver" {
-		log.Error("Failed to save file record to database.")
+		c.logger().Error("Failed to save file record to database.")
 		return err
 	}
 
-	log.Info("Add file record: %+v", fileRecord)
+	c.logger().Infof("Add file record: %+v", fileRecord)
+	return nil
+}
+
+// Mark an upload as failed and remove the partial files it left behind
+func (c *UploadController) failUpload(fileRecord models.ImageDB, tempPaths []string) {
+	for _, path := range tempPaths {
+		err := os.RemoveAll(path)
+		if err != nil {
+			c.logger().Error(util.FailedToDeleteCache + " " + path)
+		}
+	}
+	if fileRecord.Chunked {
+		err := releaseImageChunks(c.Db, fileRecord.ImageId)
+		if err != nil {
+			c.logger().Error("fail to release chunks of failed upload " + fileRecord.ImageId)
+		}
+		fileRecord.Chunked = false
+	}
+	if fileRecord.BlobDigest != "" {
+		err := releaseBlob(c.Db, fileRecord.BlobDigest)
+		if err != nil {
+			c.logger().Error("fail to release blob " + fileRecord.BlobDigest + " of failed upload")
+		}
+		fileRecord.BlobDigest = ""
+		fileRecord.SaveFileName = ""
+	}
+	_, err := c.Db.DeleteWithFilters("image_tag", map[string]interface{}{"image_id__exact": fileRecord.ImageId})
+	if err != nil {
+		c.logger().Error("fail to remove tags of failed upload " + fileRecord.ImageId)
+	}
+	fileRecord.Status = util.ImageStatusFailed
+	err = c.insertOrUpdateFileRecord(&fileRecord)
+	if err != nil {
+		c.logger().Error("fail to mark upload of image " + fileRecord.ImageId + " as failed")
+		return
+	}
+	c.logger().Warn("upload of image " + fileRecord.ImageId + " marked as failed")
+}
+
+// Check an upload may be published to the logical image, the error response is written otherwise
+func (c *UploadController) checkImageNameUsable(clientIp, imageName string) bool {
+	err := util.ValidateImageName(imageName)
+	if err != nil {
+		c.HandleApiError(clientIp, util.BadRequest, err.Error(), util.ErrInvalidParameter.WithDetails(err.Error()))
+		return false
+	}
+	logical, err := c.findLogicalImage(imageName)
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to query database",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return false
+	}
+	if logical != nil && !c.canManageLogicalImage(logical) {
+		c.HandleApiError(clientIp, util.StatusForbidden, "no permission to manage this logical image",
+			util.ErrForbidden.WithDetails("name "+imageName))
+		return false
+	}
+	return true
+}
+
+// Publish a stored upload as the next revision of the logical image and add the revision to the upload details,
+// the error response is written otherwise and the caller rolls the upload back
+func (c *UploadController) publishUpload(clientIp, imageName string, fileRecord *models.ImageDB,
+	uploadDetails map[string]string) bool {
+	imageId := fileRecord.ImageId
+	revision, err := c.addImageRevision(imageName, fileRecord)
+	if err == errRevisionExists || err == errConcurrentModification {
+		c.HandleApiError(clientIp, util.StatusConflict, "image "+imageId+" couldn't be published: "+err.Error(),
+			util.ErrImageInUse.WithDetails("imageId "+imageId+": "+err.Error()))
+		return false
+	}
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to add revision",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return false
+	}
+	c.recordAudit(util.AuditActionRevision, imageId, util.AuditOutcomeSuccess,
+		"name="+imageName+" revision="+strconv.FormatInt(revision.Revision, 10))
+	uploadDetails[util.ImageName] = imageName
+	uploadDetails["revision"] = strconv.FormatInt(revision.Revision, 10)
+	return true
+}
+
+// imageReader hashes and counts an image while it is read and stops it at the max file size
+type imageReader struct {
+	r    io.Reader
+	hash hash.Hash
+	size int64
+}
+
+func (r *imageReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.hash.Write(p[:n])
+	r.size += int64(n)
+	if r.size > util.MaxAppPackageFile {
+		return n, errFileTooLarge
+	}
+	return n, err
+}
+
+func (r *imageReader) checksum() string {
+	return hex.EncodeToString(r.hash.Sum(nil))
+}
+
+// uploadStream remembers why reading the request failed, which tells client errors from storage errors
+type uploadStream struct {
+	r   io.Reader
+	err error
+}
+
+func (s *uploadStream) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err != nil && err != io.EOF {
+		s.err = err
+	}
+	return n, err
+}
+
+// Store an image read once from r, it is split into the chunk store or written as is or compressed into a blob
+// while it is hashed. Checksum, size and where the image is stored are recorded on fileRecord.
+func (c *UploadController) storeImage(fileRecord *models.ImageDB, storageMedium, saveFileName,
+	newSaveFileName string, r io.Reader) error {
+	src := &imageReader{r: r, hash: sha256.New()}
+	isZip := filepath.Ext(fileRecord.FileName) == ".zip"
+	if !isZip && util.ChunkStoreEnabled() {
+		count, err := storeImageChunks(c.Db, fileRecord.ImageId, src)
+		if err != nil {
+			return err
+		}
+		fileRecord.Chunked = true
+		fileRecord.SaveFileName = ""
+		fileRecord.Checksum, fileRecord.Size = src.checksum(), src.size
+		c.logger().Info("stored image " + fileRecord.ImageId + " as " + strconv.FormatInt(count, 10) + " chunks")
+		return nil
+	}
+
+	//if file is not zip file, compress it to zip unless the policy stores its format as uploaded
+	imageCodec := codec.Codec{Name: codec.None}
+	if !isZip {
+		imageCodec = c.compressionCodec(fileRecord.FileName)
+	}
+	var path, digest string
+	var size int64
+	var err error
+	encrypted := util.EncryptionEnabled()
+	if imageCodec.Zipped() {
+		path = storageMedium + newSaveFileName + ".zip"
+		entryName := filepath.Base(fileRecord.FileName)
+		if entryName == util.ManifestEntryName {
+			// the manifest keeps its name, so it is told apart from the image
+			entryName = util.ImageEntryName
+		}
+		digest, size, err = compressImage(src, entryName, path, imageCodec, encrypted)
+	} else {
+		path = storageMedium + saveFileName
+		size, err = writeImage(src, path, encrypted)
+		digest = src.checksum()
+	}
+	if err != nil {
+		return err
+	}
+	if !isZip {
+		fileRecord.Codec = imageCodec.String()
+	} else if packaged, err := packageManifest(path, encrypted); err == nil {
+		fileRecord.Manifest = packaged
+	} else {
+		// a zip which can't be read is kept as uploaded, it has no files to be listed or verified
+		c.logger().Warn("fail to build manifest of package " + fileRecord.ImageId + ": " + err.Error())
+	}
+	fileRecord.Checksum, fileRecord.Size = src.checksum(), src.size
+	fileRecord.Encrypted, err = storeBlob(c.Db, path, digest, size, encrypted)
+	if err != nil {
+		return err
+	}
+	fileRecord.BlobDigest = digest
+	fileRecord.SaveFileName = blobStore.RelativePath(digest)
 	return nil
 }
 
+// Pick the codec of an upload from the compression policy, an invalid policy falls back to the default codec
+func (c *UploadController) compressionCodec(filename string) codec.Codec {
+	policy, err := codec.ParsePolicy(util.GetAppConfig("compressionPolicy"))
+	if err != nil {
+		c.logger().Error("invalid compressionPolicy, using " + codec.Default.String() + ": " + err.Error())
+		return codec.Default
+	}
+	return policy.For(filepath.Ext(filename))
+}
+
 //add more storage logic here
 func (c *UploadController) getStorageMedium(priority string) string {
 	switch {
@@ -92,236 +281,422 @@ func (c *UploadController) getStorageMedium(priority string) string {
 	}
 }
 
-// @Title saveByPriority
-// @Description upload file
-// @Param   priority     string  true   "priority "
-// @Param   saveFilename 	string  	true   "file"   eg.9c73996089944709bad8efa7f532aebe1.zip
-func (c *UploadController) saveByPriority(priority string, saveFilename string) error {
-	switch {
-	case priority == "A":
-		return errors.New("sorry, this storage medium is not supported right now")
-
-	default:
-		defaultPath := util.LocalStoragePath
-
-		err := createDirectory(defaultPath)
-		if err != nil {
-			log.Error("failed to create file path" + defaultPath)
-			return err
-		}
-
-		err = c.SaveToFile(util.FormFile, defaultPath+saveFilename)
-		if err != nil {
-			c.writeErrorResponse("fail to upload package", util.StatusInternalServerError)
-			return err
-		} else {
-			log.Info("save file to " + defaultPath)
-			return nil
-		}
+// Write an image to path as it is read, returns its size
+func writeImage(r io.Reader, path string, encrypted bool) (int64, error) {
+	out, err := createStoredFile(path, encrypted)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+	size, err := io.Copy(out, r)
+	if err != nil {
+		return 0, err
 	}
+	return size, out.Close()
 }
 
-//压缩文件
-//files 文件数组，可以是不同dir下的文件或者文件夹
-//dest 压缩文件存放地址
-func Compress(files []*os.File, dest string) error {
-	d, _ := os.Create(dest)
-	defer d.Close()
-	w := zip.NewWriter(d)
-	defer w.Close()
-	for _, file := range files {
-		err := compress(file, "", w)
-		if err != nil {
-			return err
-		}
+// Compress an image into a zip under its original name with a fixed time as it is read, followed by a manifest of
+// its SHA-256, so identical uploads of a file give identical zips which share one blob. Returns the digest and
+// size of the zip.
+func compressImage(src *imageReader, entryName, dest string, imageCodec codec.Codec,
+	encrypted bool) (string, int64, error) {
+	out, err := createStoredFile(dest, encrypted)
+	if err != nil {
+		return "", 0, err
 	}
-	return nil
+	defer out.Close()
+	h := sha256.New()
+	w := imageCodec.NewZipWriter(io.MultiWriter(out, h), util.CompressionWorkers())
+	header := &zip.FileHeader{
+		Name:     entryName,
+		Method:   imageCodec.Method(),
+		Modified: time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	header.SetMode(0644)
+	writer, err := w.CreateHeader(header)
+	if err != nil {
+		return "", 0, err
+	}
+	_, err = io.Copy(writer, src)
+	if err != nil {
+		return "", 0, err
+	}
+	err = writeManifestEntry(w, entryName, src.checksum())
+	if err != nil {
+		return "", 0, err
+	}
+	err = w.Close()
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), out.Size(), out.Close()
 }
 
-func compress(file *os.File, prefix string, zw *zip.Writer) error {
-	info, err := file.Stat()
+// @Title Get
+// @Description list images readable by the caller, filtered by metadata and tags. A v1 request without
+// query parameters is answered as the upload probe of older releases.
+// @Param   userId        query  string  false  "caller, sees own, public and shared images"
+// @Param   tenantId      query  string  false  "tenant of the caller"
+// @Param   ownerId       query  string  false  "owner of the images"
+// @Param   ownerTenantId query  string  false  "tenant of the owner"
+// @Param   osType        query  string  false  "osType"
+// @Param   osVersion     query  string  false  "osVersion"
+// @Param   architecture  query  string  false  "x86_64 or aarch64"
+// @Param   diskFormat    query  string  false  "diskFormat"
+// @Param   visibility    query  string  false  "private, shared or public"
+// @Param   tags          query  string  false  "comma separated, images carrying all tags are listed"
+// @Param   status        query  string  false  "admin only, lists images of this status such as corrupt"
+// @Param   limit         query  int     false  "limit"
+// @Param   offset        query  int     false  "offset"
+// @Success 200 ok
+// @Failure 400 bad request
+// @router "/image-management/v1/images [get]
+func (c *UploadController) Get() {
+	c.logger().Info("Image list request received.")
+	clientIp := c.Ctx.Input.IP()
+	err := util.ValidateSrcAddress(clientIp)
 	if err != nil {
-		return err
+		c.HandleApiError(clientIp, util.BadRequest, util.ClientIpaddressInvalid, util.ErrInvalidClientIp)
+		return
 	}
-	if info.IsDir() {
-		prefix = prefix + info.Name() + "/"
-		fileInfos, err := file.Readdir(-1)
-		if err != nil {
-			return err
+	c.displayReceivedMsg(clientIp)
+	// a v1 get without query is the probe of older releases, it is answered without querying the database
+	if !c.isApiV2() && c.Ctx.Request.URL.RawQuery == "" {
+		c.Ctx.WriteString("Upload get request received.")
+		return
+	}
+
+	filters := map[string]interface{}{
+		"status__in": []string{"", util.ImageStatusActive},
+	}
+	for query, field := range imageListFilters {
+		if value := c.Ctx.Input.Query(query); value != "" {
+			filters[field] = value
 		}
-		for _, fi := range fileInfos {
-			f, err := os.Open(file.Name() + "/" + fi.Name())
-			if err != nil {
-				return err
-			}
-			err = compress(f, prefix, zw)
-			file.Close()
-			if err != nil {
-				return err
-			}
+	}
+	if status := c.Ctx.Input.Query("status"); status != "" {
+		// images which aren't available, like the ones the scrubber found corrupt, are listed to admins only
+		if !c.isAdmin() {
+			c.HandleApiError(clientIp, util.StatusForbidden, "admin token is required",
+				util.ErrForbidden.WithDetails("status"))
+			return
 		}
-	} else {
-		header, err := zip.FileInfoHeader(info)
-		header.Name = prefix + header.Name
-		if err != nil {
-			return err
+		filters["status__in"] = []string{status}
+		if status == util.ImageStatusActive {
+			filters["status__in"] = []string{"", status}
 		}
-		writer, err := zw.CreateHeader(header)
+	}
+	if visibility := c.Ctx.Input.Query("visibility"); visibility != "" && visibility == util.GetDefaultVisibility() {
+		// images stored without visibility have the default one
+		delete(filters, imageListFilters["visibility"])
+		filters["visibility__in"] = []string{"", visibility}
+	}
+	if value := c.Ctx.Input.Query("tags"); value != "" {
+		imageIds, err := c.queryImageIdsByTags(strings.Split(value, ","))
 		if err != nil {
-			return err
+			c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to query database",
+				util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+			return
 		}
-		_, err = io.Copy(writer, file)
-		file.Close()
-		if err != nil {
-			return err
+		if len(imageIds) == 0 {
+			c.writeImageList(clientIp, nil, 0)
+			return
 		}
+		filters["image_id__in"] = imageIds
 	}
-	return nil
-}
 
-// 编写一个函数，接收两个文件路径:
-//srcFile := "e:/copyFileTest02.pdf" -- 源文件路径
-//dstFile := "e:/Go/tools/copyFileTest02.pdf" -- 目标文件路径
-func copyFile(srcFileName string, dstFileName string) (written int64, err error) {
-	srcFile, err := os.Open(srcFileName)
-	if err != nil {
-		fmt.Printf("open file error = %v\n", err)
+	limit, offset, ok := c.listPage(clientIp)
+	if !ok {
+		return
 	}
-	defer srcFile.Close()
 
-	//通过srcFile，获取到READER
-	reader := bufio.NewReader(srcFile)
+	var images []*models.ImageDB
+	var total int64
+	readable, err := c.readableConditions()
+	if err == nil {
+		total, err = c.Db.QueryCountWithConditions("image_d_b", filters, readable)
+	}
+	if err == nil {
+		_, err = c.Db.QueryTableWithConditions("image_d_b", &images, filters, readable, []string{"-upload_time"},
+			limit, offset)
+	}
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to query database",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return
+	}
+	c.writeImageList(clientIp, images, total)
+}
 
-	//打开dstFileName
-	dstFile, err := os.OpenFile(dstFileName, os.O_WRONLY|os.O_CREATE, 0666)
+// Write a page of images with their tags as the list response, total counts the images of every page
+func (c *UploadController) writeImageList(clientIp string, images []*models.ImageDB, total int64) {
+	imageIds := make([]string, 0, len(images))
+	for _, image := range images {
+		imageIds = append(imageIds, image.ImageId)
+	}
+	tagsById, err := c.queryTagsOfImages(imageIds)
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to query database",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return
+	}
+	details := make([]*ImageDetail, 0, len(images))
+	for _, image := range images {
+		details = append(details, newImageDetail(image, tagsById[image.ImageId]))
+	}
+	listResp, err := json.Marshal(map[string]interface{}{
+		"total":  total,
+		"images": details,
+	})
 	if err != nil {
-		fmt.Printf("open file error = %v\n", err)
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to return image list", util.ErrInternal)
 		return
 	}
+	_, _ = c.Ctx.ResponseWriter.Write(listResp)
+}
 
-	//通过dstFile，获取到WRITER
-	writer := bufio.NewWriter(dstFile)
-	//writer.Flush()
+// Open the multipart body of an upload, the stream filter keeps beego from buffering it
+func (c *UploadController) multipartReader() (*multipart.Reader, error) {
+	contentType, _ := c.Ctx.Input.GetData(util.UploadContentTypeKey).(string)
+	if contentType == "" {
+		contentType = c.Ctx.Input.Header("Content-Type")
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+		return nil, errors.New("request should be multipart/form-data")
+	}
+	return multipart.NewReader(c.Ctx.Request.Body, params["boundary"]), nil
+}
 
-	defer dstFile.Close()
+// Read a form field of the multipart body, it is added to the request form so GetString sees it
+func (c *UploadController) readFormField(part *multipart.Part) error {
+	value, err := ioutil.ReadAll(io.LimitReader(part, util.MaxMetadataBodySize+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(value)) > util.MaxMetadataBodySize {
+		return errors.New("form field " + part.FormName() + " is larger than max size")
+	}
+	if c.Ctx.Request.Form == nil {
+		c.Ctx.Request.Form = url.Values{}
+	}
+	c.Ctx.Request.Form.Add(part.FormName(), string(value))
+	return nil
+}
 
-	return io.Copy(writer, reader)
+// Check the requested storage medium is supported, the error response is written otherwise
+func (c *UploadController) checkPriority(clientIp string) bool {
+	priority := c.GetString(util.Priority)
+	if priority == "A" {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to upload package",
+			util.ErrStorageNotSupported.WithDetails("priority "+priority))
+		return false
+	}
+	return true
 }
 
-// @Title Get
-// @Description test connection is ok or not
-// @Success 200 ok
-// @Failure 400 bad request
-// @router "/image-management/v1/images [get]
-func (c *UploadController) Get() {
-	log.Info("Upload get request received.")
-	c.Ctx.WriteString("Upload get request received.")
+// Store the file part of an upload while it is received, the error response is written otherwise
+func (c *UploadController) receiveImage(clientIp, imageId string, tr *transfer.Transfer,
+	part *multipart.Part) (*models.ImageDB, []string, bool) {
+	filename := part.FileName() //original name for file   1.zip or 1.qcow2
+	err := util.ValidateFileExtension(filename)
+	if err != nil || len(filename) > util.MaxFileNameSize {
+		c.HandleApiError(clientIp, util.BadRequest,
+			"File shouldn't contains any extension or filename is larger than max size", util.ErrUnsupportedFileType)
+		return nil, nil, false
+	}
+	if !c.checkPriority(clientIp) {
+		return nil, nil, false
+	}
+	// uploads are saved locally whatever the priority, the storage medium is reported to let fe know
+	err = createDirectory(util.LocalStoragePath)
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to upload package",
+			util.ErrStorageFailure.WithDetails(err.Error()))
+		return nil, nil, false
+	}
+	saveFileName := imageId + filename //9c73996089944709bad8efa7f532aebe+   1.zip or  1.qcow2
+	newSaveFileName := strings.TrimSuffix(saveFileName, filepath.Ext(filename)) //9c73996089944709bad8efa7f532aebe+1
+
+	fileRecord := &models.ImageDB{
+		ImageId:       imageId,
+		FileName:      filename,
+		UserId:        c.GetString(util.UserId),
+		TenantId:      c.GetString(util.TenantId),
+		SaveFileName:  saveFileName,
+		StorageMedium: c.getStorageMedium(c.GetString(util.Priority)),
+		UploadTime:    time.Now(),
+		Status:        util.ImageStatusUploading,
+		DiskFormat:    util.DiskFormatFromFileName(filename),
+		Visibility:    util.GetDefaultVisibility(),
+	}
+	err = c.insertOrUpdateFileRecord(fileRecord)
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to insert imageID, filename, userID to database",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return nil, nil, false
+	}
+	tempPaths := []string{util.LocalStoragePath + saveFileName, util.LocalStoragePath + newSaveFileName + ".zip"}
+	stream := &uploadStream{r: tr.Reader(part)}
+	err = c.storeImage(fileRecord, util.LocalStoragePath, saveFileName, newSaveFileName, stream)
+	if err != nil {
+		c.failUpload(*fileRecord, tempPaths)
+		switch {
+		case err == errFileTooLarge:
+			c.HandleApiError(clientIp, util.BadRequest, "File size is larger than max size", util.ErrFileTooLarge)
+		case stream.err == transfer.ErrInterrupted:
+			c.HandleApiError(clientIp, util.StatusServiceUnavailable, err.Error(), util.ErrServiceShuttingDown)
+		case stream.err != nil:
+			c.HandleApiError(clientIp, util.BadRequest, "Upload package file error",
+				util.ErrInvalidFile.WithDetails(stream.err.Error()))
+		default:
+			c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to upload package",
+				util.ErrStorageFailure.WithDetails(err.Error()))
+		}
+		return nil, nil, false
+	}
+	return fileRecord, tempPaths, true
 }
 
 // @Title Post
-// @Description upload file
+// @Description upload file, the body is streamed once into storage so form fields may come before or after the file
 // @Param   usrId       form-data 	string	true   "usrId"
 // @Param   priority    form-data   string  true   "priority "
 // @Param   file        form-data 	file	true   "file"
+// @Param   imageName   form-data 	string	false  "publish the upload as the next revision of this logical image"
 // @Success 200 ok
 // @Failure 400 bad request
 // @router "/image-management/v1/images [post]
 func (c *UploadController) Post() {
-	log.Info("Upload post request received.")
+	c.logger().Info("Upload post request received.")
+	c.auditAs(util.AuditActionUpload)
 	clientIp := c.Ctx.Input.IP()
 	err := util.ValidateSrcAddress(clientIp)
 	if err != nil {
-		c.HandleLoggingForError(clientIp, util.BadRequest, util.ClientIpaddressInvalid)
+		c.HandleApiError(clientIp, util.BadRequest, util.ClientIpaddressInvalid, util.ErrInvalidClientIp)
 		return
 	}
 	c.displayReceivedMsg(clientIp)
-	file, head, err := c.GetFile("file")
+	reader, err := c.multipartReader()
 	if err != nil {
-		c.HandleLoggingForError(clientIp, util.BadRequest, "Upload package file error")
-		return
-	}
-	err = util.ValidateFileExtension(head.Filename)
-	if err != nil || len(head.Filename) > util.MaxFileNameSize {
-		c.HandleLoggingForError(clientIp, util.BadRequest,
-			"File shouldn't contains any extension or filename is larger than max size")
+		c.HandleApiError(clientIp, util.BadRequest, "Upload package file error", util.ErrInvalidFile.WithDetails(err.Error()))
 		return
 	}
-	err = util.ValidateFileSize(head.Size, util.MaxAppPackageFile)
-	if err != nil {
-		c.HandleLoggingForError(clientIp, util.BadRequest, "File size is larger than max size")
-		return
-	}
-	defer file.Close()
-
-	filename := head.Filename //original name for file   1.zip or 1.qcow2
-	userId := c.GetString(util.UserId)
-	priority := c.GetString(util.Priority)
 
 	//create imageId, fileName, uploadTime, userId
 	imageId := createImageID()
-
-	//get a storage medium to let fe know
-	storageMedium := c.getStorageMedium(priority)
-	saveFileName := imageId + filename //9c73996089944709bad8efa7f532aebe+   1.zip or  1.qcow2
-	err = c.saveByPriority(priority, saveFileName)
+	c.Ctx.Input.SetData(util.ImageIdKey, imageId)
+	tr, err := transfer.Begin(transfer.Upload, imageId)
 	if err != nil {
-		c.HandleLoggingForError(clientIp, util.StatusInternalServerError, "fail to upload package")
+		c.HandleApiError(clientIp, util.StatusServiceUnavailable, err.Error(), util.ErrServiceShuttingDown)
 		return
 	}
+	defer transfer.End(tr)
 
-	//if file is not zip file, compress it to zip
-	if filepath.Ext(head.Filename) != ".zip" {
-		originalName := strings.TrimSuffix(filename, filepath.Ext(filename))
-		zipFilePath := storageMedium + originalName
-		err := createDirectory(zipFilePath)
-		if err != nil {
-			log.Error("when compress, failed to create file path to" + zipFilePath)
-			return
+	var fileRecord *models.ImageDB
+	var tempPaths []string
+	fail := func(status int, v1Msg string, apiErr util.ApiError) {
+		if fileRecord != nil {
+			c.failUpload(*fileRecord, tempPaths)
 		}
-		_, err = copyFile(storageMedium+saveFileName, zipFilePath+"/"+filename)
-		if err != nil {
-			log.Error("when compress, failed to create file path to" + zipFilePath)
-			return
+		c.HandleApiError(clientIp, status, v1Msg, apiErr)
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
 		}
-		f1, err := os.Open(zipFilePath)
 		if err != nil {
-			log.Error("failed to open upload file")
+			fail(util.BadRequest, "Upload package file error", util.ErrInvalidFile.WithDetails(err.Error()))
 			return
 		}
-		var files = []*os.File{f1}
-		newSaveFileName := strings.TrimSuffix(saveFileName, filepath.Ext(filename)) //9c73996089944709bad8efa7f532aebe+1
-		err = Compress(files, storageMedium+newSaveFileName+".zip")
-		if err != nil {
-			log.Error("failed to compress upload file")
+		if part.FormName() != util.FormFile {
+			err = c.readFormField(part)
+			if err != nil {
+				fail(util.BadRequest, err.Error(), util.ErrInvalidParameter.WithDetails(err.Error()))
+				return
+			}
+			continue
+		}
+		if fileRecord != nil {
+			fail(util.BadRequest, "only one file can be uploaded", util.ErrInvalidFile.WithDetails("only one file can be uploaded"))
 			return
 		}
-		err = os.Remove(storageMedium + saveFileName)
-		if err != nil {
-			c.writeErrorResponse(util.FailedToDeleteCache, util.StatusInternalServerError)
+		var ok bool
+		fileRecord, tempPaths, ok = c.receiveImage(clientIp, imageId, tr, part)
+		if !ok {
 			return
 		}
-		err = os.RemoveAll(zipFilePath)
+	}
+	if fileRecord == nil {
+		c.HandleApiError(clientIp, util.BadRequest, "Upload package file error", util.ErrInvalidFile)
+		return
+	}
+
+	// form fields may follow the file, so they are validated once the body is read
+	filename := fileRecord.FileName
+	userId := c.GetString(util.UserId)
+	priority := c.GetString(util.Priority)
+	metadata, err := c.metadataFromForm()
+	if err != nil {
+		fail(util.BadRequest, err.Error(), util.ErrInvalidParameter.WithDetails(err.Error()))
+		return
+	}
+	imageName := c.GetString(util.ImageName)
+	if !c.checkPriority(clientIp) || (imageName != "" && !c.checkImageNameUsable(clientIp, imageName)) ||
+		!c.applySignature(clientIp, fileRecord) {
+		c.failUpload(*fileRecord, tempPaths)
+		return
+	}
+	storageMedium := c.getStorageMedium(priority)
+	fileRecord.UserId = userId
+	fileRecord.TenantId = c.GetString(util.TenantId)
+	fileRecord.StorageMedium = storageMedium
+	metadata.applyTo(fileRecord)
+	// tags are written before the image is activated, so it is never listed without them
+	if metadata.Tags != nil {
+		err = c.replaceImageTags(imageId, *metadata.Tags)
 		if err != nil {
-			c.writeErrorResponse(util.FailedToDeleteCache, util.StatusInternalServerError)
+			c.failUpload(*fileRecord, tempPaths)
+			c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to save image tags",
+				util.ErrDatabaseUnavailable.WithDetails(err.Error()))
 			return
 		}
-		saveFileName = newSaveFileName + ".zip"
 	}
-
-	err = c.insertOrUpdateFileRecord(imageId, filename, userId, saveFileName, storageMedium)
+	fileRecord.Status = util.ImageStatusActive
+	c.scanImage(fileRecord)
+	err = c.insertOrUpdateFileRecord(fileRecord)
 	if err != nil {
-		log.Error("fail to insert imageID, filename, userID to database")
+		c.failUpload(*fileRecord, nil)
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to insert imageID, filename, userID to database",
+			util.ErrDatabaseUnavailable.WithDetails(err.Error()))
 		return
 	}
-	uploadResp, err := json.Marshal(map[string]string{
-		"imageId":       imageId,
-		"fileName":      filename,
-		"uploadTime":    time.Now().Format("2006-01-02 15:04:05"),
-		"userId":        userId,
-		"storageMedium": storageMedium,
-	})
+	uploadDetails := map[string]string{
+		"imageId":         imageId,
+		"fileName":        filename,
+		"uploadTime":      fileRecord.UploadTime.Format("2006-01-02 15:04:05"),
+		"userId":          userId,
+		"storageMedium":   storageMedium,
+		"checksum":        fileRecord.Checksum,
+		"signer":          fileRecord.Signer,
+		"signatureStatus": fileRecord.SignatureStatus,
+		"scanStatus":      scanStatus(fileRecord),
+	}
+	// an upload which can't be published is rolled back, so the client isn't left with an image it didn't ask for
+	if imageName != "" && fileRecord.Status != util.ImageStatusQuarantined &&
+		!c.publishUpload(clientIp, imageName, fileRecord, uploadDetails) {
+		c.failUpload(*fileRecord, nil)
+		return
+	}
+	c.recordAudit(util.AuditActionUpload, imageId, util.AuditOutcomeSuccess,
+		"file="+filename+" size="+strconv.FormatInt(fileRecord.Size, 10))
+	if !c.checkQuarantine(clientIp, fileRecord) {
+		return
+	}
+	uploadResp, err := json.Marshal(uploadDetails)
 	if err != nil {
-		c.HandleLoggingForError(clientIp, util.StatusInternalServerError, "fail to return upload details")
+		c.HandleApiError(clientIp, util.StatusInternalServerError, "fail to return upload details", util.ErrInternal)
 		return
 	}
 	_, _ = c.Ctx.ResponseWriter.Write(uploadResp)
@@ -0,0 +1,369 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fileSystem/models"
+	"fileSystem/pkg/codec"
+	"fileSystem/util"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Seed images uploaded a minute apart, the last one is the newest
+func newListTestDb() *fakeDb {
+	db := newFakeDb()
+	begin := time.Date(2021, 7, 1, 10, 0, 0, 0, time.UTC)
+	for i, image := range []models.ImageDB{
+		{ImageId: "ubuntu1", OsType: "ubuntu", Architecture: util.ArchX86, Status: util.ImageStatusActive},
+		{ImageId: "ubuntu2", OsType: "ubuntu", Architecture: util.ArchAarch64},
+		{ImageId: "centos1", OsType: "centos", Architecture: util.ArchX86, Status: util.ImageStatusActive},
+		{ImageId: "uploading", OsType: "ubuntu", Architecture: util.ArchX86, Status: util.ImageStatusUploading},
+	} {
+		image.UploadTime = begin.Add(time.Duration(i) * time.Minute)
+		db.insert(&image)
+	}
+	for imageId, tags := range map[string][]string{
+		"ubuntu1":   {"base", "lts"},
+		"ubuntu2":   {"base"},
+		"centos1":   {"lts"},
+		"uploading": {"base", "lts"},
+	} {
+		for _, tag := range tags {
+			db.insert(&models.ImageTag{ImageId: imageId, Tag: tag})
+		}
+	}
+	return db
+}
+
+// List images, returns the ids in the order of the response
+func listImages(t *testing.T, db *fakeDb, query string) []string {
+	t.Helper()
+	c := &UploadController{BaseController{Db: db}}
+	_, rw := newTestRequest(c, http.MethodGet, "/image-management/v1/images?"+query, nil, nil)
+	c.Get()
+	if rw.Code != util.StatusOK {
+		t.Fatalf("got status %d: %s", rw.Code, rw.Body.String())
+	}
+	var result struct {
+		Images []*ImageDetail `json:"images"`
+	}
+	if err := json.Unmarshal(rw.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	imageIds := make([]string, 0, len(result.Images))
+	for _, image := range result.Images {
+		imageIds = append(imageIds, image.ImageId)
+	}
+	return imageIds
+}
+
+func sameIds(got []string, want ...string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestListImagesSkipsUnavailable(t *testing.T) {
+	if got := listImages(t, newListTestDb(), "offset=0"); !sameIds(got, "centos1", "ubuntu2", "ubuntu1") {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestBareV1GetIsUploadProbe(t *testing.T) {
+	c := &UploadController{BaseController{Db: newFakeDb()}}
+	_, rw := newTestRequest(c, http.MethodGet, "/image-management/v1/images", nil, nil)
+	c.Get()
+	if rw.Code != util.StatusOK || rw.Body.String() != "Upload get request received." {
+		t.Fatalf("got status %d and %q for the upload probe", rw.Code, rw.Body.String())
+	}
+}
+
+func TestListImagesFiltersMetadata(t *testing.T) {
+	db := newListTestDb()
+	if got := listImages(t, db, "osType=ubuntu&architecture=x86_64"); !sameIds(got, "ubuntu1") {
+		t.Fatalf("got %v", got)
+	}
+	if got := listImages(t, db, "osType=debian"); len(got) != 0 {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestListImagesFiltersTags(t *testing.T) {
+	db := newListTestDb()
+	if got := listImages(t, db, "tags=base,lts"); !sameIds(got, "ubuntu1") {
+		t.Fatalf("got %v for images carrying both tags", got)
+	}
+	if got := listImages(t, db, "tags=lts"); !sameIds(got, "centos1", "ubuntu1") {
+		t.Fatalf("got %v", got)
+	}
+	if got := listImages(t, db, "tags=none"); len(got) != 0 {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestListImagesPaginates(t *testing.T) {
+	if got := listImages(t, newListTestDb(), "limit=1&offset=1"); !sameIds(got, "ubuntu2") {
+		t.Fatalf("got %v", got)
+	}
+	c := &UploadController{BaseController{Db: newListTestDb()}}
+	_, rw := newTestRequest(c, http.MethodGet, "/image-management/v1/images?limit=1", nil, nil)
+	c.Get()
+	var result struct {
+		Total  int64          `json:"total"`
+		Images []*ImageDetail `json:"images"`
+	}
+	if err := json.Unmarshal(rw.Body.Bytes(), &result); err != nil || result.Total != 3 || len(result.Images) != 1 {
+		t.Fatalf("got %s, want a page of 1 of 3 images", rw.Body.String())
+	}
+}
+
+func TestListImagesPaginatesReadableImages(t *testing.T) {
+	db := newFakeDb()
+	begin := time.Date(2021, 7, 1, 10, 0, 0, 0, time.UTC)
+	for i, image := range []models.ImageDB{
+		{ImageId: "own", UserId: "user1", Visibility: util.VisibilityPrivate},
+		{ImageId: "private", UserId: "user2", Visibility: util.VisibilityPrivate},
+		{ImageId: "granted", UserId: "user2", Visibility: util.VisibilityShared},
+		{ImageId: "notGranted", UserId: "user2", Visibility: util.VisibilityShared},
+		{ImageId: "public", UserId: "user2"},
+	} {
+		image.Status = util.ImageStatusActive
+		image.UploadTime = begin.Add(time.Duration(i) * time.Minute)
+		db.insert(&image)
+	}
+	db.insert(&models.ImageShare{ImageId: "granted", GranteeType: util.GranteeTenant, GranteeId: "tenant1"})
+	db.insert(&models.ImageShare{ImageId: "private", GranteeType: util.GranteeUser, GranteeId: "user1"})
+
+	if got := listImages(t, db, "userId=user1&tenantId=tenant1"); !sameIds(got, "public", "granted", "own") {
+		t.Fatalf("got %v", got)
+	}
+	if got := listImages(t, db, "userId=user1&tenantId=tenant1&limit=2&offset=1"); !sameIds(got, "granted", "own") {
+		t.Fatalf("got %v for the second page", got)
+	}
+	if got := listImages(t, db, "userId=user3"); !sameIds(got, "public") {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestListImagesReturnsTags(t *testing.T) {
+	c := &UploadController{BaseController{Db: newListTestDb()}}
+	_, rw := newTestRequest(c, http.MethodGet, "/image-management/v1/images?osType=centos", nil, nil)
+	c.Get()
+	var result struct {
+		Images []*ImageDetail `json:"images"`
+	}
+	if err := json.Unmarshal(rw.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Images) != 1 || len(result.Images[0].Tags) != 1 || result.Images[0].Tags[0] != "lts" {
+		t.Fatalf("unexpected list %s", rw.Body.String())
+	}
+}
+
+func TestListImagesHidesUnreadable(t *testing.T) {
+	db := newListTestDb()
+	db.insert(&models.ImageDB{ImageId: "private1", UserId: "owner", Visibility: util.VisibilityPrivate,
+		UploadTime: time.Date(2021, 7, 1, 9, 0, 0, 0, time.UTC)})
+	db.insert(&models.ImageDB{ImageId: "shared1", UserId: "owner", Visibility: util.VisibilityShared,
+		UploadTime: time.Date(2021, 7, 1, 8, 0, 0, 0, time.UTC)})
+	db.insert(&models.ImageShare{ImageId: "shared1", GranteeType: util.GranteeUser, GranteeId: "user2",
+		Permission: util.PermissionRead})
+
+	if got := listImages(t, db, "ownerId=owner&userId=owner"); !sameIds(got, "private1", "shared1") {
+		t.Fatalf("owner got %v", got)
+	}
+	if got := listImages(t, db, "ownerId=owner&userId=user2"); !sameIds(got, "shared1") {
+		t.Fatalf("grantee got %v", got)
+	}
+	if got := listImages(t, db, "ownerId=owner&userId=user3"); len(got) != 0 {
+		t.Fatalf("other user got %v", got)
+	}
+}
+
+func TestCompressionCodecFollowsPolicy(t *testing.T) {
+	c := &UploadController{BaseController{Db: newFakeDb()}}
+	newTestRequest(c, http.MethodPost, "/image-management/v1/images", nil, nil)
+	setTestConfig(t, "compressionPolicy", "qcow2:store,iso:none,default:zstd-3")
+	for name, want := range map[string]string{"disk.qcow2": "store", "cd.ISO": "none", "disk.img": "zstd-3"} {
+		if got := c.compressionCodec(name).String(); got != want {
+			t.Fatalf("%s got codec %s, want %s", name, got, want)
+		}
+	}
+	setTestConfig(t, "compressionPolicy", "qcow2:gzip")
+	if got := c.compressionCodec("disk.qcow2"); got != codec.Default {
+		t.Fatalf("invalid policy got codec %s, want the default", got)
+	}
+}
+
+func TestFailUploadRemovesTags(t *testing.T) {
+	db := newFakeDb()
+	db.insert(&models.ImageTag{ImageId: "image1", Tag: "lts"})
+	db.insert(&models.ImageTag{ImageId: "image2", Tag: "lts"})
+	c := &UploadController{BaseController{Db: db}}
+	newTestRequest(c, http.MethodPost, "/image-management/v1/images", nil, nil)
+	c.failUpload(models.ImageDB{ImageId: "image1", Status: util.ImageStatusActive}, nil)
+	if tags, _ := c.queryImageTags("image1"); len(tags) != 0 {
+		t.Fatalf("failed upload kept tags %v", tags)
+	}
+	if tags, _ := c.queryImageTags("image2"); len(tags) != 1 {
+		t.Fatalf("tags of another image were removed, got %v", tags)
+	}
+	var images []*models.ImageDB
+	if db.QueryTable("image_d_b", &images, "image_id__exact", "image1"); images[0].Status != util.ImageStatusFailed {
+		t.Fatalf("got status %s, want %s", images[0].Status, util.ImageStatusFailed)
+	}
+}
+
+// onceReader fails when it is read again after EOF, uploads must be streamed once
+type onceReader struct {
+	r   io.Reader
+	eof bool
+}
+
+func (o *onceReader) Read(p []byte) (int, error) {
+	if o.eof {
+		return 0, errors.New("upload read again after EOF")
+	}
+	n, err := o.r.Read(p)
+	o.eof = err == io.EOF
+	return n, err
+}
+
+// Stream content through storeImage into a temporary storage medium
+func storeTestImage(t *testing.T, db *fakeDb, imageId, filename string, content []byte) (*models.ImageDB, string) {
+	dir := newTestDir(t)
+	c := &UploadController{BaseController{Db: db}}
+	newTestRequest(c, http.MethodPost, "/image-management/v1/images", nil, nil)
+	record := &models.ImageDB{ImageId: imageId, FileName: filename}
+	saveFileName := imageId + filename
+	err := c.storeImage(record, dir, saveFileName, strings.TrimSuffix(saveFileName, filepath.Ext(filename)),
+		&onceReader{r: bytes.NewReader(content)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record, dir
+}
+
+func TestStoreImageCompressesIntoSharedBlob(t *testing.T) {
+	useTestStores(t)
+	setTestConfig(t, "compressionPolicy", "default:deflate")
+	db := newFakeDb()
+	content := bytes.Repeat([]byte("disk block "), 4096)
+	sum := sha256.Sum256(content)
+
+	record, dir := storeTestImage(t, db, "image1", "disk.img", content)
+	if record.Checksum != hex.EncodeToString(sum[:]) || record.Size != int64(len(content)) {
+		t.Fatalf("got checksum %s and size %d", record.Checksum, record.Size)
+	}
+	if record.Codec != "deflate" || record.BlobDigest == "" || record.BlobDigest == record.Checksum {
+		t.Fatalf("image wasn't compressed into a blob: %+v", record)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("%d files left in the storage medium", len(files))
+	}
+	zr, err := zip.OpenReader(blobStore.Path(record.BlobDigest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	entry, err := zr.File[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer entry.Close()
+	if got, _ := ioutil.ReadAll(entry); !bytes.Equal(got, content) {
+		t.Fatal("zip entry differs from the upload")
+	}
+
+	// the zip is reproducible, so the same image uploaded again shares the blob
+	again, _ := storeTestImage(t, db, "image2", "disk.img", content)
+	if again.BlobDigest != record.BlobDigest {
+		t.Fatalf("identical uploads got blobs %s and %s", record.BlobDigest, again.BlobDigest)
+	}
+	if blob, _ := readBlob(t, db, record.BlobDigest); blob.RefCount != 2 {
+		t.Fatalf("got ref count %d, want 2", blob.RefCount)
+	}
+}
+
+func TestStoreImageKeepsFileNameInZip(t *testing.T) {
+	useTestStores(t)
+	setTestConfig(t, "compressionPolicy", "default:deflate")
+	for filename, want := range map[string]string{"Disk.QCOW2": "Disk.QCOW2", util.ManifestEntryName: util.ImageEntryName} {
+		record, _ := storeTestImage(t, newFakeDb(), "image1", filename, []byte("disk block"))
+		zr, err := zip.OpenReader(blobStore.Path(record.BlobDigest))
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := []string{}
+		for _, file := range zr.File {
+			names = append(names, file.Name)
+		}
+		_ = zr.Close()
+		if len(names) != 2 || names[0] != want || names[1] != util.ManifestEntryName {
+			t.Fatalf("%s stored as entries %v, want %s and the manifest", filename, names, want)
+		}
+	}
+}
+
+func TestStoreImageKeepsZipUploads(t *testing.T) {
+	useTestStores(t)
+	db := newFakeDb()
+	content := []byte("PK\x05\x06" + strings.Repeat("\x00", 18))
+	record, _ := storeTestImage(t, db, "image1", "package.zip", content)
+	if record.BlobDigest != record.Checksum || record.Codec != "" {
+		t.Fatalf("zip upload was rewritten: %+v", record)
+	}
+	if stored, _ := ioutil.ReadFile(blobStore.Path(record.BlobDigest)); !bytes.Equal(stored, content) {
+		t.Fatal("stored zip differs from the upload")
+	}
+}
+
+func TestStoreImageSplitsIntoChunks(t *testing.T) {
+	useTestStores(t)
+	setTestConfig(t, "chunkStoreEnabled", "true")
+	setTestConfig(t, "chunkAvgKB", "1")
+	db := newFakeDb()
+	content := bytes.Repeat([]byte("disk block "), 4096)
+	record, dir := storeTestImage(t, db, "image1", "disk.img", content)
+	if !record.Chunked || record.BlobDigest != "" || record.Size != int64(len(content)) {
+		t.Fatalf("image wasn't chunked: %+v", record)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("%d files left in the storage medium", len(files))
+	}
+	if chunks, _ := queryImageChunks(db, "image1"); len(chunks) == 0 {
+		t.Fatal("no chunk list was recorded")
+	}
+}
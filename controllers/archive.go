@@ -0,0 +1,224 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// @Title  controllers
+// @Description  zip, tar, tar.gz, tar.zst and gzip downloads generated while images are streamed
+// @Author  GuoZhen Gao (2021/6/30 10:40)
+package controllers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"fileSystem/models"
+	"fileSystem/pkg/codec"
+	"fileSystem/util"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// imageStream reads the original bytes of an image front to back
+type imageStream struct {
+	io.Reader
+	closers []io.Closer
+}
+
+// Close closes everything the stream reads from
+func (s *imageStream) Close() error {
+	var err error
+	for i := len(s.closers) - 1; i >= 0; i-- {
+		if closeErr := s.closers[i].Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Get the download format of the request, isZip=true is the zip format, empty is the image itself
+func (this *BaseController) downloadFormat() (string, error) {
+	format := this.Ctx.Input.Query("format")
+	if format == "" {
+		if this.Ctx.Input.Query("isZip") == "true" {
+			return util.FormatZip, nil
+		}
+		return "", nil
+	}
+	return format, util.ValidateDownloadFormat(format)
+}
+
+// Open the requested entry of an image as a stream with the name and size of its file. Zipped images are
+// inflated while they are read, so nothing is extracted to disk, and verified against their manifest.
+func (this *BaseController) openImageStream(image *models.ImageDB, entryName string) (string, *imageStream, int64, error) {
+	if image.Chunked || image.Codec == codec.None {
+		err := checkUnzippedEntry(image, entryName)
+		if err != nil {
+			return "", nil, 0, err
+		}
+		content, err := this.openStoredImage(image)
+		if err != nil {
+			return "", nil, 0, err
+		}
+		stream := &imageStream{Reader: io.NewSectionReader(content, 0, content.Size()), closers: []io.Closer{content}}
+		return image.FileName, stream, content.Size(), nil
+	}
+
+	reader, file, name, err := openImageEntry(image, entryName)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	expected, err := entryDigest(image, reader.File, file)
+	if err != nil {
+		_ = reader.Close()
+		return "", nil, 0, err
+	}
+	entry, err := file.Open()
+	if err != nil {
+		_ = reader.Close()
+		return "", nil, 0, err
+	}
+	// the digest is checked at the end of the stream, a corrupt image ends in an error instead of EOF
+	stream := &imageStream{Reader: verifyingReader(entry, file.Name, expected), closers: []io.Closer{reader, entry}}
+	return name, stream, int64(file.UncompressedSize64), nil
+}
+
+// Get the file extension and content type of a download format
+func archiveType(format string) (string, string) {
+	switch format {
+	case util.FormatZip:
+		return ".zip", "application/zip"
+	case util.FormatTarGz:
+		return ".tar.gz", "application/gzip"
+	case util.FormatTarZst:
+		return ".tar.zst", "application/zstd"
+	case util.FormatGzip:
+		return ".gz", "application/gzip"
+	default:
+		return ".tar", "application/x-tar"
+	}
+}
+
+// Serve an image as a tar, tar.gz, tar.zst or gzip generated while it is sent, so the size isn't
+// known up front and ranges aren't supported
+func (this *BaseController) serveArchive(clientIp string, image *models.ImageDB, format string) {
+	name, stream, size, err := this.openImageStream(image, this.Ctx.Input.Query("entry"))
+	if err != nil {
+		this.handleEntryError(clientIp, err)
+		return
+	}
+	defer stream.Close()
+
+	extension, contentType := archiveType(format)
+	downloadName := name + extension
+	this.markDownloaded(image.ImageId)
+	this.recordAudit(util.AuditActionDownload, image.ImageId, util.AuditOutcomeSuccess, this.downloadAuditDetails(downloadName))
+	this.setDownloadHeaders(downloadName, contentType)
+
+	archive, err := newArchiveWriter(this.Ctx.ResponseWriter, format, strings.TrimSuffix(downloadName, ".gz"),
+		image.UploadTime)
+	if err == nil {
+		err = archive.add(name, size, image.UploadTime, stream)
+	}
+	if err == nil {
+		err = archive.close()
+	}
+	if err != nil {
+		// the response has started, the client sees a truncated archive
+		this.logger().Error("fail to stream " + format + " of image " + image.ImageId + ": " + err.Error())
+	}
+}
+
+// archiveWriter writes files into a zip, tar, tar.gz or tar.zst, or a single file into a gzip
+type archiveWriter struct {
+	format     string
+	compressor io.WriteCloser
+	out        io.Writer
+	tw         *tar.Writer
+	zw         *zip.Writer
+}
+
+// Create an archive writer of the format, name and modTime are recorded in the gzip header
+func newArchiveWriter(w io.Writer, format, name string, modTime time.Time) (*archiveWriter, error) {
+	a := &archiveWriter{format: format, out: w}
+	var err error
+	switch format {
+	case util.FormatTarGz, util.FormatGzip:
+		a.compressor, err = codec.NewGzipWriter(w, name, modTime, util.CompressionWorkers())
+	case util.FormatTarZst:
+		a.compressor, err = codec.NewZstdWriter(w)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if a.compressor != nil {
+		a.out = a.compressor
+	}
+	switch format {
+	case util.FormatZip:
+		a.zw = codec.Default.NewZipWriter(a.out, util.CompressionWorkers())
+	case util.FormatGzip:
+	default:
+		a.tw = tar.NewWriter(a.out)
+	}
+	return a, nil
+}
+
+// Add a file of size bytes read from r
+func (a *archiveWriter) add(name string, size int64, modTime time.Time, r io.Reader) error {
+	var w io.Writer
+	var err error
+	switch {
+	case a.zw != nil:
+		header := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modTime}
+		header.SetMode(0644)
+		w, err = a.zw.CreateHeader(header)
+	case a.tw != nil:
+		w, err = a.tw, a.tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Size:     size,
+			Mode:     0644,
+			ModTime:  modTime,
+		})
+	default:
+		w = a.out
+	}
+	if err != nil {
+		return err
+	}
+	written, err := io.Copy(w, r)
+	if err == nil && written != size {
+		err = errors.New(name + " is " + strconv.FormatInt(written, 10) + " bytes instead of " +
+			strconv.FormatInt(size, 10))
+	}
+	return err
+}
+
+// Finish the archive, nothing may be added afterwards
+func (a *archiveWriter) close() error {
+	var err error
+	switch {
+	case a.zw != nil:
+		err = a.zw.Close()
+	case a.tw != nil:
+		err = a.tw.Close()
+	}
+	if err == nil && a.compressor != nil {
+		err = a.compressor.Close()
+	}
+	return err
+}
@@ -20,10 +20,12 @@
 package controllers
 
 import (
+	"fileSystem/models"
 	"fileSystem/pkg/dbAdpater"
 	"fileSystem/util"
 	"github.com/astaxie/beego"
 	log "github.com/sirupsen/logrus"
+	"strings"
 )
 
 // BaseController   Define the base for other controllers
@@ -32,28 +34,101 @@ type BaseController struct {
 	Db dbAdpater.Database
 }
 
+// Images uploaded before status tracking have an empty status and are available
+func imageAvailable(image *models.ImageDB) bool {
+	return image.Status == "" || image.Status == util.ImageStatusActive
+}
+
+// Get a logger carrying request id, user, image and route of the current request
+func (c *BaseController) logger() *log.Entry {
+	return log.WithFields(util.RequestLogFields(c.Ctx))
+}
+
 // To display log for received message
 func (c *BaseController) displayReceivedMsg(clientIp string) {
-	log.Info("Received message from ClientIP [" + clientIp + util.Operation + c.Ctx.Request.Method + "]" +
+	c.logger().Info("Received message from ClientIP [" + clientIp + util.Operation + c.Ctx.Request.Method + "]" +
 		util.Resource + c.Ctx.Input.URL() + "]")
 }
 
 // Write response
 func (c *BaseController) writeResponse(msg string, code int) {
 	c.Data["json"] = msg
-	c.Ctx.ResponseWriter.WriteHeader(code)
+	c.Ctx.Output.SetStatus(code)
 	c.ServeJSON()
 }
 
 // Write error response
 func (c *BaseController) writeErrorResponse(errMsg string, code int) {
-	log.Error(errMsg)
+	c.logger().Error(errMsg)
 	c.writeResponse(errMsg, code)
 }
 
 // Handled logging for error case
 func (c *BaseController) HandleLoggingForError(clientIp string, code int, errMsg string) {
 	c.writeErrorResponse(errMsg, code)
-	log.Info("Response message for ClientIP [" + clientIp + util.Operation + c.Ctx.Request.Method + "]" +
+	c.logger().Info("Response message for ClientIP [" + clientIp + util.Operation + c.Ctx.Request.Method + "]" +
 		util.Resource + c.Ctx.Input.URL() + "] Result [Failure: " + errMsg + ".]")
 }
+
+// Report whether the request was routed through the v2 api
+func (c *BaseController) isApiV2() bool {
+	return strings.HasPrefix(c.Ctx.Input.URL(), util.ApiV2Prefix)
+}
+
+// Get the request id assigned to the current request
+func (c *BaseController) requestId() string {
+	if id, ok := c.Ctx.Input.GetData(util.RequestIdKey).(string); ok && id != "" {
+		return id
+	}
+	// the request id filter normally assigns the id, this only covers requests that bypassed it
+	id := createImageID()
+	c.Ctx.Input.SetData(util.RequestIdKey, id)
+	return id
+}
+
+// Handled logging for error case, v1 clients keep the legacy message and status
+// while v2 clients get the error envelope with a stable error code
+func (c *BaseController) HandleApiError(clientIp string, v1Code int, v1Msg string, apiErr util.ApiError) {
+	c.auditFailure(apiErr)
+	if !c.isApiV2() {
+		c.HandleLoggingForError(clientIp, v1Code, v1Msg)
+		return
+	}
+	apiErr.RequestId = c.requestId()
+	c.logger().Error(apiErr.Code + ": " + apiErr.Message + " " + apiErr.Details)
+	c.Data["json"] = apiErr
+	c.Ctx.Output.SetStatus(apiErr.Status)
+	c.ServeJSON()
+	c.logger().Info("Response message for ClientIP [" + clientIp + util.Operation + c.Ctx.Request.Method + "]" +
+		util.Resource + c.Ctx.Input.URL() + "] Result [Failure: " + apiErr.Code + ".]")
+}
+
+// Query the image record, the error response is written when the image can't be returned
+func (c *BaseController) queryImage(clientIp, imageId, v1Msg string) (*models.ImageDB, bool) {
+	var images []*models.ImageDB
+	num, err := c.Db.QueryTable("image_d_b", &images, "image_id__exact", imageId)
+	if err != nil {
+		c.HandleApiError(clientIp, util.StatusNotFound, v1Msg, util.ErrDatabaseUnavailable.WithDetails(err.Error()))
+		return nil, false
+	}
+	if num == 0 {
+		c.HandleApiError(clientIp, util.StatusNotFound, v1Msg, util.ErrImageNotFound.WithDetails("imageId "+imageId))
+		return nil, false
+	}
+	return images[0], true
+}
+
+// Read the limit and offset of a list request, the error response is written when they are invalid
+func (c *BaseController) listPage(clientIp string) (int64, int64, bool) {
+	limit, err := c.GetInt64("limit", util.DefaultImageListLimit)
+	if err != nil || limit < 0 {
+		c.HandleApiError(clientIp, util.BadRequest, "limit is invalid", util.ErrInvalidParameter.WithDetails("limit"))
+		return 0, 0, false
+	}
+	offset, err := c.GetInt64("offset", 0)
+	if err != nil || offset < 0 {
+		c.HandleApiError(clientIp, util.BadRequest, "offset is invalid", util.ErrInvalidParameter.WithDetails("offset"))
+		return 0, 0, false
+	}
+	return limit, offset, true
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"encoding/json"
+	"fileSystem/models"
+	"fileSystem/util"
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Prepare a controller to serve a request, the response is written to the returned recorder
+func newTestRequest(controller beego.ControllerInterface, method, url string, body io.Reader,
+	params map[string]string) (*http.Request, *httptest.ResponseRecorder) {
+	req := httptest.NewRequest(method, url, body)
+	rw := httptest.NewRecorder()
+	ctx := context.NewContext()
+	ctx.Reset(rw, req)
+	for key, value := range params {
+		ctx.Input.SetParam(key, value)
+	}
+	controller.Init(ctx, "TestController", method, controller)
+	return req, rw
+}
+
+// Create a directory removed when the test ends, with a trailing separator like the storage paths
+func newTestDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "filesystem-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return dir + "/"
+}
+
+// Set an app.conf value for the duration of a test
+func setTestConfig(t *testing.T, key, value string) {
+	old := beego.AppConfig.String(key)
+	if err := beego.AppConfig.Set(key, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = beego.AppConfig.Set(key, old) })
+}
+
+func TestApiErrorV2Envelope(t *testing.T) {
+	c := &ImageController{BaseController{Db: newFakeDb()}}
+	_, rw := newTestRequest(c, http.MethodGet, "/image-management/v2/images/missing", nil,
+		map[string]string{":imageId": "missing"})
+	// assigned by the request id filter
+	c.Ctx.Input.SetData(util.RequestIdKey, "request-1")
+	c.Get()
+
+	if rw.Code != util.StatusNotFound {
+		t.Fatalf("got status %d, want %d", rw.Code, util.StatusNotFound)
+	}
+	var apiErr util.ApiError
+	if err := json.Unmarshal(rw.Body.Bytes(), &apiErr); err != nil {
+		t.Fatalf("invalid error envelope %q: %v", rw.Body.String(), err)
+	}
+	if apiErr.Code != "IMAGE_NOT_FOUND" || apiErr.RequestId != "request-1" || apiErr.Details != "imageId missing" {
+		t.Fatalf("unexpected error envelope %+v", apiErr)
+	}
+}
+
+func TestApiErrorV1KeepsLegacyMessage(t *testing.T) {
+	c := &ImageController{BaseController{Db: newFakeDb()}}
+	_, rw := newTestRequest(c, http.MethodGet, "/image-management/v1/images/missing", nil,
+		map[string]string{":imageId": "missing"})
+	c.Get()
+
+	if rw.Code != util.StatusNotFound {
+		t.Fatalf("got status %d, want %d", rw.Code, util.StatusNotFound)
+	}
+	if body := strings.TrimSpace(rw.Body.String()); body != `"fail to query this imageId in database"` {
+		t.Fatalf("got body %s", body)
+	}
+}
+
+func TestApiErrorV2ServesFoundImage(t *testing.T) {
+	db := newFakeDb()
+	db.insert(&models.ImageDB{ImageId: "image1", SaveFileName: "image1.zip"})
+	c := &ImageController{BaseController{Db: db}}
+	_, rw := newTestRequest(c, http.MethodGet, "/image-management/v2/images/image1", nil,
+		map[string]string{":imageId": "image1"})
+	c.Get()
+
+	if rw.Code != util.StatusOK || !strings.Contains(rw.Body.String(), `"fileName":"image1.zip"`) {
+		t.Fatalf("got status %d and body %s", rw.Code, rw.Body.String())
+	}
+}
+
+func TestWithDetailsKeepsCatalogue(t *testing.T) {
+	apiErr := util.ErrImageNotFound.WithDetails("imageId a")
+	if apiErr.Details != "imageId a" || util.ErrImageNotFound.Details != "" {
+		t.Fatalf("WithDetails changed the catalogue: %+v", util.ErrImageNotFound)
+	}
+}
+
+func TestLoggerCarriesRequestFields(t *testing.T) {
+	c := &ImageController{BaseController{Db: newFakeDb()}}
+	newTestRequest(c, http.MethodGet, "/image-management/v1/images/image1?userId=user1", nil,
+		map[string]string{":imageId": "image1"})
+	c.Ctx.Input.SetData(util.RequestIdKey, "request-1")
+
+	fields := c.logger().Data
+	for key, want := range map[string]string{
+		util.RequestIdKey: "request-1",
+		util.ImageIdKey:   "image1",
+		util.UserId:       "user1",
+		"clientIp":        "192.0.2.1",
+	} {
+		if fields[key] != want {
+			t.Fatalf("got %s %v, want %s", key, fields[key], want)
+		}
+	}
+}
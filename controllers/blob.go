@@ -0,0 +1,180 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// @Title  controllers
+// @Description  reference counted blob and chunk storage for filesystem
+// @Author  GuoZhen Gao (2021/6/30 10:40)
+package controllers
+
+import (
+	"fileSystem/models"
+	"fileSystem/pkg/dbAdpater"
+	"fileSystem/pkg/storage"
+	"fileSystem/pkg/worker"
+	"fileSystem/util"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"time"
+)
+
+var (
+	blobStore  = storage.NewBlobStore(util.LocalStoragePath + util.BlobDirectory)
+	chunkStore = storage.NewBlobStore(util.LocalStoragePath + util.ChunkDirectory)
+)
+
+// Take count references to a blob or chunk, row is inserted when this is the first reference.
+// Returns whether row was inserted.
+func claimRefs(db dbAdpater.Database, table, digest string, count int64, row interface{}) (bool, error) {
+	filters := map[string]interface{}{"digest__exact": digest}
+	num, err := db.IncrementField(table, filters, "ref_count", count)
+	if err != nil || num > 0 {
+		return false, err
+	}
+	err = db.InsertData(row)
+	if err != nil && err.Error() != util.LastInsertIdNotSupported {
+		return false, err
+	}
+	return true, nil
+}
+
+// Read whether a stored blob is encrypted
+func blobEncrypted(db dbAdpater.Database, digest string) (bool, error) {
+	blob := &models.Blob{Digest: digest}
+	err := db.ReadData(blob)
+	return blob.Encrypted, err
+}
+
+// Drop count references to a blob or chunk, the collector removes it once unreferenced for the grace period
+func releaseRefs(db dbAdpater.Database, table, digest string, count int64) error {
+	filters := map[string]interface{}{"digest__exact": digest}
+	_, err := db.IncrementField(table, map[string]interface{}{
+		"digest__exact":  digest,
+		"ref_count__gte": count,
+	}, "ref_count", -count)
+	if err != nil {
+		return err
+	}
+	_, err = db.UpdateWithFilters(table, filters, map[string]interface{}{"update_time": time.Now()})
+	return err
+}
+
+// Move a file of the given digest and size into the blob store and take a reference to it,
+// an identical blob is shared instead of storing another copy. Returns whether the stored blob is encrypted,
+// which is the one of the shared blob rather than the one of the file.
+func storeBlob(db dbAdpater.Database, path, digest string, size int64, encrypted bool) (bool, error) {
+	// the reference is taken under the digest lock so the collector can't remove the blob in between
+	unlock := blobStore.Lock(digest)
+	defer unlock()
+	inserted, err := claimRefs(db, "blob", digest, 1,
+		&models.Blob{Digest: digest, Size: size, RefCount: 1, Encrypted: encrypted})
+	if err != nil {
+		return false, err
+	}
+	stored := encrypted
+	if inserted {
+		// a file the collector failed to remove belongs to no row, it is replaced
+		err = blobStore.Remove(digest)
+	} else {
+		stored, err = blobEncrypted(db, digest)
+	}
+	var created bool
+	if err == nil {
+		created, err = blobStore.Place(path, digest)
+	}
+	if err == nil && created && !inserted && stored != encrypted {
+		// the file of the shared blob was lost, the one placed instead is recorded on the rows sharing it
+		stored = encrypted
+		err = updateBlobEncrypted(db, digest, encrypted)
+	}
+	if err != nil {
+		_ = releaseRefs(db, "blob", digest, 1)
+		return false, err
+	}
+	if !created {
+		log.Info("deduplicated upload into existing blob " + digest)
+	}
+	return stored, nil
+}
+
+// Record whether a blob is encrypted on its row and on the images sharing it
+func updateBlobEncrypted(db dbAdpater.Database, digest string, encrypted bool) error {
+	params := map[string]interface{}{"encrypted": encrypted}
+	_, err := db.UpdateWithFilters("blob", map[string]interface{}{"digest__exact": digest}, params)
+	if err != nil {
+		return err
+	}
+	_, err = db.UpdateWithFilters("image_d_b", map[string]interface{}{"blob_digest__exact": digest}, params)
+	return err
+}
+
+// Drop a reference to a blob
+func releaseBlob(db dbAdpater.Database, digest string) error {
+	return releaseRefs(db, "blob", digest, 1)
+}
+
+// NewBlobGcJob   Create the background job removing blobs and chunks no image refers to
+func NewBlobGcJob(db dbAdpater.Database) worker.Job {
+	return func() error {
+		grace := util.GetAppConfigInt64("blobGcGraceMinutes", util.DefaultBlobGcGraceMins)
+		filters := map[string]interface{}{
+			"ref_count__lte":   0,
+			"update_time__lte": time.Now().Add(-time.Duration(grace) * time.Minute),
+		}
+		var blobs []*models.Blob
+		_, err := db.QueryTableWithFilters("blob", &blobs, filters, nil, 0, 0)
+		if err != nil {
+			return err
+		}
+		for _, blob := range blobs {
+			err = collectUnreferenced(db, "blob", blobStore, blob.Digest, blob.Size)
+			if err != nil {
+				return err
+			}
+		}
+		var chunks []*models.Chunk
+		_, err = db.QueryTableWithFilters("chunk", &chunks, filters, nil, 0, 0)
+		if err != nil {
+			return err
+		}
+		for _, chunk := range chunks {
+			err = collectUnreferenced(db, "chunk", chunkStore, chunk.Digest, chunk.Size)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Remove an unreferenced blob or chunk, it is kept when an upload took a reference since it was queried
+func collectUnreferenced(db dbAdpater.Database, table string, store *storage.BlobStore, digest string,
+	size int64) error {
+	unlock := store.Lock(digest)
+	defer unlock()
+	num, err := db.DeleteWithFilters(table, map[string]interface{}{
+		"digest__exact":  digest,
+		"ref_count__lte": 0,
+	})
+	if err != nil || num == 0 {
+		return err
+	}
+	err = store.Remove(digest)
+	if err != nil {
+		return err
+	}
+	log.Info("removed unreferenced " + table + " " + digest + " of " + strconv.FormatInt(size, 10) + " bytes")
+	return nil
+}
@@ -0,0 +1,235 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fileSystem/models"
+	"fileSystem/pkg/storage"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Point the blob and chunk stores to a temporary directory for the duration of a test
+func useTestStores(t *testing.T) string {
+	root := newTestDir(t)
+	blobs, chunks := blobStore, chunkStore
+	blobStore = storage.NewBlobStore(filepath.Join(root, "blobs"))
+	chunkStore = storage.NewBlobStore(filepath.Join(root, "chunks"))
+	t.Cleanup(func() { blobStore, chunkStore = blobs, chunks })
+	return root
+}
+
+// Write content to a new file to be stored, returns its path and digest
+func writeUpload(t *testing.T, root, content string) (string, string) {
+	file, err := ioutil.TempFile(root, "upload-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err = file.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(content))
+	return file.Name(), hex.EncodeToString(sum[:])
+}
+
+// Store content as a blob, returns its digest
+func storeTestBlob(t *testing.T, db *fakeDb, root, content string) string {
+	path, digest := writeUpload(t, root, content)
+	if _, err := storeBlob(db, path, digest, int64(len(content)), false); err != nil {
+		t.Fatal(err)
+	}
+	return digest
+}
+
+func readBlob(t *testing.T, db *fakeDb, digest string) (*models.Blob, bool) {
+	blob := &models.Blob{Digest: digest}
+	if err := db.ReadData(blob); err != nil {
+		return nil, false
+	}
+	return blob, true
+}
+
+func blobFileExists(digest string) bool {
+	_, err := os.Stat(blobStore.Path(digest))
+	return err == nil
+}
+
+func TestStoreBlobSharesIdenticalContent(t *testing.T) {
+	root := useTestStores(t)
+	db := newFakeDb()
+	var digest string
+	for i := 0; i < 2; i++ {
+		var path string
+		path, digest = writeUpload(t, root, "same content")
+		if _, err := storeBlob(db, path, digest, 12, false); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("upload %d was left behind: %v", i, err)
+		}
+	}
+
+	blob, ok := readBlob(t, db, digest)
+	if !ok || blob.RefCount != 2 || blob.Size != 12 {
+		t.Fatalf("unexpected blob %+v", blob)
+	}
+	if rows := db.tables["blob"]; len(rows) != 1 {
+		t.Fatalf("got %d blob rows, want 1", len(rows))
+	}
+	if !blobFileExists(digest) {
+		t.Fatal("blob file is missing")
+	}
+}
+
+func TestReleaseBlobNeverGoesNegative(t *testing.T) {
+	root := useTestStores(t)
+	db := newFakeDb()
+	digest := storeTestBlob(t, db, root, "content")
+	for i := 0; i < 2; i++ {
+		if err := releaseBlob(db, digest); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if blob, _ := readBlob(t, db, digest); blob.RefCount != 0 {
+		t.Fatalf("got ref count %d, want 0", blob.RefCount)
+	}
+}
+
+func TestBlobGcRemovesUnreferencedBlobs(t *testing.T) {
+	root := useTestStores(t)
+	db := newFakeDb()
+	unused := storeTestBlob(t, db, root, "unused")
+	used := storeTestBlob(t, db, root, "used")
+	if err := releaseBlob(db, unused); err != nil {
+		t.Fatal(err)
+	}
+
+	// within the grace period the unreferenced blob is kept for uploads about to share it
+	setTestConfig(t, "blobGcGraceMinutes", "60")
+	if err := NewBlobGcJob(db)(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := readBlob(t, db, unused); !ok || !blobFileExists(unused) {
+		t.Fatal("unreferenced blob was removed within the grace period")
+	}
+
+	setTestConfig(t, "blobGcGraceMinutes", "0")
+	if err := NewBlobGcJob(db)(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := readBlob(t, db, unused); ok || blobFileExists(unused) {
+		t.Fatal("unreferenced blob was kept")
+	}
+	if blob, ok := readBlob(t, db, used); !ok || blob.RefCount != 1 || !blobFileExists(used) {
+		t.Fatal("referenced blob was removed")
+	}
+}
+
+func TestStoreBlobRevivesReleasedBlob(t *testing.T) {
+	root := useTestStores(t)
+	db := newFakeDb()
+	digest := storeTestBlob(t, db, root, "content")
+	if err := releaseBlob(db, digest); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new reference taken before the collector runs keeps the blob
+	storeTestBlob(t, db, root, "content")
+	setTestConfig(t, "blobGcGraceMinutes", "0")
+	if err := NewBlobGcJob(db)(); err != nil {
+		t.Fatal(err)
+	}
+	if blob, ok := readBlob(t, db, digest); !ok || blob.RefCount != 1 || !blobFileExists(digest) {
+		t.Fatal("blob referenced again was removed")
+	}
+}
+
+func TestPurgeImageReleasesSharedBlob(t *testing.T) {
+	root := useTestStores(t)
+	db := newFakeDb()
+	digest := storeTestBlob(t, db, root, "content")
+	storeTestBlob(t, db, root, "content")
+	db.insert(&models.ImageDB{ImageId: "image1", BlobDigest: digest})
+	db.insert(&models.ImageDB{ImageId: "image2", BlobDigest: digest})
+
+	if err := purgeImage(db, readImage(t, db, "image1")); err != nil {
+		t.Fatal(err)
+	}
+	if blob, _ := readBlob(t, db, digest); blob.RefCount != 1 || !blobFileExists(digest) {
+		t.Fatalf("blob shared with image2 wasn't kept: %+v", blob)
+	}
+}
+
+func TestStoreBlobKeepsEncryptionOfSharedBlob(t *testing.T) {
+	root := useTestStores(t)
+	db := newFakeDb()
+	path, digest := writeUpload(t, root, "content")
+	if _, err := storeBlob(db, path, digest, 7, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// encryption was disabled since, the new upload still shares the encrypted file
+	path, _ = writeUpload(t, root, "content")
+	encrypted, err := storeBlob(db, path, digest, 7, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !encrypted {
+		t.Fatal("deduplicated upload wasn't reported as encrypted")
+	}
+	if blob, _ := readBlob(t, db, digest); !blob.Encrypted {
+		t.Fatal("blob row lost its encryption flag")
+	}
+}
+
+func TestStoreBlobRecordsReplacedFile(t *testing.T) {
+	root := useTestStores(t)
+	db := newFakeDb()
+	path, digest := writeUpload(t, root, "content")
+	if _, err := storeBlob(db, path, digest, 7, true); err != nil {
+		t.Fatal(err)
+	}
+	err := db.InsertData(&models.ImageDB{ImageId: "image1", BlobDigest: digest, Encrypted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(blobStore.Path(digest)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the lost file is replaced by a plain one, every row sharing the blob has to follow
+	path, _ = writeUpload(t, root, "content")
+	encrypted, err := storeBlob(db, path, digest, 7, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encrypted || !blobFileExists(digest) {
+		t.Fatalf("got encrypted %v, file exists %v", encrypted, blobFileExists(digest))
+	}
+	if blob, _ := readBlob(t, db, digest); blob.Encrypted || blob.RefCount != 2 {
+		t.Fatalf("unexpected blob %+v", blob)
+	}
+	image := &models.ImageDB{ImageId: "image1"}
+	if err = db.ReadData(image); err != nil || image.Encrypted {
+		t.Fatalf("image sharing the blob still claims encryption: %v", err)
+	}
+}
@@ -0,0 +1,250 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// @Title  controllers
+// @Description  content defined chunk storage for filesystem
+// @Author  GuoZhen Gao (2021/6/30 10:40)
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fileSystem/models"
+	"fileSystem/pkg/chunker"
+	"fileSystem/pkg/dbAdpater"
+	"fileSystem/util"
+	"io"
+	"sort"
+	"sync"
+)
+
+const imageChunkInsertBulk = 100
+
+var errChunkMissing = errors.New("chunk of image is missing in storage")
+
+// Split an image into content defined chunks as it is read, store the chunks not stored yet and record
+// the chunk list of the image. Returns the number of chunks.
+func storeImageChunks(db dbAdpater.Database, imageId string, r io.Reader) (int64, error) {
+	avg := util.GetAppConfigInt64("chunkAvgKB", util.DefaultChunkAvgKB) * 1024
+	c, err := chunker.New(r, int(avg))
+	if err != nil {
+		return 0, err
+	}
+
+	refs := map[string]int64{}
+	var rows []*models.ImageChunk
+	var offset int64
+	encrypted := util.EncryptionEnabled()
+	for {
+		data, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = storeChunk(db, data, encrypted, refs, &rows, imageId, offset)
+		}
+		if err != nil {
+			releaseChunkRefs(db, refs)
+			return 0, err
+		}
+		offset += int64(len(data))
+	}
+	for start := 0; start < len(rows); start += imageChunkInsertBulk {
+		end := start + imageChunkInsertBulk
+		if end > len(rows) {
+			end = len(rows)
+		}
+		_, err = db.InsertMultiData(imageChunkInsertBulk, rows[start:end])
+		if err != nil && err.Error() != util.LastInsertIdNotSupported {
+			releaseChunkRefs(db, refs)
+			_, _ = db.DeleteWithFilters("image_chunk", map[string]interface{}{"image_id__exact": imageId})
+			return 0, err
+		}
+	}
+	return int64(len(rows)), nil
+}
+
+// Store one chunk unless it is stored already and take a reference to it. A chunk stored already keeps
+// whether it is encrypted, a missing file of it is written again the same way.
+func storeChunk(db dbAdpater.Database, data []byte, encrypted bool, refs map[string]int64,
+	rows *[]*models.ImageChunk, imageId string, offset int64) error {
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	// the reference is taken under the digest lock so the collector can't remove the chunk in between
+	unlock := chunkStore.Lock(digest)
+	inserted, err := claimRefs(db, "chunk", digest, 1,
+		&models.Chunk{Digest: digest, Size: int64(len(data)), RefCount: 1, Encrypted: encrypted})
+	if err == nil {
+		if inserted {
+			// a file the collector failed to remove belongs to no row, it is replaced
+			err = chunkStore.Remove(digest)
+		} else {
+			chunk := &models.Chunk{Digest: digest}
+			err = db.ReadData(chunk)
+			encrypted = chunk.Encrypted
+		}
+		var sealed []byte
+		if err == nil {
+			sealed, err = sealStoredData(data, encrypted)
+		}
+		if err == nil {
+			_, err = chunkStore.Write(digest, sealed)
+		}
+		if err != nil {
+			_ = releaseRefs(db, "chunk", digest, 1)
+		}
+	}
+	unlock()
+	if err != nil {
+		return err
+	}
+	refs[digest]++
+	*rows = append(*rows, &models.ImageChunk{
+		ImageId:   imageId,
+		Seq:       int64(len(*rows)),
+		Digest:    digest,
+		Offset:    offset,
+		Size:      int64(len(data)),
+		Encrypted: encrypted,
+	})
+	return nil
+}
+
+// Drop the references counted per chunk digest, failures are left to be fixed by a later release
+func releaseChunkRefs(db dbAdpater.Database, refs map[string]int64) {
+	for digest, count := range refs {
+		_ = releaseRefs(db, "chunk", digest, count)
+	}
+}
+
+// Query the chunk list of a chunked image ordered by position
+func queryImageChunks(db dbAdpater.Database, imageId string) ([]*models.ImageChunk, error) {
+	var chunks []*models.ImageChunk
+	_, err := db.QueryTableWithFilters("image_chunk", &chunks,
+		map[string]interface{}{"image_id__exact": imageId}, []string{"seq"}, 0, 0)
+	return chunks, err
+}
+
+// Drop the chunk references of an image and its chunk list
+func releaseImageChunks(db dbAdpater.Database, imageId string) error {
+	chunks, err := queryImageChunks(db, imageId)
+	if err != nil {
+		return err
+	}
+	refs := map[string]int64{}
+	for _, chunk := range chunks {
+		refs[chunk.Digest]++
+	}
+	for digest, count := range refs {
+		err = releaseRefs(db, "chunk", digest, count)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = db.DeleteWithFilters("image_chunk", map[string]interface{}{"image_id__exact": imageId})
+	return err
+}
+
+// chunkReaderAt reassembles a chunked image, reads spanning chunks are served from consecutive chunk files
+type chunkReaderAt struct {
+	chunks []*models.ImageChunk
+	size   int64
+
+	mu      sync.Mutex
+	current int
+	file    *storedFile
+}
+
+func newChunkReaderAt(chunks []*models.ImageChunk) *chunkReaderAt {
+	r := &chunkReaderAt{chunks: chunks, current: -1}
+	if len(chunks) > 0 {
+		last := chunks[len(chunks)-1]
+		r.size = last.Offset + last.Size
+	}
+	return r
+}
+
+// Size returns the size of the reassembled image
+func (r *chunkReaderAt) Size() int64 {
+	return r.size
+}
+
+// ReadAt reads the reassembled image at off
+func (r *chunkReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	n := 0
+	for n < len(p) && off < r.size {
+		i := sort.Search(len(r.chunks), func(i int) bool {
+			return r.chunks[i].Offset+r.chunks[i].Size > off
+		})
+		f, err := r.open(i)
+		if err != nil {
+			return n, err
+		}
+		chunk := r.chunks[i]
+		want := p[n:]
+		if remaining := chunk.Offset + chunk.Size - off; int64(len(want)) > remaining {
+			want = want[:remaining]
+		}
+		read, err := f.ReadAt(want, off-chunk.Offset)
+		n += read
+		off += int64(read)
+		if err != nil && !(err == io.EOF && read == len(want)) {
+			return n, errChunkMissing
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Open the file of the i-th chunk, the last opened file is kept for sequential reads
+func (r *chunkReaderAt) open(i int) (*storedFile, error) {
+	if i == r.current {
+		return r.file, nil
+	}
+	if r.file != nil {
+		_ = r.file.Close()
+		r.file = nil
+	}
+	f, err := openStoredFile(chunkStore.Path(r.chunks[i].Digest), r.chunks[i].Encrypted)
+	if err != nil {
+		r.current = -1
+		return nil, errChunkMissing
+	}
+	r.file = f
+	r.current = i
+	return f, nil
+}
+
+// Close releases the open chunk file
+func (r *chunkReaderAt) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	r.current = -1
+	return err
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"bytes"
+	"fileSystem/models"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+// Store content as a chunked image, returns the reassembled image
+func storeTestChunks(t *testing.T, db *fakeDb, imageId string, content []byte) []byte {
+	if _, err := storeImageChunks(db, imageId, bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	chunks, err := queryImageChunks(db, imageId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newChunkReaderAt(chunks)
+	defer r.Close()
+	var out bytes.Buffer
+	if _, err = io.Copy(&out, io.NewSectionReader(r, 0, r.Size())); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func TestChunkedImagesShareChunks(t *testing.T) {
+	useTestStores(t)
+	setTestConfig(t, "chunkAvgKB", "1")
+	db := newFakeDb()
+	base := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(base)
+	appended := append(append([]byte{}, base...), []byte("appended to the base image")...)
+
+	if got := storeTestChunks(t, db, "image1", base); !bytes.Equal(got, base) {
+		t.Fatal("reassembled image1 differs from its upload")
+	}
+	if got := storeTestChunks(t, db, "image2", appended); !bytes.Equal(got, appended) {
+		t.Fatal("reassembled image2 differs from its upload")
+	}
+	chunks1, _ := queryImageChunks(db, "image1")
+	chunks2, _ := queryImageChunks(db, "image2")
+	if stored := len(db.tables["chunk"]); stored >= len(chunks1)+len(chunks2)-1 {
+		t.Fatalf("got %d stored chunks for %d and %d image chunks", stored, len(chunks1), len(chunks2))
+	}
+
+	if err := releaseImageChunks(db, "image1"); err != nil {
+		t.Fatal(err)
+	}
+	if rows, _ := queryImageChunks(db, "image1"); len(rows) != 0 {
+		t.Fatalf("chunk list of the released image was kept")
+	}
+	for _, row := range db.tables["chunk"] {
+		chunk := row.Interface().(*models.Chunk)
+		var used int64
+		for _, imageChunk := range chunks2 {
+			if imageChunk.Digest == chunk.Digest {
+				used++
+			}
+		}
+		if chunk.RefCount != used {
+			t.Fatalf("chunk %s has %d references, image2 uses it %d times", chunk.Digest, chunk.RefCount, used)
+		}
+	}
+	if got := storeTestChunks(t, db, "image3", appended); !bytes.Equal(got, appended) {
+		t.Fatal("reassembled image3 differs from its upload")
+	}
+}
+
+func TestChunkReaderReportsMissingChunk(t *testing.T) {
+	useTestStores(t)
+	setTestConfig(t, "chunkAvgKB", "1")
+	db := newFakeDb()
+	content := make([]byte, 16*1024)
+	rand.New(rand.NewSource(2)).Read(content)
+	storeTestChunks(t, db, "image1", content)
+	chunks, _ := queryImageChunks(db, "image1")
+	if err := chunkStore.Remove(chunks[len(chunks)-1].Digest); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newChunkReaderAt(chunks)
+	defer r.Close()
+	_, err := io.Copy(ioutil.Discard, io.NewSectionReader(r, 0, r.Size()))
+	if err != errChunkMissing {
+		t.Fatalf("got error %v, want %v", err, errChunkMissing)
+	}
+}
@@ -0,0 +1,397 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"fileSystem/pkg/dbAdpater"
+	"github.com/astaxie/beego/orm"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// fakeDb is an in-memory dbAdpater.Database, methods the tests don't use are left to the nil embedded adapter.
+// Tables hold pointers to model structs and are filtered the way beego filters them.
+type fakeDb struct {
+	dbAdpater.Database
+	mu      sync.Mutex
+	tables  map[string][]reflect.Value
+	nextId  int64
+	pingErr error
+	// inserts into these tables fail with the given error
+	insertErrs map[string]error
+}
+
+func newFakeDb() *fakeDb {
+	return &fakeDb{tables: map[string][]reflect.Value{}}
+}
+
+// Convert a Go name to its column or table name the way beego does
+func snakeName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Find the struct field of a column, named by its column tag or after the field
+func columnField(t reflect.Type, column string) reflect.StructField {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := snakeName(field.Name)
+		for _, option := range strings.Split(field.Tag.Get("orm"), ";") {
+			if strings.HasPrefix(option, "column(") {
+				name = strings.TrimSuffix(strings.TrimPrefix(option, "column("), ")")
+			}
+		}
+		if name == column {
+			return field
+		}
+	}
+	panic("fake db: unknown column " + column + " of " + t.Name())
+}
+
+// Order two column values, ok is false when they can't be compared
+func compare(a, b interface{}) (int, bool) {
+	switch x := a.(type) {
+	case int64:
+		y, ok := b.(int64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		y, ok := b.(string)
+		return strings.Compare(x, y), ok
+	case time.Time:
+		// unset times are stored as NULL, which never compares
+		y, ok := b.(time.Time)
+		if !ok || x.IsZero() || y.IsZero() {
+			return 0, false
+		}
+		switch {
+		case x.Before(y):
+			return -1, true
+		case x.After(y):
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// Check a filter such as user_id__exact or event_time__gte, a key without operator is an exact match. Zero
+// values are NULL for isnull.
+func matchFilter(row reflect.Value, key string, value interface{}) bool {
+	column, op := key, "exact"
+	if i := strings.LastIndex(key, "__"); i >= 0 {
+		column, op = key[:i], key[i+2:]
+	}
+	if values, ok := value.([]interface{}); ok && len(values) == 1 {
+		value = values[0]
+	}
+	actual := row.FieldByIndex(columnField(row.Type(), column).Index).Interface()
+	if v := reflect.ValueOf(value); v.Kind() >= reflect.Int && v.Kind() <= reflect.Int64 {
+		value = v.Int()
+	}
+	switch op {
+	case "exact":
+		return actual == value
+	case "in":
+		list := reflect.ValueOf(value)
+		for i := 0; i < list.Len(); i++ {
+			if list.Index(i).Interface() == actual {
+				return true
+			}
+		}
+		return false
+	case "isnull":
+		return reflect.ValueOf(actual).IsZero() == value.(bool)
+	}
+	c, ok := compare(actual, value)
+	switch op {
+	case "gt":
+		return ok && c > 0
+	case "gte":
+		return ok && c >= 0
+	case "lt":
+		return ok && c < 0
+	case "lte":
+		return ok && c <= 0
+	}
+	panic("fake db: unsupported filter " + key)
+}
+
+func (db *fakeDb) match(row reflect.Value, filters map[string]interface{}) bool {
+	for key, value := range filters {
+		if !matchFilter(row, key, value) {
+			return false
+		}
+	}
+	return true
+}
+
+func (db *fakeDb) rows(table string, filters map[string]interface{}) []reflect.Value {
+	var rows []reflect.Value
+	for _, row := range db.tables[table] {
+		if db.match(row.Elem(), filters) {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// Copy rows into a pointer to a slice of struct pointers
+func fill(container interface{}, rows []reflect.Value) int64 {
+	target := reflect.ValueOf(container).Elem()
+	result := reflect.MakeSlice(target.Type(), 0, len(rows))
+	for _, row := range rows {
+		item := reflect.New(row.Elem().Type())
+		item.Elem().Set(row.Elem())
+		result = reflect.Append(result, item)
+	}
+	target.Set(result)
+	return int64(len(rows))
+}
+
+// Add a copy of a model to its table, auto ids and unset auto_now times are filled in as the database would
+func (db *fakeDb) insert(data interface{}) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	src := reflect.ValueOf(data).Elem()
+	for i := 0; i < src.NumField(); i++ {
+		tag := src.Type().Field(i).Tag.Get("orm")
+		field := src.Field(i)
+		switch {
+		case strings.Contains(tag, "auto_now"):
+			if field.Interface().(time.Time).IsZero() {
+				field.Set(reflect.ValueOf(time.Now()))
+			}
+		case strings.HasPrefix(tag, "auto") && field.Int() == 0:
+			db.nextId++
+			field.SetInt(db.nextId)
+		}
+	}
+	row := reflect.New(src.Type())
+	row.Elem().Set(src)
+	table := snakeName(src.Type().Name())
+	db.tables[table] = append(db.tables[table], row)
+}
+
+// Update the row matching the given columns of data
+func (db *fakeDb) InsertOrUpdateData(data interface{}, cols ...string) error {
+	db.mu.Lock()
+	src := reflect.ValueOf(data).Elem()
+	filters := map[string]interface{}{}
+	for _, col := range cols {
+		filters[col] = src.FieldByIndex(columnField(src.Type(), col).Index).Interface()
+	}
+	rows := db.rows(snakeName(src.Type().Name()), filters)
+	db.mu.Unlock()
+	if len(rows) == 0 {
+		db.insert(data)
+		return nil
+	}
+	rows[0].Elem().Set(src)
+	return nil
+}
+
+func (db *fakeDb) InsertData(data interface{}) error {
+	if err := db.insertErrs[snakeName(reflect.TypeOf(data).Elem().Name())]; err != nil {
+		return err
+	}
+	db.insert(data)
+	return nil
+}
+
+func (db *fakeDb) InsertMultiData(bulk int, data interface{}) (int64, error) {
+	rows := reflect.ValueOf(data)
+	for i := 0; i < rows.Len(); i++ {
+		db.insert(rows.Index(i).Interface())
+	}
+	return int64(rows.Len()), nil
+}
+
+func (db *fakeDb) QueryTable(tableName string, container interface{}, field string,
+	container1 ...interface{}) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return fill(container, db.rows(tableName, map[string]interface{}{field: container1})), nil
+}
+
+func (db *fakeDb) QueryCountWithFilters(tableName string, filters map[string]interface{}) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return int64(len(db.rows(tableName, filters))), nil
+}
+
+func (db *fakeDb) QueryTableWithFilters(tableName string, container interface{}, filters map[string]interface{},
+	orderBy []string, limit, offset int64) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return fill(container, page(db.rows(tableName, filters), orderBy, limit, offset)), nil
+}
+
+func (db *fakeDb) QueryTableWithConditions(tableName string, container interface{}, filters map[string]interface{},
+	anyOf []map[string]interface{}, orderBy []string, limit, offset int64) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return fill(container, page(db.matchAny(db.rows(tableName, filters), anyOf), orderBy, limit, offset)), nil
+}
+
+func (db *fakeDb) QueryCountWithConditions(tableName string, filters map[string]interface{},
+	anyOf []map[string]interface{}) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return int64(len(db.matchAny(db.rows(tableName, filters), anyOf))), nil
+}
+
+// Keep the rows matching any of the conditions, no condition keeps every row
+func (db *fakeDb) matchAny(rows []reflect.Value, anyOf []map[string]interface{}) []reflect.Value {
+	if len(anyOf) == 0 {
+		return rows
+	}
+	var matching []reflect.Value
+	for _, row := range rows {
+		for _, condition := range anyOf {
+			if db.match(row.Elem(), condition) {
+				matching = append(matching, row)
+				break
+			}
+		}
+	}
+	return matching
+}
+
+// Sort rows and cut the page, a non positive limit keeps every row
+func page(rows []reflect.Value, orderBy []string, limit, offset int64) []reflect.Value {
+	for i := len(orderBy) - 1; i >= 0; i-- {
+		column, desc := strings.TrimPrefix(orderBy[i], "-"), strings.HasPrefix(orderBy[i], "-")
+		sort.SliceStable(rows, func(a, b int) bool {
+			index := columnField(rows[a].Elem().Type(), column).Index
+			c, _ := compare(rows[a].Elem().FieldByIndex(index).Interface(), rows[b].Elem().FieldByIndex(index).Interface())
+			return (c < 0 && !desc) || (c > 0 && desc)
+		})
+	}
+	if offset > int64(len(rows)) {
+		offset = int64(len(rows))
+	}
+	rows = rows[offset:]
+	if limit > 0 && limit < int64(len(rows)) {
+		rows = rows[:limit]
+	}
+	return rows
+}
+
+// Read a row by its primary key or by the given columns
+func (db *fakeDb) ReadData(data interface{}, cols ...string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	src := reflect.ValueOf(data).Elem()
+	if len(cols) == 0 {
+		for i := 0; i < src.NumField(); i++ {
+			if tag := src.Type().Field(i).Tag.Get("orm"); strings.HasPrefix(tag, "pk") || tag == "auto" {
+				cols = []string{snakeName(src.Type().Field(i).Name)}
+			}
+		}
+	}
+	filters := map[string]interface{}{}
+	for _, col := range cols {
+		filters[col] = src.FieldByIndex(columnField(src.Type(), col).Index).Interface()
+	}
+	rows := db.rows(snakeName(src.Type().Name()), filters)
+	if len(rows) == 0 {
+		return orm.ErrNoRows
+	}
+	src.Set(rows[0].Elem())
+	return nil
+}
+
+func (db *fakeDb) UpdateWithFilters(tableName string, filters map[string]interface{},
+	params map[string]interface{}) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	rows := db.rows(tableName, filters)
+	for _, row := range rows {
+		for column, value := range params {
+			field := columnField(row.Elem().Type(), column)
+			if value == nil {
+				row.Elem().FieldByIndex(field.Index).Set(reflect.Zero(field.Type))
+				continue
+			}
+			row.Elem().FieldByIndex(field.Index).Set(reflect.ValueOf(value).Convert(field.Type))
+		}
+	}
+	return int64(len(rows)), nil
+}
+
+func (db *fakeDb) IncrementField(tableName string, filters map[string]interface{}, field string,
+	delta int64) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	rows := db.rows(tableName, filters)
+	for _, row := range rows {
+		value := row.Elem().FieldByIndex(columnField(row.Elem().Type(), field).Index)
+		value.SetInt(value.Int() + delta)
+	}
+	return int64(len(rows)), nil
+}
+
+func (db *fakeDb) DeleteWithFilters(tableName string, filters map[string]interface{}) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var kept []reflect.Value
+	for _, row := range db.tables[tableName] {
+		if !db.match(row.Elem(), filters) {
+			kept = append(kept, row)
+		}
+	}
+	deleted := len(db.tables[tableName]) - len(kept)
+	db.tables[tableName] = kept
+	return int64(deleted), nil
+}
+
+// Delete the rows matching the given columns of data
+func (db *fakeDb) DeleteData(data interface{}, cols ...string) error {
+	src := reflect.ValueOf(data).Elem()
+	filters := map[string]interface{}{}
+	for _, col := range cols {
+		filters[col] = src.FieldByIndex(columnField(src.Type(), col).Index).Interface()
+	}
+	_, err := db.DeleteWithFilters(snakeName(src.Type().Name()), filters)
+	return err
+}
+
+func (db *fakeDb) Ping() error {
+	return db.pingErr
+}
@@ -0,0 +1,181 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// @Title  controllers
+// @Description  stored files encrypted at rest, written encrypted when enabled and decrypted as they are read
+// @Author  GuoZhen Gao (2021/6/30 10:40)
+package controllers
+
+import (
+	"archive/zip"
+	"fileSystem/pkg/envelope"
+	"fileSystem/util"
+	"io"
+	"os"
+)
+
+// master keys of stored files, read again only when the key file changes
+var keyFile envelope.KeyFileCache
+
+// Load the master keys, a rotated key file is taken without a restart
+func storageKeys() (envelope.KeyProvider, error) {
+	return keyFile.Load(util.GetAppConfig("encryptionKeyFile"), util.GetAppConfig("encryptionActiveKey"))
+}
+
+// storedFile is a stored file read as its plaintext, temporary files are removed on close
+type storedFile struct {
+	io.ReaderAt
+	file *os.File
+	size int64
+	temp bool
+}
+
+// Size returns the size of the plaintext
+func (f *storedFile) Size() int64 {
+	return f.size
+}
+
+// Close closes the file and removes it when it is temporary
+func (f *storedFile) Close() error {
+	err := f.file.Close()
+	if f.temp {
+		_ = os.Remove(f.file.Name())
+	}
+	return err
+}
+
+// Open a stored file as recorded on its row, encrypted files are decrypted as they are read and files stored
+// before encryption was enabled are read as they are
+func openStoredFile(path string, encrypted bool) (*storedFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if !encrypted {
+		return &storedFile{ReaderAt: f, file: f, size: info.Size()}, nil
+	}
+	keys, err := storageKeys()
+	if err == nil {
+		var reader *envelope.Reader
+		reader, err = envelope.NewReader(f, info.Size(), keys)
+		if err == nil {
+			return &storedFile{ReaderAt: reader, file: f, size: reader.Size()}, nil
+		}
+	}
+	_ = f.Close()
+	return nil, err
+}
+
+// storedWriter writes a stored file, encrypted when encryption is enabled, and counts the plaintext written
+type storedWriter struct {
+	w      io.Writer
+	enc    io.WriteCloser
+	file   *os.File
+	size   int64
+	closed bool
+}
+
+// Create a stored file, an encrypted file is encrypted with a new data key. Callers pass
+// util.EncryptionEnabled() and record it on the row of the file.
+func createStoredFile(path string, encrypted bool) (*storedWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if !encrypted {
+		return &storedWriter{w: f, file: f}, nil
+	}
+	keys, err := storageKeys()
+	if err == nil {
+		var enc io.WriteCloser
+		enc, err = envelope.NewWriter(f, keys)
+		if err == nil {
+			return &storedWriter{w: enc, enc: enc, file: f}, nil
+		}
+	}
+	_ = f.Close()
+	_ = os.Remove(path)
+	return nil, err
+}
+
+func (w *storedWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Size returns the size of the plaintext written
+func (w *storedWriter) Size() int64 {
+	return w.size
+}
+
+// Close writes the last encrypted segment and closes the file, closing again does nothing
+func (w *storedWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	var err error
+	if w.enc != nil {
+		err = w.enc.Close()
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Encrypt the content of a stored file written in one piece, data is returned as is unless encrypted
+func sealStoredData(data []byte, encrypted bool) ([]byte, error) {
+	if !encrypted {
+		return data, nil
+	}
+	keys, err := storageKeys()
+	if err != nil {
+		return nil, err
+	}
+	return envelope.Seal(data, keys)
+}
+
+// storedZip is a stored zip read through its plaintext
+type storedZip struct {
+	*zip.Reader
+	file *storedFile
+}
+
+// Close closes the stored file of the zip
+func (z *storedZip) Close() error {
+	return z.file.Close()
+}
+
+// Open a stored zip, encrypted or not
+func openStoredZip(path string, encrypted bool) (*storedZip, error) {
+	f, err := openStoredFile(path, encrypted)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := zip.NewReader(f, f.Size())
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &storedZip{Reader: reader, file: f}, nil
+}
@@ -0,0 +1,407 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// @Title  controllers
+// @Description  image metadata helpers for filesystem
+// @Author  GuoZhen Gao (2021/6/30 10:40)
+package controllers
+
+import (
+	"errors"
+	"fileSystem/models"
+	"fileSystem/util"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errConcurrentModification = errors.New("image was modified concurrently")
+
+// ImageDetail   Define the image returned by query apis
+type ImageDetail struct {
+	ImageId       string   `json:"imageId"`
+	FileName      string   `json:"fileName"`
+	UploadTime    string   `json:"uploadTime"`
+	UserId        string   `json:"userId"`
+	TenantId      string   `json:"tenantId"`
+	StorageMedium string   `json:"storageMedium"`
+	Status        string   `json:"status"`
+	DisplayName   string   `json:"displayName"`
+	Description   string   `json:"description"`
+	Tags          []string `json:"tags"`
+	OsType        string   `json:"osType"`
+	OsVersion     string   `json:"osVersion"`
+	Architecture  string   `json:"architecture"`
+	Visibility    string   `json:"visibility"`
+	DiskFormat    string   `json:"diskFormat"`
+	MinDiskGB     int64    `json:"minDiskGB"`
+	MinRamMB      int64    `json:"minRamMB"`
+	ExpiresAt     string   `json:"expiresAt,omitempty"`
+	LastDownload  string   `json:"lastDownloadTime,omitempty"`
+	Checksum      string   `json:"checksum,omitempty"`
+	Codec         string   `json:"codec,omitempty"`
+	Signer        string   `json:"signer,omitempty"`
+	SignStatus    string   `json:"signatureStatus"`
+	ScanStatus    string   `json:"scanStatus"`
+	ScanResult    string   `json:"scanResult,omitempty"`
+	ScannedTime   string   `json:"scannedTime,omitempty"`
+	LastVerified  string   `json:"lastVerifiedTime,omitempty"`
+}
+
+// ImageMetadataPatch   Define the editable image metadata, absent fields are left unchanged
+type ImageMetadataPatch struct {
+	DisplayName  *string   `json:"displayName"`
+	Description  *string   `json:"description"`
+	Tags         *[]string `json:"tags"`
+	OsType       *string   `json:"osType"`
+	OsVersion    *string   `json:"osVersion"`
+	Architecture *string   `json:"architecture"`
+	Visibility   *string   `json:"visibility"`
+	DiskFormat   *string   `json:"diskFormat"`
+	MinDiskGB    *int64    `json:"minDiskGB"`
+	MinRamMB     *int64    `json:"minRamMB"`
+	ExpiresAt    *string   `json:"expiresAt"`
+}
+
+// query parameters of the image list mapped to their filters
+var imageListFilters = map[string]string{
+	"osType":        "os_type__exact",
+	"osVersion":     "os_version__exact",
+	"architecture":  "architecture__exact",
+	"diskFormat":    "disk_format__exact",
+	"visibility":    "visibility__exact",
+	"ownerId":       "user_id__exact",
+	"ownerTenantId": "tenant_id__exact",
+}
+
+func newImageDetail(image *models.ImageDB, tags []string) *ImageDetail {
+	if tags == nil {
+		tags = []string{}
+	}
+	return &ImageDetail{
+		ImageId:       image.ImageId,
+		FileName:      image.SaveFileName,
+		UploadTime:    image.UploadTime.Format("2006-01-02 15:04:05"),
+		UserId:        image.UserId,
+		TenantId:      image.TenantId,
+		StorageMedium: image.StorageMedium,
+		Status:        image.Status,
+		DisplayName:   image.DisplayName,
+		Description:   image.Description,
+		Tags:          tags,
+		OsType:        image.OsType,
+		OsVersion:     image.OsVersion,
+		Architecture:  image.Architecture,
+		Visibility:    effectiveVisibility(image),
+		DiskFormat:    image.DiskFormat,
+		MinDiskGB:     image.MinDiskGB,
+		MinRamMB:      image.MinRamMB,
+		ExpiresAt:     formatOptionalTime(image.ExpireTime),
+		LastDownload:  formatOptionalTime(image.LastDownloadTime),
+		Checksum:      image.Checksum,
+		Codec:         image.Codec,
+		Signer:        image.Signer,
+		SignStatus:    signatureStatus(image),
+		ScanStatus:    scanStatus(image),
+		ScanResult:    image.ScanResult,
+		ScannedTime:   formatOptionalTime(image.ScannedTime),
+		LastVerified:  formatOptionalTime(image.LastVerifiedTime),
+	}
+}
+
+// Format a nullable time column, unset times are returned empty
+func formatOptionalTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("2006-01-02 15:04:05")
+}
+
+// Get the ETag of the current image metadata
+func imageETag(image *models.ImageDB) string {
+	return "\"" + strconv.FormatInt(image.ResourceVersion, 10) + "\""
+}
+
+// Validate every field present in the patch, empty strings clear optional fields
+func (p *ImageMetadataPatch) validate() error {
+	if p.DisplayName != nil {
+		if err := util.ValidateDisplayName(*p.DisplayName); err != nil {
+			return err
+		}
+	}
+	if p.Description != nil {
+		if err := util.ValidateDescription(*p.Description); err != nil {
+			return err
+		}
+	}
+	if p.Tags != nil {
+		if err := util.ValidateTags(*p.Tags); err != nil {
+			return err
+		}
+	}
+	if p.OsType != nil && *p.OsType != "" {
+		if err := util.ValidateOsType(*p.OsType); err != nil {
+			return err
+		}
+	}
+	if p.OsVersion != nil && *p.OsVersion != "" {
+		if err := util.ValidateOsVersion(*p.OsVersion); err != nil {
+			return err
+		}
+	}
+	if p.Architecture != nil && *p.Architecture != "" {
+		if err := util.ValidateArchitecture(*p.Architecture); err != nil {
+			return err
+		}
+	}
+	if p.Visibility != nil {
+		if err := util.ValidateVisibility(*p.Visibility); err != nil {
+			return err
+		}
+	}
+	if p.DiskFormat != nil && *p.DiskFormat != "" {
+		if err := util.ValidateDiskFormat(*p.DiskFormat); err != nil {
+			return err
+		}
+	}
+	if p.MinDiskGB != nil {
+		if err := util.ValidateMinRequirement("minDiskGB", *p.MinDiskGB, util.MaxMinDiskGB); err != nil {
+			return err
+		}
+	}
+	if p.ExpiresAt != nil && *p.ExpiresAt != "" {
+		if _, err := util.ParseExpiresAt(*p.ExpiresAt); err != nil {
+			return err
+		}
+	}
+	if p.MinRamMB != nil {
+		if err := util.ValidateMinRequirement("minRamMB", *p.MinRamMB, util.MaxMinRamMB); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get the columns changed by the patch and the names of the changed fields
+func (p *ImageMetadataPatch) params() (map[string]interface{}, []string) {
+	params := map[string]interface{}{}
+	var changed []string
+	for column, value := range map[string]*string{
+		"display_name": p.DisplayName,
+		"description":  p.Description,
+		"os_type":      p.OsType,
+		"os_version":   p.OsVersion,
+		"architecture": p.Architecture,
+		"visibility":   p.Visibility,
+		"disk_format":  p.DiskFormat,
+	} {
+		if value != nil {
+			params[column] = *value
+			changed = append(changed, column)
+		}
+	}
+	for column, value := range map[string]*int64{
+		"min_disk_gb": p.MinDiskGB,
+		"min_ram_mb":  p.MinRamMB,
+	} {
+		if value != nil {
+			params[column] = *value
+			changed = append(changed, column)
+		}
+	}
+	if p.ExpiresAt != nil {
+		params["expire_time"] = p.expireTime()
+		changed = append(changed, "expire_time")
+	}
+	if p.Tags != nil {
+		changed = append(changed, "tags")
+	}
+	sort.Strings(changed)
+	return params, changed
+}
+
+// Set the metadata given in the patch on a new image record
+func (p *ImageMetadataPatch) applyTo(image *models.ImageDB) {
+	for field, value := range map[*string]*string{
+		&image.DisplayName:  p.DisplayName,
+		&image.Description:  p.Description,
+		&image.OsType:       p.OsType,
+		&image.OsVersion:    p.OsVersion,
+		&image.Architecture: p.Architecture,
+		&image.Visibility:   p.Visibility,
+		&image.DiskFormat:   p.DiskFormat,
+	} {
+		if value != nil {
+			*field = *value
+		}
+	}
+	if p.MinDiskGB != nil {
+		image.MinDiskGB = *p.MinDiskGB
+	}
+	if p.MinRamMB != nil {
+		image.MinRamMB = *p.MinRamMB
+	}
+	if expireTime, ok := p.expireTime().(time.Time); ok {
+		image.ExpireTime = expireTime
+	}
+}
+
+// Get the expiry column value of a validated patch, an empty expiresAt clears the expiry
+func (p *ImageMetadataPatch) expireTime() interface{} {
+	if p.ExpiresAt == nil || *p.ExpiresAt == "" {
+		return nil
+	}
+	expireTime, _ := util.ParseExpiresAt(*p.ExpiresAt)
+	return expireTime
+}
+
+// Read the metadata sent as form fields along with an upload, tags are comma separated
+func (c *BaseController) metadataFromForm() (*ImageMetadataPatch, error) {
+	patch := &ImageMetadataPatch{}
+	for key, field := range map[string]**string{
+		"displayName":  &patch.DisplayName,
+		"description":  &patch.Description,
+		"osType":       &patch.OsType,
+		"osVersion":    &patch.OsVersion,
+		"architecture": &patch.Architecture,
+		"visibility":   &patch.Visibility,
+		"diskFormat":   &patch.DiskFormat,
+		"expiresAt":    &patch.ExpiresAt,
+	} {
+		if value := c.GetString(key); value != "" {
+			*field = &value
+		}
+	}
+	for key, field := range map[string]**int64{
+		"minDiskGB": &patch.MinDiskGB,
+		"minRamMB":  &patch.MinRamMB,
+	} {
+		if c.GetString(key) == "" {
+			continue
+		}
+		value, err := c.GetInt64(key)
+		if err != nil {
+			return nil, errors.New(key + " should be an integer")
+		}
+		*field = &value
+	}
+	if value := c.GetString("tags"); value != "" {
+		tags := strings.Split(value, ",")
+		for i := range tags {
+			tags[i] = strings.TrimSpace(tags[i])
+		}
+		patch.Tags = &tags
+	}
+	return patch, patch.validate()
+}
+
+// Query tags of an image
+func (c *BaseController) queryImageTags(imageId string) ([]string, error) {
+	var imageTags []*models.ImageTag
+	_, err := c.Db.QueryTableWithFilters("image_tag", &imageTags,
+		map[string]interface{}{"image_id__exact": imageId}, []string{"tag"}, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	tags := make([]string, 0, len(imageTags))
+	for _, imageTag := range imageTags {
+		tags = append(tags, imageTag.Tag)
+	}
+	return tags, nil
+}
+
+// Query tags of several images at once, keyed by image id
+func (c *BaseController) queryTagsOfImages(imageIds []string) (map[string][]string, error) {
+	tagsById := map[string][]string{}
+	if len(imageIds) == 0 {
+		return tagsById, nil
+	}
+	var imageTags []*models.ImageTag
+	_, err := c.Db.QueryTableWithFilters("image_tag", &imageTags,
+		map[string]interface{}{"image_id__in": imageIds}, []string{"tag"}, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, imageTag := range imageTags {
+		tagsById[imageTag.ImageId] = append(tagsById[imageTag.ImageId], imageTag.Tag)
+	}
+	return tagsById, nil
+}
+
+// Query ids of images carrying every given tag
+func (c *BaseController) queryImageIdsByTags(tags []string) ([]string, error) {
+	var imageIds []string
+	for i, tag := range tags {
+		var imageTags []*models.ImageTag
+		filters := map[string]interface{}{"tag__exact": tag}
+		if i > 0 {
+			if len(imageIds) == 0 {
+				return imageIds, nil
+			}
+			filters["image_id__in"] = imageIds
+		}
+		_, err := c.Db.QueryTableWithFilters("image_tag", &imageTags, filters, nil, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		matched := make([]string, 0, len(imageTags))
+		for _, imageTag := range imageTags {
+			matched = append(matched, imageTag.ImageId)
+		}
+		imageIds = matched
+	}
+	return imageIds, nil
+}
+
+// Replace all tags of an image
+func (c *BaseController) replaceImageTags(imageId string, tags []string) error {
+	_, err := c.Db.DeleteWithFilters("image_tag", map[string]interface{}{"image_id__exact": imageId})
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		err = c.Db.InsertData(&models.ImageTag{ImageId: imageId, Tag: tag})
+		if err != nil && err.Error() != util.LastInsertIdNotSupported {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply a metadata patch when the image still has the expected resource version
+func (c *BaseController) updateImageMetadata(image *models.ImageDB, patch *ImageMetadataPatch) ([]string, error) {
+	params, changed := patch.params()
+	params["resource_version"] = image.ResourceVersion + 1
+	params["update_time"] = time.Now()
+	num, err := c.Db.UpdateWithFilters("image_d_b", map[string]interface{}{
+		"image_id__exact":         image.ImageId,
+		"resource_version__exact": image.ResourceVersion,
+	}, params)
+	if err != nil {
+		return nil, err
+	}
+	if num == 0 {
+		return nil, errConcurrentModification
+	}
+	if patch.Tags != nil {
+		err = c.replaceImageTags(image.ImageId, *patch.Tags)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return changed, nil
+}
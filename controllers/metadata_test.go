@@ -0,0 +1,76 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"fileSystem/models"
+	"testing"
+	"time"
+)
+
+func TestMetadataPatchValidate(t *testing.T) {
+	str := func(s string) *string { return &s }
+	size := func(n int64) *int64 { return &n }
+	tests := []struct {
+		name  string
+		patch ImageMetadataPatch
+		valid bool
+	}{
+		{"empty", ImageMetadataPatch{}, true},
+		{"full", ImageMetadataPatch{OsType: str("ubuntu"), OsVersion: str("20.04"),
+			Architecture: str("aarch64"), DiskFormat: str("qcow2"), MinDiskGB: size(20)}, true},
+		{"cleared os type", ImageMetadataPatch{OsType: str("")}, true},
+		{"os type", ImageMetadataPatch{OsType: str("beos")}, false},
+		{"architecture", ImageMetadataPatch{Architecture: str("mips")}, false},
+		{"disk format", ImageMetadataPatch{DiskFormat: str("tar")}, false},
+		{"negative disk", ImageMetadataPatch{MinDiskGB: size(-1)}, false},
+		{"duplicated tag", ImageMetadataPatch{Tags: &[]string{"a", "a"}}, false},
+		{"expiry", ImageMetadataPatch{ExpiresAt: str(time.Now().Add(time.Hour).Format(time.RFC3339))}, true},
+		{"cleared expiry", ImageMetadataPatch{ExpiresAt: str("")}, true},
+		{"past expiry", ImageMetadataPatch{ExpiresAt: str("2021-07-01T10:00:00Z")}, false},
+		{"expiry format", ImageMetadataPatch{ExpiresAt: str("2099-07-01")}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.patch.validate(); (err == nil) != tt.valid {
+				t.Fatalf("got %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestMetadataPatchParams(t *testing.T) {
+	osType, minDisk := "centos", int64(40)
+	params, changed := (&ImageMetadataPatch{OsType: &osType, MinDiskGB: &minDisk}).params()
+	if params["os_type"] != "centos" || params["min_disk_gb"] != int64(40) || len(changed) != 2 {
+		t.Fatalf("got params %v, changed %v", params, changed)
+	}
+
+	image := &models.ImageDB{OsType: "ubuntu", OsVersion: "20.04"}
+	(&ImageMetadataPatch{OsType: &osType, MinDiskGB: &minDisk}).applyTo(image)
+	if image.OsType != "centos" || image.OsVersion != "20.04" || image.MinDiskGB != 40 {
+		t.Fatalf("unexpected image %+v", image)
+	}
+}
+
+func TestMetadataPatchClearsExpiry(t *testing.T) {
+	cleared := ""
+	params, changed := (&ImageMetadataPatch{ExpiresAt: &cleared}).params()
+	if value, ok := params["expire_time"]; !ok || value != nil || len(changed) != 1 {
+		t.Fatalf("got params %v, changed %v", params, changed)
+	}
+}
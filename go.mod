@@ -19,6 +19,7 @@ go 1.14
 require (
         github.com/astaxie/beego v1.12.0
 	github.com/go-playground/validator/v10 v10.4.1
+	github.com/klauspost/compress v1.11.13
 	github.com/lib/pq v1.7.0
 	github.com/satori/go.uuid v1.2.0
 	github.com/shiena/ansicolor v0.0.0-20200904210342-c7312218db18 // indirect
@@ -17,25 +17,33 @@
 package main
 
 import (
+	"context"
 	_ "fileSystem/models"
+	"fileSystem/pkg/transfer"
+	"fileSystem/pkg/worker"
 	_ "fileSystem/routers"
+	"fileSystem/util"
 	"github.com/astaxie/beego"
 	"github.com/astaxie/beego/plugins/cors"
+	log "github.com/sirupsen/logrus"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 )
 
-
-
-
-
+// interruptGracePeriod is how long interrupted uploads are given to clean up before the process exits
+const interruptGracePeriod = 10 * time.Second
 
 func main() {
 
-	beego.InsertFilter("*", beego.BeforeRouter,cors.Allow(&cors.Options{
-		AllowOrigins: []string{"*"},
-		AllowMethods: []string{"PUT", "PATCH", "POST", "GET", "DELETE", "OPTIONS"},
-		AllowHeaders: []string{"Origin", "X-Requested-With", "Content-Type", "Accept"},
-		ExposeHeaders: []string{"Content-Length"},
+	beego.InsertFilter("*", beego.BeforeRouter, cors.Allow(&cors.Options{
+		AllowOrigins:     []string{"*"},
+		AllowMethods:     []string{"PUT", "PATCH", "POST", "GET", "DELETE", "OPTIONS"},
+		AllowHeaders:     []string{"Origin", "X-Requested-With", "Content-Type", "Accept", util.RequestIdHeader},
+		ExposeHeaders:    []string{"Content-Length", util.RequestIdHeader},
 		AllowCredentials: true,
 	}))
 
@@ -45,7 +53,46 @@ func main() {
 		return
 	})
 
+	stopped := make(chan struct{})
+	go func() {
+		beego.Run()
+		close(stopped)
+	}()
 
-	beego.Run()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case sig := <-signals:
+		log.Info("received signal " + sig.String() + ", shutting down")
+		shutdown()
+	case <-stopped:
+		log.Error("http server stopped unexpectedly")
+		os.Exit(1)
+	}
 }
 
+// Stop accepting uploads and let in-flight transfers finish before the deadline,
+// uploads still running after it are interrupted, their handlers mark them failed and remove their files
+func shutdown() {
+	timeout := util.GetAppConfigInt64("shutdownTimeout", util.DefaultShutdownTimeout)
+	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	transfer.StartDraining()
+	log.Info("waiting up to " + strconv.FormatInt(timeout, 10) + "s for " +
+		strconv.Itoa(transfer.ActiveCount()) + " in-flight transfers")
+
+	err := beego.BeeApp.Server.Shutdown(ctx)
+	if err != nil {
+		log.Warn("http server shutdown didn't complete: " + err.Error())
+		// closing the connections unblocks interrupted uploads, so their handlers mark them failed
+		transfer.InterruptAll()
+		_ = beego.BeeApp.Server.Close()
+		if !transfer.WaitIdle(time.Now().Add(interruptGracePeriod)) {
+			log.Warn(strconv.Itoa(transfer.ActiveCount()) + " interrupted transfers didn't stop")
+		}
+	}
+	worker.StopAll(deadline)
+	log.Info("shutdown complete")
+}
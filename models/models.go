@@ -29,11 +29,201 @@ type ImageDB struct {
 	ImageId       string `orm:"pk"`
 	FileName      string
 	UserId        string
+	TenantId      string
 	SaveFileName  string
 	StorageMedium string
 	UploadTime    time.Time `orm:"auto_now_add;type(datetime)"`
+	Status        string
+
+	// editable metadata, ResourceVersion is bumped on every change and exposed as ETag
+	DisplayName     string
+	Description     string `orm:"null;type(text)"`
+	OsType          string
+	OsVersion       string
+	Architecture    string
+	Visibility      string
+	DiskFormat      string
+	MinDiskGB       int64 `orm:"column(min_disk_gb)"`
+	MinRamMB        int64 `orm:"column(min_ram_mb)"`
+	ResourceVersion int64
+	UpdateTime      time.Time `orm:"null;type(datetime)"`
+
+	// set when the image is moved to trash, it is purged once the retention period has passed
+	TrashedTime time.Time `orm:"null;type(datetime)"`
+	TrashedBy   string
+
+	// retention inputs, expired or idle images are moved to trash by the retention job
+	ExpireTime       time.Time `orm:"null;type(datetime)"`
+	LastDownloadTime time.Time `orm:"null;type(datetime)"`
+
+	// Checksum is the SHA-256 of the uploaded file, BlobDigest names the shared blob holding the stored zip
+	Checksum   string
+	BlobDigest string `orm:"index"`
+
+	// SHA-256 manifest of the files of an uploaded zip in .mf format, zips created on upload embed theirs
+	Manifest string `orm:"null;type(text)"`
+
+	// chunked images are stored as content defined chunks listed by ImageChunk instead of a blob
+	Chunked bool
+	Size    int64
+
+	// the stored file is encrypted at rest, false for files stored before encryption was enabled.
+	// Chunked images record it on each of their chunks.
+	Encrypted bool
+
+	// Codec is how a non zip upload is stored, none keeps it as uploaded, empty is a deflate zip of an older release
+	Codec string
+
+	// detached signature of Checksum, SignatureStatus is unsigned, verified with the Signer who signed it,
+	// or untrusted when no key of the trust store verifies it. Empty is an image of an older release.
+	Signature       string `orm:"null;type(text)"`
+	Signer          string
+	SignatureStatus string
+
+	// malware scan of the upload, ScanStatus is clean, infected with the malware named by ScanResult, error
+	// with the reason in ScanResult or skipped when the image is larger than the scanner takes.
+	// Empty is an image uploaded while no scanner was configured.
+	ScanStatus  string
+	ScanResult  string    `orm:"null;type(text)"`
+	ScannedTime time.Time `orm:"null;type(datetime)"`
+
+	// last time the scrubber found the stored image matching its digests, images which don't are marked corrupt
+	LastVerifiedTime time.Time `orm:"null;type(datetime)"`
+}
+
+// ImageTag   Define a free-form tag attached to an image
+type ImageTag struct {
+	Id      int64  `orm:"auto"`
+	ImageId string `orm:"index"`
+	Tag     string `orm:"index"`
+}
+
+// TableUnique   Define an image carries each tag once
+func (t *ImageTag) TableUnique() [][]string {
+	return [][]string{{"ImageId", "Tag"}}
+}
+
+// ImageShare   Define a grant giving a user or tenant access to an image
+type ImageShare struct {
+	Id          int64     `orm:"auto" json:"shareId"`
+	ImageId     string    `orm:"index" json:"imageId"`
+	GranteeType string    `json:"granteeType"`
+	GranteeId   string    `orm:"index" json:"granteeId"`
+	Permission  string    `json:"permission"`
+	GrantedBy   string    `json:"grantedBy"`
+	CreateTime  time.Time `orm:"auto_now_add;type(datetime)" json:"createTime"`
+}
+
+// TableUnique   Define one grant per grantee of an image
+func (s *ImageShare) TableUnique() [][]string {
+	return [][]string{{"ImageId", "GranteeType", "GranteeId"}}
+}
+
+// LogicalImage   Define a named image whose content is published as numbered revisions
+type LogicalImage struct {
+	Name           string    `orm:"pk" json:"name"`
+	UserId         string    `json:"userId"`
+	TenantId       string    `json:"tenantId"`
+	LatestRevision int64     `json:"latestRevision"`
+	CreateTime     time.Time `orm:"auto_now_add;type(datetime)" json:"createTime"`
+}
+
+// ImageRevision   Define an immutable revision of a logical image backed by an uploaded image
+type ImageRevision struct {
+	Id         int64     `orm:"auto" json:"-"`
+	Name       string    `orm:"index" json:"name"`
+	Revision   int64     `json:"revision"`
+	ImageId    string    `orm:"unique" json:"imageId"`
+	CreateTime time.Time `orm:"auto_now_add;type(datetime)" json:"createTime"`
+}
+
+// TableUnique   Define revision numbers are unique within a logical image
+func (r *ImageRevision) TableUnique() [][]string {
+	return [][]string{{"Name", "Revision"}}
+}
+
+// ImageAlias   Define a movable alias like latest or stable pointing to a revision
+type ImageAlias struct {
+	Id         int64     `orm:"auto" json:"-"`
+	Name       string    `orm:"index" json:"name"`
+	Alias      string    `json:"alias"`
+	Revision   int64     `json:"revision"`
+	UpdateTime time.Time `orm:"auto_now;type(datetime)" json:"updateTime"`
+}
+
+// TableUnique   Define an alias is unique within a logical image
+func (a *ImageAlias) TableUnique() [][]string {
+	return [][]string{{"Name", "Alias"}}
+}
+
+// Blob   Define a stored zip shared by every image with the same content
+type Blob struct {
+	Digest     string    `orm:"pk" json:"digest"`
+	Size       int64     `json:"size"`
+	RefCount   int64     `json:"refCount"`
+	Encrypted  bool      `json:"encrypted"`
+	CreateTime time.Time `orm:"auto_now_add;type(datetime)" json:"createTime"`
+	UpdateTime time.Time `orm:"auto_now;type(datetime)" json:"updateTime"`
+}
+
+// Chunk   Define a content defined chunk shared by every image containing it
+type Chunk struct {
+	Digest     string    `orm:"pk" json:"digest"`
+	Size       int64     `json:"size"`
+	RefCount   int64     `json:"refCount"`
+	Encrypted  bool      `json:"encrypted"`
+	CreateTime time.Time `orm:"auto_now_add;type(datetime)" json:"createTime"`
+	UpdateTime time.Time `orm:"auto_now;type(datetime)" json:"updateTime"`
+}
+
+// ImageChunk   Define the position of a chunk within a chunked image
+type ImageChunk struct {
+	Id      int64  `orm:"auto" json:"-"`
+	ImageId string `orm:"index" json:"imageId"`
+	Seq     int64  `json:"seq"`
+	Digest  string `orm:"index" json:"digest"`
+	Offset  int64  `json:"offset"`
+	Size    int64  `json:"size"`
+
+	// copied from the chunk so reading an image needn't query every chunk
+	Encrypted bool `json:"encrypted"`
+}
+
+// TableUnique   Define a position holds one chunk
+func (c *ImageChunk) TableUnique() [][]string {
+	return [][]string{{"ImageId", "Seq"}}
+}
+
+// RetentionPolicy   Define how long images of a user or tenant are kept
+type RetentionPolicy struct {
+	Id           int64     `orm:"auto" json:"policyId"`
+	Scope        string    `json:"scope"`
+	ScopeId      string    `json:"scopeId"`
+	MaxIdleDays  int64     `json:"maxIdleDays"`
+	MaxRevisions int64     `json:"maxRevisions"`
+	UpdatedBy    string    `json:"updatedBy"`
+	UpdateTime   time.Time `orm:"auto_now;type(datetime)" json:"updateTime"`
+}
+
+// TableUnique   Define one policy per user or tenant
+func (p *RetentionPolicy) TableUnique() [][]string {
+	return [][]string{{"Scope", "ScopeId"}}
+}
+
+// AuditEvent   Define the persisted audit record of an image operation
+type AuditEvent struct {
+	Id        int64     `orm:"auto" json:"id"`
+	EventTime time.Time `orm:"auto_now_add;type(datetime);index" json:"eventTime"`
+	Action    string    `orm:"index" json:"action"`
+	ImageId   string    `orm:"index" json:"imageId"`
+	UserId    string    `orm:"index" json:"userId"`
+	ClientIp  string    `json:"clientIp"`
+	RequestId string    `json:"requestId"`
+	Outcome   string    `json:"outcome"`
+	Details   string    `orm:"type(text)" json:"details"`
 }
 
 func init() {
-	orm.RegisterModel(new(ImageDB))
+	orm.RegisterModel(new(ImageDB), new(ImageTag), new(ImageShare), new(LogicalImage), new(ImageRevision),
+		new(ImageAlias), new(Blob), new(Chunk), new(ImageChunk), new(RetentionPolicy), new(AuditEvent))
 }
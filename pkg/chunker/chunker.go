@@ -0,0 +1,148 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// @Title  chunker
+// @Description  content defined chunking with a gear rolling hash
+// @Author  GuoZhen Gao (2021/6/30 10:40)
+package chunker
+
+import (
+	"errors"
+	"io"
+	"math/bits"
+)
+
+// ErrInvalidSize is returned when the average chunk size isn't a power of two of at least 256 bytes
+var ErrInvalidSize = errors.New("average chunk size should be a power of two of at least 256 bytes")
+
+// gear table of the rolling hash, generated by splitmix64 from a fixed seed so chunk
+// boundaries, and with them chunk digests, never change between releases
+var gear = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x6a09e667f3bcc908)
+	for i := range table {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// Chunker   Define a FastCDC style splitter, boundaries depend on content so an insert
+// or change in the input only alters the chunks around it
+type Chunker struct {
+	r     io.Reader
+	buf   []byte
+	start int
+	end   int
+	eof   bool
+
+	min, avg, max int
+	// the stricter mask applies below the average size and the looser one above it,
+	// which keeps chunk sizes close to the average
+	maskS, maskL uint64
+}
+
+// New   Create a chunker cutting chunks between avg/4 and avg*4 bytes, avg is the expected size
+func New(r io.Reader, avg int) (*Chunker, error) {
+	if avg < 256 || avg&(avg-1) != 0 {
+		return nil, ErrInvalidSize
+	}
+	n := bits.TrailingZeros(uint(avg))
+	return &Chunker{
+		r:     r,
+		buf:   make([]byte, avg*8),
+		min:   avg / 4,
+		avg:   avg,
+		max:   avg * 4,
+		maskS: highBits(n + 1),
+		maskL: highBits(n - 1),
+	}, nil
+}
+
+// the high bits of the gear hash depend on the most input bytes, so masks select them
+func highBits(n int) uint64 {
+	return ((uint64(1) << uint(n)) - 1) << uint(64-n)
+}
+
+// Next returns the next chunk, io.EOF is returned after the last one.
+// The chunk is only valid until the following call.
+func (c *Chunker) Next() ([]byte, error) {
+	err := c.fill()
+	if err != nil {
+		return nil, err
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+	data := c.buf[c.start:c.end]
+	n := c.cut(data)
+	c.start += n
+	return data[:n], nil
+}
+
+// Read until a maximum size chunk is buffered or the input ends
+func (c *Chunker) fill() error {
+	if c.end-c.start >= c.max || c.eof {
+		return nil
+	}
+	if c.start > 0 {
+		c.end = copy(c.buf, c.buf[c.start:c.end])
+		c.start = 0
+	}
+	for c.end < len(c.buf) && !c.eof {
+		n, err := c.r.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Find the length of the chunk at the start of data
+func (c *Chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.min {
+		return n
+	}
+	if n > c.max {
+		n = c.max
+	}
+	normal := c.avg
+	if n < normal {
+		normal = n
+	}
+	var fp uint64
+	i := c.min
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
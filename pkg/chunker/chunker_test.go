@@ -0,0 +1,140 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+const testAvg = 4096
+
+func randomData(size int, seed int64) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func split(t *testing.T, r io.Reader) [][]byte {
+	c, err := New(r, testAvg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunks [][]byte
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, append([]byte(nil), chunk...))
+	}
+}
+
+func TestNewRejectsInvalidSize(t *testing.T) {
+	for _, avg := range []int{0, 128, 1000, 4097} {
+		if _, err := New(bytes.NewReader(nil), avg); err != ErrInvalidSize {
+			t.Fatalf("average %d gave %v", avg, err)
+		}
+	}
+}
+
+func TestChunksReassembleWithinBounds(t *testing.T) {
+	for _, size := range []int{0, 1, testAvg / 4, testAvg*4 + 1, 1 << 20} {
+		data := randomData(size, int64(size))
+		chunks := split(t, bytes.NewReader(data))
+		if got := bytes.Join(chunks, nil); !bytes.Equal(got, data) {
+			t.Fatalf("chunks of %d bytes don't reassemble", size)
+		}
+		for i, chunk := range chunks {
+			if len(chunk) > testAvg*4 || (i < len(chunks)-1 && len(chunk) < testAvg/4) {
+				t.Fatalf("chunk %d of %d bytes is out of bounds", i, len(chunk))
+			}
+		}
+	}
+}
+
+func TestChunksDontDependOnReads(t *testing.T) {
+	data := randomData(1<<20, 1)
+	whole := split(t, bytes.NewReader(data))
+	// a reader returning a few bytes at a time gives the same boundaries
+	small := split(t, &shortReader{r: bytes.NewReader(data), n: 7})
+	if len(whole) != len(small) {
+		t.Fatalf("%d chunks, %d with short reads", len(whole), len(small))
+	}
+	for i := range whole {
+		if !bytes.Equal(whole[i], small[i]) {
+			t.Fatalf("chunk %d differs with short reads", i)
+		}
+	}
+}
+
+func TestInsertOnlyChangesNearbyChunks(t *testing.T) {
+	data := randomData(1<<20, 2)
+	edited := append(append(append([]byte(nil), data[:1000]...), "inserted"...), data[1000:]...)
+	digests := map[[sha256.Size]byte]bool{}
+	original := split(t, bytes.NewReader(data))
+	for _, chunk := range original {
+		digests[sha256.Sum256(chunk)] = true
+	}
+	changed := 0
+	for _, chunk := range split(t, bytes.NewReader(edited)) {
+		if !digests[sha256.Sum256(chunk)] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Fatalf("insert changed %d of %d chunks", changed, len(original))
+	}
+}
+
+func TestReadErrorIsReturned(t *testing.T) {
+	failure := errors.New("disk failure")
+	c, err := New(io.MultiReader(bytes.NewReader(randomData(100, 3)), &failingReader{err: failure}), testAvg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Next(); err != failure {
+		t.Fatalf("read error gave %v", err)
+	}
+}
+
+type shortReader struct {
+	r io.Reader
+	n int
+}
+
+func (r *shortReader) Read(p []byte) (int, error) {
+	if len(p) > r.n {
+		p = p[:r.n]
+	}
+	return r.r.Read(p)
+}
+
+type failingReader struct {
+	err error
+}
+
+func (r *failingReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
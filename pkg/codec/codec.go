@@ -0,0 +1,186 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// @Title  codec
+// @Description  compression codecs of stored images and the per format compression policy
+// @Author  GuoZhen Gao (2021/6/30 10:40)
+package codec
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"errors"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Codec names, None stores the image as uploaded without a zip around it
+const (
+	None    = "none"
+	Store   = "store"
+	Deflate = "deflate"
+	Zstd    = "zstd"
+
+	// ZipMethodZstd is the zip compression method id of zstd
+	ZipMethodZstd uint16 = 93
+
+	// DefaultFormat is the policy key applied to formats without an entry of their own
+	DefaultFormat = "default"
+)
+
+// ErrInvalidCodec is returned for codec specs other than none, store, deflate[-1..9] or zstd[-1..22]
+var ErrInvalidCodec = errors.New("codec should be none, store, deflate[-1..9] or zstd[-1..22]")
+
+func init() {
+	// zips written with zstd are read back by every zip reader of the process
+	zip.RegisterDecompressor(ZipMethodZstd, func(r io.Reader) io.ReadCloser {
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return errReader{err}
+		}
+		return d.IOReadCloser()
+	})
+}
+
+// errReader fails every read, zip decompressors have no way to return an error
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+func (r errReader) Close() error {
+	return nil
+}
+
+// Codec   Define how an image is compressed, Level 0 is the default level of the codec
+type Codec struct {
+	Name  string
+	Level int
+}
+
+// Default is the codec of images stored before compression became configurable
+var Default = Codec{Name: Deflate}
+
+// Parse a codec spec such as store, deflate-6 or zstd-3
+func Parse(spec string) (Codec, error) {
+	spec = strings.ToLower(strings.TrimSpace(spec))
+	name, level := spec, 0
+	if i := strings.LastIndex(spec, "-"); i > 0 {
+		value, err := strconv.Atoi(spec[i+1:])
+		if err != nil {
+			return Codec{}, ErrInvalidCodec
+		}
+		name, level = spec[:i], value
+	}
+	switch {
+	case (name == None || name == Store) && level == 0:
+	case name == Deflate && level >= 0 && level <= flate.BestCompression:
+	case name == Zstd && level >= 0 && level <= 22:
+	default:
+		return Codec{}, ErrInvalidCodec
+	}
+	return Codec{Name: name, Level: level}, nil
+}
+
+// String returns the spec of the codec, which is what images record
+func (c Codec) String() string {
+	if c.Level == 0 {
+		return c.Name
+	}
+	return c.Name + "-" + strconv.Itoa(c.Level)
+}
+
+// Zipped reports whether the codec wraps the image in a zip
+func (c Codec) Zipped() bool {
+	return c.Name != None
+}
+
+// Method returns the zip compression method of the codec
+func (c Codec) Method() uint16 {
+	switch c.Name {
+	case Store:
+		return zip.Store
+	case Zstd:
+		return ZipMethodZstd
+	default:
+		return zip.Deflate
+	}
+}
+
+// NewZipWriter creates a zip writer compressing entries of the codec method at the codec level. Deflate entries
+// are compressed in blocks of a fixed size by workers goroutines, so the bytes written don't depend on workers
+// and an image stored on nodes with different core counts gives the same zip.
+func (c Codec) NewZipWriter(w io.Writer, workers int) *zip.Writer {
+	zw := zip.NewWriter(w)
+	level := c.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	switch {
+	case c.Name == Deflate:
+		zw.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+			return NewParallelWriter(out, level, workers)
+		})
+	case c.Name == Zstd:
+		zstdLevel := zstd.SpeedDefault
+		if c.Level != 0 {
+			zstdLevel = zstd.EncoderLevelFromZstd(c.Level)
+		}
+		zw.RegisterCompressor(ZipMethodZstd, func(out io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(out, zstd.WithEncoderLevel(zstdLevel), zstd.WithEncoderConcurrency(1))
+		})
+	}
+	return zw
+}
+
+// Policy   Define the codec used for each image format, formats are lower case file extensions without the dot
+type Policy map[string]Codec
+
+// ParsePolicy parses a comma separated list of format:codec entries, e.g. "qcow2:store,img:zstd,default:deflate"
+func ParsePolicy(value string) (Policy, error) {
+	policy := Policy{}
+	for _, entry := range strings.Split(value, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, errors.New("policy entry " + entry + " should be format:codec")
+		}
+		c, err := Parse(parts[1])
+		if err != nil {
+			return nil, errors.New("policy entry " + entry + ": " + err.Error())
+		}
+		policy[strings.ToLower(strings.TrimPrefix(strings.TrimSpace(parts[0]), "."))] = c
+	}
+	return policy, nil
+}
+
+// For returns the codec of a format, falling back to the default entry and then to Default
+func (p Policy) For(format string) Codec {
+	if c, ok := p[strings.ToLower(strings.TrimPrefix(format, "."))]; ok {
+		return c
+	}
+	if c, ok := p[DefaultFormat]; ok {
+		return c
+	}
+	return Default
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package codec
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		spec string
+		want Codec
+		ok   bool
+	}{
+		{"none", Codec{Name: None}, true},
+		{"store", Codec{Name: Store}, true},
+		{" Deflate ", Codec{Name: Deflate}, true},
+		{"deflate-9", Codec{Name: Deflate, Level: 9}, true},
+		{"zstd-22", Codec{Name: Zstd, Level: 22}, true},
+		{"deflate-10", Codec{}, false},
+		{"zstd-23", Codec{}, false},
+		{"store-1", Codec{}, false},
+		{"zstd-fast", Codec{}, false},
+		{"gzip", Codec{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := Parse(tt.spec)
+			if (err == nil) != tt.ok || got != tt.want {
+				t.Fatalf("got %+v, %v", got, err)
+			}
+			if tt.ok && got.String() != tt.want.String() {
+				t.Fatalf("got spec %q", got.String())
+			}
+		})
+	}
+}
+
+func TestPolicyFor(t *testing.T) {
+	policy, err := ParsePolicy("qcow2:store, .ISO:none,img:zstd-3,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for format, want := range map[string]string{".qcow2": "store", ".iso": "none", "IMG": "zstd-3", ".raw": "deflate"} {
+		if got := policy.For(format).String(); got != want {
+			t.Fatalf("format %s got codec %s, want %s", format, got, want)
+		}
+	}
+	policy, err = ParsePolicy("default:zstd")
+	if err != nil || policy.For(".raw").String() != "zstd" {
+		t.Fatalf("default entry isn't used: %v", err)
+	}
+	for _, value := range []string{"qcow2", ":store", "qcow2:gzip"} {
+		if _, err = ParsePolicy(value); err == nil {
+			t.Fatalf("policy %q was accepted", value)
+		}
+	}
+}
+
+func TestZipRoundTrip(t *testing.T) {
+	content := bytes.Repeat([]byte("image content "), 1000)
+	for _, spec := range []string{"store", "deflate", "deflate-1", "zstd", "zstd-19"} {
+		t.Run(spec, func(t *testing.T) {
+			c, err := Parse(spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			zw := c.NewZipWriter(&buf, 2)
+			w, err := zw.CreateHeader(&zip.FileHeader{Name: "image.img", Method: c.Method()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = w.Write(content); err != nil {
+				t.Fatal(err)
+			}
+			if err = zw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if zr.File[0].Method != c.Method() {
+				t.Fatalf("got method %d, want %d", zr.File[0].Method, c.Method())
+			}
+			r, err := zr.File[0].Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			got, err := ioutil.ReadAll(r)
+			if err != nil || !bytes.Equal(got, content) {
+				t.Fatalf("entry differs after the round trip: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// @Title  codec
+// @Description  gzip and zstd stream writers for archive downloads
+// @Author  GuoZhen Gao (2021/6/30 10:40)
+package codec
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"github.com/klauspost/compress/zstd"
+	"hash"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// gzipWriter wraps a parallel deflate stream in the gzip header and trailer
+type gzipWriter struct {
+	w       io.Writer
+	deflate *ParallelWriter
+	crc     hash.Hash32
+	size    uint32
+}
+
+// NewGzipWriter   Create a gzip writer naming its content, deflate runs on workers goroutines when
+// workers is more than one
+func NewGzipWriter(w io.Writer, name string, modTime time.Time, workers int) (io.WriteCloser, error) {
+	if workers <= 1 {
+		gw := gzip.NewWriter(w)
+		gw.Name = name
+		gw.ModTime = modTime
+		return gw, nil
+	}
+	// the header gzip.Writer would write: magic, deflate, FNAME flag, mtime, no extra flags, unknown os
+	header := []byte{0x1f, 0x8b, 8, 0x08, 0, 0, 0, 0, 0, 255}
+	if modTime.Unix() > 0 {
+		binary.LittleEndian.PutUint32(header[4:8], uint32(modTime.Unix()))
+	}
+	header = append(append(header, latin1(name)...), 0)
+	_, err := w.Write(header)
+	if err != nil {
+		return nil, err
+	}
+	deflate, err := NewParallelWriter(w, flate.DefaultCompression, workers)
+	if err != nil {
+		return nil, err
+	}
+	return &gzipWriter{w: w, deflate: deflate, crc: crc32.NewIEEE()}, nil
+}
+
+func (g *gzipWriter) Write(p []byte) (int, error) {
+	n, err := g.deflate.Write(p)
+	g.crc.Write(p[:n])
+	g.size += uint32(n)
+	return n, err
+}
+
+func (g *gzipWriter) Close() error {
+	err := g.deflate.Close()
+	if err != nil {
+		return err
+	}
+	var trailer [8]byte
+	binary.LittleEndian.PutUint32(trailer[:4], g.crc.Sum32())
+	binary.LittleEndian.PutUint32(trailer[4:], g.size)
+	_, err = g.w.Write(trailer[:])
+	return err
+}
+
+// gzip names are latin-1, other characters are dropped
+func latin1(name string) []byte {
+	b := make([]byte, 0, len(name))
+	for _, r := range name {
+		if r > 0 && r <= 0xff {
+			b = append(b, byte(r))
+		}
+	}
+	return b
+}
+
+// NewZstdWriter   Create a zstd stream writer at the default level
+func NewZstdWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedDefault))
+}
@@ -0,0 +1,178 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// @Title  codec
+// @Description  parallel deflate compressor producing a single standard deflate stream
+// @Author  GuoZhen Gao (2021/6/30 10:40)
+package codec
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+)
+
+const (
+	// DefaultBlockSize is the amount of input compressed by one worker at a time
+	DefaultBlockSize = 1 << 20
+
+	// the deflate window, each block is primed with this much of the block before it
+	dictSize = 32 << 10
+)
+
+var errWriterClosed = errors.New("parallel deflate writer is closed")
+
+// ParallelWriter   Define a deflate compressor splitting its input into blocks compressed by several
+// goroutines. Every block but the last ends with a sync flush, so the blocks concatenate into one deflate
+// stream which any inflater reads, and each block is primed with the end of the previous one to keep the
+// ratio close to a single threaded compressor.
+type ParallelWriter struct {
+	w         io.Writer
+	level     int
+	blockSize int
+
+	buf    []byte
+	dict   []byte
+	queue  chan *deflateBlock
+	done   chan struct{}
+	closed bool
+
+	mu  sync.Mutex
+	err error
+}
+
+type deflateBlock struct {
+	data []byte
+	dict []byte
+	last bool
+	out  bytes.Buffer
+	err  error
+	done chan struct{}
+}
+
+// NewParallelWriter   Create a parallel deflate writer using up to workers goroutines at the flate level
+func NewParallelWriter(w io.Writer, level, workers int) (*ParallelWriter, error) {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return nil, ErrInvalidCodec
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	p := &ParallelWriter{
+		w:         w,
+		level:     level,
+		blockSize: DefaultBlockSize,
+		buf:       make([]byte, 0, DefaultBlockSize),
+		queue:     make(chan *deflateBlock, workers-1),
+		done:      make(chan struct{}),
+	}
+	go p.writeBlocks()
+	return p, nil
+}
+
+// Write buffers p and hands every full block to a worker
+func (p *ParallelWriter) Write(data []byte) (int, error) {
+	if p.closed {
+		return 0, errWriterClosed
+	}
+	written := 0
+	for len(data) > 0 {
+		if err := p.failure(); err != nil {
+			return written, err
+		}
+		n := copy(p.buf[len(p.buf):cap(p.buf)], data)
+		p.buf = p.buf[:len(p.buf)+n]
+		data = data[n:]
+		written += n
+		if len(p.buf) == cap(p.buf) {
+			p.dispatch(false)
+		}
+	}
+	return written, nil
+}
+
+// Close compresses the buffered input as the final block and waits until all output is written
+func (p *ParallelWriter) Close() error {
+	if p.closed {
+		return p.failure()
+	}
+	p.closed = true
+	p.dispatch(true)
+	close(p.queue)
+	<-p.done
+	return p.failure()
+}
+
+// Start compressing the buffered input. Blocks are queued in order, the queue and the block being written
+// bound the blocks in flight to the number of workers.
+func (p *ParallelWriter) dispatch(last bool) {
+	b := &deflateBlock{data: p.buf, dict: p.dict, last: last, done: make(chan struct{})}
+	if len(p.buf) >= dictSize {
+		p.dict = p.buf[len(p.buf)-dictSize:]
+	} else {
+		p.dict = append(append([]byte{}, p.dict...), p.buf...)
+		if len(p.dict) > dictSize {
+			p.dict = p.dict[len(p.dict)-dictSize:]
+		}
+	}
+	p.buf = make([]byte, 0, p.blockSize)
+	p.queue <- b
+	go b.compress(p.level)
+}
+
+// Write compressed blocks in input order, blocks after a failure are only waited for
+func (p *ParallelWriter) writeBlocks() {
+	defer close(p.done)
+	for b := range p.queue {
+		<-b.done
+		if p.failure() != nil {
+			continue
+		}
+		err := b.err
+		if err == nil {
+			_, err = p.w.Write(b.out.Bytes())
+		}
+		if err != nil {
+			p.mu.Lock()
+			p.err = err
+			p.mu.Unlock()
+		}
+	}
+}
+
+func (p *ParallelWriter) failure() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+func (b *deflateBlock) compress(level int) {
+	defer close(b.done)
+	fw, err := flate.NewWriterDict(&b.out, level, b.dict)
+	if err == nil {
+		_, err = fw.Write(b.data)
+	}
+	if err == nil {
+		if b.last {
+			err = fw.Close()
+		} else {
+			err = fw.Flush()
+		}
+	}
+	b.err = err
+}
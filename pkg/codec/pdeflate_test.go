@@ -0,0 +1,196 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package codec
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+// imageLike returns data mixing zero runs, repetitive text and random bytes
+func imageLike(size int) []byte {
+	rng := rand.New(rand.NewSource(1))
+	data := make([]byte, 0, size)
+	line := []byte("inode 00001234 owner root mode 0644\n")
+	for len(data) < size {
+		run := make([]byte, 16<<10)
+		switch rng.Intn(3) {
+		case 1:
+			for i := range run {
+				run[i] = line[i%len(line)]
+			}
+		case 2:
+			rng.Read(run)
+		}
+		data = append(data, run...)
+	}
+	return data[:size]
+}
+
+func deflateParallel(t testing.TB, data []byte, level, workers int) []byte {
+	var out bytes.Buffer
+	w, err := NewParallelWriter(&out, level, workers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// odd sized writes cross block boundaries
+	for len(data) > 0 {
+		n := 100003
+		if n > len(data) {
+			n = len(data)
+		}
+		if _, err = w.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func TestParallelWriterRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, dictSize, DefaultBlockSize, 3*DefaultBlockSize + 12345} {
+		data := imageLike(size)
+		compressed := deflateParallel(t, data, flate.DefaultCompression, 4)
+		inflated, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(compressed)))
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(inflated, data) {
+			t.Fatalf("size %d: inflated data doesn't match", size)
+		}
+	}
+}
+
+func TestParallelWriterOutputDoesNotDependOnWorkers(t *testing.T) {
+	data := imageLike(5*DefaultBlockSize + 777)
+	expected := deflateParallel(t, data, flate.DefaultCompression, 1)
+	for _, workers := range []int{0, 2, 3, 8} {
+		if !bytes.Equal(deflateParallel(t, data, flate.DefaultCompression, workers), expected) {
+			t.Fatalf("output with %d workers differs from one worker", workers)
+		}
+	}
+}
+
+func TestParallelWriterRejectsInvalidLevel(t *testing.T) {
+	if _, err := NewParallelWriter(ioutil.Discard, 10, 2); err != ErrInvalidCodec {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestParallelWriterReportsWriteFailure(t *testing.T) {
+	w, err := NewParallelWriter(failingWriter{}, flate.BestSpeed, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write(imageLike(3 * DefaultBlockSize))
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil || err.Error() != "disk full" {
+		t.Fatalf("err = %v", err)
+	}
+	if _, err = w.Write([]byte{1}); err != errWriterClosed {
+		t.Fatalf("write after close err = %v", err)
+	}
+}
+
+func zipImage(t *testing.T, c Codec, data []byte, workers int) []byte {
+	var out bytes.Buffer
+	zw := c.NewZipWriter(&out, workers)
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: "disk.qcow2", Method: c.Method()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err = zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func TestZipWriterIsIndependentOfWorkers(t *testing.T) {
+	data := imageLike(2*DefaultBlockSize + 5)
+	for _, c := range []Codec{Default, {Name: Deflate, Level: flate.BestSpeed}} {
+		expected := zipImage(t, c, data, 1)
+		if !bytes.Equal(zipImage(t, c, data, 4), expected) {
+			t.Fatalf("%s zip differs with 4 workers", c)
+		}
+		r, err := zip.NewReader(bytes.NewReader(expected), int64(len(expected)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc, err := r.File[0].Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		inflated, err := ioutil.ReadAll(rc)
+		if err != nil || !bytes.Equal(inflated, data) {
+			t.Fatalf("%s zip entry doesn't match: %v", c, err)
+		}
+	}
+}
+
+func BenchmarkParallelWriter(b *testing.B) {
+	data := imageLike(8 * DefaultBlockSize)
+	for _, bench := range []struct {
+		name      string
+		newWriter func(io.Writer) (io.WriteCloser, error)
+	}{
+		{"single", func(w io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(w, flate.DefaultCompression)
+		}},
+		{"parallel-1", func(w io.Writer) (io.WriteCloser, error) {
+			return NewParallelWriter(w, flate.DefaultCompression, 1)
+		}},
+		{"parallel-4", func(w io.Writer) (io.WriteCloser, error) {
+			return NewParallelWriter(w, flate.DefaultCompression, 4)
+		}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				w, err := bench.newWriter(ioutil.Discard)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err = w.Write(data); err != nil {
+					b.Fatal(err)
+				}
+				if err = w.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -23,11 +23,25 @@ package dbAdpater
 type Database interface {
 	InitDatabase() error
 	InsertOrUpdateData(data interface{}, cols ...string) (err error)
+	InsertData(data interface{}) (err error)
+	InsertMultiData(bulk int, data interface{}) (int64, error)
 	ReadData(data interface{}, cols ...string) (err error)
 	DeleteData(data interface{}, cols ...string) (err error)
 	QueryCount(tableName string) (int64, error)
 	QueryCountForTable(tableName, fieldName, fieldValue string) (int64, error)
+	QueryCountWithFilters(tableName string, filters map[string]interface{}) (int64, error)
+	QueryCountWithConditions(tableName string, filters map[string]interface{},
+		anyOf []map[string]interface{}) (int64, error)
 	QueryTable(query string, container interface{}, field string, container1 ...interface{}) (num int64, err error)
+	QueryTableWithFilters(tableName string, container interface{}, filters map[string]interface{},
+		orderBy []string, limit, offset int64) (num int64, err error)
+	QueryTableWithConditions(tableName string, container interface{}, filters map[string]interface{},
+		anyOf []map[string]interface{}, orderBy []string, limit, offset int64) (num int64, err error)
+	UpdateWithFilters(tableName string, filters map[string]interface{}, params map[string]interface{}) (int64, error)
+	DeleteWithFilters(tableName string, filters map[string]interface{}) (int64, error)
+	IncrementField(tableName string, filters map[string]interface{}, field string, delta int64) (int64, error)
 	QueryForDownload(tableName string, container interface{}, imageId string) error
 	LoadRelated(md interface{}, name string) (int64, error)
+	QueryAggregate(tableName, sumExpr string) (count int64, sum int64, err error)
+	Ping() error
 }
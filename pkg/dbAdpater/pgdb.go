@@ -58,6 +58,17 @@ func (db *PgDb) InsertOrUpdateData(data interface{}, cols ...string) (err error)
 	return err
 }
 
+// Insert data into controller
+func (db *PgDb) InsertData(data interface{}) (err error) {
+	_, err = db.ormer.Insert(data)
+	return err
+}
+
+// Insert a slice of rows, bulk rows per statement
+func (db *PgDb) InsertMultiData(bulk int, data interface{}) (int64, error) {
+	return db.ormer.InsertMulti(bulk, data)
+}
+
 // Read data from controller
 func (db *PgDb) ReadData(data interface{}, cols ...string) (err error) {
 	err = db.ormer.Read(data, cols...)
@@ -82,6 +93,15 @@ func (db *PgDb) QueryCountForTable(tableName, fieldName, fieldValue string) (int
 	return num, err
 }
 
+// Query count of rows matching all filters
+func (db *PgDb) QueryCountWithFilters(tableName string, filters map[string]interface{}) (int64, error) {
+	qs := db.ormer.QueryTable(tableName)
+	for field, value := range filters {
+		qs = qs.Filter(field, value)
+	}
+	return qs.Count()
+}
+
 // return a raw query setter for raw sql string.
 func (db *PgDb) QueryTable(tableName string, container interface{}, field string, container1 ...interface{}) (num int64, err error) {
 
@@ -94,6 +114,95 @@ func (db *PgDb) QueryTable(tableName string, container interface{}, field string
 	return num, err
 }
 
+// Query rows matching all filters, a non positive limit returns every matching row
+func (db *PgDb) QueryTableWithFilters(tableName string, container interface{}, filters map[string]interface{},
+	orderBy []string, limit, offset int64) (num int64, err error) {
+	qs := db.ormer.QueryTable(tableName)
+	for field, value := range filters {
+		qs = qs.Filter(field, value)
+	}
+	if len(orderBy) > 0 {
+		qs = qs.OrderBy(orderBy...)
+	}
+	if limit > 0 {
+		qs = qs.Limit(limit, offset)
+	} else {
+		qs = qs.Limit(-1, offset)
+	}
+	return qs.All(container)
+}
+
+// Query rows matching all filters and any of the anyOf conditions, a condition matches when all its filters
+// match. No anyOf condition leaves the rows unrestricted, a non positive limit returns every matching row.
+func (db *PgDb) QueryTableWithConditions(tableName string, container interface{}, filters map[string]interface{},
+	anyOf []map[string]interface{}, orderBy []string, limit, offset int64) (num int64, err error) {
+	qs := db.ormer.QueryTable(tableName).SetCond(newCondition(filters, anyOf))
+	if len(orderBy) > 0 {
+		qs = qs.OrderBy(orderBy...)
+	}
+	if limit > 0 {
+		qs = qs.Limit(limit, offset)
+	} else {
+		qs = qs.Limit(-1, offset)
+	}
+	return qs.All(container)
+}
+
+// Count rows matching all filters and any of the anyOf conditions, the way QueryTableWithConditions matches them
+func (db *PgDb) QueryCountWithConditions(tableName string, filters map[string]interface{},
+	anyOf []map[string]interface{}) (int64, error) {
+	return db.ormer.QueryTable(tableName).SetCond(newCondition(filters, anyOf)).Count()
+}
+
+// Build the condition matching all filters and any of the anyOf conditions
+func newCondition(filters map[string]interface{}, anyOf []map[string]interface{}) *orm.Condition {
+	cond := orm.NewCondition()
+	for field, value := range filters {
+		cond = cond.And(field, value)
+	}
+	if len(anyOf) > 0 {
+		any := orm.NewCondition()
+		for _, condition := range anyOf {
+			all := orm.NewCondition()
+			for field, value := range condition {
+				all = all.And(field, value)
+			}
+			any = any.OrCond(all)
+		}
+		cond = cond.AndCond(any)
+	}
+	return cond
+}
+
+// Update columns of rows matching all filters, returns the number of updated rows
+func (db *PgDb) UpdateWithFilters(tableName string, filters map[string]interface{},
+	params map[string]interface{}) (int64, error) {
+	qs := db.ormer.QueryTable(tableName)
+	for field, value := range filters {
+		qs = qs.Filter(field, value)
+	}
+	return qs.Update(params)
+}
+
+// Delete rows matching all filters, returns the number of deleted rows
+func (db *PgDb) DeleteWithFilters(tableName string, filters map[string]interface{}) (int64, error) {
+	qs := db.ormer.QueryTable(tableName)
+	for field, value := range filters {
+		qs = qs.Filter(field, value)
+	}
+	return qs.Delete()
+}
+
+// Atomically add delta to a numeric column of rows matching all filters, returns the number of updated rows
+func (db *PgDb) IncrementField(tableName string, filters map[string]interface{}, field string,
+	delta int64) (int64, error) {
+	qs := db.ormer.QueryTable(tableName)
+	for key, value := range filters {
+		qs = qs.Filter(key, value)
+	}
+	return qs.Update(orm.Params{field: orm.ColValue(orm.ColAdd, delta)})
+}
+
 //return the download path
 func (db *PgDb) QueryForDownload(tableName string, container interface{}, imageId string) error {
 	qs := db.ormer.QueryTable(tableName)
@@ -107,6 +216,18 @@ func (db *PgDb) LoadRelated(md interface{}, name string) (int64, error) {
 	return num, err
 }
 
+// Count the rows of a table and sum an expression over them, tableName and sumExpr are trusted constants
+func (db *PgDb) QueryAggregate(tableName, sumExpr string) (count int64, sum int64, err error) {
+	err = db.ormer.Raw("SELECT COUNT(*), COALESCE(SUM(" + sumExpr + "), 0) FROM " + tableName).QueryRow(&count, &sum)
+	return count, sum, err
+}
+
+// Check the database connection is usable
+func (db *PgDb) Ping() error {
+	var result int
+	return db.ormer.Raw("SELECT 1").QueryRow(&result)
+}
+
 func (db *PgDb) InitDatabase() error {
 	dbUser := util.GetDbUser()
 	dbPwd := []byte(os.Getenv("POSTGRES_PASSWORD"))
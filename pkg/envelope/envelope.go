@@ -0,0 +1,402 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// @Title  envelope
+// @Description  envelope encryption of stored files with AES-256-GCM data keys wrapped by a master key
+// @Author  GuoZhen Gao (2021/6/30 10:40)
+//
+// Every file gets a random data key, the file starts with a header of fixed size holding the data key
+// wrapped by a master key, so rotating the master key rewrites the header only:
+//
+//	magic        8 bytes   "FSENC\x00\x00\x01"
+//	segment      4 bytes   plaintext bytes per segment
+//	key id       1 + 64    length and name of the master key
+//	wrapped key  2 + 177   length and wrapped data key
+//
+// The plaintext follows in segments sealed one by one, the nonce of a segment is its index and a flag marking
+// the last one, so segments can't be reordered and a truncated file doesn't decrypt. Any byte range is read
+// by decrypting the segments it covers.
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+const (
+	// HeaderSize is the size of the header in front of the first segment
+	HeaderSize = 256
+	// DefaultSegmentSize is the plaintext size of the segments new files are written with
+	DefaultSegmentSize = 64 << 10
+
+	maxKeyIdLength   = 64
+	maxWrappedLength = HeaderSize - 8 - 4 - 1 - maxKeyIdLength - 2
+	maxSegmentSize   = 16 << 20
+	dataKeySize      = 32
+	tagSize          = 16
+)
+
+var magic = []byte("FSENC\x00\x00\x01")
+
+// ErrCorrupt is returned for encrypted files which are truncated or were modified
+var ErrCorrupt = errors.New("encrypted file is truncated or was modified")
+
+// ErrNotEncrypted is returned when a file doesn't start with the envelope header
+var ErrNotEncrypted = errors.New("file isn't encrypted")
+
+// header is the envelope header of a file
+type header struct {
+	segmentSize int
+	keyId       string
+	wrapped     []byte
+}
+
+func (h *header) marshal() ([]byte, error) {
+	if len(h.keyId) == 0 || len(h.keyId) > maxKeyIdLength {
+		return nil, errors.New("master key id should have 1 to 64 bytes")
+	}
+	if len(h.wrapped) > maxWrappedLength {
+		return nil, errors.New("wrapped data key is too long")
+	}
+	buf := make([]byte, HeaderSize)
+	copy(buf, magic)
+	binary.BigEndian.PutUint32(buf[8:], uint32(h.segmentSize))
+	buf[12] = byte(len(h.keyId))
+	copy(buf[13:], h.keyId)
+	off := 13 + maxKeyIdLength
+	binary.BigEndian.PutUint16(buf[off:], uint16(len(h.wrapped)))
+	copy(buf[off+2:], h.wrapped)
+	return buf, nil
+}
+
+func readHeader(r io.ReaderAt) (*header, error) {
+	buf := make([]byte, HeaderSize)
+	n, err := r.ReadAt(buf, 0)
+	if n < len(magic) || string(buf[:len(magic)]) != string(magic) {
+		return nil, ErrNotEncrypted
+	}
+	if n < HeaderSize {
+		if err == nil || err == io.EOF {
+			err = ErrCorrupt
+		}
+		return nil, err
+	}
+	h := &header{segmentSize: int(binary.BigEndian.Uint32(buf[8:]))}
+	keyIdLength := int(buf[12])
+	off := 13 + maxKeyIdLength
+	wrappedLength := int(binary.BigEndian.Uint16(buf[off:]))
+	if h.segmentSize <= 0 || h.segmentSize > maxSegmentSize || keyIdLength == 0 || keyIdLength > maxKeyIdLength ||
+		wrappedLength > maxWrappedLength {
+		return nil, ErrCorrupt
+	}
+	h.keyId = string(buf[13 : 13+keyIdLength])
+	h.wrapped = append([]byte(nil), buf[off+2:off+2+wrappedLength]...)
+	return h, nil
+}
+
+// IsEncrypted reports whether a file starts with the envelope header
+func IsEncrypted(r io.ReaderAt) (bool, error) {
+	buf := make([]byte, len(magic))
+	n, err := r.ReadAt(buf, 0)
+	if n == len(magic) {
+		return string(buf) == string(magic), nil
+	}
+	if err == io.EOF {
+		return false, nil
+	}
+	return false, err
+}
+
+// KeyId returns the id of the master key the data key of a file is wrapped with
+func KeyId(r io.ReaderAt) (string, error) {
+	h, err := readHeader(r)
+	if err != nil {
+		return "", err
+	}
+	return h.keyId, nil
+}
+
+func newAead(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// The nonce of a segment is its index followed by a flag set on the last segment
+func segmentNonce(index int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, uint64(index))
+	if last {
+		nonce[8] = 1
+	}
+	return nonce
+}
+
+// writer seals the plaintext written to it segment by segment, a segment is held back until it is known
+// whether it is the last one
+type writer struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	buf   []byte
+	out   []byte
+	index int64
+	err   error
+}
+
+// NewWriter writes the header of a new encrypted file to w with a new data key wrapped by the active key
+// of keys, the plaintext written to the returned writer is sealed into w. Close writes the last segment
+// and doesn't close w.
+func NewWriter(w io.Writer, keys KeyProvider) (io.WriteCloser, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+	keyId := keys.ActiveKey()
+	wrapped, err := keys.Wrap(keyId, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	h := &header{segmentSize: DefaultSegmentSize, keyId: keyId, wrapped: wrapped}
+	buf, err := h.marshal()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAead(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(buf); err != nil {
+		return nil, err
+	}
+	return &writer{
+		w:    w,
+		aead: aead,
+		buf:  make([]byte, 0, DefaultSegmentSize),
+		out:  make([]byte, 0, DefaultSegmentSize+tagSize),
+	}, nil
+}
+
+func (e *writer) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	written := 0
+	for len(p) > 0 {
+		if len(e.buf) == cap(e.buf) {
+			// more plaintext follows, so the full segment isn't the last one
+			if e.err = e.seal(false); e.err != nil {
+				return written, e.err
+			}
+		}
+		n := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *writer) seal(last bool) error {
+	e.out = e.aead.Seal(e.out[:0], segmentNonce(e.index, last), e.buf, nil)
+	e.index++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(e.out)
+	return err
+}
+
+func (e *writer) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+	e.err = e.seal(true)
+	if e.err != nil {
+		return e.err
+	}
+	e.err = errors.New("envelope writer is closed")
+	return nil
+}
+
+// Reader   Define the plaintext of an encrypted file read at any offset
+type Reader struct {
+	r           io.ReaderAt
+	aead        cipher.AEAD
+	segmentSize int64
+	segments    int64
+	size        int64
+
+	mu      sync.Mutex
+	current int64
+	plain   []byte
+	sealed  []byte
+}
+
+// NewReader opens an encrypted file of the given size, the data key is unwrapped with keys
+func NewReader(r io.ReaderAt, size int64, keys KeyProvider) (*Reader, error) {
+	h, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := keys.Unwrap(h.keyId, h.wrapped)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAead(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	// every file has at least one segment, the last one holds 1 to segmentSize bytes unless the file is empty
+	body := size - HeaderSize
+	sealedSize := int64(h.segmentSize + tagSize)
+	if body < tagSize {
+		return nil, ErrCorrupt
+	}
+	segments := (body + sealedSize - 1) / sealedSize
+	if last := body - (segments-1)*sealedSize; last < tagSize || (last == tagSize && segments > 1) {
+		return nil, ErrCorrupt
+	}
+	return &Reader{
+		r:           r,
+		aead:        aead,
+		segmentSize: int64(h.segmentSize),
+		segments:    segments,
+		size:        body - segments*tagSize,
+		current:     -1,
+	}, nil
+}
+
+// Size returns the size of the plaintext
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+// ReadAt reads the plaintext at off, segments which don't decrypt give ErrCorrupt
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for n < len(p) && off < r.size {
+		index := off / r.segmentSize
+		if err := r.open(index); err != nil {
+			return n, err
+		}
+		read := copy(p[n:], r.plain[off-index*r.segmentSize:])
+		n += read
+		off += int64(read)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Decrypt a segment, the last decrypted segment is kept for sequential reads
+func (r *Reader) open(index int64) error {
+	if index == r.current {
+		return nil
+	}
+	r.current = -1
+	sealedSize := r.segmentSize + tagSize
+	length := sealedSize
+	if index == r.segments-1 {
+		length = r.size + r.segments*tagSize - index*sealedSize
+	}
+	if int64(cap(r.sealed)) < length {
+		r.sealed = make([]byte, sealedSize)
+	}
+	sealed := r.sealed[:length]
+	n, err := r.r.ReadAt(sealed, HeaderSize+index*sealedSize)
+	if int64(n) < length {
+		if err == nil || err == io.EOF {
+			err = ErrCorrupt
+		}
+		return err
+	}
+	r.plain, err = r.aead.Open(r.plain[:0], segmentNonce(index, index == r.segments-1), sealed, nil)
+	if err != nil {
+		return ErrCorrupt
+	}
+	r.current = index
+	return nil
+}
+
+// Seal encrypts data as a whole file
+func Seal(data []byte, keys KeyProvider) ([]byte, error) {
+	out := &sliceWriter{buf: make([]byte, 0, HeaderSize+len(data)+(len(data)/DefaultSegmentSize+1)*tagSize)}
+	w, err := NewWriter(out, keys)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(data); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return out.buf, nil
+}
+
+type sliceWriter struct {
+	buf []byte
+}
+
+func (s *sliceWriter) Write(p []byte) (int, error) {
+	s.buf = append(s.buf, p...)
+	return len(p), nil
+}
+
+// ReaderWriterAt is a file whose header is rewritten in place
+type ReaderWriterAt interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// Rewrap wraps the data key of an encrypted file with the active key of keys, the segments are left as they
+// are. Returns false when the data key already is wrapped with the active key.
+func Rewrap(f ReaderWriterAt, keys KeyProvider) (bool, error) {
+	h, err := readHeader(f)
+	if err != nil {
+		return false, err
+	}
+	active := keys.ActiveKey()
+	if h.keyId == active {
+		return false, nil
+	}
+	dataKey, err := keys.Unwrap(h.keyId, h.wrapped)
+	if err != nil {
+		return false, err
+	}
+	h.keyId = active
+	h.wrapped, err = keys.Wrap(active, dataKey)
+	if err != nil {
+		return false, err
+	}
+	buf, err := h.marshal()
+	if err != nil {
+		return false, err
+	}
+	_, err = f.WriteAt(buf, 0)
+	return err == nil, err
+}
@@ -0,0 +1,201 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package envelope
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testKeyFile(t *testing.T, active string, ids ...string) *KeyFile {
+	t.Helper()
+	var data bytes.Buffer
+	for _, id := range ids {
+		data.WriteString(id + "=" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte(id[:1]), 32)) + "\n")
+	}
+	keys, err := ParseKeyFile(data.Bytes(), active)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// memFile is an in memory file whose header can be rewritten in place
+type memFile []byte
+
+func (m memFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(m)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m memFile) WriteAt(p []byte, off int64) (int, error) {
+	return copy(m[off:], p), nil
+}
+
+func readAll(t *testing.T, sealed []byte, keys KeyProvider) ([]byte, error) {
+	t.Helper()
+	r, err := NewReader(memFile(sealed), int64(len(sealed)), keys)
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, r.Size())
+	_, err = r.ReadAt(plain, 0)
+	if err == io.EOF {
+		err = nil
+	}
+	return plain, err
+}
+
+func TestSealRoundTrip(t *testing.T) {
+	keys := testKeyFile(t, "", "k1")
+	for _, size := range []int{0, 1, DefaultSegmentSize, 2*DefaultSegmentSize + 7} {
+		data := bytes.Repeat([]byte("0123456789"), size/10+1)[:size]
+		sealed, err := Seal(data, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encrypted, _ := IsEncrypted(memFile(sealed)); !encrypted {
+			t.Fatalf("sealed %d bytes aren't recognized as encrypted", size)
+		}
+		plain, err := readAll(t, sealed, keys)
+		if err != nil || !bytes.Equal(plain, data) {
+			t.Fatalf("round trip of %d bytes failed: %v", size, err)
+		}
+	}
+	if encrypted, err := IsEncrypted(memFile("plain text which is long enough")); encrypted || err != nil {
+		t.Fatalf("got %v and %v for a plain file", encrypted, err)
+	}
+}
+
+func TestReadAtAcrossSegments(t *testing.T) {
+	keys := testKeyFile(t, "", "k1")
+	data := bytes.Repeat([]byte("abcdefghij"), DefaultSegmentSize/5)
+	sealed, err := Seal(data, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(memFile(sealed), int64(len(sealed)), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	off := int64(DefaultSegmentSize - 3)
+	buf := make([]byte, 10)
+	if _, err = r.ReadAt(buf, off); err != nil || !bytes.Equal(buf, data[off:off+10]) {
+		t.Fatalf("got %q and %v, want %q", buf, err, data[off:off+10])
+	}
+}
+
+func TestDetectsTamperingAndTruncation(t *testing.T) {
+	keys := testKeyFile(t, "", "k1")
+	data := bytes.Repeat([]byte("x"), DefaultSegmentSize+100)
+	sealed, err := Seal(data, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]byte(nil), sealed...)
+	tampered[HeaderSize+10] ^= 1
+	if _, err = readAll(t, tampered, keys); err != ErrCorrupt {
+		t.Fatalf("got %v for a modified segment, want %v", err, ErrCorrupt)
+	}
+	// dropping the last segment leaves a file whose remaining segment isn't marked last
+	truncated := sealed[:HeaderSize+DefaultSegmentSize+tagSize]
+	if _, err = readAll(t, truncated, keys); err != ErrCorrupt {
+		t.Fatalf("got %v for a truncated file, want %v", err, ErrCorrupt)
+	}
+}
+
+func TestRewrapRotatesKey(t *testing.T) {
+	old := testKeyFile(t, "k1", "k1", "k2")
+	sealed, err := Seal([]byte("image"), old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated := testKeyFile(t, "k2", "k1", "k2")
+	if changed, err := Rewrap(memFile(sealed), rotated); !changed || err != nil {
+		t.Fatalf("got %v and %v rewrapping with a new key", changed, err)
+	}
+	if keyId, _ := KeyId(memFile(sealed)); keyId != "k2" {
+		t.Fatalf("data key is wrapped with %s, want k2", keyId)
+	}
+	if changed, err := Rewrap(memFile(sealed), rotated); changed || err != nil {
+		t.Fatalf("got %v and %v rewrapping with the active key", changed, err)
+	}
+	if plain, err := readAll(t, sealed, testKeyFile(t, "", "k2")); err != nil || string(plain) != "image" {
+		t.Fatalf("got %q and %v after rotation", plain, err)
+	}
+	if _, err = readAll(t, sealed, testKeyFile(t, "", "k1")); err != ErrUnknownKey {
+		t.Fatalf("got %v without the wrapping key, want %v", err, ErrUnknownKey)
+	}
+}
+
+func TestParseKeyFileRejects(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	for _, data := range []string{"", "# only a comment\n", "k1\n", "k1=short\n", "k1=" + key + "\nk1=" + key + "\n"} {
+		if _, err := ParseKeyFile([]byte(data), ""); err == nil {
+			t.Fatalf("parsed invalid key file %q", data)
+		}
+	}
+	if _, err := ParseKeyFile([]byte("k1="+key), "k2"); err == nil {
+		t.Fatal("accepted an active key which isn't in the key file")
+	}
+}
+
+func TestKeyFileCacheReloadsOnChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "master.keys")
+	key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	if err = ioutil.WriteFile(path, []byte("k1="+key+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var cache KeyFileCache
+	first, err := cache.Load(path, "")
+	if err != nil || first.ActiveKey() != "k1" {
+		t.Fatalf("got %v loading the key file", err)
+	}
+	if again, err := cache.Load(path, ""); err != nil || again != first {
+		t.Fatal("unchanged key file was loaded again")
+	}
+
+	if err = ioutil.WriteFile(path, []byte("k1="+key+"\nk2="+key+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if rotated, err := cache.Load(path, "k2"); err != nil || rotated.ActiveKey() != "k2" {
+		t.Fatalf("got %v loading the rotated key file", err)
+	}
+	if _, err = cache.Load(filepath.Join(dir, "missing.keys"), ""); err == nil {
+		t.Fatal("missing key file was loaded")
+	}
+}
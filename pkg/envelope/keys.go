@@ -0,0 +1,180 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// @Title  envelope
+// @Description  master keys data keys are wrapped with, read from a local key file standing in for a KMS
+// @Author  GuoZhen Gao (2021/6/30 10:40)
+package envelope
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrUnknownKey is returned when a data key is wrapped with a master key the key provider doesn't have
+var ErrUnknownKey = errors.New("master key is unknown")
+
+// KeyProvider wraps and unwraps data keys with named master keys, a KMS client implements it
+// the same way as the key file
+type KeyProvider interface {
+	// ActiveKey returns the id of the master key new data keys are wrapped with
+	ActiveKey() string
+	Wrap(keyId string, dataKey []byte) ([]byte, error)
+	Unwrap(keyId string, wrapped []byte) ([]byte, error)
+}
+
+// KeyFile   Define the master keys of a local key file, keys stay in the file after rotation so data keys
+// wrapped with them are still unwrapped
+type KeyFile struct {
+	keys   map[string][]byte
+	active string
+}
+
+// KeyFileCache   Define a key file loaded once and loaded again when the file or the active key changes
+type KeyFileCache struct {
+	mu      sync.Mutex
+	path    string
+	active  string
+	modTime time.Time
+	size    int64
+	keys    *KeyFile
+}
+
+// LoadKeyFile reads a key file of id=base64 lines with 32 byte AES-256 keys, empty lines and lines starting
+// with # are skipped. active names the key new data keys are wrapped with, empty takes the first key.
+func LoadKeyFile(path, active string) (*KeyFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeyFile(data, active)
+}
+
+// Load returns the keys of a key file, the file is read again when its path, modification time or size or
+// the active key changes so a rotated key is taken without a restart
+func (c *KeyFileCache) Load(path, active string) (*KeyFile, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.keys != nil && c.path == path && c.active == active && c.modTime.Equal(info.ModTime()) &&
+		c.size == info.Size() {
+		return c.keys, nil
+	}
+	keys, err := LoadKeyFile(path, active)
+	if err != nil {
+		return nil, err
+	}
+	c.path, c.active, c.modTime, c.size, c.keys = path, active, info.ModTime(), info.Size(), keys
+	return keys, nil
+}
+
+// ParseKeyFile parses the content of a key file
+func ParseKeyFile(data []byte, active string) (*KeyFile, error) {
+	k := &KeyFile{keys: map[string][]byte{}}
+	var first string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.SplitN(text, "=", 2)
+		keyId := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || keyId == "" || len(keyId) > maxKeyIdLength {
+			return nil, errors.New("line " + strconv.Itoa(line) + " of key file should be id=base64 key")
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(parts[1]))
+		if err != nil || len(key) != 32 {
+			return nil, errors.New("key " + keyId + " should be 32 base64 encoded bytes")
+		}
+		if _, ok := k.keys[keyId]; ok {
+			return nil, errors.New("key " + keyId + " is repeated")
+		}
+		if first == "" {
+			first = keyId
+		}
+		k.keys[keyId] = key
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if first == "" {
+		return nil, errors.New("key file has no key")
+	}
+	if active == "" {
+		active = first
+	}
+	if _, ok := k.keys[active]; !ok {
+		return nil, errors.New("active key " + active + " isn't in the key file")
+	}
+	k.active = active
+	return k, nil
+}
+
+// ActiveKey returns the id of the key new data keys are wrapped with
+func (k *KeyFile) ActiveKey() string {
+	return k.active
+}
+
+// Wrap seals a data key with a master key, the key id is authenticated with it
+func (k *KeyFile) Wrap(keyId string, dataKey []byte) ([]byte, error) {
+	key, ok := k.keys[keyId]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	aead, err := newAead(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, dataKey, []byte(keyId)), nil
+}
+
+// Unwrap opens a data key wrapped with a master key
+func (k *KeyFile) Unwrap(keyId string, wrapped []byte) ([]byte, error) {
+	key, ok := k.keys[keyId]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	aead, err := newAead(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, ErrCorrupt
+	}
+	dataKey, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], []byte(keyId))
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	return dataKey, nil
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// @Title  manifest
+// @Description  integrity manifests of image packages in the .mf format of EdgeGallery app packages
+// @Author  GuoZhen Gao (2021/6/30 10:40)
+//
+// A manifest lists one block per file, blocks are separated by blank lines:
+//
+//	Source: image.qcow2
+//	Algorithm: SHA-256
+//	Hash: 4b882bd21ea679b8824fea91a9fda97f4d1cccb1fd53e1cdfe119e9938ddd0e6
+package manifest
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"strings"
+)
+
+// AlgorithmSha256 is the only hash algorithm manifests are written with
+const AlgorithmSha256 = "SHA-256"
+
+// Entry   Define the digest of one file of a package
+type Entry struct {
+	Source    string
+	Algorithm string
+	Hash      string
+}
+
+// Manifest   Define the digests of the files of a package in the order they were added
+type Manifest struct {
+	Entries []Entry
+}
+
+// Add the SHA-256 digest of a file
+func (m *Manifest) Add(source, hash string) {
+	m.Entries = append(m.Entries, Entry{Source: source, Algorithm: AlgorithmSha256, Hash: strings.ToLower(hash)})
+}
+
+// Hash returns the SHA-256 digest of a file, false when the manifest doesn't list it
+func (m *Manifest) Hash(source string) (string, bool) {
+	for _, entry := range m.Entries {
+		if entry.Source == source && entry.Algorithm == AlgorithmSha256 {
+			return entry.Hash, true
+		}
+	}
+	return "", false
+}
+
+// Bytes returns the manifest as written into packages, the same entries always give the same bytes
+func (m *Manifest) Bytes() []byte {
+	var buf bytes.Buffer
+	for i, entry := range m.Entries {
+		if i > 0 {
+			buf.WriteString("\n")
+		}
+		buf.WriteString("Source: " + entry.Source + "\n")
+		buf.WriteString("Algorithm: " + entry.Algorithm + "\n")
+		buf.WriteString("Hash: " + entry.Hash + "\n")
+	}
+	return buf.Bytes()
+}
+
+// Parse a manifest, blocks without a source and keys other than Source, Algorithm and Hash are ignored
+// so manifests with a metadata block are read as well
+func Parse(data []byte) (*Manifest, error) {
+	m := &Manifest{}
+	var entry Entry
+	flush := func() error {
+		if entry.Source != "" {
+			if entry.Algorithm == "" || entry.Hash == "" {
+				return errors.New("manifest entry " + entry.Source + " has no algorithm or hash")
+			}
+			m.Entries = append(m.Entries, entry)
+		}
+		entry = Entry{}
+		return nil
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+		switch strings.TrimSpace(parts[0]) {
+		case "Source":
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			entry.Source = value
+		case "Algorithm":
+			entry.Algorithm = value
+		case "Hash":
+			entry.Hash = strings.ToLower(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// @Title  scanner
+// @Description  ClamAV daemon client scanning streams with the INSTREAM command
+// @Author  GuoZhen Gao (2021/6/30 10:40)
+//
+// The client sends zINSTREAM followed by chunks of a 4 byte big endian length and data, a chunk of length 0
+// ends the stream. The daemon answers one NUL terminated line:
+//
+//	stream: OK                          nothing found
+//	stream: Eicar-Signature FOUND       malware found
+//	INSTREAM size limit exceeded. ERROR the stream is longer than StreamMaxLength of clamd.conf
+package scanner
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const clamdChunkSize = 64 << 10
+
+// ErrSizeLimit is returned when the stream is longer than StreamMaxLength of the daemon
+var ErrSizeLimit = errors.New("clamd: stream is longer than StreamMaxLength")
+
+// ClamdScanner   Define a client of a ClamAV daemon listening on tcp://host:port or unix:///path
+type ClamdScanner struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+// NewClamdScanner creates a clamd client, an address without scheme is a tcp address. The timeout applies
+// to every read and write, so long streams aren't cut off.
+func NewClamdScanner(address string, timeout time.Duration) (*ClamdScanner, error) {
+	network := "tcp"
+	switch {
+	case strings.HasPrefix(address, "tcp://"):
+		address = strings.TrimPrefix(address, "tcp://")
+	case strings.HasPrefix(address, "unix://"):
+		network, address = "unix", strings.TrimPrefix(address, "unix://")
+	}
+	if address == "" {
+		return nil, errors.New("clamd address is empty")
+	}
+	return &ClamdScanner{network: network, address: address, timeout: timeout}, nil
+}
+
+// Name returns the name of the scanner
+func (c *ClamdScanner) Name() string {
+	return Clamd
+}
+
+// Scan streams r to the daemon and returns its verdict
+func (c *ClamdScanner) Scan(r io.Reader) (*Result, error) {
+	conn, err := net.DialTimeout(c.network, c.address, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	err = c.send(conn, r)
+	// the daemon may stop the stream early, its reply tells why
+	reply, readErr := c.reply(conn)
+	if readErr != nil {
+		if err != nil {
+			return nil, err
+		}
+		return nil, readErr
+	}
+	result, parseErr := parseReply(reply)
+	if parseErr != nil || err == nil {
+		return result, parseErr
+	}
+	return nil, err
+}
+
+func (c *ClamdScanner) send(conn net.Conn, r io.Reader) error {
+	if err := c.write(conn, []byte("zINSTREAM\x00")); err != nil {
+		return err
+	}
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if writeErr := c.write(conn, buf[:4+n]); writeErr != nil {
+				return writeErr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return c.write(conn, []byte{0, 0, 0, 0})
+}
+
+func (c *ClamdScanner) write(conn net.Conn, p []byte) error {
+	if c.timeout > 0 {
+		if err := conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+			return err
+		}
+	}
+	_, err := conn.Write(p)
+	return err
+}
+
+func (c *ClamdScanner) reply(conn net.Conn) (string, error) {
+	if c.timeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+			return "", err
+		}
+	}
+	reply, err := bufio.NewReader(io.LimitReader(conn, 4096)).ReadString(0)
+	if err == io.EOF && reply != "" {
+		err = nil
+	}
+	return strings.TrimSpace(strings.TrimRight(reply, "\x00")), err
+}
+
+// Parse the reply of the daemon to a stream
+func parseReply(reply string) (*Result, error) {
+	switch {
+	case strings.HasSuffix(reply, " FOUND"):
+		signature := strings.TrimSuffix(reply, " FOUND")
+		if i := strings.Index(signature, ": "); i >= 0 {
+			signature = signature[i+2:]
+		}
+		return &Result{Infected: true, Signature: signature}, nil
+	case strings.HasSuffix(reply, ": OK"):
+		return &Result{}, nil
+	case strings.HasPrefix(reply, "INSTREAM size limit exceeded"):
+		return nil, ErrSizeLimit
+	case reply == "":
+		return nil, errors.New("clamd closed the connection without reply")
+	default:
+		return nil, errors.New("clamd: " + reply)
+	}
+}
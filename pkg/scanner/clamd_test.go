@@ -0,0 +1,120 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scanner
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Serve one clamd INSTREAM request, the streamed content is sent on the returned channel
+func fakeClamd(t *testing.T, reply string) (string, <-chan []byte) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		command := make([]byte, len("zINSTREAM\x00"))
+		if _, err = io.ReadFull(conn, command); err != nil {
+			return
+		}
+		var content bytes.Buffer
+		for {
+			var size uint32
+			if err = binary.Read(conn, binary.BigEndian, &size); err != nil {
+				return
+			}
+			if size == 0 {
+				break
+			}
+			if _, err = io.CopyN(&content, conn, int64(size)); err != nil {
+				return
+			}
+		}
+		received <- content.Bytes()
+		_, _ = conn.Write([]byte(reply + "\x00"))
+	}()
+	return "tcp://" + listener.Addr().String(), received
+}
+
+func TestClamdScan(t *testing.T) {
+	content := bytes.Repeat([]byte("image "), clamdChunkSize/3)
+	for _, tt := range []struct {
+		reply string
+		want  Result
+	}{
+		{"stream: OK", Result{}},
+		{"stream: Eicar-Test-Signature FOUND", Result{Infected: true, Signature: "Eicar-Test-Signature"}},
+	} {
+		address, received := fakeClamd(t, tt.reply)
+		s, err := New(Clamd, address, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := s.Scan(bytes.NewReader(content))
+		if err != nil || *result != tt.want {
+			t.Fatalf("got %+v and %v for reply %q, want %+v", result, err, tt.reply, tt.want)
+		}
+		if got := <-received; !bytes.Equal(got, content) {
+			t.Fatalf("daemon received %d bytes, want %d", len(got), len(content))
+		}
+	}
+}
+
+func TestClamdScanReportsErrors(t *testing.T) {
+	for reply, want := range map[string]error{
+		"INSTREAM size limit exceeded. ERROR": ErrSizeLimit,
+		"stream: Can't allocate memory ERROR": nil,
+	} {
+		address, _ := fakeClamd(t, reply)
+		s, err := NewClamdScanner(address, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.Scan(bytes.NewReader([]byte("image")))
+		if err == nil || (want != nil && err != want) {
+			t.Fatalf("got %v for reply %q, want %v", err, reply, want)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	if s, err := New("", "", 0); s != nil || err != nil {
+		t.Fatalf("got %v and %v without a scanner name", s, err)
+	}
+	if _, err := New("unknown", "localhost:3310", 0); err == nil {
+		t.Fatal("created an unsupported scanner")
+	}
+	if _, err := New(Clamd, "unix://", 0); err == nil {
+		t.Fatal("created a clamd scanner without address")
+	}
+	s, err := NewClamdScanner("unix:///run/clamd.sock", 0)
+	if err != nil || s.network != "unix" || s.address != "/run/clamd.sock" {
+		t.Fatalf("got %+v and %v for a unix address", s, err)
+	}
+}
@@ -0,0 +1,55 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// @Title  scanner
+// @Description  malware scanners uploaded images are checked with before they are published
+// @Author  GuoZhen Gao (2021/6/30 10:40)
+package scanner
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// Clamd is the name of the ClamAV daemon scanner
+const Clamd = "clamd"
+
+// Result   Define the outcome of a scan, Signature names the malware found
+type Result struct {
+	Infected  bool
+	Signature string
+}
+
+// Scanner checks the content of an image for malware
+type Scanner interface {
+	// Name returns the name the scanner is configured with
+	Name() string
+	// Scan reads r to the end, an error means the content couldn't be scanned
+	Scan(r io.Reader) (*Result, error)
+}
+
+// New creates the scanner of the given name, an empty name gives no scanner
+func New(name, address string, timeout time.Duration) (Scanner, error) {
+	switch name {
+	case "":
+		return nil, nil
+	case Clamd:
+		return NewClamdScanner(address, timeout)
+	default:
+		return nil, errors.New("scanner " + name + " is not supported")
+	}
+}
@@ -0,0 +1,216 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// @Title  signing
+// @Description  detached image signatures verified against a trust store of public keys
+// @Author  GuoZhen Gao (2021/6/30 10:40)
+//
+// Signatures are made over the SHA-256 digest of the image file rather than the file itself, so images of
+// any size are verified without reading them again:
+//
+//	ECDSA     ASN.1 signature of the digest, as written by cosign sign-blob or openssl dgst -sha256 -sign
+//	Ed25519   signature of the 32 digest bytes
+//
+// Signatures are base64 encoded. The trust store is a directory of PEM encoded PKIX public keys, the file
+// name without extension is the name of the signer.
+package signing
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrNoTrustedKey is returned when no key of the trust store verifies a signature
+var ErrNoTrustedKey = errors.New("signature isn't verified by any trusted key")
+
+// ErrMalformedSignature is returned for signatures which aren't base64
+var ErrMalformedSignature = errors.New("signature should be base64 encoded")
+
+// TrustedKey   Define a public key of the trust store and the signer it belongs to
+type TrustedKey struct {
+	Signer string
+	Key    crypto.PublicKey
+}
+
+// TrustStore   Define the public keys signatures are verified with
+type TrustStore struct {
+	Keys []TrustedKey
+}
+
+// TrustStoreCache   Define a trust store loaded once and loaded again when its key files change
+type TrustStoreCache struct {
+	mu      sync.Mutex
+	dir     string
+	version string
+	store   *TrustStore
+}
+
+// isKeyFile reports whether a trust store file holds a public key
+func isKeyFile(info os.FileInfo) bool {
+	ext := filepath.Ext(info.Name())
+	return !info.IsDir() && (ext == ".pem" || ext == ".pub")
+}
+
+// LoadTrustStore reads the .pem and .pub files of a directory, an empty path or a missing directory gives an
+// empty store
+func LoadTrustStore(dir string) (*TrustStore, error) {
+	store := &TrustStore{}
+	if dir == "" {
+		return store, nil
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if !isKeyFile(info) {
+			continue
+		}
+		ext := filepath.Ext(info.Name())
+		data, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		key, err := ParsePublicKey(data)
+		if err != nil {
+			return nil, errors.New(info.Name() + ": " + err.Error())
+		}
+		store.Keys = append(store.Keys, TrustedKey{Signer: strings.TrimSuffix(info.Name(), ext), Key: key})
+	}
+	return store, nil
+}
+
+// Describe the key files of a trust store by name, size and modification time, so replacing a key in place
+// changes it as well as adding, removing or renaming one. A missing directory has an empty version.
+func trustStoreVersion(dir string) (string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var version strings.Builder
+	for _, info := range infos {
+		if !isKeyFile(info) {
+			continue
+		}
+		// key files are often links to mounted secrets, the file they point at is described
+		target, err := os.Stat(filepath.Join(dir, info.Name()))
+		if err != nil {
+			return "", err
+		}
+		version.WriteString(info.Name() + " " + strconv.FormatInt(target.Size(), 10) + " " +
+			strconv.FormatInt(target.ModTime().UnixNano(), 10) + "\n")
+	}
+	return version.String(), nil
+}
+
+// Load returns the trust store of a directory. The directory is read again when its path changes or one of its
+// key files is added, removed or modified.
+func (c *TrustStoreCache) Load(dir string) (*TrustStore, error) {
+	var version string
+	if dir != "" {
+		var err error
+		version, err = trustStoreVersion(dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.store != nil && c.dir == dir && c.version == version {
+		return c.store, nil
+	}
+	store, err := LoadTrustStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	c.dir, c.version, c.store = dir, version, store
+	return store, nil
+}
+
+// ParsePublicKey parses a PEM encoded PKIX Ed25519 or ECDSA public key
+func ParsePublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("no PEM encoded public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case ed25519.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	default:
+		return nil, errors.New("public key should be Ed25519 or ECDSA")
+	}
+}
+
+// DecodeSignature decodes a base64 signature, surrounding white space and missing padding are accepted
+func DecodeSignature(encoded string) ([]byte, error) {
+	encoded = strings.TrimRight(strings.TrimSpace(encoded), "=")
+	signature, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil || len(signature) == 0 {
+		return nil, ErrMalformedSignature
+	}
+	return signature, nil
+}
+
+// Verify a signature of a SHA-256 digest, returns the signer of the first key verifying it
+func (t *TrustStore) Verify(digest, signature []byte) (string, error) {
+	for _, key := range t.Keys {
+		if verifyKey(key.Key, digest, signature) {
+			return key.Signer, nil
+		}
+	}
+	return "", ErrNoTrustedKey
+}
+
+func verifyKey(key crypto.PublicKey, digest, signature []byte) bool {
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		return len(signature) == ed25519.SignatureSize && ed25519.Verify(k, digest, signature)
+	case *ecdsa.PublicKey:
+		var sig struct {
+			R, S *big.Int
+		}
+		rest, err := asn1.Unmarshal(signature, &sig)
+		if err != nil || len(rest) != 0 || sig.R == nil || sig.S == nil {
+			return false
+		}
+		return ecdsa.Verify(k, digest, sig.R, sig.S)
+	default:
+		return false
+	}
+}
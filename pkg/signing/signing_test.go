@@ -0,0 +1,186 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package signing
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writePublicKey(t *testing.T, dir, name string, key interface{}) {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	if err = ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTrustStoreDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "truststore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return dir
+}
+
+func TestVerifyEd25519AndEcdsa(t *testing.T) {
+	dir := newTrustStoreDir(t)
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPrivate, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePublicKey(t, dir, "alice.pem", edPublic)
+	writePublicKey(t, dir, "bob.pub", &ecPrivate.PublicKey)
+	if err = ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := LoadTrustStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(store.Keys) != 2 {
+		t.Fatalf("got %d keys, want 2", len(store.Keys))
+	}
+	digest := sha256.Sum256([]byte("image"))
+	r, s, err := ecdsa.Sign(rand.Reader, ecPrivate, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecSignature, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for signer, signature := range map[string][]byte{
+		"alice": ed25519.Sign(edPrivate, digest[:]),
+		"bob":   ecSignature,
+	} {
+		got, err := store.Verify(digest[:], signature)
+		if err != nil || got != signer {
+			t.Fatalf("got signer %q and %v, want %s", got, err, signer)
+		}
+	}
+	other := sha256.Sum256([]byte("other"))
+	if _, err = store.Verify(other[:], ecSignature); err != ErrNoTrustedKey {
+		t.Fatalf("got %v for a signature of another digest, want %v", err, ErrNoTrustedKey)
+	}
+}
+
+func TestLoadTrustStoreRejectsInvalidKey(t *testing.T) {
+	dir := newTrustStoreDir(t)
+	if err := ioutil.WriteFile(filepath.Join(dir, "broken.pem"), []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadTrustStore(dir); err == nil {
+		t.Fatal("loaded a trust store with an invalid key")
+	}
+}
+
+func TestLoadTrustStoreMissingDirectoryIsEmpty(t *testing.T) {
+	for _, dir := range []string{"", filepath.Join(newTrustStoreDir(t), "absent")} {
+		store, err := LoadTrustStore(dir)
+		if err != nil || len(store.Keys) != 0 {
+			t.Fatalf("got %v and %v loading %q, want an empty store", store, err, dir)
+		}
+		if _, err = store.Verify(make([]byte, sha256.Size), []byte("signature")); err != ErrNoTrustedKey {
+			t.Fatalf("got %v verifying with an empty store, want %v", err, ErrNoTrustedKey)
+		}
+	}
+}
+
+func TestDecodeSignature(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString([]byte("signature!"))
+	for _, s := range []string{encoded, " " + encoded + "\n", base64.RawStdEncoding.EncodeToString([]byte("signature!"))} {
+		if got, err := DecodeSignature(s); err != nil || string(got) != "signature!" {
+			t.Fatalf("got %q and %v decoding %q", got, err, s)
+		}
+	}
+	for _, s := range []string{"", "not base64!"} {
+		if _, err := DecodeSignature(s); err != ErrMalformedSignature {
+			t.Fatalf("got %v decoding %q, want %v", err, s, ErrMalformedSignature)
+		}
+	}
+}
+
+func TestTrustStoreCacheReloadsOnChange(t *testing.T) {
+	dir := filepath.Join(newTrustStoreDir(t), "trust")
+	var cache TrustStoreCache
+
+	store, err := cache.Load(dir)
+	if err != nil || len(store.Keys) != 0 {
+		t.Fatalf("got %v and %v for a missing directory", store, err)
+	}
+	if err = os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePublicKey(t, dir, "release.pem", public)
+	store, err = cache.Load(dir)
+	if err != nil || len(store.Keys) != 1 {
+		t.Fatalf("got %v and %v for a created directory", store, err)
+	}
+	if again, err := cache.Load(dir); err != nil || again != store {
+		t.Fatal("unchanged directory was loaded again")
+	}
+
+	// a key replaced in place leaves the directory alone, the modification time of the file may be coarse
+	rotated, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePublicKey(t, dir, "release.pem", rotated)
+	path := filepath.Join(dir, "release.pem")
+	if err = os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	store, err = cache.Load(dir)
+	if err != nil || len(store.Keys) != 1 || !rotated.Equal(store.Keys[0].Key) {
+		t.Fatalf("got %v and %v, the replaced key is still trusted", store, err)
+	}
+
+	if err = os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if store, err = cache.Load(dir); err != nil || len(store.Keys) != 0 {
+		t.Fatalf("got %v and %v, the removed key is still trusted", store, err)
+	}
+}
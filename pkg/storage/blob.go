@@ -0,0 +1,150 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// @Title  storage
+// @Description  content addressed blob store for filesystem
+// @Author  GuoZhen Gao (2021/6/30 10:40)
+package storage
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+)
+
+const algorithm = "sha256"
+
+var digestPattern = regexp.MustCompile(`^[a-f0-9]{64}$`)
+
+// ErrInvalidDigest is returned for digests which are not lowercase hex SHA-256 values
+var ErrInvalidDigest = errors.New("digest should be a lowercase hex sha256 value")
+
+// BlobStore   Define a directory of blobs stored once per SHA-256 digest as <root>/sha256/<2 hex>/<digest>
+type BlobStore struct {
+	root  string
+	mu    sync.Mutex
+	locks map[string]*digestLock
+}
+
+type digestLock struct {
+	sync.Mutex
+	users int
+}
+
+// NewBlobStore   Create a blob store rooted at the directory
+func NewBlobStore(root string) *BlobStore {
+	return &BlobStore{root: root, locks: map[string]*digestLock{}}
+}
+
+// Check a digest is a lowercase hex SHA-256 value
+func ValidateDigest(digest string) error {
+	if !digestPattern.MatchString(digest) {
+		return ErrInvalidDigest
+	}
+	return nil
+}
+
+// RelativePath returns the path of a blob relative to the parent of the store root
+func (s *BlobStore) RelativePath(digest string) string {
+	return filepath.Join(filepath.Base(s.root), algorithm, digest[:2], digest)
+}
+
+// Path returns the absolute path of a blob
+func (s *BlobStore) Path(digest string) string {
+	return filepath.Join(s.root, algorithm, digest[:2], digest)
+}
+
+// Lock serializes placing and removing a blob, the returned func releases the lock
+func (s *BlobStore) Lock(digest string) func() {
+	s.mu.Lock()
+	l, ok := s.locks[digest]
+	if !ok {
+		l = &digestLock{}
+		s.locks[digest] = l
+	}
+	l.users++
+	s.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		s.mu.Lock()
+		l.users--
+		if l.users == 0 {
+			delete(s.locks, digest)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Place moves a file with the given digest into the store, the file is dropped when the blob already exists.
+// Callers hold the digest lock.
+func (s *BlobStore) Place(path, digest string) (bool, error) {
+	if err := ValidateDigest(digest); err != nil {
+		return false, err
+	}
+	target := s.Path(digest)
+	if _, err := os.Stat(target); err == nil {
+		return false, os.Remove(path)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return false, err
+	}
+	if err := os.Rename(path, target); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Write stores data under its digest unless the blob already exists. Callers hold the digest lock.
+func (s *BlobStore) Write(digest string, data []byte) (bool, error) {
+	if err := ValidateDigest(digest); err != nil {
+		return false, err
+	}
+	target := s.Path(digest)
+	if _, err := os.Stat(target); err == nil {
+		return false, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return false, err
+	}
+	// written to a temporary name first so a crash never leaves a truncated blob under its digest
+	tmp := target + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		_ = os.Remove(tmp)
+		return false, err
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		_ = os.Remove(tmp)
+		return false, err
+	}
+	return true, nil
+}
+
+// Remove deletes a blob, a missing blob is not an error. Callers hold the digest lock.
+func (s *BlobStore) Remove(digest string) error {
+	if err := ValidateDigest(digest); err != nil {
+		return err
+	}
+	err := os.Remove(s.Path(digest))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// @Title  transfer
+// @Description  track in-flight uploads and downloads for graceful shutdown
+// @Author  GuoZhen Gao (2021/6/30 10:40)
+package transfer
+
+import (
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	Upload   string = "upload"
+	Download string = "download"
+)
+
+// ErrDraining is returned when a new upload is requested while the service shuts down
+var ErrDraining = errors.New("service is shutting down, new uploads are not accepted")
+
+// ErrInterrupted is returned by reads of a transfer interrupted at shutdown
+var ErrInterrupted = errors.New("transfer interrupted by shutdown")
+
+// Transfer   Define one in-flight upload or download
+type Transfer struct {
+	Kind    string
+	ImageId string
+	Started time.Time
+
+	mu          sync.Mutex
+	interrupted bool
+}
+
+// Interrupted reports whether the transfer was interrupted because the drain deadline passed
+func (t *Transfer) Interrupted() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.interrupted
+}
+
+// Reader fails reads of r once the transfer is interrupted, so the handler stops and cleans up itself
+func (t *Transfer) Reader(r io.Reader) io.Reader {
+	return &transferReader{t: t, r: r}
+}
+
+type transferReader struct {
+	t *Transfer
+	r io.Reader
+}
+
+func (r *transferReader) Read(p []byte) (int, error) {
+	if r.t.Interrupted() {
+		return 0, ErrInterrupted
+	}
+	return r.r.Read(p)
+}
+
+var (
+	mu       sync.Mutex
+	draining bool
+	active   = map[*Transfer]struct{}{}
+)
+
+// Begin tracking a transfer, uploads are refused once draining has started
+func Begin(kind, imageId string) (*Transfer, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if draining && kind == Upload {
+		return nil, ErrDraining
+	}
+	t := &Transfer{Kind: kind, ImageId: imageId, Started: time.Now()}
+	active[t] = struct{}{}
+	return t, nil
+}
+
+// End tracking a transfer
+func End(t *Transfer) {
+	if t == nil {
+		return
+	}
+	mu.Lock()
+	delete(active, t)
+	mu.Unlock()
+}
+
+// StartDraining stops accepting new uploads
+func StartDraining() {
+	mu.Lock()
+	draining = true
+	mu.Unlock()
+	log.Info("transfer draining started, new uploads are refused")
+}
+
+// Draining reports whether the service is shutting down
+func Draining() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return draining
+}
+
+// ActiveCount returns the number of in-flight transfers
+func ActiveCount() int {
+	mu.Lock()
+	defer mu.Unlock()
+	return len(active)
+}
+
+// InterruptAll marks every transfer still in flight as interrupted, their handlers clean them up
+func InterruptAll() {
+	mu.Lock()
+	defer mu.Unlock()
+	for t := range active {
+		log.Warn("interrupting " + t.Kind + " of image " + t.ImageId + " started at " + t.Started.Format(time.RFC3339))
+		t.mu.Lock()
+		t.interrupted = true
+		t.mu.Unlock()
+	}
+}
+
+// WaitIdle waits until no transfer is in flight or the deadline passes, false is returned on timeout
+func WaitIdle(deadline time.Time) bool {
+	for ActiveCount() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
@@ -0,0 +1,49 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package transfer
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInterruptAllFailsReadsOfActiveTransfers(t *testing.T) {
+	tr, err := Begin(Upload, "image1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := tr.Reader(strings.NewReader("image"))
+	if _, err := r.Read(make([]byte, 2)); err != nil {
+		t.Fatalf("got %v before the interrupt", err)
+	}
+	InterruptAll()
+	if !tr.Interrupted() {
+		t.Fatal("transfer wasn't marked interrupted")
+	}
+	if _, err := r.Read(make([]byte, 2)); err != ErrInterrupted {
+		t.Fatalf("got %v after the interrupt, want %v", err, ErrInterrupted)
+	}
+	// the handler still owns the transfer until it ends it
+	if WaitIdle(time.Now()) {
+		t.Fatal("interrupted transfer was ended before its handler ended it")
+	}
+	End(tr)
+	if !WaitIdle(time.Now().Add(time.Second)) {
+		t.Fatalf("%d transfers left", ActiveCount())
+	}
+}
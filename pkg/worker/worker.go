@@ -0,0 +1,190 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// @Title  worker
+// @Description  background worker registry for filesystem
+// @Author  GuoZhen Gao (2021/6/30 10:40)
+package worker
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Job   Define one run of a periodic background job
+type Job func() error
+
+// State   Define the reported state of a background worker
+type State struct {
+	Name      string    `json:"name"`
+	Running   bool      `json:"running"`
+	Interval  string    `json:"interval"`
+	RunCount  int64     `json:"runCount"`
+	LastRun   time.Time `json:"lastRun"`
+	LastError string    `json:"lastError,omitempty"`
+	Stalled   bool      `json:"stalled"`
+}
+
+type worker struct {
+	mu       sync.Mutex
+	name     string
+	interval time.Duration
+	job      Job
+	running  bool
+	runCount int64
+	lastRun  time.Time
+	lastErr  error
+	started  time.Time
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = map[string]*worker{}
+	stopping   = make(chan struct{})
+	stopOnce   sync.Once
+)
+
+// Stopping returns a channel closed once StopAll is called, long runs return early when it is
+func Stopping() <-chan struct{} {
+	return stopping
+}
+
+// Start a named job that runs every interval until Stop is called, a job without positive interval isn't started
+func Start(name string, interval time.Duration, job Job) {
+	if interval <= 0 {
+		log.Error("worker " + name + " is not started, interval " + interval.String() + " is not positive")
+		return
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := registry[name]; ok {
+		log.Warn("worker " + name + " is already started")
+		return
+	}
+	w := &worker{
+		name:     name,
+		interval: interval,
+		job:      job,
+		running:  true,
+		started:  time.Now(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	registry[name] = w
+	go w.loop()
+	log.Info("worker " + name + " started with interval " + interval.String())
+}
+
+// Stop all workers, waiting for in-progress runs until the deadline elapses
+func StopAll(deadline time.Time) {
+	registryMu.Lock()
+	workers := make([]*worker, 0, len(registry))
+	for _, w := range registry {
+		workers = append(workers, w)
+	}
+	registryMu.Unlock()
+
+	stopOnce.Do(func() { close(stopping) })
+	for _, w := range workers {
+		close(w.stop)
+	}
+	for _, w := range workers {
+		select {
+		case <-w.done:
+		case <-time.After(time.Until(deadline)):
+			log.Warn("worker " + w.name + " did not stop before deadline")
+		}
+	}
+}
+
+// States returns a snapshot of all registered workers ordered by name
+func States() []State {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	states := make([]State, 0, len(registry))
+	for _, w := range registry {
+		states = append(states, w.state())
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Name < states[j].Name })
+	return states
+}
+
+func (w *worker) loop() {
+	defer close(w.done)
+	defer func() {
+		w.mu.Lock()
+		w.running = false
+		w.mu.Unlock()
+	}()
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.runOnce()
+		}
+	}
+}
+
+func (w *worker) runOnce() {
+	var err error
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("recover panic as %v", r)
+			}
+		}()
+		err = w.job()
+	}()
+	if err != nil {
+		log.Error("worker " + w.name + " run failed: " + err.Error())
+	}
+
+	w.mu.Lock()
+	w.runCount++
+	w.lastRun = time.Now()
+	w.lastErr = err
+	w.mu.Unlock()
+}
+
+func (w *worker) state() State {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s := State{
+		Name:     w.name,
+		Running:  w.running,
+		Interval: w.interval.String(),
+		RunCount: w.runCount,
+		LastRun:  w.lastRun,
+	}
+	if w.lastErr != nil {
+		s.LastError = w.lastErr.Error()
+	}
+	// a worker that has not completed a run for three intervals is considered stalled
+	last := w.lastRun
+	if last.IsZero() {
+		last = w.started
+	}
+	s.Stalled = w.running && time.Since(last) > 3*w.interval
+	return s
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package worker
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func findState(name string) (State, bool) {
+	for _, state := range States() {
+		if state.Name == name {
+			return state, true
+		}
+	}
+	return State{}, false
+}
+
+func waitForRuns(t *testing.T, name string, runs int64) State {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if state, ok := findState(name); ok && state.RunCount >= runs {
+			return state
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("worker %s didn't run %d times", name, runs)
+	return State{}
+}
+
+func TestStartRejectsNonPositiveInterval(t *testing.T) {
+	for _, interval := range []time.Duration{0, -time.Minute} {
+		Start("non-positive", interval, func() error { return nil })
+		if _, ok := findState("non-positive"); ok {
+			t.Fatalf("worker with interval %s was started", interval)
+		}
+	}
+}
+
+func TestWorkerRunsAndRecordsState(t *testing.T) {
+	runs := make(chan struct{}, 10)
+	Start("records", 10*time.Millisecond, func() error {
+		runs <- struct{}{}
+		return errors.New("disk full")
+	})
+	state := waitForRuns(t, "records", 2)
+	if !state.Running || state.Stalled {
+		t.Fatalf("unexpected state %+v", state)
+	}
+	if state.LastError != "disk full" {
+		t.Fatalf("last error = %q", state.LastError)
+	}
+	if state.LastRun.IsZero() {
+		t.Fatal("last run isn't recorded")
+	}
+}
+
+func TestWorkerRecoversPanic(t *testing.T) {
+	Start("panics", 10*time.Millisecond, func() error {
+		panic("boom")
+	})
+	state := waitForRuns(t, "panics", 2)
+	if state.LastError != "recover panic as boom" {
+		t.Fatalf("last error = %q", state.LastError)
+	}
+}
+
+func TestStartTwiceKeepsFirstJob(t *testing.T) {
+	Start("twice", time.Hour, func() error { return nil })
+	Start("twice", 10*time.Millisecond, func() error { return nil })
+	state, ok := findState("twice")
+	if !ok || state.Interval != time.Hour.String() {
+		t.Fatalf("unexpected state %+v", state)
+	}
+}
+
+func TestStalledAfterThreeIntervals(t *testing.T) {
+	w := &worker{name: "stalled", interval: time.Millisecond, running: true, started: time.Now().Add(-time.Second)}
+	if !w.state().Stalled {
+		t.Fatal("worker without run for three intervals isn't stalled")
+	}
+	w.lastRun = time.Now()
+	if w.state().Stalled {
+		t.Fatal("worker which just ran is stalled")
+	}
+}
+
+// runs last, it stops every worker started by the tests above
+func TestStopAllSignalsRunningJobs(t *testing.T) {
+	started := make(chan struct{}, 1)
+	Start("long run", 10*time.Millisecond, func() error {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		select {
+		case <-Stopping():
+			return nil
+		case <-time.After(time.Minute):
+			return errors.New("run wasn't told to stop")
+		}
+	})
+	<-started
+	begin := time.Now()
+	StopAll(time.Now().Add(10 * time.Second))
+	if elapsed := time.Since(begin); elapsed > 5*time.Second {
+		t.Fatalf("StopAll waited %s for a run watching Stopping", elapsed)
+	}
+	for _, state := range States() {
+		if state.Running {
+			t.Fatalf("worker %s is still running", state.Name)
+		}
+	}
+}
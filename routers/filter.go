@@ -0,0 +1,170 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// @Title   routers
+// @Description  request id and access log filters
+// @Author  GuoZhen Gao (2021/6/30 10:40)
+package routers
+
+import (
+	"bufio"
+	"errors"
+	"fileSystem/util"
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/context"
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	startTimeKey      = "requestStartTime"
+	countingBodyKey   = "requestCountingBody"
+	countingWriterKey = "requestCountingWriter"
+	maxRequestIdSize  = 128
+)
+
+var (
+	requestIdPattern  = regexp.MustCompile(`^[A-Za-z0-9._:-]+$`)
+	uploadPathPattern = regexp.MustCompile(`^/image-management/v[12]/images/?$`)
+)
+
+// counts bytes sent to the client and remembers whether the client went away
+type countingWriter struct {
+	http.ResponseWriter
+	written int64
+	err     error
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+func (w *countingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *countingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("webserver doesn't support hijacking")
+}
+
+func (w *countingWriter) CloseNotify() <-chan bool {
+	if cn, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(chan bool)
+}
+
+// counts bytes received from the client
+type countingBody struct {
+	io.ReadCloser
+	read int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	return n, err
+}
+
+func init() {
+	beego.InsertFilter("*", beego.BeforeStatic, requestIdFilter)
+	beego.InsertFilter("*", beego.BeforeStatic, streamUploadFilter)
+	beego.InsertFilter("*", beego.FinishRouter, accessLogFilter, false)
+}
+
+// Assign the request id and start counting transferred bytes
+func requestIdFilter(ctx *context.Context) {
+	id := ctx.Input.Header(util.RequestIdHeader)
+	if len(id) > maxRequestIdSize || !requestIdPattern.MatchString(id) {
+		id = strings.Replace(uuid.NewV4().String(), "-", "", -1)
+	}
+	ctx.Input.SetData(util.RequestIdKey, id)
+	ctx.Input.SetData(startTimeKey, time.Now())
+	ctx.Output.Header(util.RequestIdHeader, id)
+
+	writer := &countingWriter{ResponseWriter: ctx.ResponseWriter.ResponseWriter}
+	ctx.ResponseWriter.ResponseWriter = writer
+	ctx.Input.SetData(countingWriterKey, writer)
+	if ctx.Request.Body != nil {
+		body := &countingBody{ReadCloser: ctx.Request.Body}
+		ctx.Request.Body = body
+		ctx.Input.SetData(countingBodyKey, body)
+	}
+}
+
+// Keep beego from parsing upload bodies, which buffers large files in temp files before the controller runs.
+// The upload api reads the multipart stream itself and finds the original content type in the input data.
+func streamUploadFilter(ctx *context.Context) {
+	contentType := ctx.Input.Header("Content-Type")
+	if ctx.Input.Method() != http.MethodPost || !uploadPathPattern.MatchString(ctx.Input.URL()) ||
+		!strings.Contains(contentType, "multipart/form-data") {
+		return
+	}
+	ctx.Input.SetData(util.UploadContentTypeKey, contentType)
+	ctx.Request.Header.Set("Content-Type", util.StreamedContentType)
+}
+
+// Write one access log line per request
+func accessLogFilter(ctx *context.Context) {
+	fields := util.RequestLogFields(ctx)
+	fields["method"] = ctx.Input.Method()
+	fields["path"] = ctx.Input.URL()
+
+	status := ctx.ResponseWriter.Status
+	if status == 0 {
+		status = util.StatusOK
+	}
+	fields["status"] = status
+	if start, ok := ctx.Input.GetData(startTimeKey).(time.Time); ok {
+		fields["durationMs"] = time.Since(start).Milliseconds()
+	}
+	if body, ok := ctx.Input.GetData(countingBodyKey).(*countingBody); ok {
+		fields["bytesIn"] = body.read
+	}
+
+	outcome := "success"
+	switch {
+	case status >= util.StatusInternalServerError:
+		outcome = "server_error"
+	case status >= util.BadRequest:
+		outcome = "client_error"
+	}
+	if writer, ok := ctx.Input.GetData(countingWriterKey).(*countingWriter); ok {
+		fields["bytesOut"] = writer.written
+		if writer.err != nil {
+			outcome = "aborted"
+		}
+	}
+	fields["outcome"] = outcome
+
+	log.WithFields(fields).Info("access")
+}
@@ -22,6 +22,8 @@ package routers
 import (
 	"fileSystem/controllers"
 	"fileSystem/pkg/dbAdpater"
+	"fileSystem/pkg/worker"
+	"fileSystem/util"
 	"github.com/astaxie/beego"
 
 	"os"
@@ -30,9 +32,49 @@ import (
 func init() {
 	adapter := initDbAdapter()
 
-	beego.Router("/image-management/v1/images",&controllers.UploadController{controllers.BaseController{Db: adapter}})
-	beego.Router("/image-management/v1/images/:imageId/action/download", &controllers.DownloadController{controllers.BaseController{Db: adapter}})
-	beego.Router("/image-management/v1/images/:imageId",&controllers.ImageController{controllers.BaseController{Db: adapter}})
+	// v2 serves the same apis as v1 but reports errors with the structured error envelope
+	for _, prefix := range []string{"/image-management/v1", "/image-management/v2"} {
+		beego.Router(prefix+"/images", &controllers.UploadController{BaseController: controllers.BaseController{Db: adapter}})
+		beego.Router(prefix+"/images/:imageId/action/download", &controllers.DownloadController{BaseController: controllers.BaseController{Db: adapter}})
+		beego.Router(prefix+"/bundles", &controllers.BundleController{BaseController: controllers.BaseController{Db: adapter}}, "post:Post")
+		beego.Router(prefix+"/images/:imageId/entries", &controllers.DownloadController{BaseController: controllers.BaseController{Db: adapter}}, "get:Entries")
+		beego.Router(prefix+"/images/:imageId/manifest", &controllers.DownloadController{BaseController: controllers.BaseController{Db: adapter}}, "get:Manifest")
+		beego.Router(prefix+"/images/:imageId/signatures", &controllers.UploadController{BaseController: controllers.BaseController{Db: adapter}}, "get:Signatures")
+		beego.Router(prefix+"/images/:imageId/action/delta-upload", &controllers.UploadController{BaseController: controllers.BaseController{Db: adapter}}, "post:DeltaUpload")
+		beego.Router(prefix+"/images/:imageId", &controllers.ImageController{BaseController: controllers.BaseController{Db: adapter}})
+		beego.Router(prefix+"/images/:imageId/signature", &controllers.ImageController{BaseController: controllers.BaseController{Db: adapter}}, "put:PutSignature")
+		beego.Router(prefix+"/images/:imageId/action/restore", &controllers.TrashController{BaseController: controllers.BaseController{Db: adapter}}, "post:Restore")
+		beego.Router(prefix+"/images/:imageId/action/purge", &controllers.TrashController{BaseController: controllers.BaseController{Db: adapter}}, "post:Purge")
+		beego.Router(prefix+"/trash", &controllers.TrashController{BaseController: controllers.BaseController{Db: adapter}}, "get:Get")
+		beego.Router(prefix+"/quarantine", &controllers.QuarantineController{BaseController: controllers.BaseController{Db: adapter}}, "get:Get")
+		beego.Router(prefix+"/quarantine/:imageId", &controllers.QuarantineController{BaseController: controllers.BaseController{Db: adapter}}, "delete:Delete")
+		beego.Router(prefix+"/quarantine/:imageId/action/release", &controllers.QuarantineController{BaseController: controllers.BaseController{Db: adapter}}, "post:Release")
+		beego.Router(prefix+"/images/:imageId/shares", &controllers.ShareController{BaseController: controllers.BaseController{Db: adapter}})
+		beego.Router(prefix+"/images/:imageId/shares/:shareId", &controllers.ShareController{BaseController: controllers.BaseController{Db: adapter}}, "delete:Delete")
+		beego.Router(prefix+"/logical-images", &controllers.LogicalImageController{BaseController: controllers.BaseController{Db: adapter}}, "get:List")
+		beego.Router(prefix+"/logical-images/:name", &controllers.LogicalImageController{BaseController: controllers.BaseController{Db: adapter}}, "get:Get;delete:Delete")
+		beego.Router(prefix+"/logical-images/:name/revisions", &controllers.LogicalImageController{BaseController: controllers.BaseController{Db: adapter}}, "post:AddRevision")
+		beego.Router(prefix+"/logical-images/:name/aliases/:alias", &controllers.LogicalImageController{BaseController: controllers.BaseController{Db: adapter}}, "put:PutAlias;delete:DeleteAlias")
+		beego.Router(prefix+"/logical-images/:name/versions/:version", &controllers.LogicalImageController{BaseController: controllers.BaseController{Db: adapter}}, "get:GetVersion")
+		beego.Router(prefix+"/logical-images/:name/versions/:version/action/download", &controllers.LogicalImageController{BaseController: controllers.BaseController{Db: adapter}}, "get:DownloadVersion")
+		beego.Router(prefix+"/retention-policies", &controllers.RetentionController{BaseController: controllers.BaseController{Db: adapter}}, "get:Get")
+		beego.Router(prefix+"/retention-policies/:scope/:scopeId", &controllers.RetentionController{BaseController: controllers.BaseController{Db: adapter}}, "put:Put;delete:Delete")
+		beego.Router(prefix+"/retention-report", &controllers.RetentionController{BaseController: controllers.BaseController{Db: adapter}}, "get:Report")
+		beego.Router(prefix+"/storage/stats", &controllers.StorageController{BaseController: controllers.BaseController{Db: adapter}}, "get:Get")
+		beego.Router(prefix+"/audit-events", &controllers.AuditController{BaseController: controllers.BaseController{Db: adapter}})
+	}
+
+	beego.Router("/health/live", &controllers.HealthController{BaseController: controllers.BaseController{Db: adapter}}, "get:Live")
+	beego.Router("/health/ready", &controllers.HealthController{BaseController: controllers.BaseController{Db: adapter}}, "get:Ready")
+
+	worker.Start("trash-purge", util.GetAppConfigMinutes("trashPurgeIntervalMinutes", util.DefaultTrashPurgeMinutes),
+		controllers.NewTrashPurgeJob(adapter))
+	worker.Start("retention", util.GetAppConfigMinutes("retentionIntervalMinutes", util.DefaultRetentionMinutes),
+		controllers.NewRetentionJob(adapter))
+	worker.Start("blob-gc", util.GetAppConfigMinutes("blobGcIntervalMinutes", util.DefaultBlobGcMinutes),
+		controllers.NewBlobGcJob(adapter))
+	worker.Start("scrub", util.GetAppConfigMinutes("scrubIntervalMinutes", util.DefaultScrubMinutes),
+		controllers.NewScrubJob(adapter))
 
 }
 
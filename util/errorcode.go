@@ -0,0 +1,74 @@
+/*
+ * Copyright 2021 Huawei Technologies Co., Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// @Title   util
+// @Description  stable error codes for v2 apis
+// @Author  GuoZhen Gao (2021/6/30 10:40)
+package util
+
+// ApiError   Define a machine readable error returned by v2 apis
+type ApiError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Details   string `json:"details,omitempty"`
+	RequestId string `json:"requestId"`
+	Status    int    `json:"-"`
+}
+
+// WithDetails returns a copy of the error carrying request specific details
+func (e ApiError) WithDetails(details string) ApiError {
+	e.Details = details
+	return e
+}
+
+func newApiError(code string, status int, message string) ApiError {
+	return ApiError{Code: code, Status: status, Message: message}
+}
+
+// Error code catalogue, codes are part of the v2 api contract and must not be renamed
+var (
+	ErrInvalidClientIp     = newApiError("INVALID_CLIENT_IP", BadRequest, "client ip address is invalid")
+	ErrInvalidParameter    = newApiError("INVALID_PARAMETER", BadRequest, "request parameter is invalid")
+	ErrInvalidFile         = newApiError("INVALID_FILE", BadRequest, "upload file is missing or unreadable")
+	ErrUnsupportedFileType = newApiError("UNSUPPORTED_FILE_TYPE", BadRequest,
+		"file extension is not supported or file name is too long")
+	ErrFileTooLarge         = newApiError("FILE_TOO_LARGE", StatusRequestEntityTooLarge, "file size is larger than max size")
+	ErrImageNotFound        = newApiError("IMAGE_NOT_FOUND", StatusNotFound, "image doesn't exist")
+	ErrShareNotFound        = newApiError("SHARE_NOT_FOUND", StatusNotFound, "share grant doesn't exist")
+	ErrLogicalImageNotFound = newApiError("LOGICAL_IMAGE_NOT_FOUND", StatusNotFound, "logical image doesn't exist")
+	ErrRevisionNotFound     = newApiError("REVISION_NOT_FOUND", StatusNotFound, "revision or alias doesn't exist")
+	ErrPolicyNotFound       = newApiError("POLICY_NOT_FOUND", StatusNotFound, "retention policy doesn't exist")
+	ErrEntryNotFound        = newApiError("ENTRY_NOT_FOUND", StatusNotFound, "package entry doesn't exist")
+	ErrManifestNotFound     = newApiError("MANIFEST_NOT_FOUND", StatusNotFound, "image has no manifest")
+	ErrImageInUse           = newApiError("IMAGE_IN_USE", StatusConflict, "image is referenced and can't be removed")
+	ErrChecksumMismatch     = newApiError("CHECKSUM_MISMATCH", BadRequest, "assembled image doesn't match its checksum")
+	ErrImageNotAvailable    = newApiError("IMAGE_NOT_AVAILABLE", StatusConflict, "image is not available")
+	ErrImageFileMissing     = newApiError("IMAGE_FILE_MISSING", StatusInternalServerError, "image file is missing in storage")
+	ErrInvalidSignature     = newApiError("INVALID_SIGNATURE", BadRequest, "signature is malformed or can't be checked")
+	ErrSignatureRequired    = newApiError("SIGNATURE_REQUIRED", StatusForbidden, "image isn't signed by a trusted key")
+	ErrImageCorrupt         = newApiError("IMAGE_CORRUPT", StatusInternalServerError, "image doesn't match its manifest")
+	ErrImageInfected        = newApiError("IMAGE_INFECTED", StatusUnprocessableEntity, "malware was found in the image")
+	ErrScanFailed           = newApiError("SCAN_FAILED", StatusServiceUnavailable, "image couldn't be scanned for malware")
+	ErrDatabaseUnavailable  = newApiError("DATABASE_UNAVAILABLE", StatusServiceUnavailable, "database is unavailable")
+	ErrStorageFailure       = newApiError("STORAGE_FAILURE", StatusInternalServerError, "fail to access image storage")
+	ErrStorageNotSupported  = newApiError("STORAGE_NOT_SUPPORTED", BadRequest, "storage medium is not supported")
+	ErrDecompressFailed     = newApiError("DECOMPRESS_FAILED", StatusInternalServerError, FailedToDecompress)
+	ErrServiceShuttingDown  = newApiError("SERVICE_SHUTTING_DOWN", StatusServiceUnavailable, "service is shutting down")
+	ErrPreconditionFailed   = newApiError("PRECONDITION_FAILED", StatusPreconditionFailed,
+		"image was modified, If-Match doesn't match the current ETag")
+	ErrForbidden = newApiError("FORBIDDEN", StatusForbidden, "operation is not permitted")
+	ErrInternal  = newApiError("INTERNAL_ERROR", StatusInternalServerError, "internal server error")
+)
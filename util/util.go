@@ -22,18 +22,32 @@ package util
 import (
 	"errors"
 	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/context"
 	"github.com/go-playground/validator/v10"
+	log "github.com/sirupsen/logrus"
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 const (
-	BadRequest                int = 400
-	StatusUnauthorized        int = 401
-	StatusInternalServerError int = 500
-	StatusNotFound            int = 404
-	StatusForbidden           int = 403
+	BadRequest                  int = 400
+	StatusUnauthorized          int = 401
+	StatusInternalServerError   int = 500
+	StatusNotFound              int = 404
+	StatusForbidden             int = 403
+	StatusServiceUnavailable    int = 503
+	StatusOK                    int = 200
+	StatusConflict              int = 409
+	StatusRequestEntityTooLarge int = 413
+	StatusPreconditionFailed    int = 412
+	StatusUnprocessableEntity   int = 422
 
 	ClientIpaddressInvalid          = "clientIp address is invalid"
 	LastInsertIdNotSupported string = "LastInsertId is not supported by this driver"
@@ -52,16 +66,132 @@ const (
 	LocalStoragePath         string = "/usr/app/vmImage/"
 	FormFile                 string = "file"
 	UserId                   string = "userId"
+	TenantId                 string = "tenantId"
 	Priority                 string = "priority"
+	StatusUp                 string = "UP"
+	StatusDown               string = "DOWN"
+	DefaultMinFreeMB         int64  = 1024
+	DefaultMinFreePercent    int64  = 5
+	DefaultShutdownTimeout   int64  = 60
+	ImageStatusUploading     string = "uploading"
+	ImageStatusActive        string = "active"
+	ImageStatusFailed        string = "failed"
+	ImageStatusTrashed       string = "trashed"
+	ImageStatusQuarantined   string = "quarantined"
+	ImageStatusCorrupt       string = "corrupt"
+	DefaultTrashRetentionHrs int64  = 72
+	DefaultTrashPurgeMinutes int64  = 10
+	ApiV2Prefix              string = "/image-management/v2/"
+	RequestIdHeader          string = "X-Request-ID"
+	RequestIdKey             string = "requestId"
+	ImageIdKey               string = "imageId"
+	AdminTokenHeader         string = "X-Admin-Token"
+	AuditActionUpload        string = "upload"
+	AuditActionDownload      string = "download"
+	AuditActionUpdate        string = "update"
+	AuditActionDelete        string = "delete"
+	AuditOutcomeSuccess      string = "success"
+	AuditOutcomeFailure      string = "failure"
+	AuditOutcomeDenied       string = "denied"
+	AuditActionKey           string = "auditAction"
+	DefaultAuditQueryLimit   int64  = 1000
+	MaxDisplayNameSize              = 128
+	MaxDescriptionSize              = 1024
+	MaxTagCount                     = 32
+	VisibilityPrivate        string = "private"
+	VisibilityShared         string = "shared"
+	VisibilityPublic         string = "public"
+	ArchX86                  string = "x86_64"
+	ArchAarch64              string = "aarch64"
+	MaxMetadataBodySize      int64  = 65536
+	MaxMinDiskGB             int64  = 65536
+	MaxMinRamMB              int64  = 4194304
+	DefaultImageListLimit    int64  = 1000
+	MaxRetentionDays         int64  = 36500
+	MaxRetentionRevisions    int64  = 10000
+	DefaultRetentionMinutes  int64  = 60
+	RetentionReasonExpired   string = "expired"
+	RetentionReasonIdle      string = "idle"
+	RetentionReasonRevisions string = "revision-limit"
+	RetentionTrashedBy       string = "retention"
+	BlobDirectory            string = "blobs"
+	ChunkDirectory           string = "chunks"
+	DefaultChunkAvgKB        int64  = 1024
+	ImageEntryName           string = "image"
+	ManifestEntryName        string = "image.mf"
+	Signature                string = "signature"
+	SignatureUnsigned        string = "unsigned"
+	SignatureVerified        string = "verified"
+	SignatureUntrusted       string = "untrusted"
+	DefaultBlobGcMinutes     int64  = 30
+	DefaultBlobGcGraceMins   int64  = 60
+	DefaultDeltaBlockSize    int64  = 1048576
+	MinDeltaBlockSize        int64  = 4096
+	MaxDeltaBlockSize        int64  = 67108864
+	MaxDeltaOps                     = 1048576
+	DeltaRecipe              string = "recipe"
+	DeltaBlocks              string = "blocks"
+	UploadContentTypeKey     string = "uploadContentType"
+	StreamedContentType      string = "application/octet-stream"
+	FormatZip                string = "zip"
+	FormatTar                string = "tar"
+	FormatTarGz              string = "tar.gz"
+	FormatTarZst             string = "tar.zst"
+	FormatGzip               string = "gzip"
+	MaxBundleImages                 = 100
+	BundleManifestName       string = "manifest.json"
+	GranteeUser              string = "user"
+	GranteeTenant            string = "tenant"
+	PermissionRead           string = "read"
+	PermissionReadWrite      string = "read-write"
+	AuditActionShare         string = "share"
+	AuditActionUnshare       string = "unshare"
+	AuditActionRevision      string = "revision"
+	AuditActionAlias         string = "alias"
+	AuditActionRestore       string = "restore"
+	AuditActionPurge         string = "purge"
+	AuditActionSign          string = "sign"
+	AuditActionQuarantine    string = "quarantine"
+	AuditActionRelease       string = "release"
+	ScanUnscanned            string = "unscanned"
+	ScanClean                string = "clean"
+	ScanInfected             string = "infected"
+	ScanFailed               string = "error"
+	ScanSkipped              string = "skipped"
+	DefaultScanMaxSizeMB     int64  = 25
+	DefaultScanTimeoutSecs   int64  = 60
+	AuditActionScrub         string = "scrub"
+	DefaultScrubMinutes      int64  = 60
+	DefaultScrubBatchSize    int64  = 100
+	DefaultScrubAgeHours     int64  = 168
+	DefaultScrubRateMBps     int64  = 50
+	DefaultScrubMaxRunMins   int64  = 30
+	AliasLatest              string = "latest"
+	ImageName                string = "imageName"
 	DriverName               string = "postgres"
 	SslMode                  string = "disable"
-	minPasswordSize         = 8
-	maxPasswordSize         = 16
-	maxPasswordCount        = 2
-	singleDigitRegex string = `\d`
-	lowerCaseRegex   string = `[a-z]`
-	upperCaseRegex   string = `[A-Z]`
-	specialCharRegex string = `['~!@#$%^&()-_=+\|[{}\];:'",<.>/?]`
+	minPasswordSize                 = 8
+	maxPasswordSize                 = 16
+	maxPasswordCount                = 2
+	singleDigitRegex         string = `\d`
+	lowerCaseRegex           string = `[a-z]`
+	upperCaseRegex           string = `[A-Z]`
+	specialCharRegex         string = `['~!@#$%^&()-_=+\|[{}\];:'",<.>/?]`
+	tagRegex                 string = `^[A-Za-z0-9][A-Za-z0-9._:-]{0,63}$`
+	osVersionRegex           string = `^[A-Za-z0-9][A-Za-z0-9._-]{0,31}$`
+	imageNameRegex           string = `^[a-z0-9][a-z0-9._-]{0,127}$`
+	aliasRegex               string = `^[a-z][a-z0-9._-]{0,63}$`
+)
+
+var (
+	tagPattern       = regexp.MustCompile(tagRegex)
+	osVersionPattern = regexp.MustCompile(osVersionRegex)
+	imageNamePattern = regexp.MustCompile(imageNameRegex)
+	aliasPattern     = regexp.MustCompile(aliasRegex)
+	supportedOsTypes = []string{"ubuntu", "centos", "debian", "openeuler", "euleros", "cirros", "windows", "linux", "other"}
+	diskFormats      = []string{"qcow2", "raw", "iso", "vmdk", "vhd", "vhdx", "vdi"}
+	downloadFormats  = []string{FormatZip, FormatTar, FormatTarGz, FormatTarZst, FormatGzip}
+	bundleFormats    = []string{FormatZip, FormatTar, FormatTarGz, FormatTarZst}
 )
 
 // Validate file size
@@ -89,17 +219,269 @@ func ValidateSrcAddress(id string) error {
 // Validate file extension
 func ValidateFileExtension(fileName string) error {
 	extension := filepath.Ext(fileName)
-	if extension != ".zip" && extension != ".qcow2" && extension != ".img" &&extension!=".iso" {
+	if extension != ".zip" && extension != ".qcow2" && extension != ".img" && extension != ".iso" {
 		return errors.New("file extension is not supported")
 	}
 	return nil
 }
 
+// Validate display name of an image
+func ValidateDisplayName(name string) error {
+	if utf8.RuneCountInString(name) > MaxDisplayNameSize {
+		return errors.New("displayName is larger than max size")
+	}
+	if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return errors.New("displayName shouldn't contain control characters")
+	}
+	return nil
+}
+
+// Validate description of an image
+func ValidateDescription(description string) error {
+	if utf8.RuneCountInString(description) > MaxDescriptionSize {
+		return errors.New("description is larger than max size")
+	}
+	return nil
+}
+
+// Validate image tags
+func ValidateTags(tags []string) error {
+	if len(tags) > MaxTagCount {
+		return errors.New("too many tags")
+	}
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		if !tagPattern.MatchString(tag) {
+			return errors.New("tag " + strconv.Quote(tag) + " is invalid")
+		}
+		if seen[tag] {
+			return errors.New("tag " + strconv.Quote(tag) + " is duplicated")
+		}
+		seen[tag] = true
+	}
+	return nil
+}
+
+// Validate os type of an image
+func ValidateOsType(osType string) error {
+	for _, supported := range supportedOsTypes {
+		if osType == supported {
+			return nil
+		}
+	}
+	return errors.New("osType should be one of " + strings.Join(supportedOsTypes, ", "))
+}
+
+// Validate os version of an image
+func ValidateOsVersion(osVersion string) error {
+	if !osVersionPattern.MatchString(osVersion) {
+		return errors.New("osVersion is invalid")
+	}
+	return nil
+}
+
+// Validate cpu architecture of an image
+func ValidateArchitecture(arch string) error {
+	if arch != ArchX86 && arch != ArchAarch64 {
+		return errors.New("architecture should be " + ArchX86 + " or " + ArchAarch64)
+	}
+	return nil
+}
+
+// Validate a share grant of an image
+func ValidateShareGrant(granteeType, granteeId, permission string) error {
+	if granteeType != GranteeUser && granteeType != GranteeTenant {
+		return errors.New("granteeType should be user or tenant")
+	}
+	if granteeId == "" || len(granteeId) > MaxFileNameSize {
+		return errors.New("granteeId is required and shouldn't be larger than max size")
+	}
+	if permission != PermissionRead && permission != PermissionReadWrite {
+		return errors.New("permission should be read or read-write")
+	}
+	return nil
+}
+
+// Parse the expiry time of an image, it must be an RFC3339 time in the future
+func ParseExpiresAt(value string) (time.Time, error) {
+	expiresAt, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return expiresAt, errors.New("expiresAt should be an RFC3339 time")
+	}
+	if !expiresAt.After(time.Now()) {
+		return expiresAt, errors.New("expiresAt should be in the future")
+	}
+	return expiresAt, nil
+}
+
+// Validate a retention policy, zero disables a limit but at least one limit is required
+func ValidateRetentionPolicy(scope, scopeId string, maxIdleDays, maxRevisions int64) error {
+	if scope != GranteeUser && scope != GranteeTenant {
+		return errors.New("scope should be user or tenant")
+	}
+	if scopeId == "" || len(scopeId) > MaxFileNameSize {
+		return errors.New("scopeId is required and shouldn't be larger than max size")
+	}
+	if maxIdleDays < 0 || maxIdleDays > MaxRetentionDays {
+		return errors.New("maxIdleDays should be between 0 and " + strconv.FormatInt(MaxRetentionDays, 10))
+	}
+	if maxRevisions < 0 || maxRevisions > MaxRetentionRevisions {
+		return errors.New("maxRevisions should be between 0 and " + strconv.FormatInt(MaxRetentionRevisions, 10))
+	}
+	if maxIdleDays == 0 && maxRevisions == 0 {
+		return errors.New("maxIdleDays or maxRevisions is required")
+	}
+	return nil
+}
+
+// Validate the block size of delta signatures, a power of two between the min and max block size
+func ValidateDeltaBlockSize(blockSize int64) error {
+	if blockSize < MinDeltaBlockSize || blockSize > MaxDeltaBlockSize || blockSize&(blockSize-1) != 0 {
+		return errors.New("blockSize should be a power of two between " + strconv.FormatInt(MinDeltaBlockSize, 10) +
+			" and " + strconv.FormatInt(MaxDeltaBlockSize, 10))
+	}
+	return nil
+}
+
+// Get the number of goroutines compressing one image, all cores are used unless compressionWorkers is set
+func CompressionWorkers() int {
+	workers := GetAppConfigInt64("compressionWorkers", 0)
+	if workers <= 0 {
+		return runtime.NumCPU()
+	}
+	return int(workers)
+}
+
+// Report whether downloads are refused for images without a signature verified by the trust store
+func RequireSignedImages() bool {
+	required, err := strconv.ParseBool(GetAppConfig("requireSignedImages"))
+	return err == nil && required
+}
+
+// Report whether new image files and chunks are stored encrypted with the keys of encryptionKeyFile
+func EncryptionEnabled() bool {
+	enabled, err := strconv.ParseBool(GetAppConfig("encryptionEnabled"))
+	return err == nil && enabled
+}
+
+// Report whether non zip uploads are split into content defined chunks
+func ChunkStoreEnabled() bool {
+	enabled, err := strconv.ParseBool(GetAppConfig("chunkStoreEnabled"))
+	return err == nil && enabled
+}
+
+// Get the visibility of images uploaded without one, public keeps images readable by every client
+func GetDefaultVisibility() string {
+	visibility := GetAppConfig("defaultVisibility")
+	if ValidateVisibility(visibility) != nil {
+		return VisibilityPublic
+	}
+	return visibility
+}
+
+// Validate name of a logical image
+func ValidateImageName(name string) error {
+	if !imageNamePattern.MatchString(name) {
+		return errors.New("image name should be lowercase letters, digits, '.', '_' or '-'")
+	}
+	return nil
+}
+
+// Validate alias of a logical image, aliases start with a letter so they never look like revisions
+func ValidateAlias(alias string) error {
+	if !aliasPattern.MatchString(alias) {
+		return errors.New("alias should start with a lowercase letter followed by letters, digits, '.', '_' or '-'")
+	}
+	return nil
+}
+
+// Validate disk format of an image
+func ValidateDiskFormat(format string) error {
+	for _, supported := range diskFormats {
+		if format == supported {
+			return nil
+		}
+	}
+	return errors.New("diskFormat should be one of " + strings.Join(diskFormats, ", "))
+}
+
+// Validate the archive format of a download
+func ValidateDownloadFormat(format string) error {
+	for _, supported := range downloadFormats {
+		if format == supported {
+			return nil
+		}
+	}
+	return errors.New("format should be one of " + strings.Join(downloadFormats, ", "))
+}
+
+// Validate the archive format of a bundle download, gzip holds a single file so it isn't one of them
+func ValidateBundleFormat(format string) error {
+	for _, supported := range bundleFormats {
+		if format == supported {
+			return nil
+		}
+	}
+	return errors.New("format should be one of " + strings.Join(bundleFormats, ", "))
+}
+
+// Validate a minimum resource requirement of an image
+func ValidateMinRequirement(name string, value, max int64) error {
+	if value < 0 || value > max {
+		return errors.New(name + " should be between 0 and " + strconv.FormatInt(max, 10))
+	}
+	return nil
+}
+
+// Get the disk format implied by the file extension, zip packages have no implied format
+func DiskFormatFromFileName(fileName string) string {
+	switch filepath.Ext(fileName) {
+	case ".qcow2":
+		return "qcow2"
+	case ".img":
+		return "raw"
+	case ".iso":
+		return "iso"
+	default:
+		return ""
+	}
+}
+
+// Report whether a file name has the extension of a disk image format
+func IsImageFileName(fileName string) bool {
+	if DiskFormatFromFileName(fileName) != "" {
+		return true
+	}
+	return ValidateDiskFormat(strings.TrimPrefix(strings.ToLower(filepath.Ext(fileName)), ".")) == nil
+}
+
+// Validate visibility of an image
+func ValidateVisibility(visibility string) error {
+	if visibility != VisibilityPrivate && visibility != VisibilityShared && visibility != VisibilityPublic {
+		return errors.New("visibility should be private, shared or public")
+	}
+	return nil
+}
+
 // Get app configuration
 func GetAppConfig(k string) string {
 	return beego.AppConfig.String(k)
 }
 
+// Get app configuration as int64, def is returned when key is absent or invalid
+func GetAppConfigInt64(k string, def int64) int64 {
+	return beego.AppConfig.DefaultInt64(k, def)
+}
+
+// Get an interval in minutes from app configuration, def is returned when the value isn't positive
+func GetAppConfigMinutes(k string, def int64) time.Duration {
+	minutes := GetAppConfigInt64(k, def)
+	if minutes <= 0 {
+		log.Warn(k + " should be positive, the default of " + strconv.FormatInt(def, 10) + " minutes is used")
+		minutes = def
+	}
+	return time.Duration(minutes) * time.Minute
+}
 
 // Get db user
 func GetDbUser() string {
@@ -125,6 +507,11 @@ func GetDbPort() string {
 	return dbPort
 }
 
+// Get the token accepted on admin apis, admin apis are disabled when it is empty
+func GetAdminToken() string {
+	return os.Getenv("FILESYSTEM_ADMIN_TOKEN")
+}
+
 // Clear byte array from memory
 func ClearByteArray(data []byte) {
 	for i := 0; i < len(data); i++ {
@@ -180,3 +567,27 @@ func GetPasswordValidCount(password *[]byte) int {
 	}
 	return pwdValidCount
 }
+
+// Get the structured log fields which tie log lines to one request
+func RequestLogFields(ctx *context.Context) log.Fields {
+	fields := log.Fields{
+		"clientIp": ctx.Input.IP(),
+	}
+	if id, ok := ctx.Input.GetData(RequestIdKey).(string); ok {
+		fields[RequestIdKey] = id
+	}
+	if route, ok := ctx.Input.GetData("RouterPattern").(string); ok {
+		fields["route"] = route
+	}
+	if userId := ctx.Input.Query(UserId); userId != "" {
+		fields[UserId] = userId
+	}
+	imageId := ctx.Input.Param(":imageId")
+	if id, ok := ctx.Input.GetData(ImageIdKey).(string); ok && imageId == "" {
+		imageId = id
+	}
+	if imageId != "" {
+		fields[ImageIdKey] = imageId
+	}
+	return fields
+}